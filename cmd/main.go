@@ -38,12 +38,24 @@ func handleBuild(args []string) {
 
 	inputFile := args[0]
 	outputFile := ""
+	debugLeaks := false
+	boundsChecks := true
+	freestanding := false
+	mergeConstants := false
 
-	// Parse -o flag
+	// Parse flags
 	for i := 1; i < len(args); i++ {
 		if args[i] == "-o" && i+1 < len(args) {
 			outputFile = args[i+1]
-			break
+			i++
+		} else if args[i] == "--debug-leaks" {
+			debugLeaks = true
+		} else if args[i] == "--no-bounds-checks" {
+			boundsChecks = false
+		} else if args[i] == "--freestanding" {
+			freestanding = true
+		} else if args[i] == "--merge-constants" {
+			mergeConstants = true
 		}
 	}
 
@@ -73,6 +85,10 @@ func handleBuild(args []string) {
 
 	// Create compiler - Now passing moduleName AND inputFile
 	comp := compiler.NewCompiler(moduleName, inputFile)
+	comp.EnableLeakCheck(debugLeaks)
+	comp.EnableBoundsChecks(boundsChecks)
+	comp.EnableFreestanding(freestanding)
+	comp.EnableConstantMerging(mergeConstants)
 
 	// Compile source file
 	module, err := comp.CompileFile(inputFile)
@@ -118,7 +134,11 @@ func printUsage() {
 	fmt.Println("  help     Show this help message")
 	fmt.Println()
 	fmt.Println("Options:")
-	fmt.Println("  -o <file>    Output file (.o for object, .ir for IR)")
+	fmt.Println("  -o <file>           Output file (.o for object, .ir for IR)")
+	fmt.Println("  --debug-leaks       Report leaked class instances when main returns")
+	fmt.Println("  --no-bounds-checks  Omit runtime index checks (release builds)")
+	fmt.Println("  --freestanding      Generate the runtime allocator instead of using libc")
+	fmt.Println("  --merge-constants   Share identical string constants across packages")
 	fmt.Println()
 	fmt.Println("Examples:")
 	fmt.Println("  arc build program.arc -o output.o     # Compile to object file")
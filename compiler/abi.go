@@ -0,0 +1,527 @@
+package compiler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-builder/types"
+)
+
+// Calls across the C boundary follow the System V x86-64 ABI. Each
+// eightbyte of an aggregate is classified INTEGER or SSE by the fields it
+// holds; aggregates of up to two eightbytes travel in registers, as an
+// integer or double per eightbyte, while larger or unaligned ones are
+// MEMORY: arguments are copied to the stack (byval) and results written
+// through a hidden first pointer (sret). An aggregate that would not fit
+// in the registers still free goes to memory as a whole. bool crosses as a
+// zero-extended byte, and variadic arguments get C's default promotions.
+//
+// Extern functions are declared with the lowered signature and calls to
+// them are lowered by emitCall. Arc functions reach C through an adapter
+// with the C signature: functions passed as C function pointers, and
+// functions declared '@export', which C can call by their unqualified name.
+
+type abiClass int
+
+const (
+	classNone abiClass = iota
+	classInteger
+	classSSE
+	classMemory
+)
+
+// Registers the ABI passes arguments in
+const (
+	abiIntRegisters = 6
+	abiSSERegisters = 8
+)
+
+type abiKind int
+
+const (
+	abiDirect   abiKind = iota // passed as is
+	abiExtend                  // bool, widened to a byte
+	abiCoerce                  // aggregate split into register parts
+	abiIndirect                // aggregate in memory: byval or sret
+)
+
+// abiValue is how one parameter or result of C type typ is passed
+type abiValue struct {
+	typ     types.Type
+	kind    abiKind
+	classes []abiClass   // one per eightbyte, for coerced aggregates
+	parts   []types.Type // the register of each eightbyte
+}
+
+// abiSignature is the C calling convention of a function
+type abiSignature struct {
+	ret    abiValue
+	params []abiValue
+}
+
+// lowered reports whether the signature differs from the IR types of its
+// values
+func (s *abiSignature) lowered() bool {
+	if s.ret.kind != abiDirect {
+		return true
+	}
+	for _, param := range s.params {
+		if param.kind != abiDirect {
+			return true
+		}
+	}
+	return false
+}
+
+// cSignature classifies the parameters and result of a C function
+func (v *IRVisitor) cSignature(ret types.Type, params []types.Type) *abiSignature {
+	sig := &abiSignature{ret: v.classifyValue(ret)}
+	freeInt, freeSSE := abiIntRegisters, abiSSERegisters
+	if sig.ret.kind == abiIndirect {
+		freeInt--
+	}
+	for _, param := range params {
+		a := v.classifyValue(param)
+		ints, sses := 0, 0
+		switch a.kind {
+		case abiCoerce:
+			for _, class := range a.classes {
+				if class == classSSE {
+					sses++
+				} else {
+					ints++
+				}
+			}
+		case abiDirect, abiExtend:
+			if types.IsFloat(param) {
+				sses = 1
+			} else {
+				ints = 1
+			}
+		}
+		if a.kind == abiCoerce && (ints > freeInt || sses > freeSSE) {
+			a = abiValue{typ: param, kind: abiIndirect}
+		} else if ints <= freeInt && sses <= freeSSE {
+			freeInt -= ints
+			freeSSE -= sses
+		}
+		sig.params = append(sig.params, a)
+	}
+	return sig
+}
+
+// classifyValue decides how a value of C type typ is passed
+func (v *IRVisitor) classifyValue(typ types.Type) abiValue {
+	switch t := typ.(type) {
+	case *types.IntType:
+		if t.BitWidth == 1 {
+			return abiValue{typ: typ, kind: abiExtend}
+		}
+	case *types.StructType, *types.ArrayType:
+		classes := v.classify(typ)
+		if classes[0] == classMemory {
+			return abiValue{typ: typ, kind: abiIndirect}
+		}
+		a := abiValue{typ: typ, kind: abiCoerce, classes: classes}
+		size := v.calculateSizeOf(typ)
+		for i, class := range classes {
+			a.parts = append(a.parts, registerType(class, size-8*i))
+		}
+		return a
+	}
+	return abiValue{typ: typ, kind: abiDirect}
+}
+
+// classify returns the class of each eightbyte of an aggregate, or just
+// classMemory
+func (v *IRVisitor) classify(typ types.Type) []abiClass {
+	size := v.calculateSizeOf(typ)
+	if size == 0 || size > 16 {
+		return []abiClass{classMemory}
+	}
+	classes := make([]abiClass, (size+7)/8)
+	if !v.classifyInto(typ, 0, classes) {
+		return []abiClass{classMemory}
+	}
+	// A trailing eightbyte of padding only is not passed
+	for len(classes) > 0 && classes[len(classes)-1] == classNone {
+		classes = classes[:len(classes)-1]
+	}
+	if len(classes) == 0 {
+		return []abiClass{classMemory}
+	}
+	return classes
+}
+
+// classifyInto merges the classes of the scalars of typ, placed at offset,
+// into classes. It fails for fields that are not naturally aligned.
+func (v *IRVisitor) classifyInto(typ types.Type, offset int, classes []abiClass) bool {
+	if offset%v.calculateAlignOf(typ) != 0 {
+		return false
+	}
+	switch t := typ.(type) {
+	case *types.StructType:
+		for _, i := range v.declaredFields(t) {
+			if !v.classifyInto(t.Fields[i], offset+v.fieldOffset(t, i), classes) {
+				return false
+			}
+		}
+	case *types.ArrayType:
+		elemSize := v.calculateSizeOf(t.ElementType)
+		for i := 0; i < int(t.Length); i++ {
+			if !v.classifyInto(t.ElementType, offset+i*elemSize, classes) {
+				return false
+			}
+		}
+	case *types.FloatType:
+		if t.BitWidth > 64 {
+			return false
+		}
+		mergeClass(classes, offset/8, classSSE)
+	default:
+		mergeClass(classes, offset/8, classInteger)
+	}
+	return true
+}
+
+func mergeClass(classes []abiClass, i int, class abiClass) {
+	if classes[i] == classNone || classes[i] == class {
+		classes[i] = class
+	} else {
+		classes[i] = classInteger
+	}
+}
+
+// registerType is the type an eightbyte of class travels as; the last
+// eightbyte of an aggregate may be narrower
+func registerType(class abiClass, size int) types.Type {
+	if class == classSSE {
+		if size <= 4 {
+			return types.F32
+		}
+		return types.F64
+	}
+	switch {
+	case size <= 1:
+		return types.I8
+	case size <= 2:
+		return types.I16
+	case size <= 4:
+		return types.I32
+	}
+	return types.I64
+}
+
+// registerStruct is the struct of the register parts of a coerced value,
+// laid out like the eightbytes they come from
+func (v *IRVisitor) registerStruct(parts []types.Type) *types.StructType {
+	names := make([]string, len(parts))
+	for i, part := range parts {
+		names[i] = fmt.Sprint(part)
+	}
+	key := strings.Join(names, ", ")
+	if regs, ok := v.ctx.abiTypes[key]; ok {
+		return regs
+	}
+	name := fmt.Sprintf("__abi.%d", len(v.ctx.abiTypes))
+	regs := types.NewStruct(name, parts, false)
+	v.ctx.abiTypes[key] = regs
+	v.ctx.Module.Types[name] = regs
+	return regs
+}
+
+// lowerSignature returns the IR result and parameter types of sig
+func (v *IRVisitor) lowerSignature(sig *abiSignature) (types.Type, []types.Type) {
+	var ret types.Type
+	var params []types.Type
+	switch sig.ret.kind {
+	case abiIndirect:
+		ret = types.Void
+		params = append(params, types.NewPointer(sig.ret.typ))
+	case abiExtend:
+		ret = types.I8
+	case abiCoerce:
+		ret = sig.ret.parts[0]
+		if len(sig.ret.parts) > 1 {
+			ret = v.registerStruct(sig.ret.parts)
+		}
+	default:
+		ret = sig.ret.typ
+	}
+	for _, param := range sig.params {
+		switch param.kind {
+		case abiIndirect:
+			params = append(params, types.NewPointer(param.typ))
+		case abiExtend:
+			params = append(params, types.I8)
+		case abiCoerce:
+			params = append(params, param.parts...)
+		default:
+			params = append(params, param.typ)
+		}
+	}
+	return ret, params
+}
+
+// markIndirect sets the byval and sret attributes of a lowered function
+func (v *IRVisitor) markIndirect(fn *ir.Function, sig *abiSignature) {
+	next := 0
+	if sig.ret.kind == abiIndirect {
+		fn.Arguments[0].SRet = sig.ret.typ
+		fn.Arguments[0].SetName("sret")
+		next = 1
+	}
+	for _, param := range sig.params {
+		switch param.kind {
+		case abiIndirect:
+			fn.Arguments[next].ByVal = param.typ
+			next++
+		case abiCoerce:
+			next += len(param.parts)
+		default:
+			next++
+		}
+	}
+}
+
+// declareCFunction declares an extern function with the C calling
+// convention for the given C types
+func (v *IRVisitor) declareCFunction(name string, ret types.Type, params []types.Type, variadic bool) *ir.Function {
+	sig := v.cSignature(ret, params)
+	irRet, irParams := v.lowerSignature(sig)
+
+	// Several externs may link to one symbol, 'func sleep "usleep"' next to
+	// 'func usleep'
+	if fn := v.ctx.Module.GetFunction(name); fn != nil {
+		if _, isExtern := v.ctx.cSignatures[fn]; !isExtern ||
+			!fn.FuncType.Equal(types.NewFunction(irRet, irParams, variadic)) {
+			v.ctx.Logger.Error("Extern '%s' conflicts with an earlier declaration of that symbol", name)
+			return nil
+		}
+		return fn
+	}
+
+	fn := v.ctx.Builder.DeclareFunction(name, irRet, irParams, variadic)
+	v.markIndirect(fn, sig)
+	v.ctx.cSignatures[fn] = sig
+	if sig.lowered() {
+		v.logger.Debug("Extern '%s' is lowered to the C ABI", name)
+	}
+	return fn
+}
+
+// emitCCall calls a function with a lowered C signature
+func (v *IRVisitor) emitCCall(fn *ir.Function, sig *abiSignature, args []ir.Value) ir.Value {
+	b := v.ctx.Builder
+	if len(args) < len(sig.params) {
+		v.ctx.Logger.Error("Function '%s' expects %d argument(s), got %d", fn.Name(), len(sig.params), len(args))
+		return v.getZeroValue(sig.ret.typ)
+	}
+
+	var callArgs []ir.Value
+	var slot ir.Value
+	if sig.ret.kind == abiIndirect {
+		slot = b.CreateAlloca(sig.ret.typ, "sret")
+		callArgs = append(callArgs, slot)
+	}
+	for i, arg := range args {
+		if i < len(sig.params) {
+			callArgs = append(callArgs, v.lowerArgument(v.coerceTo(arg, sig.params[i].typ), sig.params[i])...)
+		} else {
+			callArgs = append(callArgs, v.promoteVararg(arg)...)
+		}
+	}
+
+	result := b.CreateCall(fn, callArgs, "")
+	switch sig.ret.kind {
+	case abiIndirect:
+		return b.CreateLoad(sig.ret.typ, slot, "")
+	case abiExtend:
+		return b.CreateTrunc(result, types.I1, "")
+	case abiCoerce:
+		parts := []ir.Value{result}
+		if len(sig.ret.parts) > 1 {
+			parts = []ir.Value{b.CreateExtractValue(result, []int{0}, ""), b.CreateExtractValue(result, []int{1}, "")}
+		}
+		return v.fromRegisters(parts, sig.ret)
+	}
+	return result
+}
+
+// lowerArgument converts an argument to the values the C ABI passes
+func (v *IRVisitor) lowerArgument(val ir.Value, a abiValue) []ir.Value {
+	b := v.ctx.Builder
+	switch a.kind {
+	case abiExtend:
+		return []ir.Value{b.CreateZExt(val, types.I8, "")}
+	case abiIndirect:
+		copied := b.CreateAlloca(a.typ, "byval")
+		b.CreateStore(val, copied)
+		return []ir.Value{copied}
+	case abiCoerce:
+		return v.toRegisters(val, a)
+	}
+	return []ir.Value{val}
+}
+
+// promoteVararg applies C's default argument promotions to a variadic
+// argument: strings become C strings, small integers int and float double
+func (v *IRVisitor) promoteVararg(val ir.Value) []ir.Value {
+	b := v.ctx.Builder
+	if v.ctx.IsString(val.Type()) {
+		return []ir.Value{v.stringToCString(val)}
+	}
+	switch t := val.Type().(type) {
+	case *types.IntType:
+		if t.BitWidth == 1 {
+			return []ir.Value{b.CreateZExt(val, types.I32, "")}
+		}
+		if t.BitWidth < 32 {
+			return []ir.Value{b.CreateSExt(val, types.I32, "")}
+		}
+	case *types.FloatType:
+		if t.BitWidth < 64 {
+			return []ir.Value{b.CreateFPExt(val, types.F64, "")}
+		}
+	case *types.StructType, *types.ArrayType:
+		return v.lowerArgument(val, v.classifyValue(val.Type()))
+	}
+	return []ir.Value{val}
+}
+
+// registerTemp allocates a slot large enough for both an aggregate and its
+// register parts, which may differ in size, and returns its address as each
+func (v *IRVisitor) registerTemp(a abiValue) (aggPtr, regsPtr ir.Value, regs *types.StructType) {
+	b := v.ctx.Builder
+	regs = v.registerStruct(a.parts)
+	if v.calculateSizeOf(regs) > v.calculateSizeOf(a.typ) {
+		tmp := b.CreateAlloca(regs, "abi.tmp")
+		return b.CreateBitCast(tmp, types.NewPointer(a.typ), ""), tmp, regs
+	}
+	tmp := b.CreateAlloca(a.typ, "abi.tmp")
+	return tmp, b.CreateBitCast(tmp, types.NewPointer(regs), ""), regs
+}
+
+// toRegisters reads an aggregate back as its register parts
+func (v *IRVisitor) toRegisters(val ir.Value, a abiValue) []ir.Value {
+	b := v.ctx.Builder
+	aggPtr, regsPtr, regs := v.registerTemp(a)
+	b.CreateStore(val, aggPtr)
+	parts := make([]ir.Value, len(a.parts))
+	for i, part := range a.parts {
+		parts[i] = b.CreateLoad(part, b.CreateStructGEP(regs, regsPtr, i, ""), "")
+	}
+	return parts
+}
+
+// fromRegisters rebuilds an aggregate from its register parts
+func (v *IRVisitor) fromRegisters(parts []ir.Value, a abiValue) ir.Value {
+	b := v.ctx.Builder
+	aggPtr, regsPtr, regs := v.registerTemp(a)
+	for i, part := range parts {
+		b.CreateStore(part, b.CreateStructGEP(regs, regsPtr, i, ""))
+	}
+	return b.CreateLoad(a.typ, aggPtr, "")
+}
+
+// cTypes maps an Arc signature to the C types it has across the boundary
+func (v *IRVisitor) cTypes(ret types.Type, params []types.Type) (types.Type, []types.Type) {
+	cParams := make([]types.Type, len(params))
+	for i, param := range params {
+		cParams[i] = v.externType(param)
+	}
+	return v.externType(ret), cParams
+}
+
+// cAdapter returns a function with the C calling convention that calls
+// fn. The adapter is named name, or when name is empty, fn itself serves
+// if its signature is already the C one.
+func (v *IRVisitor) cAdapter(fn *ir.Function, name string) *ir.Function {
+	if _, isExtern := v.ctx.cSignatures[fn]; isExtern && name == "" {
+		return fn
+	}
+	if adapter, ok := v.ctx.cAdapters[fn]; ok {
+		return adapter
+	}
+	reuse := name == "" || name == fn.Name()
+	if name == "" {
+		name = "__arc_c_" + fn.Name()
+	}
+	arc := v.functionSignature(fn)
+	ret, params := v.cTypes(arc.Ret, arc.Params)
+	sig := v.cSignature(ret, params)
+	if reuse && !sig.lowered() && v.ctx.indirectReturns[fn] == nil {
+		return fn
+	}
+
+	irRet, irParams := v.lowerSignature(sig)
+	state := v.ctx.SuspendFunction()
+	adapter := v.ctx.Builder.CreateFunction(name, irRet, irParams, false)
+	v.markIndirect(adapter, sig)
+	v.ctx.cAdapters[fn] = adapter
+	v.ctx.EnterFunction(adapter)
+	v.ctx.SetInsertBlock(v.ctx.Builder.CreateBlock("entry"))
+
+	// Rebuild the Arc arguments from the C ones
+	b := v.ctx.Builder
+	cArgs := adapter.Arguments
+	if sig.ret.kind == abiIndirect {
+		cArgs = cArgs[1:]
+	}
+	args := make([]ir.Value, 0, len(sig.params))
+	for i, param := range sig.params {
+		var val ir.Value
+		switch param.kind {
+		case abiExtend:
+			val = b.CreateTrunc(cArgs[0], types.I1, "")
+		case abiIndirect:
+			val = b.CreateLoad(param.typ, cArgs[0], "")
+		case abiCoerce:
+			parts := make([]ir.Value, len(param.parts))
+			for j := range parts {
+				parts[j] = cArgs[j]
+			}
+			val = v.fromRegisters(parts, param)
+			cArgs = cArgs[len(param.parts)-1:]
+		default:
+			val = cArgs[0]
+		}
+		cArgs = cArgs[1:]
+		args = append(args, v.coerceTo(val, arc.Params[i]))
+	}
+
+	result := v.emitCall(fn, args)
+	if ret.Kind() != types.VoidKind {
+		result = v.coerceTo(result, ret)
+	}
+	switch sig.ret.kind {
+	case abiIndirect:
+		b.CreateStore(result, adapter.Arguments[0])
+		b.CreateRetVoid()
+	case abiExtend:
+		b.CreateRet(b.CreateZExt(result, types.I8, ""))
+	case abiCoerce:
+		parts := v.toRegisters(result, sig.ret)
+		if len(parts) == 1 {
+			b.CreateRet(parts[0])
+			break
+		}
+		var agg ir.Value = b.ConstZero(irRet)
+		for i, part := range parts {
+			agg = b.CreateInsertValue(agg, part, []int{i}, "")
+		}
+		b.CreateRet(agg)
+	default:
+		if ret.Kind() == types.VoidKind {
+			b.CreateRetVoid()
+		} else {
+			b.CreateRet(result)
+		}
+	}
+
+	v.ctx.ExitFunction()
+	v.ctx.ResumeFunction(state)
+	v.logger.Debug("C adapter %s for %s", name, fn.Name())
+	return adapter
+}
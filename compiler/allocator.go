@@ -0,0 +1,150 @@
+package compiler
+
+import (
+	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-builder/types"
+)
+
+// Runtime allocations (class instances, closure environments, collection
+// buffers) go through emitMalloc, emitRealloc and emitFree. Hosted builds
+// call the C library; freestanding builds call allocator functions generated
+// here on top of mmap, so programs need no libc.
+
+// allocHeaderSize precedes each freestanding allocation and records its
+// mapped size
+const allocHeaderSize = 16
+
+const (
+	sysMmap   = 9
+	sysMunmap = 11
+)
+
+func (v *IRVisitor) allocatorName(name string) string {
+	if v.ctx.Freestanding {
+		return "__arc_" + name
+	}
+	return name
+}
+
+func (v *IRVisitor) emitMalloc(size ir.Value) ir.Value {
+	return v.ctx.Builder.CreateCallByName(v.allocatorName("malloc"), types.NewPointer(types.I8), []ir.Value{size}, "")
+}
+
+func (v *IRVisitor) emitRealloc(ptr, size ir.Value) ir.Value {
+	return v.ctx.Builder.CreateCallByName(v.allocatorName("realloc"), types.NewPointer(types.I8), []ir.Value{ptr, size}, "")
+}
+
+func (v *IRVisitor) emitFree(ptr ir.Value) {
+	v.ctx.Builder.CreateCallByName(v.allocatorName("free"), types.Void, []ir.Value{ptr}, "")
+}
+
+// emitFreestandingAllocator defines __arc_malloc, __arc_free and
+// __arc_realloc. Every allocation is its own anonymous mapping, which is
+// simple and returns zeroed memory, but costs at least a page and an mmap
+// and munmap syscall per object, including each class instance, string
+// buffer and closure environment. A failed mapping returns null.
+func (v *IRVisitor) emitFreestandingAllocator() {
+	bytePtr := types.NewPointer(types.I8)
+	i64 := func(n int64) ir.Value { return v.ctx.Builder.ConstInt(types.I64, n) }
+
+	// __arc_malloc(size): map size+header bytes and remember the total
+	malloc := v.ctx.Builder.CreateFunction("__arc_malloc", bytePtr, []types.Type{types.U64}, false)
+	malloc.Arguments[0].SetName("size")
+	entry := v.ctx.Builder.CreateBlock("entry")
+	failedBlock := v.ctx.Builder.CreateBlock("failed")
+	mappedBlock := v.ctx.Builder.CreateBlock("mapped")
+	v.ctx.SetInsertBlock(entry)
+	total := v.ctx.Builder.CreateAdd(v.castValue(malloc.Arguments[0], types.I64), i64(allocHeaderSize), "")
+	addr := v.ctx.Builder.CreateSyscall([]ir.Value{
+		i64(sysMmap),
+		i64(0),
+		total,
+		i64(3),    // PROT_READ | PROT_WRITE
+		i64(0x22), // MAP_PRIVATE | MAP_ANONYMOUS
+		i64(-1),
+		i64(0),
+	})
+	// The kernel reports failure as -errno, in -4095..-1
+	failed := v.ctx.Builder.CreateICmpUGT(addr, i64(-4096), "")
+	v.ctx.Builder.CreateCondBr(failed, failedBlock, mappedBlock)
+	v.ctx.SetInsertBlock(failedBlock)
+	v.ctx.Builder.CreateRet(v.ctx.Builder.ConstNull(bytePtr))
+
+	v.ctx.SetInsertBlock(mappedBlock)
+	base := v.ctx.Builder.CreateIntToPtr(addr, types.NewPointer(types.I64), "")
+	v.ctx.Builder.CreateStore(total, base)
+	user := v.ctx.Builder.CreateGEP(types.I8, v.ctx.Builder.CreateBitCast(base, bytePtr, ""), []ir.Value{i64(allocHeaderSize)}, "")
+	v.ctx.Builder.CreateRet(user)
+
+	// __arc_free(ptr): unmap the whole allocation
+	free := v.ctx.Builder.CreateFunction("__arc_free", types.Void, []types.Type{bytePtr}, false)
+	free.Arguments[0].SetName("ptr")
+	entry = v.ctx.Builder.CreateBlock("entry")
+	unmapBlock := v.ctx.Builder.CreateBlock("unmap")
+	doneBlock := v.ctx.Builder.CreateBlock("done")
+	v.ctx.SetInsertBlock(entry)
+	isNull := v.ctx.Builder.CreateICmpEQ(free.Arguments[0], v.ctx.Builder.ConstNull(bytePtr), "")
+	v.ctx.Builder.CreateCondBr(isNull, doneBlock, unmapBlock)
+	v.ctx.SetInsertBlock(unmapBlock)
+	header := v.ctx.Builder.CreateGEP(types.I8, free.Arguments[0], []ir.Value{i64(-allocHeaderSize)}, "")
+	size := v.ctx.Builder.CreateLoad(types.I64, v.ctx.Builder.CreateBitCast(header, types.NewPointer(types.I64), ""), "")
+	v.ctx.Builder.CreateSyscall([]ir.Value{i64(sysMunmap), v.ctx.Builder.CreatePtrToInt(header, types.I64, ""), size})
+	v.ctx.Builder.CreateBr(doneBlock)
+	v.ctx.SetInsertBlock(doneBlock)
+	v.ctx.Builder.CreateRetVoid()
+
+	// __arc_realloc(ptr, size): allocate, copy the smaller of the two sizes,
+	// release the old block. On failure the old block is left untouched.
+	realloc := v.ctx.Builder.CreateFunction("__arc_realloc", bytePtr, []types.Type{bytePtr, types.U64}, false)
+	realloc.Arguments[0].SetName("ptr")
+	realloc.Arguments[1].SetName("size")
+	old, newSize := realloc.Arguments[0], realloc.Arguments[1]
+	entry = v.ctx.Builder.CreateBlock("entry")
+	freshBlock := v.ctx.Builder.CreateBlock("fresh")
+	copyBlock := v.ctx.Builder.CreateBlock("copy")
+	failedBlock = v.ctx.Builder.CreateBlock("failed")
+	copyStartBlock := v.ctx.Builder.CreateBlock("copy.start")
+	loopBlock := v.ctx.Builder.CreateBlock("copy.loop")
+	bodyBlock := v.ctx.Builder.CreateBlock("copy.body")
+	doneBlock = v.ctx.Builder.CreateBlock("copy.done")
+
+	v.ctx.SetInsertBlock(entry)
+	isNull = v.ctx.Builder.CreateICmpEQ(old, v.ctx.Builder.ConstNull(bytePtr), "")
+	v.ctx.Builder.CreateCondBr(isNull, freshBlock, copyBlock)
+
+	v.ctx.SetInsertBlock(freshBlock)
+	v.ctx.Builder.CreateRet(v.emitMalloc(newSize))
+
+	v.ctx.SetInsertBlock(copyBlock)
+	fresh := v.emitMalloc(newSize)
+	v.ctx.Builder.CreateCondBr(v.ctx.Builder.CreateICmpEQ(fresh, v.ctx.Builder.ConstNull(bytePtr), ""), failedBlock, copyStartBlock)
+
+	v.ctx.SetInsertBlock(failedBlock)
+	v.ctx.Builder.CreateRet(v.ctx.Builder.ConstNull(bytePtr))
+
+	v.ctx.SetInsertBlock(copyStartBlock)
+	header = v.ctx.Builder.CreateGEP(types.I8, old, []ir.Value{i64(-allocHeaderSize)}, "")
+	oldTotal := v.ctx.Builder.CreateLoad(types.I64, v.ctx.Builder.CreateBitCast(header, types.NewPointer(types.I64), ""), "")
+	oldSize := v.ctx.Builder.CreateSub(oldTotal, i64(allocHeaderSize), "")
+	wanted := v.castValue(newSize, types.I64)
+	shrinking := v.ctx.Builder.CreateICmpSLT(wanted, oldSize, "")
+	count := v.ctx.Builder.CreateSelect(shrinking, wanted, oldSize, "")
+	indexPtr := v.ctx.Builder.CreateAlloca(types.I64, "i")
+	v.ctx.Builder.CreateStore(i64(0), indexPtr)
+	v.ctx.Builder.CreateBr(loopBlock)
+
+	v.ctx.SetInsertBlock(loopBlock)
+	index := v.ctx.Builder.CreateLoad(types.I64, indexPtr, "")
+	more := v.ctx.Builder.CreateICmpSLT(index, count, "")
+	v.ctx.Builder.CreateCondBr(more, bodyBlock, doneBlock)
+
+	v.ctx.SetInsertBlock(bodyBlock)
+	b := v.ctx.Builder.CreateLoad(types.I8, v.ctx.Builder.CreateGEP(types.I8, old, []ir.Value{index}, ""), "")
+	v.ctx.Builder.CreateStore(b, v.ctx.Builder.CreateGEP(types.I8, fresh, []ir.Value{index}, ""))
+	v.ctx.Builder.CreateStore(v.ctx.Builder.CreateAdd(index, i64(1), ""), indexPtr)
+	v.ctx.Builder.CreateBr(loopBlock)
+
+	v.ctx.SetInsertBlock(doneBlock)
+	v.emitFree(old)
+	v.ctx.Builder.CreateRet(fresh)
+}
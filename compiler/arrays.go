@@ -0,0 +1,410 @@
+package compiler
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/antlr4-go/antlr/v4"
+	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-builder/types"
+	"github.com/arc-language/core-parser"
+)
+
+// Fixed-size arrays ([N]T) are values: assigning or passing one copies all
+// of its elements. Indexing with a constant is checked against N at compile
+// time.
+
+func (v *IRVisitor) resolveArrayType(ctx parser.IArrayTypeContext) types.Type {
+	elemType := v.resolveType(ctx.Type_())
+
+	c, err := v.evalConst(ctx.Expression())
+	if err == nil && c.kind != constInt {
+		err = fmt.Errorf("not an integer")
+	}
+	if err != nil {
+		v.ctx.Logger.Error("Array length '%s' must be a compile-time constant: %v", ctx.Expression().GetText(), err)
+		return types.NewArray(elemType, 0)
+	}
+	if c.i.Sign() < 0 || !c.i.IsInt64() {
+		v.ctx.Logger.Error("Array length must be between 0 and %d, got %s", int64(math.MaxInt64), c.i)
+		return types.NewArray(elemType, 0)
+	}
+
+	return types.NewArray(elemType, c.i.Int64())
+}
+
+// constIntValue returns the value of an integer constant
+func (v *IRVisitor) constIntValue(val ir.Value) (int64, bool) {
+	if c, ok := val.(*ir.ConstantInt); ok {
+		return c.Value, true
+	}
+	return 0, false
+}
+
+func (v *IRVisitor) VisitArrayLiteral(ctx *parser.ArrayLiteralContext) interface{} {
+	exprs := ctx.AllExpression()
+	if len(exprs) == 0 {
+		v.ctx.Logger.Error("Empty array literal needs a type annotation")
+		return v.ctx.Builder.ConstZero(types.NewArray(types.I64, 0))
+	}
+
+	values := make([]ir.Value, len(exprs))
+	for i, expr := range exprs {
+		values[i] = v.Visit(expr).(ir.Value)
+	}
+
+	// The first typed element decides the element type; untyped literals
+	// adapt to it, anything else must already match
+	elemType := values[0].Type()
+	for _, val := range values {
+		if !v.isUntypedLiteral(val) {
+			elemType = val.Type()
+			break
+		}
+	}
+	for i := range values {
+		values[i] = v.adaptLiteral(values[i], elemType)
+		if !v.ctx.SameType(values[i].Type(), elemType) {
+			v.ctx.Logger.Error("Array literal element %d is %s, but the array holds %s",
+				i, v.typeName(values[i].Type()), v.typeName(elemType))
+		}
+	}
+	arrType := types.NewArray(elemType, int64(len(values)))
+
+	// Constant elements produce a constant array, usable as a global initializer
+	if constants, ok := v.allConstant(values); ok {
+		return &ir.ConstantArray{
+			BaseValue: ir.BaseValue{ValType: arrType},
+			Elements:  constants,
+		}
+	}
+
+	// The array owns its class elements
+	var agg ir.Value = v.ctx.Builder.ConstZero(arrType)
+	for i, val := range values {
+		v.takeOwnership(val)
+		agg = v.ctx.Builder.CreateInsertValue(agg, val, []int{i}, "")
+	}
+	v.markOwned(agg)
+	return agg
+}
+
+func (v *IRVisitor) allConstant(values []ir.Value) ([]ir.Constant, bool) {
+	constants := make([]ir.Constant, len(values))
+	for i, val := range values {
+		c, ok := val.(ir.Constant)
+		if !ok {
+			return nil, false
+		}
+		constants[i] = c
+	}
+	return constants, true
+}
+
+// convertArray converts an array value element by element, so literals such
+// as [1, 2, 3] can initialize a [3]int32
+func (v *IRVisitor) convertArray(val ir.Value, target *types.ArrayType) ir.Value {
+	srcType := val.Type().(*types.ArrayType)
+	if srcType.Length != target.Length {
+		v.ctx.Logger.Error("Cannot use array of %d element(s) as %v", srcType.Length, target)
+		return v.getZeroValue(target)
+	}
+
+	if constArr, ok := val.(*ir.ConstantArray); ok {
+		elements := make([]ir.Constant, len(constArr.Elements))
+		allConst := true
+		for i, elem := range constArr.Elements {
+			c, ok := v.constCast(elem, target.ElementType)
+			if !ok {
+				allConst = false
+				break
+			}
+			elements[i] = c
+		}
+		if allConst {
+			return &ir.ConstantArray{
+				BaseValue: ir.BaseValue{ValType: target},
+				Elements:  elements,
+			}
+		}
+	}
+
+	var agg ir.Value = v.ctx.Builder.ConstZero(target)
+	for i := 0; i < int(target.Length); i++ {
+		elem := v.ctx.Builder.CreateExtractValue(val, []int{i}, "")
+		agg = v.ctx.Builder.CreateInsertValue(agg, v.coerceTo(elem, target.ElementType), []int{i}, "")
+	}
+	return agg
+}
+
+// constCast converts a constant without emitting instructions
+func (v *IRVisitor) constCast(c ir.Constant, target types.Type) (ir.Constant, bool) {
+	if c.Type().Equal(target) {
+		return c, true
+	}
+	if intConst, ok := c.(*ir.ConstantInt); ok {
+		if intType, ok := target.(*types.IntType); ok {
+			return v.ctx.Builder.ConstInt(intType, intConst.Value), true
+		}
+		if floatType, ok := target.(*types.FloatType); ok {
+			return v.ctx.Builder.ConstFloat(floatType, float64(intConst.Value)), true
+		}
+	}
+	if floatConst, ok := c.(*ir.ConstantFloat); ok {
+		if floatType, ok := target.(*types.FloatType); ok {
+			return v.ctx.Builder.ConstFloat(floatType, floatConst.Value), true
+		}
+	}
+	if arrConst, ok := c.(*ir.ConstantArray); ok {
+		if arrType, ok := target.(*types.ArrayType); ok {
+			if converted, ok := v.convertArray(arrConst, arrType).(ir.Constant); ok {
+				return converted, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// checkArrayIndex reports constant indices outside [0, N)
+func (v *IRVisitor) checkArrayIndex(arrType *types.ArrayType, index ir.Value) bool {
+	i, isConst := v.constIntValue(index)
+	if !isConst {
+		return true
+	}
+	if i < 0 || i >= arrType.Length {
+		v.ctx.Logger.Error("Index %d out of bounds for array of length %d", i, arrType.Length)
+		return false
+	}
+	return true
+}
+
+// indexValue reads base[index]. baseAddr, when known, is where an array
+// value is stored, so variable indices need not copy it.
+func (v *IRVisitor) indexValue(base, baseAddr, index ir.Value, at antlr.ParserRuleContext) ir.Value {
+	if elemType, isVector := v.ctx.VectorElem(base.Type()); isVector {
+		elemAddr := v.vectorElementAddress(base, elemType, index, at)
+		return v.ctx.Builder.CreateLoad(elemType, elemAddr, "")
+	}
+	if info, isMap := v.ctx.MapInfo(base.Type()); isMap {
+		return v.mapLookup(info, base, index)
+	}
+	if v.ctx.IsString(base.Type()) {
+		return v.stringByte(base, index, at)
+	}
+
+	switch typ := base.Type().(type) {
+	case *types.ArrayType:
+		if !v.checkArrayIndex(typ, index) {
+			return v.getZeroValue(typ.ElementType)
+		}
+		if i, isConst := v.constIntValue(index); isConst {
+			return v.ctx.Builder.CreateExtractValue(base, []int{int(i)}, "")
+		}
+		if baseAddr == nil {
+			baseAddr = v.ctx.Builder.CreateAlloca(typ, "")
+			v.ctx.Builder.CreateStore(base, baseAddr)
+		}
+		elemAddr, elemType := v.elementAddress(baseAddr, typ, index, at)
+		return v.ctx.Builder.CreateLoad(elemType, elemAddr, "")
+	case *types.PointerType:
+		elemAddr := v.ctx.Builder.CreateGEP(typ.ElementType, base, []ir.Value{v.castValue(index, types.I64)}, "")
+		return v.ctx.Builder.CreateLoad(typ.ElementType, elemAddr, "")
+	}
+
+	if elemType, isSlice := v.ctx.SliceElem(base.Type()); isSlice {
+		elemAddr := v.sliceElementAddress(base, elemType, index, at)
+		return v.ctx.Builder.CreateLoad(elemType, elemAddr, "")
+	}
+
+	v.ctx.Logger.Error("Cannot index value of type %v", base.Type())
+	return base
+}
+
+// elementAddress returns the address of element 'index' of the array stored
+// at addr. Constant indices are checked at compile time, others at runtime.
+func (v *IRVisitor) elementAddress(addr ir.Value, arrType *types.ArrayType, index ir.Value, at antlr.ParserRuleContext) (ir.Value, types.Type) {
+	if _, isConst := v.constIntValue(index); isConst {
+		v.checkArrayIndex(arrType, index)
+	} else {
+		v.emitBoundsCheck(index, v.ctx.Builder.ConstInt(types.U64, arrType.Length), at)
+	}
+	zero := v.ctx.Builder.ConstInt(types.I64, 0)
+	gep := v.ctx.Builder.CreateInBoundsGEP(arrType, addr, []ir.Value{zero, v.castValue(index, types.I64)}, "")
+	return gep, arrType.ElementType
+}
+
+// indexAddress returns the address of slot[index], where slot holds an
+// array, slice, vector, map or pointer of type slotType
+func (v *IRVisitor) indexAddress(slot ir.Value, slotType types.Type, index ir.Value, at antlr.ParserRuleContext) (ir.Value, types.Type, bool) {
+	if elemType, isSlice := v.ctx.SliceElem(slotType); isSlice {
+		slice := v.ctx.Builder.CreateLoad(slotType, slot, "")
+		return v.sliceElementAddress(slice, elemType, index, at), elemType, true
+	}
+	if elemType, isVector := v.ctx.VectorElem(slotType); isVector {
+		vec := v.ctx.Builder.CreateLoad(slotType, slot, "")
+		return v.vectorElementAddress(vec, elemType, index, at), elemType, true
+	}
+	if info, isMap := v.ctx.MapInfo(slotType); isMap {
+		m := v.ctx.Builder.CreateLoad(slotType, slot, "")
+		return v.mapValueAddress(info, m, index), info.Value, true
+	}
+
+	switch typ := slotType.(type) {
+	case *types.ArrayType:
+		addr, elemType := v.elementAddress(slot, typ, index, at)
+		return addr, elemType, true
+	case *types.PointerType:
+		ptr := v.ctx.Builder.CreateLoad(typ, slot, "")
+		addr := v.ctx.Builder.CreateGEP(typ.ElementType, ptr, []ir.Value{v.castValue(index, types.I64)}, "")
+		return addr, typ.ElementType, true
+	}
+	return nil, nil, false
+}
+
+// addressOf returns where an assignable postfix expression (a, a.f, a[i],
+// p.f[i].g, ...) is stored, and the type stored there
+func (v *IRVisitor) addressOf(ctx parser.IPostfixExpressionContext) (ir.Value, types.Type, bool) {
+	primary := ctx.PrimaryExpression()
+	if primary == nil || primary.IDENTIFIER() == nil {
+		return nil, nil, false
+	}
+	sym, ok := v.lookupSymbol(primary.IDENTIFIER().GetText())
+	if !ok || sym.IsConst {
+		return nil, nil, false
+	}
+	addr, typ, isVar := sym.Address()
+	if !isVar {
+		return nil, nil, false
+	}
+
+	// Check the whole path before emitting anything, so a caller falling
+	// back to evaluating the expression does not run its indices twice
+	if !v.addressable(typ, ctx.AllPostfixOp()) {
+		return nil, nil, false
+	}
+
+	for _, opCtx := range ctx.AllPostfixOp() {
+		op := opCtx.(*parser.PostfixOpContext)
+		switch {
+		case op.LBRACKET() != nil:
+			index := v.Visit(op.Expression()).(ir.Value)
+			if addr, typ, ok = v.indexAddress(addr, typ, index, op); !ok {
+				return nil, nil, false
+			}
+		case op.DOT() != nil && op.IDENTIFIER() != nil:
+			if addr, typ, ok = v.fieldAddress(addr, typ, op.IDENTIFIER().GetText()); !ok {
+				return nil, nil, false
+			}
+		default:
+			return nil, nil, false
+		}
+	}
+	return addr, typ, true
+}
+
+// addressable reports whether addressOf can follow ops from a slot of type
+// typ, without evaluating any of the indices
+func (v *IRVisitor) addressable(typ types.Type, ops []parser.IPostfixOpContext) bool {
+	for _, opCtx := range ops {
+		op := opCtx.(*parser.PostfixOpContext)
+		var ok bool
+		switch {
+		case op.LBRACKET() != nil:
+			typ, ok = v.indexedType(typ)
+		case op.DOT() != nil && op.IDENTIFIER() != nil:
+			var structType *types.StructType
+			var idx int
+			if structType, idx, ok = v.fieldOf(typ, op.IDENTIFIER().GetText()); ok {
+				typ = structType.Fields[idx]
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// indexedType returns the element type indexAddress finds in a slot of
+// type slotType
+func (v *IRVisitor) indexedType(slotType types.Type) (types.Type, bool) {
+	if elemType, isSlice := v.ctx.SliceElem(slotType); isSlice {
+		return elemType, true
+	}
+	if elemType, isVector := v.ctx.VectorElem(slotType); isVector {
+		return elemType, true
+	}
+	if info, isMap := v.ctx.MapInfo(slotType); isMap {
+		return info.Value, true
+	}
+
+	switch typ := slotType.(type) {
+	case *types.ArrayType:
+		return typ.ElementType, true
+	case *types.PointerType:
+		return typ.ElementType, true
+	}
+	return nil, false
+}
+
+// fieldOf finds a field of the struct slotType holds or points to
+func (v *IRVisitor) fieldOf(slotType types.Type, fieldName string) (*types.StructType, int, bool) {
+	structType, isStruct := slotType.(*types.StructType)
+	if ptrType, ok := slotType.(*types.PointerType); ok {
+		structType, isStruct = ptrType.ElementType.(*types.StructType)
+	}
+	if !isStruct {
+		return nil, -1, false
+	}
+
+	idx := v.findFieldIndex(structType, fieldName)
+	if v.ctx.IsClassType(structType.Name) {
+		idx = -1
+		if fieldIdx, ok := v.ctx.ClassFieldIndices[structType.Name][fieldName]; ok {
+			idx = fieldIdx
+		}
+	}
+	return structType, idx, idx >= 0
+}
+
+// fieldAddress returns the address of a field of the struct stored at slot,
+// or of the struct a stored pointer refers to
+func (v *IRVisitor) fieldAddress(slot ir.Value, slotType types.Type, fieldName string) (ir.Value, types.Type, bool) {
+	structType, idx, ok := v.fieldOf(slotType, fieldName)
+	if !ok {
+		return nil, nil, false
+	}
+	if _, isPtr := slotType.(*types.PointerType); isPtr {
+		slot = v.ctx.Builder.CreateLoad(slotType, slot, "")
+	}
+	return v.ctx.Builder.CreateStructGEP(structType, slot, idx, ""), structType.Fields[idx], true
+}
+
+// builtinLen implements len(x)
+func (v *IRVisitor) builtinLen(args []ir.Value) ir.Value {
+	if len(args) != 1 {
+		v.ctx.Logger.Error("len expects exactly one argument, got %d", len(args))
+		return v.ctx.Builder.ConstInt(types.U64, 0)
+	}
+
+	switch typ := args[0].Type().(type) {
+	case *types.ArrayType:
+		return v.ctx.Builder.ConstInt(types.U64, typ.Length)
+	}
+	if _, isSlice := v.ctx.SliceElem(args[0].Type()); isSlice {
+		return v.ctx.Builder.CreateExtractValue(args[0], []int{1}, "")
+	}
+	if _, isVector := v.ctx.VectorElem(args[0].Type()); isVector {
+		vecType := args[0].Type().(*types.PointerType).ElementType.(*types.StructType)
+		return v.vectorField(vecType, args[0], vectorLenField)
+	}
+	if info, isMap := v.ctx.MapInfo(args[0].Type()); isMap {
+		return v.mapField(info, args[0], mapLenField)
+	}
+	if v.ctx.IsString(args[0].Type()) {
+		return v.stringLen(args[0])
+	}
+
+	v.ctx.Logger.Error("len is not defined for values of type %v", args[0].Type())
+	return v.ctx.Builder.ConstInt(types.U64, 0)
+}
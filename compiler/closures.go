@@ -0,0 +1,531 @@
+package compiler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/antlr4-go/antlr/v4"
+	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-builder/types"
+	"github.com/arc-language/core-parser"
+)
+
+// Function values are closures: a { code, env } pair of opaque pointers.
+// The code takes the environment as a hidden first parameter. Plain
+// functions are adapted through a thunk that ignores it, while extern
+// signatures keep raw function pointers so C APIs can receive them.
+//
+// Environments are reference counted like class instances. Each starts with
+// the header { count, deinit } of the hidden class __closure_env, where
+// deinit releases the captures of the literal that built it.
+
+// closureEnvHeaderFields is the number of header fields preceding the
+// captures of an environment
+const closureEnvHeaderFields = 2
+
+// closureSignature is the Arc-level signature behind a closure type
+type closureSignature struct {
+	Ret    types.Type
+	Params []types.Type
+}
+
+// closureCapture is an outer variable referenced by a function literal
+type closureCapture struct {
+	Name     string
+	ByRef    bool
+	Value    ir.Value   // current value (by value) or its address (by ref)
+	ElemType types.Type // type of the variable itself
+}
+
+// ClosureType returns the closure struct for a signature, creating it once
+func (c *Context) ClosureType(ret types.Type, params []types.Type) *types.StructType {
+	parts := make([]string, len(params))
+	for i, p := range params {
+		parts[i] = fmt.Sprint(p)
+	}
+	key := fmt.Sprintf("func(%s) %v", strings.Join(parts, ", "), ret)
+	if closureType, ok := c.closureTypes[key]; ok {
+		return closureType
+	}
+
+	opaque := types.NewPointer(types.I8)
+	name := fmt.Sprintf("__closure.%d", len(c.closureTypes))
+	closureType := types.NewStruct(name, []types.Type{opaque, opaque}, false)
+	c.closureTypes[key] = closureType
+	c.closureSigs[closureType] = &closureSignature{Ret: ret, Params: params}
+	c.Module.Types[name] = closureType
+
+	c.Logger.Debug("Registered closure type %s as '%s'", key, name)
+	return closureType
+}
+
+// ClosureSignature returns the signature if typ is a closure type
+func (c *Context) ClosureSignature(typ types.Type) (*closureSignature, bool) {
+	structType, ok := typ.(*types.StructType)
+	if !ok {
+		return nil, false
+	}
+	sig, ok := c.closureSigs[structType]
+	return sig, ok
+}
+
+// resolveFunctionType resolves 'func(int32) bool' to its closure type
+func (v *IRVisitor) resolveFunctionType(ctx parser.IFunctionTypeContext) types.Type {
+	params := make([]types.Type, 0)
+	if ctx.TypeList() != nil {
+		for _, typeCtx := range ctx.TypeList().AllType_() {
+			params = append(params, v.resolveType(typeCtx))
+		}
+	}
+	var ret types.Type = types.Void
+	if ctx.Type_() != nil {
+		ret = v.resolveType(ctx.Type_())
+	}
+	return v.ctx.ClosureType(ret, params)
+}
+
+// rawFunctionPointer is the C representation of a closure signature
+func (v *IRVisitor) rawFunctionPointer(sig *closureSignature) types.Type {
+	return types.NewPointer(types.NewFunction(sig.Ret, sig.Params, false))
+}
+
+// externType maps Arc types to their C interop representation
+func (v *IRVisitor) externType(typ types.Type) types.Type {
+	if sig, ok := v.ctx.ClosureSignature(typ); ok {
+		return v.rawFunctionPointer(sig)
+	}
+	if v.ctx.IsString(typ) {
+		return types.NewPointer(types.I8)
+	}
+	return typ
+}
+
+// functionSignature describes a plain function as a closure signature
+func (v *IRVisitor) functionSignature(fn *ir.Function) *closureSignature {
+	if sig, isExtern := v.ctx.cSignatures[fn]; isExtern {
+		params := make([]types.Type, len(sig.params))
+		for i, param := range sig.params {
+			params[i] = param.typ
+		}
+		return &closureSignature{Ret: sig.ret.typ, Params: params}
+	}
+	args := fn.Arguments
+	ret := fn.FuncType.ReturnType
+	if resultType, indirect := v.ctx.indirectReturns[fn]; indirect {
+		args = args[:len(args)-1]
+		ret = resultType
+	}
+	params := make([]types.Type, len(args))
+	for i, arg := range args {
+		params[i] = arg.Type()
+	}
+	return &closureSignature{Ret: ret, Params: params}
+}
+
+// makeClosure packs a code pointer and environment into a closure value
+func (v *IRVisitor) makeClosure(code ir.Value, env ir.Value, closureType *types.StructType) ir.Value {
+	opaque := types.NewPointer(types.I8)
+	var closure ir.Value = v.ctx.Builder.ConstZero(closureType)
+	codePtr := v.ctx.Builder.CreateBitCast(code, opaque, "")
+	closure = v.ctx.Builder.CreateInsertValue(closure, codePtr, []int{0}, "")
+	closure = v.ctx.Builder.CreateInsertValue(closure, env, []int{1}, "")
+	return closure
+}
+
+// callClosure invokes a closure value, passing its environment first
+func (v *IRVisitor) callClosure(closure ir.Value, sig *closureSignature, args []ir.Value) ir.Value {
+	if len(args) != len(sig.Params) {
+		v.ctx.Logger.Error("Function value expects %d argument(s), got %d", len(sig.Params), len(args))
+		return v.ctx.Builder.ConstInt(types.I64, 0)
+	}
+
+	opaque := types.NewPointer(types.I8)
+	codeParams := append([]types.Type{opaque}, sig.Params...)
+	codeType := types.NewPointer(types.NewFunction(sig.Ret, codeParams, false))
+
+	code := v.ctx.Builder.CreateExtractValue(closure, []int{0}, "")
+	env := v.ctx.Builder.CreateExtractValue(closure, []int{1}, "")
+	code = v.ctx.Builder.CreateBitCast(code, codeType, "")
+
+	callArgs := []ir.Value{env}
+	for i, arg := range args {
+		callArgs = append(callArgs, v.coerceTo(arg, sig.Params[i]))
+	}
+	return v.ctx.Builder.CreateCall(code, callArgs, "")
+}
+
+// thunkFor returns an adapter with the closure calling convention that
+// forwards to a plain function, ignoring the environment
+func (v *IRVisitor) thunkFor(fn *ir.Function) *ir.Function {
+	if thunk, ok := v.ctx.thunks[fn]; ok {
+		return thunk
+	}
+
+	sig := v.functionSignature(fn)
+	paramTypes := append([]types.Type{types.NewPointer(types.I8)}, sig.Params...)
+
+	state := v.ctx.SuspendFunction()
+	thunk := v.ctx.Builder.CreateFunction("__arc_thunk_"+fn.Name(), sig.Ret, paramTypes, false)
+	thunk.Arguments[0].SetName("env")
+	v.ctx.thunks[fn] = thunk
+
+	entry := v.ctx.Builder.CreateBlock("entry")
+	v.ctx.SetInsertBlock(entry)
+
+	args := make([]ir.Value, 0, len(sig.Params))
+	for _, arg := range thunk.Arguments[1:] {
+		args = append(args, arg)
+	}
+	result := v.emitCall(fn, args)
+	if sig.Ret.Kind() == types.VoidKind {
+		v.ctx.Builder.CreateRetVoid()
+	} else {
+		v.ctx.Builder.CreateRet(result)
+	}
+
+	v.ctx.ResumeFunction(state)
+	return thunk
+}
+
+// coerceTo converts val to the type of the slot it flows into: plain
+// functions become closures or raw C function pointers, integers are
+// resized
+func (v *IRVisitor) coerceTo(val ir.Value, target types.Type) ir.Value {
+	if v.ctx.SameType(val.Type(), target) {
+		return val
+	}
+
+	// Untyped literals take the type the context expects
+	if adapted := v.adaptLiteral(val, target); adapted != val {
+		return adapted
+	}
+
+	// Distinct types only convert through cast<>
+	if v.mixesDistinct(val.Type(), target) {
+		v.ctx.Logger.Error("Cannot use %s as %s without cast<>", v.typeName(val.Type()), v.typeName(target))
+		return val
+	}
+	if val.Type().Equal(target) {
+		return val
+	}
+
+	if _, isClosure := v.ctx.ClosureSignature(target); isClosure {
+		if fn, ok := val.(*ir.Function); ok {
+			null := v.ctx.Builder.ConstNull(types.NewPointer(types.I8))
+			return v.makeClosure(v.thunkFor(fn), null, target.(*types.StructType))
+		}
+		if _, ok := v.ctx.ClosureSignature(val.Type()); ok {
+			v.ctx.Logger.Error("Function value of type %v cannot be used as %v", val.Type(), target)
+		}
+		return val
+	}
+
+	if _, isClosure := v.ctx.ClosureSignature(val.Type()); isClosure {
+		if ptrType, ok := target.(*types.PointerType); ok {
+			if _, isFn := ptrType.ElementType.(*types.FunctionType); isFn {
+				v.ctx.Logger.Error("Closure values cannot be passed as C function pointers; pass a named function or a literal that captures nothing")
+			}
+		}
+		return val
+	}
+
+	// Functions handed to C as function pointers are called with the C
+	// calling convention
+	if fn, ok := val.(*ir.Function); ok {
+		if ptrType, ok := target.(*types.PointerType); ok {
+			if _, isFn := ptrType.ElementType.(*types.FunctionType); isFn {
+				adapter := v.cAdapter(fn, "")
+				if adapter.Type().Equal(target) {
+					return adapter
+				}
+				return v.ctx.Builder.CreateBitCast(adapter, target, "")
+			}
+		}
+	}
+
+	// Slices decay to their data pointer, so they can be passed to C
+	if _, isSlice := v.ctx.SliceElem(val.Type()); isSlice && types.IsPointer(target) {
+		data := v.ctx.Builder.CreateExtractValue(val, []int{0}, "")
+		if data.Type().Equal(target) {
+			return data
+		}
+		return v.ctx.Builder.CreateBitCast(data, target, "")
+	}
+
+	// Strings become C strings for pointer parameters, and C strings
+	// returned from extern functions read as strings
+	if v.ctx.IsString(val.Type()) && types.IsPointer(target) {
+		cstr := v.stringToCString(val)
+		if cstr.Type().Equal(target) {
+			return cstr
+		}
+		return v.ctx.Builder.CreateBitCast(cstr, target, "")
+	}
+	if v.ctx.IsString(target) && val.Type().Equal(types.NewPointer(types.I8)) {
+		return v.stringFromCString(val)
+	}
+
+	if elem, isOptional := v.ctx.OptionalElem(target); isOptional {
+		return v.wrapOptional(val, target.(*types.StructType), elem)
+	}
+
+	if arrType, ok := target.(*types.ArrayType); ok {
+		if _, isArray := val.Type().(*types.ArrayType); isArray {
+			return v.convertArray(val, arrType)
+		}
+	}
+
+	return v.castValue(val, target)
+}
+
+// VisitFunctionLiteral compiles an anonymous function. Literals that capture
+// nothing are plain functions, usable wherever a named function is. Captured
+// variables are copied into a heap environment by default; names listed as
+// '&name' in the capture list are shared by reference. The environment lives
+// until the last closure value sharing it is released, so closures may
+// safely outlive the frame that created them as long as they capture by
+// value.
+func (v *IRVisitor) VisitFunctionLiteral(ctx *parser.FunctionLiteralContext) interface{} {
+	var retType types.Type = types.Void
+	if ctx.Type_() != nil {
+		retType = v.resolveType(ctx.Type_())
+	}
+
+	paramTypes := make([]types.Type, 0)
+	paramNames := make([]string, 0)
+	if ctx.ParameterList() != nil {
+		for _, param := range ctx.ParameterList().AllParameter() {
+			paramNames = append(paramNames, param.IDENTIFIER().GetText())
+			paramTypes = append(paramTypes, v.resolveType(param.Type_()))
+		}
+	}
+
+	captures := v.collectCaptures(ctx, paramNames)
+
+	v.ctx.lambdaCount++
+	name := fmt.Sprintf("__arc_lambda_%d", v.ctx.lambdaCount)
+	if v.ctx.currentNamespace != nil && v.ctx.currentNamespace.Name != "" {
+		name = v.ctx.currentNamespace.Name + "_" + name
+	}
+
+	// Environment layout: the header, then by-value captures hold the value
+	// and by-ref ones the address
+	envFields := append([]types.Type{}, v.ctx.ClosureEnvType.Fields...)
+	for _, capture := range captures {
+		envFields = append(envFields, capture.Value.Type())
+	}
+	envType := types.NewStruct(name+".env", envFields, false)
+
+	codeParams := paramTypes
+	if len(captures) > 0 {
+		codeParams = append([]types.Type{types.NewPointer(types.I8)}, paramTypes...)
+		v.ctx.Module.Types[envType.Name] = envType
+	}
+
+	v.logger.Debug("Compiling function literal %s with %d capture(s)", name, len(captures))
+
+	// Compile the body as a separate function, then resume the current one
+	state := v.ctx.SuspendFunction()
+	fn := v.ctx.Builder.CreateFunction(name, retType, codeParams, false)
+
+	args := fn.Arguments
+	if len(captures) > 0 {
+		args[0].SetName("env")
+		args = args[1:]
+	}
+	for i, arg := range args {
+		arg.SetName(paramNames[i])
+	}
+
+	v.ctx.EnterFunction(fn)
+
+	entry := v.ctx.Builder.CreateBlock("entry")
+	v.ctx.SetInsertBlock(entry)
+
+	if len(captures) > 0 {
+		env := v.ctx.Builder.CreateBitCast(fn.Arguments[0], types.NewPointer(envType), "")
+		for i, capture := range captures {
+			slot := v.ctx.Builder.CreateStructGEP(envType, env, closureEnvHeaderFields+i, capture.Name+".env")
+			if capture.ByRef {
+				addr := v.ctx.Builder.CreateLoad(envFields[i], slot, "")
+				v.ctx.currentScope.DefineAddress(capture.Name, addr, capture.ElemType)
+			} else {
+				v.ctx.currentScope.DefineAddress(capture.Name, slot, capture.ElemType)
+			}
+		}
+	}
+
+	for i, arg := range args {
+		alloc := v.ctx.Builder.CreateAlloca(arg.Type(), paramNames[i]+".addr")
+		v.ctx.Builder.CreateStore(arg, alloc)
+		v.ctx.currentScope.Define(paramNames[i], alloc)
+	}
+
+	// The body's temporaries and errors are its own, not those of the
+	// statement the literal appears in
+	v.withTemporaries(func() {
+		v.Visit(ctx.Block())
+
+		if v.ctx.Builder.GetInsertBlock().Terminator() == nil {
+			v.ctx.EmitCleanupsUntil(nil)
+			if retType.Kind() == types.VoidKind {
+				v.ctx.Builder.CreateRetVoid()
+			} else {
+				v.ctx.Builder.CreateRet(v.getZeroValue(retType))
+			}
+		}
+	})
+
+	v.ctx.ExitFunction()
+	v.ctx.ResumeFunction(state)
+
+	if len(captures) == 0 {
+		return fn
+	}
+
+	// Build the environment on the heap so the closure can escape
+	deinit := v.emitEnvDeinit(envType, captures)
+	env := v.allocClassInstance(envType)
+	deinitSlot := v.ctx.Builder.CreateStructGEP(envType, env, 1, "")
+	v.ctx.Builder.CreateStore(v.ctx.Builder.CreateBitCast(deinit, types.NewPointer(types.I8), ""), deinitSlot)
+	for i, capture := range captures {
+		slot := v.ctx.Builder.CreateStructGEP(envType, env, closureEnvHeaderFields+i, "")
+		if !capture.ByRef {
+			v.takeOwnership(capture.Value)
+		}
+		v.ctx.Builder.CreateStore(capture.Value, slot)
+	}
+
+	rawEnv := v.ctx.Builder.CreateBitCast(env, types.NewPointer(types.I8), "")
+	closure := v.makeClosure(fn, rawEnv, v.ctx.ClosureType(retType, paramTypes))
+	v.markOwned(closure)
+	return closure
+}
+
+// emitEnvDeinit defines the deinit of a literal's environment, which
+// releases the values it captured
+func (v *IRVisitor) emitEnvDeinit(envType *types.StructType, captures []closureCapture) *ir.Function {
+	state := v.ctx.SuspendFunction()
+	header := types.NewPointer(v.ctx.ClosureEnvType)
+	fn := v.ctx.Builder.CreateFunction(strings.TrimSuffix(envType.Name, ".env")+"_env_deinit", types.Void, []types.Type{header}, false)
+	fn.Arguments[0].SetName("env")
+	v.ctx.SetInsertBlock(v.ctx.Builder.CreateBlock("entry"))
+
+	env := v.ctx.Builder.CreateBitCast(fn.Arguments[0], types.NewPointer(envType), "")
+	for i, capture := range captures {
+		field := envType.Fields[closureEnvHeaderFields+i]
+		if !capture.ByRef && v.isManaged(field) {
+			slot := v.ctx.Builder.CreateStructGEP(envType, env, closureEnvHeaderFields+i, "")
+			v.emitRelease(v.ctx.Builder.CreateLoad(field, slot, ""))
+		}
+	}
+	v.ctx.Builder.CreateRetVoid()
+
+	v.ctx.ResumeFunction(state)
+	v.closureEnvDeinit()
+	return fn
+}
+
+// closureEnvDeinit returns the deinit of __closure_env, which calls the one
+// stored in the environment, emitting it the first time
+func (v *IRVisitor) closureEnvDeinit() *ir.Function {
+	envName := v.ctx.ClosureEnvType.Name
+	if deinit, ok := v.ctx.Deinits[envName]; ok {
+		return deinit
+	}
+
+	state := v.ctx.SuspendFunction()
+	header := types.NewPointer(v.ctx.ClosureEnvType)
+	fn := v.ctx.Builder.CreateFunction(envName+"_deinit", types.Void, []types.Type{header}, false)
+	fn.Arguments[0].SetName("env")
+	v.ctx.Deinits[envName] = fn
+	v.ctx.SetInsertBlock(v.ctx.Builder.CreateBlock("entry"))
+
+	env := fn.Arguments[0]
+	slot := v.ctx.Builder.CreateStructGEP(v.ctx.ClosureEnvType, env, 1, "")
+	deinitType := types.NewPointer(types.NewFunction(types.Void, []types.Type{header}, false))
+	deinit := v.ctx.Builder.CreateBitCast(v.ctx.Builder.CreateLoad(types.NewPointer(types.I8), slot, ""), deinitType, "")
+	v.ctx.Builder.CreateCall(deinit, []ir.Value{env}, "")
+	v.ctx.Builder.CreateRetVoid()
+
+	v.ctx.ResumeFunction(state)
+	return fn
+}
+
+// collectCaptures finds the enclosing function's variables referenced in a
+// function literal body, in order of first use
+func (v *IRVisitor) collectCaptures(ctx *parser.FunctionLiteralContext, params []string) []closureCapture {
+	byRef := make(map[string]bool)
+	if ctx.CaptureList() != nil {
+		for _, item := range ctx.CaptureList().AllCaptureItem() {
+			byRef[item.IDENTIFIER().GetText()] = item.AMP() != nil
+		}
+	}
+
+	skip := make(map[string]bool)
+	for _, name := range params {
+		skip[name] = true
+	}
+
+	captures := make([]closureCapture, 0)
+	var walk func(tree antlr.Tree)
+	walk = func(tree antlr.Tree) {
+		var name string
+		switch node := tree.(type) {
+		case *parser.PrimaryExpressionContext:
+			if node.IDENTIFIER() != nil {
+				name = node.IDENTIFIER().GetText()
+			}
+		case *parser.LeftHandSideContext:
+			if node.IDENTIFIER() != nil && node.DOT() == nil {
+				name = node.IDENTIFIER().GetText()
+			}
+		}
+
+		if name != "" && !skip[name] && v.isLocalSymbol(name) {
+			skip[name] = true
+			sym, _ := v.ctx.currentScope.Lookup(name)
+			if addr, elemType, isVar := sym.Address(); isVar {
+				capture := closureCapture{Name: name, ByRef: byRef[name], ElemType: elemType}
+				if capture.ByRef {
+					capture.Value = addr
+				} else {
+					capture.Value = v.ctx.Builder.CreateLoad(elemType, addr, name+".captured")
+				}
+				captures = append(captures, capture)
+			} else {
+				// Constants are always copied
+				captures = append(captures, closureCapture{Name: name, Value: sym.Value, ElemType: sym.Value.Type()})
+			}
+		}
+
+		for _, child := range tree.GetChildren() {
+			walk(child)
+		}
+	}
+	walk(ctx.Block())
+
+	for name := range byRef {
+		if !v.isLocalSymbol(name) {
+			v.ctx.Logger.Error("Capture '%s' is not a local variable of the enclosing function", name)
+		}
+	}
+
+	return captures
+}
+
+// isLocalSymbol reports whether name is defined in the current function
+func (v *IRVisitor) isLocalSymbol(name string) bool {
+	if v.ctx.functionScope == nil {
+		return false
+	}
+	for s := v.ctx.currentScope; s != nil; s = s.parent {
+		if _, ok := s.LookupLocal(name); ok {
+			return true
+		}
+		if s == v.ctx.functionScope {
+			break
+		}
+	}
+	return false
+}
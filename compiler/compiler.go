@@ -144,6 +144,11 @@ func (c *Compiler) compileFileInternal(filename string, isEntry bool) (*ir.Modul
 	visitor := NewIRVisitor(c, filename)
 	visitor.Visit(tree)
 	
+	// Runtime helpers are emitted once every package has been compiled
+	if isEntry {
+		visitor.emitRuntimeSupport()
+	}
+	
 	// Check for compilation errors
 	if c.context.Logger.HasErrors() {
 		if isEntry {
@@ -181,6 +186,7 @@ func (c *Compiler) CompileString(source string) (*ir.Module, error) {
 	// Generate IR
 	visitor := NewIRVisitor(c, "<string>")
 	visitor.Visit(tree)
+	visitor.emitRuntimeSupport()
 	
 	// Check for compilation errors
 	if c.context.Logger.HasErrors() {
@@ -194,6 +200,26 @@ func (c *Compiler) CompileString(source string) (*ir.Module, error) {
 	return c.context.Module, nil
 }
 
+// EnableLeakCheck makes the program report leaked class instances when main returns
+func (c *Compiler) EnableLeakCheck(enabled bool) {
+	c.context.DebugLeaks = enabled
+}
+
+// EnableBoundsChecks controls the runtime checks on slice and array indices
+func (c *Compiler) EnableBoundsChecks(enabled bool) {
+	c.context.BoundsChecks = enabled
+}
+
+// EnableFreestanding makes runtime support independent of libc
+func (c *Compiler) EnableFreestanding(enabled bool) {
+	c.context.Freestanding = enabled
+}
+
+// EnableConstantMerging makes packages share identical string constants
+func (c *Compiler) EnableConstantMerging(enabled bool) {
+	c.context.MergeConstants = enabled
+}
+
 // GetModule returns the compiled module
 func (c *Compiler) GetModule() *ir.Module {
 	return c.context.Module
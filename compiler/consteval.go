@@ -0,0 +1,1012 @@
+package compiler
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+
+	"github.com/antlr4-go/antlr/v4"
+	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-builder/types"
+	"github.com/arc-language/core-parser"
+)
+
+// The constant evaluator folds expressions over the parse tree without
+// emitting IR. Integers are exact: an untyped literal keeps arbitrary
+// precision until it meets a type, and typed arithmetic that leaves the
+// range of its type is an overflow error instead of wrapping. Functions
+// declared 'const func' can be called; their bodies are interpreted over
+// the same values, with limits so that runaway recursion or loops are
+// reported instead of hanging the compiler.
+//
+// An expression that is simply not constant (it reads a variable, calls
+// an ordinary function, ...) yields an error the caller reports or falls
+// back on. Errors in an expression that is constant, such as overflow or
+// division by zero, are reported here and evaluation continues.
+
+const (
+	constStepLimit  = 1000000
+	constDepthLimit = 256
+)
+
+// errConstAborted ends an evaluation that hit a limit or another error
+// that has already been reported
+var errConstAborted = errors.New("constant evaluation aborted")
+
+type constKind int
+
+const (
+	constInt constKind = iota
+	constFloat
+	constBool
+	constString
+	constVoid
+)
+
+// constValue is a compile-time value. typ is nil for untyped integer and
+// float literals; untyped integers set char when they come from a char
+// literal.
+type constValue struct {
+	kind constKind
+	typ  types.Type
+	char bool
+	i    *big.Int
+	f    float64
+	b    bool
+	s    string
+}
+
+func constBoolean(b bool) constValue {
+	return constValue{kind: constBool, typ: types.I1, b: b}
+}
+
+// constLocal is a variable of a const function being interpreted
+type constLocal struct {
+	value   constValue
+	mutable bool
+}
+
+// constFrame is one activation of a const function
+type constFrame struct {
+	name      string
+	namespace *Namespace
+	retType   types.Type
+	scopes    []map[string]*constLocal
+	result    constValue
+}
+
+func (f *constFrame) lookup(name string) (*constLocal, bool) {
+	for i := len(f.scopes) - 1; i >= 0; i-- {
+		if local, ok := f.scopes[i][name]; ok {
+			return local, true
+		}
+	}
+	return nil, false
+}
+
+type constFlow int
+
+const (
+	flowNext constFlow = iota
+	flowBreak
+	flowContinue
+	flowReturn
+)
+
+type constEvaluator struct {
+	v     *IRVisitor
+	frame *constFrame
+	steps int
+	depth int
+}
+
+// evalConst evaluates expr at compile time
+func (v *IRVisitor) evalConst(expr antlr.ParseTree) (constValue, error) {
+	return v.runConst(&constEvaluator{v: v}, expr)
+}
+
+// evalConstIn evaluates expr as if written at the top level of namespace
+// ns, out of reach of the locals of the function being compiled
+func (v *IRVisitor) evalConstIn(expr antlr.ParseTree, ns *Namespace, name string) (constValue, error) {
+	frame := &constFrame{name: name, namespace: ns, retType: types.Void}
+	frame.scopes = []map[string]*constLocal{{}}
+	return v.runConst(&constEvaluator{v: v, frame: frame}, expr)
+}
+
+func (v *IRVisitor) runConst(e *constEvaluator, expr antlr.ParseTree) (constValue, error) {
+	c, err := e.eval(expr)
+	if err == errConstAborted {
+		return constValue{kind: constInt, i: new(big.Int)}, nil
+	}
+	if err == nil && c.kind == constVoid {
+		return c, fmt.Errorf("'%s' does not produce a value", expr.GetText())
+	}
+	return c, err
+}
+
+// registerConstFunction makes a 'const func' callable from constant
+// expressions before the function itself is compiled
+func (v *IRVisitor) registerConstFunction(ctx *parser.FunctionDeclContext) {
+	if ctx.CONST() == nil {
+		return
+	}
+	name := ctx.IDENTIFIER().GetText()
+	if ctx.THROWS() != nil {
+		v.ctx.Logger.Error("const function '%s' cannot be declared 'throws'", name)
+		return
+	}
+	if ctx.ParameterList() != nil && ctx.ParameterList().ELLIPSIS() != nil {
+		v.ctx.Logger.Error("const function '%s' cannot be variadic", name)
+		return
+	}
+	v.declaringNamespace().ConstFunctions[name] = ctx
+}
+
+func (e *constEvaluator) namespace() *Namespace {
+	if e.frame != nil {
+		return e.frame.namespace
+	}
+	return e.v.declaringNamespace()
+}
+
+func (e *constEvaluator) eval(tree antlr.ParseTree) (constValue, error) {
+	switch ctx := tree.(type) {
+	case *parser.ExpressionContext:
+		return e.eval(ctx.LogicalOrExpression())
+	case *parser.LogicalOrExpressionContext:
+		return e.logical(ctx, true)
+	case *parser.LogicalAndExpressionContext:
+		return e.logical(ctx, false)
+	case *parser.EqualityExpressionContext, *parser.RelationalExpressionContext,
+		*parser.AdditiveExpressionContext, *parser.MultiplicativeExpressionContext:
+		return e.chain(tree.(antlr.ParserRuleContext))
+	case *parser.RangeExpressionContext:
+		if ctx.RANGE() != nil || ctx.RANGE_INCLUSIVE() != nil {
+			return constValue{}, fmt.Errorf("ranges are not constants")
+		}
+		return e.eval(ctx.AdditiveExpression(0))
+	case *parser.UnaryExpressionContext:
+		return e.unary(ctx)
+	case *parser.PostfixExpressionContext:
+		return e.postfix(ctx)
+	case *parser.PrimaryExpressionContext:
+		return e.primary(ctx)
+	}
+	return constValue{}, fmt.Errorf("'%s' is not a constant expression", tree.GetText())
+}
+
+// operatorChain splits a binary expression rule into its operands and the
+// operators between them, in source order
+func operatorChain(ctx antlr.ParserRuleContext) ([]antlr.ParseTree, []string) {
+	var operands []antlr.ParseTree
+	var ops []string
+	for _, child := range ctx.GetChildren() {
+		switch c := child.(type) {
+		case antlr.TerminalNode:
+			ops = append(ops, c.GetText())
+		case antlr.ParseTree:
+			operands = append(operands, c)
+		}
+	}
+	return operands, ops
+}
+
+func (e *constEvaluator) logical(ctx antlr.ParserRuleContext, or bool) (constValue, error) {
+	operands, _ := operatorChain(ctx)
+	if len(operands) == 1 {
+		return e.eval(operands[0])
+	}
+	for _, operand := range operands {
+		c, err := e.eval(operand)
+		if err != nil {
+			return c, err
+		}
+		if c.kind != constBool {
+			return c, fmt.Errorf("'%s' is not a bool", operand.GetText())
+		}
+		if c.b == or {
+			return constBoolean(or), nil
+		}
+	}
+	return constBoolean(!or), nil
+}
+
+func (e *constEvaluator) chain(ctx antlr.ParserRuleContext) (constValue, error) {
+	operands, ops := operatorChain(ctx)
+	result, err := e.eval(operands[0])
+	for i := 1; i < len(operands) && err == nil; i++ {
+		var rhs constValue
+		if rhs, err = e.eval(operands[i]); err == nil {
+			result, err = e.binary(ops[i-1], result, rhs)
+		}
+	}
+	return result, err
+}
+
+func (e *constEvaluator) unary(ctx *parser.UnaryExpressionContext) (constValue, error) {
+	if ctx.PostfixExpression() != nil {
+		return e.eval(ctx.PostfixExpression())
+	}
+	if ctx.MINUS() == nil && ctx.NOT() == nil {
+		return constValue{}, fmt.Errorf("'%s' is not a constant expression", ctx.GetText())
+	}
+	x, err := e.eval(ctx.UnaryExpression())
+	if err != nil {
+		return x, err
+	}
+
+	switch {
+	case ctx.MINUS() != nil && x.kind == constInt:
+		return e.checkInt(x, new(big.Int).Neg(x.i)), nil
+	case ctx.MINUS() != nil && x.kind == constFloat:
+		x.f = -x.f
+		return x, nil
+	case ctx.NOT() != nil && x.kind == constBool:
+		return constBoolean(!x.b), nil
+	case ctx.NOT() != nil && x.kind == constInt:
+		// Bitwise complement: -x-1 in two's complement, max-x unsigned
+		if intType, ok := x.typ.(*types.IntType); ok && !intType.Signed {
+			_, max := intRange(intType)
+			return e.checkInt(x, max.Sub(max, x.i)), nil
+		}
+		return e.checkInt(x, new(big.Int).Not(x.i)), nil
+	}
+	return x, fmt.Errorf("invalid operand for '%s'", ctx.GetText()[:1])
+}
+
+func (e *constEvaluator) postfix(ctx *parser.PostfixExpressionContext) (constValue, error) {
+	ops := ctx.AllPostfixOp()
+	primary := ctx.PrimaryExpression()
+	if len(ops) == 0 {
+		return e.eval(primary)
+	}
+
+	var result constValue
+	var err error
+	var target *Namespace
+	if primary.IDENTIFIER() != nil {
+		target = e.v.ctx.NamespaceRegistry[primary.IDENTIFIER().GetText()]
+	}
+	switch {
+	case target != nil && ops[0].DOT() != nil && ops[0].IDENTIFIER() != nil:
+		// ns.f(args) and ns.NAME
+		name := ops[0].IDENTIFIER().GetText()
+		ops = ops[1:]
+		if len(ops) > 0 && ops[0].LPAREN() != nil {
+			result, err = e.call(target, name, ops[0])
+			ops = ops[1:]
+		} else if sym, ok := target.LookupGlobal(name); ok {
+			result, err = e.symbol(name, sym)
+		} else {
+			err = fmt.Errorf("'%s' is not a constant in namespace '%s'", name, target.Name)
+		}
+	case primary.IDENTIFIER() != nil && ops[0].LPAREN() != nil:
+		result, err = e.call(e.namespace(), primary.IDENTIFIER().GetText(), ops[0])
+		ops = ops[1:]
+	default:
+		result, err = e.eval(primary)
+	}
+
+	for _, op := range ops {
+		if err != nil {
+			return result, err
+		}
+		// Only string length has a constant value among members
+		if result.kind == constString && op.DOT() != nil && op.IDENTIFIER() != nil && op.IDENTIFIER().GetText() == "len" {
+			result = constValue{kind: constInt, typ: types.U64, i: big.NewInt(int64(len(result.s)))}
+			continue
+		}
+		return result, fmt.Errorf("'%s' is not a constant expression", ctx.GetText())
+	}
+	return result, err
+}
+
+func (e *constEvaluator) primary(ctx *parser.PrimaryExpressionContext) (constValue, error) {
+	switch {
+	case ctx.Literal() != nil:
+		return e.literal(ctx.Literal().(*parser.LiteralContext))
+	case ctx.Expression() != nil:
+		return e.eval(ctx.Expression())
+	case ctx.CastExpression() != nil:
+		cast := ctx.CastExpression()
+		x, err := e.eval(cast.Expression())
+		if err != nil {
+			return x, err
+		}
+		return e.convert(x, e.resolveType(cast.Type_()), true)
+	case ctx.IntrinsicExpression() != nil:
+		intrinsic := ctx.IntrinsicExpression()
+		if intrinsic.SIZEOF() != nil {
+			size := e.v.calculateSizeOf(e.resolveType(intrinsic.Type_()))
+			return constValue{kind: constInt, typ: types.U64, i: big.NewInt(int64(size))}, nil
+		}
+		if intrinsic.ALIGNOF() != nil {
+			align := e.v.calculateAlignOf(e.resolveType(intrinsic.Type_()))
+			return constValue{kind: constInt, typ: types.U64, i: big.NewInt(int64(align))}, nil
+		}
+		if intrinsic.OFFSETOF() != nil && len(intrinsic.AllExpression()) == 1 {
+			offset, ok := e.v.offsetOf(e.resolveType(intrinsic.Type_()), intrinsic.Expression(0).GetText())
+			if !ok {
+				return constValue{}, errConstAborted
+			}
+			return constValue{kind: constInt, typ: types.U64, i: big.NewInt(int64(offset))}, nil
+		}
+	case ctx.IDENTIFIER() != nil:
+		name := ctx.IDENTIFIER().GetText()
+		if e.frame != nil {
+			if local, ok := e.frame.lookup(name); ok {
+				return local.value, nil
+			}
+			if sym, ok := e.frame.namespace.LookupGlobal(name); ok {
+				return e.symbol(name, sym)
+			}
+		} else if sym, ok := e.v.lookupSymbol(name); ok {
+			return e.symbol(name, sym)
+		}
+		return constValue{}, fmt.Errorf("'%s' is not a constant", name)
+	}
+	return constValue{}, fmt.Errorf("'%s' is not a constant expression", ctx.GetText())
+}
+
+// resolveType resolves a type in the namespace of the code being evaluated
+func (e *constEvaluator) resolveType(ctx parser.ITypeContext) types.Type {
+	saved := e.v.ctx.currentNamespace
+	e.v.ctx.currentNamespace = e.namespace()
+	defer func() { e.v.ctx.currentNamespace = saved }()
+	return e.v.resolveType(ctx)
+}
+
+func (e *constEvaluator) literal(ctx *parser.LiteralContext) (constValue, error) {
+	switch {
+	case ctx.INTEGER_LITERAL() != nil:
+		text := ctx.INTEGER_LITERAL().GetText()
+		digits, suffix := splitNumericSuffix(text)
+		if floatType, isFloat := floatSuffixes[suffix]; isFloat {
+			return e.irConstant(e.v.floatLiteral(digits, floatType, text))
+		}
+		value, err := parseIntegerLiteral(digits)
+		if err != nil {
+			return constValue{}, fmt.Errorf("invalid integer literal '%s': %v", text, err)
+		}
+		c := constValue{kind: constInt, i: value}
+		if suffix != "" {
+			typ, ok := integerSuffixes[suffix]
+			if !ok {
+				return c, fmt.Errorf("invalid integer literal '%s': unknown suffix '%s'", text, suffix)
+			}
+			c.typ = typ
+			return e.checkInt(c, value), nil
+		}
+		return c, nil
+	case ctx.FLOAT_LITERAL() != nil:
+		lit := e.v.floatLiteralText(ctx.FLOAT_LITERAL().GetText())
+		c, err := e.irConstant(lit)
+		if e.v.floatLiterals[lit] {
+			c.typ = nil
+		}
+		return c, err
+	case ctx.BOOLEAN_LITERAL() != nil:
+		return constBoolean(ctx.BOOLEAN_LITERAL().GetText() == "true"), nil
+	case ctx.CHAR_LITERAL() != nil:
+		r, err := parseCharLiteral(ctx.CHAR_LITERAL().GetText())
+		if err != nil {
+			return constValue{}, err
+		}
+		return constValue{kind: constInt, char: true, i: big.NewInt(int64(r))}, nil
+	case ctx.STRING_LITERAL() != nil:
+		raw := ctx.STRING_LITERAL().GetText()
+		if len(raw) < 2 || strings.ContainsAny(raw, "{}") {
+			return constValue{}, fmt.Errorf("interpolated strings are not constants")
+		}
+		return constValue{kind: constString, typ: e.v.ctx.StringType, s: e.v.unescapeString(raw[1 : len(raw)-1])}, nil
+	}
+	return constValue{}, fmt.Errorf("'%s' is not a constant", ctx.GetText())
+}
+
+// symbol reads a constant declared with 'const'
+func (e *constEvaluator) symbol(name string, sym *Symbol) (constValue, error) {
+	switch lit := sym.Literal.(type) {
+	case string:
+		return constValue{kind: constString, typ: e.v.ctx.StringType, s: lit}, nil
+	case intLiteral:
+		return constValue{kind: constInt, i: new(big.Int).Set(lit.value)}, nil
+	case rune:
+		return constValue{kind: constInt, char: true, i: big.NewInt(int64(lit))}, nil
+	case float64:
+		return constValue{kind: constFloat, f: lit}, nil
+	}
+	if !sym.IsConst || sym.IsAddress || sym.Value == nil {
+		return constValue{}, fmt.Errorf("'%s' is not a constant", name)
+	}
+	// Constants local to the function being compiled keep their literal
+	// in the visitor
+	if lit, ok := e.v.intLiterals[sym.Value]; ok {
+		return constValue{kind: constInt, i: new(big.Int).Set(lit.value)}, nil
+	}
+	if r, ok := e.v.charLiterals[sym.Value]; ok {
+		return constValue{kind: constInt, char: true, i: big.NewInt(int64(r))}, nil
+	}
+	if s, ok := e.v.stringLiterals[sym.Value]; ok {
+		return constValue{kind: constString, typ: e.v.ctx.StringType, s: s}, nil
+	}
+	c, err := e.irConstant(sym.Value)
+	if err != nil {
+		return c, fmt.Errorf("'%s' is not a constant", name)
+	}
+	if e.v.floatLiterals[sym.Value] {
+		c.typ = nil
+	}
+	return c, nil
+}
+
+// irConstant reads back a constant produced by the IR builder
+func (e *constEvaluator) irConstant(val ir.Value) (constValue, error) {
+	switch c := val.(type) {
+	case *ir.ConstantInt:
+		typ := c.Type().(*types.IntType)
+		if typ.BitWidth == 1 {
+			return constBoolean(c.Value != 0), nil
+		}
+		value := big.NewInt(c.Value)
+		if !typ.Signed && c.Value < 0 {
+			value.Add(value, new(big.Int).Lsh(big.NewInt(1), uint(typ.BitWidth)))
+		}
+		return constValue{kind: constInt, typ: typ, i: value}, nil
+	case *ir.ConstantFloat:
+		return constValue{kind: constFloat, typ: c.Type(), f: c.Value}, nil
+	}
+	return constValue{}, fmt.Errorf("value is not a constant")
+}
+
+// checkInt gives x the value n, reporting overflow of its type
+func (e *constEvaluator) checkInt(x constValue, n *big.Int) constValue {
+	x.i = n
+	if intType, ok := x.typ.(*types.IntType); ok && !fitsInt(n, intType) {
+		min, max := intRange(intType)
+		e.v.ctx.Logger.Error("Constant %s overflows %v (range %s to %s)", n, intType, min, max)
+		x.i = wrapInt(n, intType)
+	}
+	return x
+}
+
+// wrapInt reduces n to the two's complement range of typ
+func wrapInt(n *big.Int, typ *types.IntType) *big.Int {
+	modulus := new(big.Int).Lsh(big.NewInt(1), uint(typ.BitWidth))
+	wrapped := new(big.Int).Mod(n, modulus)
+	if typ.Signed && wrapped.Cmp(new(big.Int).Rsh(modulus, 1)) >= 0 {
+		wrapped.Sub(wrapped, modulus)
+	}
+	return wrapped
+}
+
+// unify gives both operands of a binary operator the same type; untyped
+// integers take the type of the other operand
+func (e *constEvaluator) unify(x, y constValue) (constValue, constValue, error) {
+	var err error
+	switch {
+	case x.typ == nil && y.typ != nil:
+		x, err = e.convert(x, y.typ, false)
+	case y.typ == nil && x.typ != nil:
+		y, err = e.convert(y, x.typ, false)
+	case x.typ == nil && x.kind == constInt && y.kind == constFloat:
+		x = constValue{kind: constFloat, f: e.toFloat(x.i)}
+	case y.typ == nil && y.kind == constInt && x.kind == constFloat:
+		y = constValue{kind: constFloat, f: e.toFloat(y.i)}
+	}
+	if err != nil {
+		return x, y, err
+	}
+	if x.kind != y.kind || (x.typ != nil && y.typ != nil && !e.v.ctx.SameType(x.typ, y.typ)) {
+		return x, y, fmt.Errorf("mismatched types %s and %s", e.v.typeName(x.Type()), e.v.typeName(y.Type()))
+	}
+	if x.typ == nil {
+		x.char = x.char && y.char
+	}
+	return x, y, nil
+}
+
+func (e *constEvaluator) binary(op string, x, y constValue) (constValue, error) {
+	x, y, err := e.unify(x, y)
+	if err != nil {
+		return x, err
+	}
+
+	// Comparisons work on every kind
+	cmp := 0
+	switch x.kind {
+	case constInt:
+		cmp = x.i.Cmp(y.i)
+	case constFloat:
+		if x.f < y.f {
+			cmp = -1
+		} else if x.f > y.f {
+			cmp = 1
+		} else if x.f != y.f {
+			// NaN compares unequal and unordered
+			return constBoolean(op == "!="), nil
+		}
+	case constString:
+		cmp = strings.Compare(x.s, y.s)
+	case constBool:
+		if x.b != y.b {
+			cmp = 1
+		}
+	}
+	switch op {
+	case "==":
+		return constBoolean(cmp == 0), nil
+	case "!=":
+		return constBoolean(cmp != 0), nil
+	}
+	if x.kind != constBool {
+		switch op {
+		case "<":
+			return constBoolean(cmp < 0), nil
+		case "<=":
+			return constBoolean(cmp <= 0), nil
+		case ">":
+			return constBoolean(cmp > 0), nil
+		case ">=":
+			return constBoolean(cmp >= 0), nil
+		}
+	}
+
+	switch x.kind {
+	case constInt:
+		n := new(big.Int)
+		switch op {
+		case "+":
+			n.Add(x.i, y.i)
+		case "-":
+			n.Sub(x.i, y.i)
+		case "*":
+			n.Mul(x.i, y.i)
+		case "/", "%":
+			if y.i.Sign() == 0 {
+				e.v.ctx.Logger.Error("Division by zero in constant expression")
+				return x, nil
+			}
+			// Truncated division, as at runtime
+			if op == "/" {
+				n.Quo(x.i, y.i)
+			} else {
+				n.Rem(x.i, y.i)
+			}
+		default:
+			return x, fmt.Errorf("operator '%s' is not defined on integers", op)
+		}
+		return e.checkInt(x, n), nil
+	case constFloat:
+		switch op {
+		case "+":
+			x.f += y.f
+		case "-":
+			x.f -= y.f
+		case "*":
+			x.f *= y.f
+		case "/":
+			x.f /= y.f
+		default:
+			return x, fmt.Errorf("operator '%s' is not defined on floats", op)
+		}
+		return e.roundFloat(x), nil
+	case constString:
+		if op == "+" {
+			x.s += y.s
+			return x, nil
+		}
+	}
+	return x, fmt.Errorf("operator '%s' is not defined on %v", op, x.Type())
+}
+
+func (e *constEvaluator) toFloat(n *big.Int) float64 {
+	f, _ := new(big.Float).SetInt(n).Float64()
+	return f
+}
+
+// roundFloat rounds a float32 result to float32 precision
+func (e *constEvaluator) roundFloat(x constValue) constValue {
+	if x.typ != nil && x.typ.Equal(types.F32) {
+		if !math.IsInf(x.f, 0) && math.Abs(x.f) > math.MaxFloat32 {
+			e.v.ctx.Logger.Error("Constant %g overflows float32", x.f)
+		}
+		x.f = float64(float32(x.f))
+	}
+	return x
+}
+
+// convert converts a constant to target. Implicit conversions must keep
+// the value; explicit casts wrap integers and truncate floats as the
+// runtime conversions do.
+func (e *constEvaluator) convert(x constValue, target types.Type, explicit bool) (constValue, error) {
+	if x.typ != nil && e.v.ctx.SameType(x.typ, target) {
+		return x, nil
+	}
+	fail := fmt.Errorf("cannot convert %s constant to %s", e.v.typeName(x.Type()), e.v.typeName(target))
+	if !explicit && x.typ != nil && e.v.mixesDistinct(x.typ, target) {
+		return x, fmt.Errorf("cannot use %s constant as %s without cast<>", e.v.typeName(x.typ), e.v.typeName(target))
+	}
+
+	switch t := target.(type) {
+	case *types.IntType:
+		if t.BitWidth == 1 {
+			break
+		}
+		result := constValue{kind: constInt, typ: t}
+		switch x.kind {
+		case constInt:
+			if explicit {
+				result.i = wrapInt(x.i, t)
+				return result, nil
+			}
+			if !fitsInt(x.i, t) {
+				min, max := intRange(t)
+				e.v.ctx.Logger.Error("Constant %s does not fit in %v (range %s to %s)", x.i, t, min, max)
+				result.i = wrapInt(x.i, t)
+				return result, nil
+			}
+			result.i = new(big.Int).Set(x.i)
+			return result, nil
+		case constFloat:
+			if !explicit {
+				return x, fail
+			}
+			if math.IsNaN(x.f) || math.IsInf(x.f, 0) {
+				e.v.ctx.Logger.Error("Cannot convert %g to %v", x.f, t)
+				result.i = new(big.Int)
+				return result, nil
+			}
+			result.i, _ = big.NewFloat(math.Trunc(x.f)).Int(nil)
+			return e.checkInt(result, result.i), nil
+		case constBool:
+			if !explicit {
+				return x, fail
+			}
+			result.i = big.NewInt(0)
+			if x.b {
+				result.i.SetInt64(1)
+			}
+			return result, nil
+		}
+	case *types.FloatType:
+		result := constValue{kind: constFloat, typ: t}
+		switch x.kind {
+		case constInt:
+			result.f = e.toFloat(x.i)
+			return e.roundFloat(result), nil
+		case constFloat:
+			result.f = x.f
+			return e.roundFloat(result), nil
+		}
+	default:
+		if e.v.ctx.IsString(target) && x.kind == constString {
+			return x, nil
+		}
+	}
+	return x, fail
+}
+
+// Type is the type a constant has once materialized
+func (c constValue) Type() types.Type {
+	switch {
+	case c.typ != nil:
+		return c.typ
+	case c.kind == constVoid:
+		return types.Void
+	case c.kind == constFloat:
+		return types.F64
+	case c.char:
+		return types.U32
+	}
+	if typ, ok := defaultLiteralType(c.i); ok {
+		return typ
+	}
+	return types.I128
+}
+
+// call interprets a call to a const function
+func (e *constEvaluator) call(ns *Namespace, name string, op parser.IPostfixOpContext) (constValue, error) {
+	decl, declNs, ok := ns.LookupConstFunction(name)
+	if !ok {
+		return constValue{}, fmt.Errorf("'%s' is not a const function", name)
+	}
+
+	var argExprs []parser.IExpressionContext
+	if op.ArgumentList() != nil {
+		argExprs = op.ArgumentList().AllExpression()
+	}
+	var params []parser.IParameterContext
+	if decl.ParameterList() != nil {
+		params = decl.ParameterList().AllParameter()
+	}
+	if len(argExprs) != len(params) {
+		return constValue{}, fmt.Errorf("'%s' expects %d arguments, got %d", name, len(params), len(argExprs))
+	}
+
+	frame := &constFrame{name: name, namespace: declNs, retType: types.Void}
+	frame.scopes = []map[string]*constLocal{{}}
+	for i, param := range params {
+		arg, err := e.eval(argExprs[i])
+		if err != nil {
+			return arg, err
+		}
+		paramType := e.withFrame(frame, func() types.Type { return e.resolveType(param.Type_()) })
+		if arg, err = e.convert(arg, paramType, false); err != nil {
+			return arg, fmt.Errorf("argument %d of '%s': %v", i+1, name, err)
+		}
+		frame.scopes[0][param.IDENTIFIER().GetText()] = &constLocal{value: arg, mutable: false}
+	}
+	if decl.Type_() != nil {
+		frame.retType = e.withFrame(frame, func() types.Type { return e.resolveType(decl.Type_()) })
+	}
+
+	if e.depth >= constDepthLimit {
+		e.v.ctx.Logger.Error("Constant evaluation of '%s' exceeded %d nested calls", name, constDepthLimit)
+		return constValue{}, errConstAborted
+	}
+	outer := e.frame
+	e.frame = frame
+	e.depth++
+	flow, err := e.block(decl.Block())
+	e.depth--
+	e.frame = outer
+	if err != nil {
+		return constValue{}, err
+	}
+
+	if frame.retType.Kind() == types.VoidKind {
+		return constValue{kind: constVoid, typ: types.Void}, nil
+	}
+	if flow != flowReturn {
+		return constValue{}, fmt.Errorf("const function '%s' ended without returning a value", name)
+	}
+	return frame.result, nil
+}
+
+func (e *constEvaluator) withFrame(frame *constFrame, fn func() types.Type) types.Type {
+	outer := e.frame
+	e.frame = frame
+	defer func() { e.frame = outer }()
+	return fn()
+}
+
+func (e *constEvaluator) block(ctx parser.IBlockContext) (constFlow, error) {
+	e.frame.scopes = append(e.frame.scopes, map[string]*constLocal{})
+	defer func() { e.frame.scopes = e.frame.scopes[:len(e.frame.scopes)-1] }()
+
+	for _, stmt := range ctx.AllStatement() {
+		flow, err := e.statement(stmt.(*parser.StatementContext))
+		if err != nil || flow != flowNext {
+			return flow, err
+		}
+	}
+	return flowNext, nil
+}
+
+func (e *constEvaluator) statement(ctx *parser.StatementContext) (constFlow, error) {
+	e.steps++
+	if e.steps > constStepLimit {
+		e.v.ctx.Logger.Error("Constant evaluation of '%s' exceeded %d steps", e.frame.name, constStepLimit)
+		return flowReturn, errConstAborted
+	}
+
+	switch {
+	case ctx.VariableDecl() != nil:
+		decl := ctx.VariableDecl()
+		if decl.TuplePattern() != nil {
+			return flowNext, fmt.Errorf("tuple patterns are not supported in const functions")
+		}
+		return flowNext, e.declare(decl.IDENTIFIER().GetText(), decl.Type_(), decl.Expression(), true)
+	case ctx.ConstDecl() != nil:
+		decl := ctx.ConstDecl()
+		return flowNext, e.declare(decl.IDENTIFIER().GetText(), decl.Type_(), decl.Expression(), false)
+	case ctx.AssignmentStmt() != nil:
+		return flowNext, e.assign(ctx.AssignmentStmt())
+	case ctx.ReturnStmt() != nil:
+		if ctx.ReturnStmt().Expression() == nil {
+			return flowReturn, nil
+		}
+		result, err := e.eval(ctx.ReturnStmt().Expression())
+		if err == nil {
+			e.frame.result, err = e.convert(result, e.frame.retType, false)
+		}
+		return flowReturn, err
+	case ctx.IfStmt() != nil:
+		ifStmt := ctx.IfStmt()
+		conds := ifStmt.AllExpression()
+		for i, cond := range conds {
+			c, err := e.condition(cond)
+			if err != nil {
+				return flowNext, err
+			}
+			if c {
+				return e.block(ifStmt.Block(i))
+			}
+		}
+		if len(ifStmt.AllBlock()) > len(conds) {
+			return e.block(ifStmt.Block(len(conds)))
+		}
+		return flowNext, nil
+	case ctx.ForStmt() != nil:
+		return e.loop(ctx.ForStmt().(*parser.ForStmtContext))
+	case ctx.BreakStmt() != nil:
+		return flowBreak, nil
+	case ctx.ContinueStmt() != nil:
+		return flowContinue, nil
+	case ctx.ExpressionStmt() != nil:
+		_, err := e.eval(ctx.ExpressionStmt().Expression())
+		return flowNext, err
+	case ctx.Block() != nil:
+		return e.block(ctx.Block())
+	}
+	return flowNext, fmt.Errorf("'%s' cannot be evaluated at compile time", ctx.GetText())
+}
+
+func (e *constEvaluator) condition(expr antlr.ParseTree) (bool, error) {
+	c, err := e.eval(expr)
+	if err == nil && c.kind != constBool {
+		err = fmt.Errorf("condition '%s' is not a bool", expr.GetText())
+	}
+	return c.b, err
+}
+
+// declare binds a local of a const function; untyped literals take their
+// default type as they would at runtime
+func (e *constEvaluator) declare(name string, typeCtx parser.ITypeContext, expr parser.IExpressionContext, mutable bool) error {
+	if expr == nil {
+		return fmt.Errorf("'%s' needs an initializer in a const function", name)
+	}
+	value, err := e.eval(expr)
+	if err != nil {
+		return err
+	}
+	typ := value.Type()
+	if typeCtx != nil {
+		typ = e.resolveType(typeCtx)
+	}
+	if value, err = e.convert(value, typ, false); err != nil {
+		return err
+	}
+	e.frame.scopes[len(e.frame.scopes)-1][name] = &constLocal{value: value, mutable: mutable}
+	return nil
+}
+
+func (e *constEvaluator) assign(ctx parser.IAssignmentStmtContext) error {
+	lhs := ctx.LeftHandSide()
+	if lhs.IDENTIFIER() == nil || lhs.DOT() != nil || lhs.STAR() != nil || lhs.LBRACKET() != nil {
+		return fmt.Errorf("only local variables can be assigned in a const function")
+	}
+	name := lhs.IDENTIFIER().GetText()
+	local, ok := e.frame.lookup(name)
+	if !ok || !local.mutable {
+		return fmt.Errorf("cannot assign to '%s' in a const function", name)
+	}
+	value, err := e.eval(ctx.Expression())
+	if err == nil {
+		local.value, err = e.convert(value, local.value.Type(), false)
+	}
+	return err
+}
+
+// loop interprets the condition and C-style forms of 'for'
+func (e *constEvaluator) loop(ctx *parser.ForStmtContext) (constFlow, error) {
+	if ctx.IN() != nil {
+		return flowNext, fmt.Errorf("for-in loops cannot be evaluated at compile time")
+	}
+	e.frame.scopes = append(e.frame.scopes, map[string]*constLocal{})
+	defer func() { e.frame.scopes = e.frame.scopes[:len(e.frame.scopes)-1] }()
+
+	semicolons := ctx.AllSEMICOLON()
+	var cond antlr.ParseTree
+	var post []antlr.ParseTree
+	if len(semicolons) == 2 {
+		if decl := ctx.VariableDecl(); decl != nil {
+			if err := e.declare(decl.IDENTIFIER().GetText(), decl.Type_(), decl.Expression(), true); err != nil {
+				return flowNext, err
+			}
+		}
+		for _, assign := range ctx.AllAssignmentStmt() {
+			if e.v.isBefore(assign, semicolons[0]) {
+				if err := e.assign(assign); err != nil {
+					return flowNext, err
+				}
+			} else if e.v.isAfter(assign, semicolons[1]) {
+				post = append(post, assign)
+			}
+		}
+		for _, expr := range ctx.AllExpression() {
+			if e.v.isAfter(expr, semicolons[0]) && e.v.isBefore(expr, semicolons[1]) {
+				cond = expr
+			} else if e.v.isAfter(expr, semicolons[1]) {
+				post = append(post, expr)
+			}
+		}
+	} else if ctx.Expression(0) != nil {
+		cond = ctx.Expression(0)
+	}
+
+	for {
+		if cond != nil {
+			ok, err := e.condition(cond)
+			if err != nil || !ok {
+				return flowNext, err
+			}
+		}
+		flow, err := e.block(ctx.Block())
+		if err != nil || flow == flowReturn {
+			return flow, err
+		}
+		if flow == flowBreak {
+			return flowNext, nil
+		}
+		for _, step := range post {
+			if assign, ok := step.(parser.IAssignmentStmtContext); ok {
+				err = e.assign(assign)
+			} else {
+				_, err = e.eval(step)
+			}
+			if err != nil {
+				return flowNext, err
+			}
+		}
+		e.steps++
+		if e.steps > constStepLimit {
+			e.v.ctx.Logger.Error("Constant evaluation of '%s' exceeded %d steps", e.frame.name, constStepLimit)
+			return flowReturn, errConstAborted
+		}
+	}
+}
+
+// convertConst converts an evaluated constant to the declared type of the
+// declaration it initializes
+func (v *IRVisitor) convertConst(c constValue, typ types.Type) (constValue, error) {
+	e := &constEvaluator{v: v}
+	return e.convert(c, typ, false)
+}
+
+// constToValue materializes a constant. Untyped numbers and chars are
+// recorded as literals so they keep adapting to their context.
+func (v *IRVisitor) constToValue(c constValue) ir.Value {
+	switch c.kind {
+	case constFloat:
+		val := v.ctx.Builder.ConstFloat(c.Type().(*types.FloatType), c.f)
+		if c.typ == nil {
+			v.floatLiterals[val] = true
+		}
+		return val
+	case constBool:
+		if c.b {
+			return v.ctx.Builder.True()
+		}
+		return v.ctx.Builder.False()
+	case constString:
+		return v.stringLiteral(c.s)
+	}
+
+	typ := c.Type().(*types.IntType)
+	val := v.intConstant(c.i, typ)
+	if c.typ == nil && c.char {
+		v.charLiterals[val] = rune(c.i.Int64())
+	} else if c.typ == nil {
+		v.intLiterals[val] = intLiteral{value: c.i}
+	}
+	return val
+}
+
+// literal is what a namespace constant remembers about an untyped value,
+// see Symbol.Literal
+func (c constValue) literal() interface{} {
+	switch {
+	case c.kind == constString:
+		return c.s
+	case c.typ != nil:
+		return nil
+	case c.kind == constFloat:
+		return c.f
+	case c.char:
+		return rune(c.i.Int64())
+	}
+	return intLiteral{value: c.i}
+}
@@ -2,15 +2,19 @@
 package compiler
 
 import (
+	"strconv"
+
 	"github.com/arc-language/core-builder/builder"
 	"github.com/arc-language/core-builder/ir"
 	"github.com/arc-language/core-builder/types"
+	"github.com/arc-language/core-parser"
 )
 
 // LoopInfo holds the target blocks for control flow within a loop
 type LoopInfo struct {
 	ContinueBlock *ir.BasicBlock // Where 'continue' jumps to
 	BreakBlock    *ir.BasicBlock // Where 'break' jumps to
+	Scope         *Scope         // Scope enclosing the loop body
 }
 
 // Namespace represents a named collection of declarations
@@ -18,7 +22,11 @@ type Namespace struct {
 	Name      string
 	Functions map[string]*ir.Function
 	Types     map[string]types.Type
+	Globals   map[string]*Symbol // top-level 'let' and 'const' declarations
 	Parent    *Namespace
+	
+	// Functions declared 'const func', callable in constant expressions
+	ConstFunctions map[string]*parser.FunctionDeclContext
 }
 
 // NewNamespace creates a new namespace
@@ -27,7 +35,10 @@ func NewNamespace(name string, parent *Namespace) *Namespace {
 		Name:      name,
 		Functions: make(map[string]*ir.Function),
 		Types:     make(map[string]types.Type),
+		Globals:   make(map[string]*Symbol),
 		Parent:    parent,
+		
+		ConstFunctions: make(map[string]*parser.FunctionDeclContext),
 	}
 }
 
@@ -42,6 +53,29 @@ func (ns *Namespace) LookupFunction(name string) (*ir.Function, bool) {
 	return nil, false
 }
 
+// LookupGlobal searches for a global or constant in this namespace and parents
+func (ns *Namespace) LookupGlobal(name string) (*Symbol, bool) {
+	if sym, ok := ns.Globals[name]; ok {
+		return sym, true
+	}
+	if ns.Parent != nil {
+		return ns.Parent.LookupGlobal(name)
+	}
+	return nil, false
+}
+
+// LookupConstFunction searches for a const function in this namespace and
+// parents, returning the namespace that declares it
+func (ns *Namespace) LookupConstFunction(name string) (*parser.FunctionDeclContext, *Namespace, bool) {
+	if decl, ok := ns.ConstFunctions[name]; ok {
+		return decl, ns, true
+	}
+	if ns.Parent != nil {
+		return ns.Parent.LookupConstFunction(name)
+	}
+	return nil, nil, false
+}
+
 // Context holds the state during compilation
 type Context struct {
 	Builder  *builder.Builder
@@ -54,8 +88,9 @@ type Context struct {
 	currentBlock    *ir.BasicBlock
 	
 	// Symbol tables
-	globalScope  *Scope
-	currentScope *Scope
+	globalScope   *Scope
+	currentScope  *Scope
+	functionScope *Scope
 	
 	// Namespace management
 	rootNamespace    *Namespace
@@ -70,17 +105,142 @@ type Context struct {
 	// Struct Field Mapping: StructName -> FieldName -> Index
 	StructFieldIndices map[string]map[string]int
 	
+	// Struct Field Defaults: StructName -> Index -> default value
+	fieldDefaults map[string]map[int]*fieldDefault
+	
+	// Layouts of structs declared with attributes: StructName -> layout
+	structLayouts map[string]*structLayout
+	
 	// Class Field Mapping: ClassName -> FieldName -> Index
 	ClassFieldIndices map[string]map[string]int
 	
 	// Track which types are classes (for reference semantics)
 	classTypes map[string]bool
 	
-	// Deferred statements stack (per function)
-	deferredStmts [][]ir.Instruction
-
+	// Method Mapping: TypeName -> MethodName -> Function
+	Methods map[string]map[string]*ir.Function
+	
+	// Destructors: ClassName -> Class_deinit
+	Deinits map[string]*ir.Function
+	
 	// Loop stack for break/continue
 	loopStack []LoopInfo
+	
+	// Report leaked class instances when main returns
+	DebugLeaks bool
+	
+	// Check slice and array indices at runtime
+	BoundsChecks bool
+	
+	// Generate the runtime allocator instead of calling libc
+	Freestanding bool
+	
+	// Share identical constants between packages instead of keeping a
+	// pool per package
+	MergeConstants bool
+	
+	// Init functions of namespaces with non-constant global initializers,
+	// in the order the namespaces were compiled
+	moduleInits []*moduleInit
+	
+	// Set once main calls __arc_module_init, which then has to be emitted
+	moduleInitUsed bool
+	
+	// Interned string literals, keyed by pool and then by content
+	stringConstants map[string]map[string]*ir.Global
+	
+	// Closure types keyed by signature, and the signature behind each
+	closureTypes map[string]*types.StructType
+	closureSigs  map[*types.StructType]*closureSignature
+	
+	// Adapters letting plain functions be called through a closure
+	thunks map[*ir.Function]*ir.Function
+	
+	// Counter for naming function literals
+	lambdaCount int
+	
+	// Counter for naming generated blocks; source positions are not unique,
+	// since deferred and interpolated code is emitted more than once
+	blockCount int
+	
+	// Tuple types keyed by element types
+	tupleTypes map[string]*types.StructType
+	tupleSet   map[*types.StructType]bool
+	
+	// Functions returning through a hidden result slot, and their result type
+	indirectReturns map[*ir.Function]types.Type
+	
+	// Hidden result slot of the function being compiled, if any
+	returnSlot ir.Value
+	
+	// Functions declared 'throws', and the value type they declare
+	throwing map[*ir.Function]types.Type
+	
+	// C calling convention of extern functions, the C adapters of Arc
+	// functions, and the register structs of coerced aggregates
+	cSignatures map[*ir.Function]*abiSignature
+	cAdapters   map[*ir.Function]*ir.Function
+	abiTypes    map[string]*types.StructType
+	
+	// Functions declared ahead of their bodies, by declaration
+	functionProtos map[*parser.FunctionDeclContext]*functionProto
+	
+	// Extern functions and variables by the namespace that declares them
+	// and their Arc name, which may differ from the C symbol they link to
+	externs map[*Namespace]map[string]*Symbol
+	
+	// Types declared 'distinct type', which lower to their base type but
+	// only mix with it through cast<>
+	distinctTypes map[types.Type]*distinctType
+	
+	// Slice types keyed by element type, and the element type behind each
+	sliceTypes map[string]*types.StructType
+	sliceElems map[*types.StructType]types.Type
+	
+	// Vector types keyed by element type, and the element type behind each
+	vectorTypes map[string]*types.StructType
+	vectorElems map[*types.StructType]types.Type
+	
+	// Map types keyed by key and value type, and the description of each
+	mapTypes map[string]*types.StructType
+	mapInfos map[*types.StructType]*mapInfo
+	
+	// Optional types keyed by wrapped type, and the wrapped type behind each
+	optionalTypes map[string]*types.StructType
+	optionalElems map[*types.StructType]types.Type
+	
+	// Range types keyed by bound type, and the bound type behind each
+	rangeTypes map[string]*types.StructType
+	rangeElems map[*types.StructType]types.Type
+	
+	// utf8Decode is the runtime UTF-8 decoder, emitted on first use
+	utf8Decode *ir.Function
+	
+	// StringType is the {data, len, owner} layout of 'string'
+	StringType *types.StructType
+	
+	// StringBufferType heads the reference counted buffer of heap strings
+	StringBufferType *types.StructType
+	
+	// ClosureEnvType heads every closure environment: {count, deinit}
+	ClosureEnvType *types.StructType
+	
+	// stringFuncs is the string runtime, emitted on first use
+	stringFuncs *stringFuncs
+	
+	// formatFuncs is the formatting runtime used by interpolated strings
+	formatFuncs *formatFuncs
+}
+
+// functionState is the per-function compilation state, saved while a nested
+// function such as a function literal is compiled
+type functionState struct {
+	function      *ir.Function
+	block         *ir.BasicBlock
+	scope         *Scope
+	functionScope *Scope
+	loopStack     []LoopInfo
+	returnSlot    ir.Value
 }
 
 // NewContext creates a new compilation context
@@ -99,9 +259,37 @@ func NewContext(entryFile string, moduleName string) *Context {
 		globalScope:        NewScope(nil),
 		namedTypes:         make(map[string]types.Type),
 		StructFieldIndices: make(map[string]map[string]int),
+		fieldDefaults:      make(map[string]map[int]*fieldDefault),
+		structLayouts:      make(map[string]*structLayout),
 		ClassFieldIndices:  make(map[string]map[string]int),
 		classTypes:         make(map[string]bool),
-		deferredStmts:      make([][]ir.Instruction, 0),
+		Methods:            make(map[string]map[string]*ir.Function),
+		Deinits:            make(map[string]*ir.Function),
+		closureTypes:       make(map[string]*types.StructType),
+		closureSigs:        make(map[*types.StructType]*closureSignature),
+		thunks:             make(map[*ir.Function]*ir.Function),
+		tupleTypes:         make(map[string]*types.StructType),
+		tupleSet:           make(map[*types.StructType]bool),
+		indirectReturns:    make(map[*ir.Function]types.Type),
+		throwing:           make(map[*ir.Function]types.Type),
+		cSignatures:        make(map[*ir.Function]*abiSignature),
+		cAdapters:          make(map[*ir.Function]*ir.Function),
+		abiTypes:           make(map[string]*types.StructType),
+		externs:            make(map[*Namespace]map[string]*Symbol),
+		functionProtos:     make(map[*parser.FunctionDeclContext]*functionProto),
+		distinctTypes:      make(map[types.Type]*distinctType),
+		sliceTypes:         make(map[string]*types.StructType),
+		sliceElems:         make(map[*types.StructType]types.Type),
+		vectorTypes:        make(map[string]*types.StructType),
+		vectorElems:        make(map[*types.StructType]types.Type),
+		mapTypes:           make(map[string]*types.StructType),
+		mapInfos:           make(map[*types.StructType]*mapInfo),
+		optionalTypes:      make(map[string]*types.StructType),
+		optionalElems:      make(map[*types.StructType]types.Type),
+		rangeTypes:         make(map[string]*types.StructType),
+		rangeElems:         make(map[*types.StructType]types.Type),
+		BoundsChecks:       true,
+		stringConstants:    make(map[string]map[string]*ir.Global),
 		loopStack:          make([]LoopInfo, 0),
 		rootNamespace:      rootNs,
 		currentNamespace:   rootNs,
@@ -207,7 +395,17 @@ func (c *Context) registerBuiltinTypes() {
 	c.namedTypes["void"] = types.Void
 	c.namedTypes["bool"] = types.I1
 	c.namedTypes["char"] = types.U32 // Unicode code point (uint32)
-	c.namedTypes["string"] = types.NewPointer(types.I8) // For now, *i8
+	c.StringBufferType = types.NewStruct("__string_buffer", []types.Type{types.I64}, false)
+	c.Module.Types["__string_buffer"] = c.StringBufferType
+	c.namedTypes["__string_buffer"] = c.StringBufferType
+	c.classTypes["__string_buffer"] = true
+	c.ClosureEnvType = types.NewStruct("__closure_env", []types.Type{types.I64, types.NewPointer(types.I8)}, false)
+	c.Module.Types["__closure_env"] = c.ClosureEnvType
+	c.namedTypes["__closure_env"] = c.ClosureEnvType
+	c.classTypes["__closure_env"] = true
+	c.StringType = types.NewStruct("__string", []types.Type{types.NewPointer(types.I8), types.U64, types.NewPointer(c.StringBufferType)}, false)
+	c.Module.Types["__string"] = c.StringType
+	c.namedTypes["string"] = c.StringType
 	
 	// Variadic arguments support
 	c.namedTypes["va_list"] = types.NewPointer(types.I8)
@@ -254,6 +452,26 @@ func (c *Context) IsClassType(name string) bool {
 	return c.classTypes[name]
 }
 
+// RegisterMethod binds a method to its receiver type
+func (c *Context) RegisterMethod(typeName, methodName string, fn *ir.Function) {
+	methods, ok := c.Methods[typeName]
+	if !ok {
+		methods = make(map[string]*ir.Function)
+		c.Methods[typeName] = methods
+	}
+	methods[methodName] = fn
+	c.Logger.Debug("Registered method '%s' on type '%s'", methodName, typeName)
+}
+
+// LookupMethod finds a method bound to a receiver type
+func (c *Context) LookupMethod(typeName, methodName string) (*ir.Function, bool) {
+	if methods, ok := c.Methods[typeName]; ok {
+		fn, ok := methods[methodName]
+		return fn, ok
+	}
+	return nil, false
+}
+
 // PushScope creates a new nested scope
 func (c *Context) PushScope() {
 	c.currentScope = NewScope(c.currentScope)
@@ -273,15 +491,14 @@ func (c *Context) EnterFunction(fn *ir.Function) {
 	c.currentFunction = fn
 	c.currentBlock = nil
 	c.PushScope()
+	c.functionScope = c.currentScope
+	c.returnSlot = nil
 	
 	// Add function parameters to scope
 	for _, arg := range fn.Arguments {
 		c.currentScope.Define(arg.Name(), arg)
 	}
 	
-	// Initialize deferred statements for this function
-	c.deferredStmts = append(c.deferredStmts, make([]ir.Instruction, 0))
-	
 	c.Logger.Debug("Entered function '%s'", fn.Name())
 }
 
@@ -293,36 +510,68 @@ func (c *Context) ExitFunction() {
 	
 	c.currentFunction = nil
 	c.currentBlock = nil
+	c.functionScope = nil
+	c.returnSlot = nil
 	c.PopScope()
-	
-	// Pop deferred statements
-	if len(c.deferredStmts) > 0 {
-		c.deferredStmts = c.deferredStmts[:len(c.deferredStmts)-1]
-	}
+
 	// Reset loop stack just in case
 	c.loopStack = c.loopStack[:0]
 }
 
+// SuspendFunction saves the state of the function being compiled so that
+// another function can be emitted before resuming it
+func (c *Context) SuspendFunction() functionState {
+	state := functionState{
+		function:      c.currentFunction,
+		block:         c.currentBlock,
+		scope:         c.currentScope,
+		functionScope: c.functionScope,
+		loopStack:     c.loopStack,
+		returnSlot:    c.returnSlot,
+	}
+	c.currentScope = c.globalScope
+	c.loopStack = make([]LoopInfo, 0)
+	return state
+}
+
+// ResumeFunction restores a state saved by SuspendFunction
+func (c *Context) ResumeFunction(state functionState) {
+	c.currentFunction = state.function
+	c.currentScope = state.scope
+	c.functionScope = state.functionScope
+	c.loopStack = state.loopStack
+	c.returnSlot = state.returnSlot
+	if state.block != nil {
+		c.SetInsertBlock(state.block)
+	}
+}
+
 // SetInsertBlock sets the current basic block for instruction insertion
 func (c *Context) SetInsertBlock(block *ir.BasicBlock) {
 	c.currentBlock = block
 	c.Builder.SetInsertPoint(block)
 }
 
-// AddDeferred adds a deferred statement to the current function
-func (c *Context) AddDeferred(inst ir.Instruction) {
-	if len(c.deferredStmts) > 0 {
-		idx := len(c.deferredStmts) - 1
-		c.deferredStmts[idx] = append(c.deferredStmts[idx], inst)
-	}
+// AddCleanup registers an emitter that runs when the current scope exits
+func (c *Context) AddCleanup(fn func()) {
+	c.currentScope.AddCleanup(fn)
 }
 
-// GetDeferredStmts returns deferred statements for current function
-func (c *Context) GetDeferredStmts() []ir.Instruction {
-	if len(c.deferredStmts) > 0 {
-		return c.deferredStmts[len(c.deferredStmts)-1]
+// EmitCleanupsUntil emits cleanups for every scope from the current one
+// outward, stopping before 'stop'. Passing nil unwinds the whole function.
+func (c *Context) EmitCleanupsUntil(stop *Scope) {
+	if stop == nil && c.functionScope != nil {
+		stop = c.functionScope.parent
+	}
+	for s := c.currentScope; s != nil && s != stop; s = s.parent {
+		s.EmitCleanups()
 	}
-	return nil
+}
+
+// BlockSuffix returns a suffix that makes block names unique in the module
+func (c *Context) BlockSuffix() string {
+	c.blockCount++
+	return strconv.Itoa(c.blockCount)
 }
 
 // --- Loop Management ---
@@ -331,6 +580,7 @@ func (c *Context) PushLoop(cont, brk *ir.BasicBlock) {
 	c.loopStack = append(c.loopStack, LoopInfo{
 		ContinueBlock: cont,
 		BreakBlock:    brk,
+		Scope:         c.currentScope,
 	})
 	c.Logger.Debug("Pushed loop context")
 }
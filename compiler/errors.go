@@ -0,0 +1,120 @@
+package compiler
+
+import (
+	"sort"
+
+	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-builder/types"
+	"github.com/arc-language/core-parser"
+)
+
+// Functions declared 'throws' return an int32 error code alongside their
+// value, zero meaning success. A throwing function returning T is lowered to
+// return the tuple (T, int32), or a bare int32 when it returns nothing, so
+// callers can handle errors locally by destructuring:
+//
+//	let (fd, err) = open_file(path)
+//
+// 'try' propagates a non-zero code to the caller, running deferred cleanups
+// on the way out like any other return. The result of a throwing call that
+// returns a value must go through 'try', destructuring or 'let _ = ...';
+// any other use of it, '.0' included, would drop the error and is rejected
+// at the end of the statement. A bare error code is handled by any use
+// other than ignoring it.
+
+// errorResultType is the lowered return type of a throwing function
+func (v *IRVisitor) errorResultType(valueType types.Type) types.Type {
+	if valueType.Kind() == types.VoidKind {
+		return types.I32
+	}
+	return v.ctx.TupleType([]types.Type{valueType, types.I32})
+}
+
+// errorResult builds the value a throwing function returns. A nil val stands
+// for the zero value of valueType.
+func (v *IRVisitor) errorResult(valueType types.Type, val, code ir.Value) ir.Value {
+	if valueType.Kind() == types.VoidKind {
+		return code
+	}
+	if val == nil {
+		val = v.getZeroValue(valueType)
+	}
+	resultType := v.errorResultType(valueType)
+	var agg ir.Value = v.ctx.Builder.ConstZero(resultType)
+	agg = v.ctx.Builder.CreateInsertValue(agg, val, []int{0}, "")
+	return v.ctx.Builder.CreateInsertValue(agg, code, []int{1}, "")
+}
+
+// emitThrow returns the error code to the caller of the current function
+func (v *IRVisitor) emitThrow(code ir.Value) {
+	valueType := v.ctx.throwing[v.ctx.currentFunction]
+	v.emitReturn(v.errorResult(valueType, nil, code))
+}
+
+func (v *IRVisitor) VisitThrowStmt(ctx *parser.ThrowStmtContext) interface{} {
+	if _, throws := v.ctx.throwing[v.ctx.currentFunction]; !throws {
+		v.ctx.Logger.Error("'throw' can only be used inside a function declared 'throws'")
+		return nil
+	}
+
+	code := v.castValue(v.Visit(ctx.Expression()).(ir.Value), types.I32)
+	v.emitThrow(code)
+	return nil
+}
+
+// reportIgnoredErrors rejects the results of throwing calls that the
+// statement just compiled used without handling their error
+func (v *IRVisitor) reportIgnoredErrors() {
+	var callees []string
+	for val, callee := range v.errorResults {
+		if v.ctx.IsTupleType(val.Type()) {
+			callees = append(callees, callee)
+		}
+		delete(v.errorResults, val)
+	}
+	sort.Strings(callees)
+	for _, callee := range callees {
+		v.ctx.Logger.Error("Error returned by '%s' is ignored; use 'try', destructure the result, or discard it with 'let _ = ...'", callee)
+	}
+}
+
+// visitTry unwraps the result of a throwing call, returning its error code
+// to the caller when it is non-zero
+func (v *IRVisitor) visitTry(result ir.Value) ir.Value {
+	if _, unhandled := v.errorResults[result]; !unhandled {
+		v.ctx.Logger.Error("'try' requires a call to a function declared 'throws'")
+		return result
+	}
+	delete(v.errorResults, result)
+
+	if _, throws := v.ctx.throwing[v.ctx.currentFunction]; !throws {
+		v.ctx.Logger.Error("'try' can only be used inside a function declared 'throws'")
+		return result
+	}
+
+	code := result
+	var value ir.Value
+	if v.ctx.IsTupleType(result.Type()) {
+		value = v.ctx.Builder.CreateExtractValue(result, []int{0}, "")
+		code = v.ctx.Builder.CreateExtractValue(result, []int{1}, "err")
+		delete(v.ownedTemps, result)
+	}
+
+	errorBlock := v.ctx.Builder.CreateBlock("try.error")
+	okBlock := v.ctx.Builder.CreateBlock("try.ok")
+	failed := v.ctx.Builder.CreateICmpNE(code, v.ctx.Builder.ConstInt(types.I32, 0), "")
+	v.ctx.Builder.CreateCondBr(failed, errorBlock, okBlock)
+
+	// A failed call returns the zero value, so there is nothing to release
+	// but the other temporaries of the statement
+	v.ctx.SetInsertBlock(errorBlock)
+	v.emitThrow(code)
+
+	v.ctx.SetInsertBlock(okBlock)
+	if value == nil {
+		return code
+	}
+	// The value carries the reference the callee returned
+	v.markOwned(value)
+	return value
+}
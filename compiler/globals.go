@@ -0,0 +1,236 @@
+package compiler
+
+import (
+	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-builder/types"
+	"github.com/arc-language/core-parser"
+)
+
+// Top-level 'let' declares a global and top-level 'const' a compile-time
+// constant. Both belong to the namespace of their file: its functions see
+// them unqualified and importers reach them as ns.name. A global whose
+// initializer is not a constant starts zeroed and is assigned by the
+// namespace's init function, __arc_init_<ns>. main calls __arc_module_init
+// before its body, which runs every init function in the order the
+// namespaces were compiled, so imported packages are initialized first.
+
+// moduleInit is the init function of one namespace, kept suspended between
+// the initializers compiled into it
+type moduleInit struct {
+	namespace *Namespace
+	fn        *ir.Function
+	state     functionState
+}
+
+// declaringNamespace returns the namespace top-level declarations go to
+func (v *IRVisitor) declaringNamespace() *Namespace {
+	if v.ctx.currentNamespace != nil {
+		return v.ctx.currentNamespace
+	}
+	return v.ctx.rootNamespace
+}
+
+// inModuleInit runs emit with the init function of the current namespace as
+// the function being compiled, creating it the first time
+func (v *IRVisitor) inModuleInit(emit func()) {
+	ns := v.declaringNamespace()
+	var init *moduleInit
+	for _, candidate := range v.ctx.moduleInits {
+		if candidate.namespace == ns {
+			init = candidate
+			break
+		}
+	}
+
+	outer := v.ctx.SuspendFunction()
+	if init == nil {
+		name := "__arc_init"
+		if ns.Name != "" {
+			name += "_" + ns.Name
+		}
+		init = &moduleInit{namespace: ns}
+		init.fn = v.ctx.Builder.CreateFunction(name, types.Void, []types.Type{}, false)
+		v.ctx.EnterFunction(init.fn)
+		v.ctx.SetInsertBlock(v.ctx.Builder.CreateBlock("entry"))
+		v.ctx.moduleInits = append(v.ctx.moduleInits, init)
+	} else {
+		v.ctx.ResumeFunction(init.state)
+	}
+
+	emit()
+
+	init.state = v.ctx.SuspendFunction()
+	v.ctx.ResumeFunction(outer)
+}
+
+// declareGlobal lowers a top-level 'let'. Constant initializers become the
+// global's initial value; anything else is stored by the init function.
+func (v *IRVisitor) declareGlobal(ctx *parser.VariableDeclContext) {
+	name := ctx.IDENTIFIER().GetText()
+	ns := v.declaringNamespace()
+	if _, exists := ns.Globals[name]; exists {
+		v.ctx.Logger.Error("'%s' is already declared in namespace '%s'", name, ns.Name)
+		return
+	}
+
+	var varType types.Type
+	if ctx.Type_() != nil {
+		varType = v.resolveType(ctx.Type_())
+	}
+	if ctx.Expression() == nil && varType == nil {
+		v.ctx.Logger.Error("Variable '%s' needs type annotation or initializer", name)
+		return
+	}
+
+	// Folded initializers need no code at all
+	var value ir.Value
+	var initial ir.Constant
+	if ctx.Expression() != nil {
+		c, err := v.evalConst(ctx.Expression())
+		if err == nil && c.kind != constString {
+			if varType != nil {
+				if c, err = v.convertConst(c, varType); err != nil {
+					v.ctx.Logger.Error("Global '%s': %v", name, err)
+					return
+				}
+			}
+			value = v.constToValue(c)
+			if varType == nil {
+				varType = value.Type()
+			}
+		}
+	}
+	if ctx.Expression() != nil && value == nil {
+		v.inModuleInit(func() {
+			value = v.visitWithHint(ctx.Expression(), varType)
+			if varType == nil {
+				varType = value.Type()
+				// Functions stored in variables are closures
+				if fn, ok := value.(*ir.Function); ok {
+					sig := v.functionSignature(fn)
+					varType = v.ctx.ClosureType(sig.Ret, sig.Params)
+				}
+			}
+			value = v.coerceTo(value, varType)
+			v.reportIgnoredErrors()
+		})
+	}
+	if c, ok := value.(ir.Constant); ok {
+		if c, ok = v.constCast(c, varType); ok {
+			initial, value = c, nil
+		}
+	}
+	if initial == nil {
+		initial = v.ctx.Builder.ConstZero(varType)
+	}
+
+	irName := name
+	if ns.Name != "" {
+		irName = ns.Name + "_" + name
+	}
+	global := v.ctx.Builder.CreateGlobalVariable(irName, varType, initial)
+
+	if value != nil {
+		v.inModuleInit(func() {
+			v.takeOwnership(value)
+			v.ctx.Builder.CreateStore(value, global)
+			v.releaseTemporaries()
+		})
+		v.logger.Debug("Global %s is initialized at startup", irName)
+	}
+
+	ns.Globals[name] = &Symbol{
+		Name:      name,
+		Value:     global,
+		Namespace: ns.Name,
+		IsAddress: true,
+		ElemType:  varType,
+	}
+	v.logger.Debug("Declared global %s of type %v", irName, varType)
+}
+
+// declareNamespaceConst lowers a top-level 'const', whose initializer must
+// be a compile-time constant
+func (v *IRVisitor) declareNamespaceConst(name string, typ types.Type, expr parser.IExpressionContext) {
+	ns := v.declaringNamespace()
+	if _, exists := ns.Globals[name]; exists {
+		v.ctx.Logger.Error("'%s' is already declared in namespace '%s'", name, ns.Name)
+		return
+	}
+
+	c, err := v.evalConst(expr)
+	if err == nil && typ != nil {
+		c, err = v.convertConst(c, typ)
+	}
+	if err != nil {
+		v.ctx.Logger.Error("Constant '%s' must be initialized with a compile-time constant: %v", name, err)
+		return
+	}
+
+	// Strings are rebuilt from their contents at each use
+	sym := &Symbol{Name: name, IsConst: true, Namespace: ns.Name, Literal: c.literal()}
+	if c.kind != constString {
+		sym.Value = v.constToValue(c)
+	}
+	ns.Globals[name] = sym
+	v.logger.Debug("Declared constant %s.%s", ns.Name, name)
+}
+
+// lookupSymbol resolves a name against the local scopes, then the globals
+// and constants of the current namespace, then, unless the namespace has a
+// function of that name, the externs it declares
+func (v *IRVisitor) lookupSymbol(name string) (*Symbol, bool) {
+	if sym, ok := v.ctx.currentScope.Lookup(name); ok {
+		return sym, true
+	}
+	ns := v.declaringNamespace()
+	if sym, ok := ns.LookupGlobal(name); ok {
+		return sym, true
+	}
+	if _, isFunction := ns.LookupFunction(name); isFunction {
+		return nil, false
+	}
+	sym, ok := v.ctx.externs[ns][name]
+	return sym, ok
+}
+
+// symbolValue reads a symbol: variables are loaded, and untyped constants
+// come back as literals again so they still adapt to their context
+func (v *IRVisitor) symbolValue(sym *Symbol) ir.Value {
+	switch lit := sym.Literal.(type) {
+	case string:
+		return v.stringLiteral(lit)
+	case intLiteral:
+		v.intLiterals[sym.Value] = lit
+	case rune:
+		v.charLiterals[sym.Value] = lit
+	case float64:
+		v.floatLiterals[sym.Value] = true
+	}
+	if addr, elemType, isVar := sym.Address(); isVar {
+		return v.ctx.Builder.CreateLoad(elemType, addr, "")
+	}
+	return sym.Value
+}
+
+// emitModuleInit finishes the init functions and, if main calls it, defines
+// __arc_module_init to run them
+func (v *IRVisitor) emitModuleInit() {
+	outer := v.ctx.SuspendFunction()
+	for _, init := range v.ctx.moduleInits {
+		v.ctx.ResumeFunction(init.state)
+		v.ctx.EmitCleanupsUntil(nil)
+		v.ctx.Builder.CreateRetVoid()
+		v.ctx.ExitFunction()
+	}
+	v.ctx.ResumeFunction(outer)
+
+	if !v.ctx.moduleInitUsed {
+		return
+	}
+	v.runtimeFunction("__arc_module_init", types.Void, []types.Type{})
+	for _, init := range v.ctx.moduleInits {
+		v.ctx.Builder.CreateCall(init.fn, []ir.Value{}, "")
+	}
+	v.ctx.Builder.CreateRetVoid()
+}
@@ -0,0 +1,799 @@
+package compiler
+
+import (
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/antlr4-go/antlr/v4"
+	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-builder/types"
+	"github.com/arc-language/core-parser"
+)
+
+// Interpolated literals embed expressions in braces:
+//
+//	"user {name} has {count} items, mask {flags:08x}"
+//
+// A literal interpolates only when it holds such a segment: a '{' directly
+// followed by a name, '(' or a unary operator and closed by a matching '}'. Other
+// literals keep their braces as written, so "{%d}" and JSON text are plain
+// strings. In an interpolated literal, '{{' and '}}' stand for literal
+// braces and any other brace is an error. Each expression may be followed by
+// a format, [<|>][0][width][.precision][verb], checked against the value's
+// type at compile time. Verbs are d, x, X, o, b and c for integers, f for
+// floats and s for strings; a char prints as a number unless it uses c.
+//
+// The literal lowers to straight-line code: every part is measured, one heap
+// buffer of the total size is allocated and the parts are written into it,
+// numbers through the formatter chosen for their type. Nothing parses a
+// format at run time. Like concatenations, the result owns its buffer.
+// Embedded expressions are parsed where they stand in the source, so their
+// errors and bounds checks report the line and column of the literal.
+
+// formatSpec is a parsed '{expr:spec}' format
+type formatSpec struct {
+	text      string
+	align     byte // '<', '>' or 0 for the type's default
+	zero      bool
+	width     int
+	precision int // -1 when absent
+	verb      byte
+}
+
+var formatSpecPattern = regexp.MustCompile(`^([<>])?(0)?([0-9]+)?(?:\.([0-9]+))?([dxXobcfs])?$`)
+
+// defaultFloatPrecision is the number of decimals a float prints without a
+// precision
+const defaultFloatPrecision = 6
+
+// interpolationPart is literal text (still escaped) or an expression
+type interpolationPart struct {
+	text   string
+	expr   string
+	offset int // byte offset of expr in the literal's body
+	spec   formatSpec
+	isExpr bool
+}
+
+// formatFuncs holds the formatting runtime, emitted on first use
+type formatFuncs struct {
+	uint  *ir.Function
+	char  *ir.Function
+	float *ir.Function
+}
+
+// formatPiece is one part of the output: a string value, or a formatter that
+// writes at dst (or only measures, when dst is null) and returns the length
+type formatPiece struct {
+	str        ir.Value
+	write      func(dst ir.Value) ir.Value
+	width      int
+	alignRight bool
+}
+
+func parseFormatSpec(text string) (formatSpec, bool) {
+	m := formatSpecPattern.FindStringSubmatch(text)
+	if m == nil {
+		return formatSpec{}, false
+	}
+	spec := formatSpec{text: text, precision: -1, zero: m[2] != ""}
+	if m[1] != "" {
+		spec.align = m[1][0]
+	}
+	if m[3] != "" {
+		spec.width, _ = strconv.Atoi(m[3])
+	}
+	if m[4] != "" {
+		spec.precision, _ = strconv.Atoi(m[4])
+	}
+	if m[5] != "" {
+		spec.verb = m[5][0]
+	}
+	return spec, true
+}
+
+// interpolates reports whether a literal body holds an embedded expression
+func interpolates(body string) bool {
+	for i := 0; i < len(body); i++ {
+		switch {
+		case body[i] == '\\':
+			// Skip the escape, including the braces of \u{...}
+			i++
+			if i+1 < len(body) && body[i] == 'u' && body[i+1] == '{' {
+				if close := strings.IndexByte(body[i:], '}'); close >= 0 {
+					i += close
+				}
+			}
+		case body[i] == '{' && i+1 < len(body) && body[i+1] == '{':
+			i++
+		case body[i] == '{' && i+1 < len(body) && startsExpression(body[i+1]):
+			if matchingBrace(body, i) >= 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// startsExpression reports whether an embedded expression may begin with c:
+// a name, a parenthesis or a unary operator
+func startsExpression(c byte) bool {
+	return strings.IndexByte("_(!-*&", c) >= 0 || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+// splitInterpolation splits the body of a literal into text and expressions
+func (v *IRVisitor) splitInterpolation(body string) ([]interpolationPart, bool) {
+	var parts []interpolationPart
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			parts = append(parts, interpolationPart{text: text.String()})
+			text.Reset()
+		}
+	}
+
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		switch {
+		case c == '\\' && i+1 < len(body):
+			// Escapes pass through untouched, including the braces of \u{...}
+			end := i + 2
+			if body[i+1] == 'u' && end < len(body) && body[end] == '{' {
+				if close := strings.IndexByte(body[end:], '}'); close >= 0 {
+					end += close + 1
+				}
+			}
+			text.WriteString(body[i:end])
+			i = end - 1
+		case c == '{' && i+1 < len(body) && body[i+1] == '{':
+			text.WriteByte('{')
+			i++
+		case c == '}' && i+1 < len(body) && body[i+1] == '}':
+			text.WriteByte('}')
+			i++
+		case c == '}':
+			v.ctx.Logger.Error("Unmatched '}' in string literal; write '}}' for a literal brace")
+			return nil, false
+		case c == '{':
+			end := matchingBrace(body, i)
+			if end < 0 {
+				v.ctx.Logger.Error("Unterminated '{' in string literal; write '{{' for a literal brace")
+				return nil, false
+			}
+			part := interpolationPart{expr: body[i+1 : end], offset: i + 1, isExpr: true, spec: formatSpec{precision: -1}}
+			if colon := topLevelColon(part.expr); colon >= 0 {
+				if spec, ok := parseFormatSpec(part.expr[colon+1:]); ok {
+					part.expr, part.spec = part.expr[:colon], spec
+				}
+			}
+			if strings.TrimSpace(part.expr) == "" {
+				v.ctx.Logger.Error("Empty '{}' in string literal")
+				return nil, false
+			}
+			flush()
+			parts = append(parts, part)
+			i = end
+		default:
+			text.WriteByte(c)
+		}
+	}
+	flush()
+	return parts, true
+}
+
+// matchingBrace returns the index of the '}' closing the '{' at open
+func matchingBrace(s string, open int) int {
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// topLevelColon returns the last ':' outside brackets, or -1
+func topLevelColon(expr string) int {
+	depth := 0
+	colon := -1
+	for i := 0; i < len(expr); i++ {
+		switch expr[i] {
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth--
+		case ':':
+			if depth == 0 {
+				colon = i
+			}
+		}
+	}
+	return colon
+}
+
+// interpolationErrors reports syntax errors in an embedded expression
+type interpolationErrors struct {
+	*antlr.DefaultErrorListener
+	v    *IRVisitor
+	expr string
+}
+
+func (l *interpolationErrors) SyntaxError(_ antlr.Recognizer, _ interface{}, line, column int, msg string, _ antlr.RecognitionException) {
+	l.v.ctx.Logger.Error("Invalid expression '{%s}' in string literal at %d:%d: %s", l.expr, line, column+1, msg)
+}
+
+// embeddedPosition returns the source line and column of byte offset in
+// the body of the string literal token
+func embeddedPosition(literal antlr.Token, body string, offset int) (line, column int) {
+	line, column = literal.GetLine(), literal.GetColumn()+1
+	before := body[:offset]
+	if nl := strings.LastIndexByte(before, '\n'); nl >= 0 {
+		line += strings.Count(before, "\n")
+		column = 0
+		before = before[nl+1:]
+	}
+	return line, column + utf8.RuneCountInString(before)
+}
+
+// parseEmbedded parses and evaluates the expression of an interpolation,
+// with its tokens placed at line and column of the source
+func (v *IRVisitor) parseEmbedded(expr string, line, column int) (ir.Value, bool) {
+	listener := &interpolationErrors{DefaultErrorListener: antlr.NewDefaultErrorListener(), v: v, expr: expr}
+	lexer := parser.NewArcLexer(antlr.NewInputStream(expr))
+	if sim, ok := lexer.Interpreter.(*antlr.LexerATNSimulator); ok {
+		sim.Line, sim.CharPositionInLine = line, column
+	}
+	lexer.RemoveErrorListeners()
+	lexer.AddErrorListener(listener)
+	stream := antlr.NewCommonTokenStream(lexer, antlr.TokenDefaultChannel)
+	p := parser.NewArcParser(stream)
+	p.RemoveErrorListeners()
+	p.AddErrorListener(listener)
+
+	errorsBefore := v.ctx.Logger.ErrorCount()
+	tree := p.Expression()
+	if v.ctx.Logger.ErrorCount() > errorsBefore {
+		return nil, false
+	}
+	if stream.LA(1) != antlr.TokenEOF {
+		v.ctx.Logger.Error("Invalid expression '{%s}' in string literal: unexpected '%s'", expr, stream.LT(1).GetText())
+		return nil, false
+	}
+
+	val, ok := v.Visit(tree).(ir.Value)
+	return val, ok
+}
+
+// visitInterpolatedString lowers a string literal that embeds expressions
+func (v *IRVisitor) visitInterpolatedString(literal antlr.Token, body string) ir.Value {
+	parts, ok := v.splitInterpolation(body)
+	if !ok {
+		return v.stringLiteral("")
+	}
+
+	// Literals with only escaped braces stay constants
+	hasExpr := false
+	for _, part := range parts {
+		hasExpr = hasExpr || part.isExpr
+	}
+	if !hasExpr {
+		var content strings.Builder
+		for _, part := range parts {
+			content.WriteString(v.unescapeString(part.text))
+		}
+		return v.stringLiteral(content.String())
+	}
+
+	pieces := make([]formatPiece, 0, len(parts))
+	for _, part := range parts {
+		if !part.isExpr {
+			pieces = append(pieces, formatPiece{str: v.stringLiteral(v.unescapeString(part.text))})
+			continue
+		}
+		line, column := embeddedPosition(literal, body, part.offset)
+		val, ok := v.parseEmbedded(part.expr, line, column)
+		if !ok {
+			return v.stringLiteral("")
+		}
+		piece, ok := v.formatPieceFor(val, part)
+		if !ok {
+			return v.stringLiteral("")
+		}
+		pieces = append(pieces, piece)
+	}
+	return v.emitFormat(pieces)
+}
+
+// formatPieceFor picks the formatter for val from its type and checks that
+// the format applies to it
+func (v *IRVisitor) formatPieceFor(val ir.Value, part interpolationPart) (formatPiece, bool) {
+	spec := part.spec
+	typ := val.Type()
+	invalid := func() (formatPiece, bool) {
+		v.ctx.Logger.Error("Format ':%s' in '{%s}' is not valid for a value of type %v", spec.text, part.expr, typ)
+		return formatPiece{}, false
+	}
+
+	piece := formatPiece{width: spec.width, alignRight: spec.align == '>'}
+	b := v.ctx.Builder
+	switch {
+	case v.ctx.IsString(typ):
+		if spec.zero || spec.precision >= 0 || (spec.verb != 0 && spec.verb != 's') {
+			return invalid()
+		}
+		piece.str = val
+
+	case typ.Equal(types.I1):
+		if spec.zero || spec.precision >= 0 || (spec.verb != 0 && spec.verb != 's') {
+			return invalid()
+		}
+		piece.str = b.CreateSelect(val, v.stringLiteral("true"), v.stringLiteral("false"), "")
+
+	case types.IsInteger(typ):
+		if spec.precision >= 0 || !strings.ContainsRune("\x00dxXobc", rune(spec.verb)) {
+			return invalid()
+		}
+		piece.alignRight = spec.align != '<'
+		if spec.verb == 'c' {
+			if spec.zero {
+				return invalid()
+			}
+			c := v.castUnsigned(val, types.U32)
+			piece.write = func(dst ir.Value) ir.Value {
+				return b.CreateCall(v.formatRuntime().char, []ir.Value{dst, c}, "")
+			}
+			break
+		}
+		piece.write = v.integerFormatter(val, spec)
+
+	case types.IsFloat(typ):
+		if spec.verb != 0 && spec.verb != 'f' {
+			return invalid()
+		}
+		piece.alignRight = spec.align != '<'
+		if typ.Equal(types.F32) {
+			val = b.CreateFPExt(val, types.F64, "")
+		}
+		precision := spec.precision
+		if precision < 0 {
+			precision = defaultFloatPrecision
+		}
+		zeroWidth := 0
+		if spec.zero {
+			zeroWidth = spec.width
+		}
+		args := []ir.Value{
+			val,
+			b.ConstFloat(types.F64, 0.5/math.Pow(10, float64(precision))),
+			b.ConstInt(types.U64, int64(precision)),
+			b.ConstInt(types.U64, int64(zeroWidth)),
+		}
+		piece.write = func(dst ir.Value) ir.Value {
+			return b.CreateCall(v.formatRuntime().float, append([]ir.Value{dst}, args...), "")
+		}
+
+	default:
+		v.ctx.Logger.Error("Cannot interpolate '{%s}': values of type %v have no string form", part.expr, typ)
+		return formatPiece{}, false
+	}
+	return piece, true
+}
+
+// integerFormatter formats an integer in the verb's base. Signed values
+// print with a sign in decimal and as their bits in the other bases.
+func (v *IRVisitor) integerFormatter(val ir.Value, spec formatSpec) func(dst ir.Value) ir.Value {
+	b := v.ctx.Builder
+	base := map[byte]int64{0: 10, 'd': 10, 'x': 16, 'X': 16, 'o': 8, 'b': 2}[spec.verb]
+
+	var magnitude, negative ir.Value = v.castUnsigned(val, types.U64), b.False()
+	if intType := val.Type().(*types.IntType); intType.Signed && base == 10 {
+		wide := v.castValue(val, types.I64)
+		negative = b.CreateICmpSLT(wide, b.ConstInt(types.I64, 0), "")
+		abs := b.CreateSelect(negative, b.CreateSub(b.ConstInt(types.I64, 0), wide, ""), wide, "")
+		magnitude = b.CreateBitCast(abs, types.U64, "")
+	}
+
+	zeroWidth := 0
+	if spec.zero {
+		zeroWidth = spec.width
+	}
+	args := []ir.Value{
+		magnitude,
+		negative,
+		b.ConstInt(types.U64, base),
+		b.ConstInt(types.I1, boolToInt(spec.verb == 'X')),
+		b.ConstInt(types.U64, int64(zeroWidth)),
+	}
+	return func(dst ir.Value) ir.Value {
+		return b.CreateCall(v.formatRuntime().uint, append([]ir.Value{dst}, args...), "")
+	}
+}
+
+// castUnsigned zero-extends or truncates an integer to the unsigned target,
+// keeping its bits whatever its signedness
+func (v *IRVisitor) castUnsigned(val ir.Value, target *types.IntType) ir.Value {
+	intType := val.Type().(*types.IntType)
+	switch {
+	case intType.BitWidth < target.BitWidth:
+		return v.ctx.Builder.CreateZExt(val, target, "")
+	case intType.BitWidth > target.BitWidth:
+		return v.ctx.Builder.CreateTrunc(val, target, "")
+	case intType.Signed:
+		return v.ctx.Builder.CreateBitCast(val, target, "")
+	}
+	return val
+}
+
+// emitFormat measures the pieces, allocates the result and writes them
+func (v *IRVisitor) emitFormat(pieces []formatPiece) ir.Value {
+	b := v.ctx.Builder
+	bytePtr := types.NewPointer(types.I8)
+	null := b.ConstNull(bytePtr)
+	zero := b.ConstInt(types.U64, 0)
+
+	lengths := make([]ir.Value, len(pieces))
+	pads := make([]ir.Value, len(pieces))
+	var total ir.Value = zero
+	for i, piece := range pieces {
+		if piece.str != nil {
+			lengths[i] = v.stringLen(piece.str)
+		} else {
+			lengths[i] = piece.write(null)
+		}
+		pads[i] = zero
+		if piece.width > 0 {
+			width := b.ConstInt(types.U64, int64(piece.width))
+			short := b.CreateICmpULT(lengths[i], width, "")
+			pads[i] = b.CreateSelect(short, b.CreateSub(width, lengths[i], ""), zero, "")
+		}
+		total = b.CreateAdd(total, b.CreateAdd(lengths[i], pads[i], ""), "")
+	}
+
+	owner, buf := v.allocStringBuffer(total)
+	var pos ir.Value = zero
+	at := func() ir.Value { return b.CreateGEP(types.I8, buf, []ir.Value{pos}, "") }
+	pad := func(i int) {
+		if piece := pieces[i]; piece.width > 0 {
+			v.emitFillBytes(at(), b.ConstInt(types.I8, ' '), pads[i])
+			pos = b.CreateAdd(pos, pads[i], "")
+		}
+	}
+	for i, piece := range pieces {
+		if piece.alignRight {
+			pad(i)
+		}
+		if piece.str != nil {
+			v.emitCopyBytes(at(), v.stringData(piece.str), lengths[i])
+		} else {
+			piece.write(at())
+		}
+		pos = b.CreateAdd(pos, lengths[i], "")
+		if !piece.alignRight {
+			pad(i)
+		}
+	}
+	result := v.makeOwnedString(buf, total, owner)
+	v.markOwned(result)
+	return result
+}
+
+// emitFillBytes stores n copies of c from dst onwards
+func (v *IRVisitor) emitFillBytes(dst, c, n ir.Value) {
+	b := v.ctx.Builder
+	indexPtr := b.CreateAlloca(types.U64, "i")
+	b.CreateStore(b.ConstInt(types.U64, 0), indexPtr)
+
+	loopBlock := b.CreateBlock("fill.loop")
+	bodyBlock := b.CreateBlock("fill.body")
+	doneBlock := b.CreateBlock("fill.done")
+	b.CreateBr(loopBlock)
+
+	v.ctx.SetInsertBlock(loopBlock)
+	index := b.CreateLoad(types.U64, indexPtr, "")
+	b.CreateCondBr(b.CreateICmpULT(index, n, ""), bodyBlock, doneBlock)
+
+	v.ctx.SetInsertBlock(bodyBlock)
+	b.CreateStore(c, b.CreateGEP(types.I8, dst, []ir.Value{index}, ""))
+	b.CreateStore(b.CreateAdd(index, b.ConstInt(types.U64, 1), ""), indexPtr)
+	b.CreateBr(loopBlock)
+
+	v.ctx.SetInsertBlock(doneBlock)
+}
+
+// formatRuntime returns the formatters, emitting them the first time
+func (v *IRVisitor) formatRuntime() *formatFuncs {
+	if v.ctx.formatFuncs != nil {
+		return v.ctx.formatFuncs
+	}
+
+	state := v.ctx.SuspendFunction()
+	rt := &formatFuncs{}
+	v.ctx.formatFuncs = rt
+	rt.uint = v.emitFormatUint()
+	rt.char = v.emitFormatChar()
+	rt.float = v.emitFormatFloat(rt.uint)
+	v.ctx.ResumeFunction(state)
+	return rt
+}
+
+// emitFormatUint defines __arc_fmt_uint(dst, v, negative, base, upper,
+// zero_width) u64, which writes v in base with a leading '-' when negative,
+// zero-filled to zero_width bytes. A null dst only measures.
+func (v *IRVisitor) emitFormatUint() *ir.Function {
+	b := v.ctx.Builder
+	bytePtr := types.NewPointer(types.I8)
+	fn := v.runtimeFunction("__arc_fmt_uint", types.U64,
+		[]types.Type{bytePtr, types.U64, types.I1, types.U64, types.I1, types.U64},
+		"dst", "v", "negative", "base", "upper", "zero_width")
+	dst, val, negative, base, upper, zeroWidth := fn.Arguments[0], fn.Arguments[1], fn.Arguments[2], fn.Arguments[3], fn.Arguments[4], fn.Arguments[5]
+	u64 := func(n int64) ir.Value { return b.ConstInt(types.U64, n) }
+
+	countBlock := b.CreateBlock("count")
+	countedBlock := b.CreateBlock("counted")
+	signBlock := b.CreateBlock("sign")
+	digitsBlock := b.CreateBlock("digits")
+	loopBlock := b.CreateBlock("loop")
+	bodyBlock := b.CreateBlock("body")
+	doneBlock := b.CreateBlock("done")
+
+	// Count the digits of v
+	countPtr := b.CreateAlloca(types.U64, "n")
+	b.CreateStore(u64(1), countPtr)
+	restPtr := b.CreateAlloca(types.U64, "rest")
+	b.CreateStore(val, restPtr)
+	b.CreateBr(countBlock)
+
+	v.ctx.SetInsertBlock(countBlock)
+	rest := b.CreateLoad(types.U64, restPtr, "")
+	more := b.CreateICmpUGE(rest, base, "")
+	nextBlock := b.CreateBlock("count.next")
+	b.CreateCondBr(more, nextBlock, countedBlock)
+
+	v.ctx.SetInsertBlock(nextBlock)
+	b.CreateStore(b.CreateUDiv(rest, base, ""), restPtr)
+	b.CreateStore(b.CreateAdd(b.CreateLoad(types.U64, countPtr, ""), u64(1), ""), countPtr)
+	b.CreateBr(countBlock)
+
+	// Zero-filling widens the digits, leaving room for the sign
+	v.ctx.SetInsertBlock(countedBlock)
+	count := b.CreateLoad(types.U64, countPtr, "")
+	sign := b.CreateZExt(negative, types.U64, "")
+	fillTo := b.CreateSelect(b.CreateICmpUGT(zeroWidth, sign, ""), b.CreateSub(zeroWidth, sign, ""), u64(0), "")
+	digits := b.CreateSelect(b.CreateICmpUGT(fillTo, count, ""), fillTo, count, "")
+	total := b.CreateAdd(digits, sign, "")
+	measureBlock := b.CreateBlock("measure")
+	writeBlock := b.CreateBlock("write")
+	b.CreateCondBr(b.CreateICmpEQ(dst, b.ConstNull(bytePtr), ""), measureBlock, writeBlock)
+
+	v.ctx.SetInsertBlock(measureBlock)
+	b.CreateRet(total)
+
+	v.ctx.SetInsertBlock(writeBlock)
+	b.CreateCondBr(negative, signBlock, digitsBlock)
+
+	v.ctx.SetInsertBlock(signBlock)
+	b.CreateStore(b.ConstInt(types.I8, '-'), dst)
+	b.CreateBr(digitsBlock)
+
+	// Write digits from the last one back; exhausted values write zeros
+	v.ctx.SetInsertBlock(digitsBlock)
+	start := b.CreateGEP(types.I8, dst, []ir.Value{sign}, "")
+	indexPtr := b.CreateAlloca(types.U64, "i")
+	b.CreateStore(digits, indexPtr)
+	b.CreateStore(val, restPtr)
+	b.CreateBr(loopBlock)
+
+	v.ctx.SetInsertBlock(loopBlock)
+	index := b.CreateLoad(types.U64, indexPtr, "")
+	b.CreateCondBr(b.CreateICmpUGT(index, u64(0), ""), bodyBlock, doneBlock)
+
+	v.ctx.SetInsertBlock(bodyBlock)
+	at := b.CreateSub(index, u64(1), "")
+	rest = b.CreateLoad(types.U64, restPtr, "")
+	digit := b.CreateURem(rest, base, "")
+	letters := b.CreateSelect(upper, u64('A'-10), u64('a'-10), "")
+	offset := b.CreateSelect(b.CreateICmpULT(digit, u64(10), ""), u64('0'), letters, "")
+	char := b.CreateTrunc(b.CreateAdd(digit, offset, ""), types.I8, "")
+	b.CreateStore(char, b.CreateGEP(types.I8, start, []ir.Value{at}, ""))
+	b.CreateStore(b.CreateUDiv(rest, base, ""), restPtr)
+	b.CreateStore(at, indexPtr)
+	b.CreateBr(loopBlock)
+
+	v.ctx.SetInsertBlock(doneBlock)
+	b.CreateRet(total)
+	return fn
+}
+
+// emitFormatChar defines __arc_fmt_char(dst, c) u64, which writes c as
+// UTF-8. Surrogates and values past U+10FFFF write U+FFFD.
+func (v *IRVisitor) emitFormatChar() *ir.Function {
+	b := v.ctx.Builder
+	bytePtr := types.NewPointer(types.I8)
+	fn := v.runtimeFunction("__arc_fmt_char", types.U64, []types.Type{bytePtr, types.U32}, "dst", "c")
+	dst, c := fn.Arguments[0], fn.Arguments[1]
+	u32 := func(n int64) ir.Value { return b.ConstInt(types.U32, n) }
+	u64 := func(n int64) ir.Value { return b.ConstInt(types.U64, n) }
+
+	surrogate := b.CreateAnd(b.CreateICmpUGE(c, u32(0xD800), ""), b.CreateICmpULE(c, u32(0xDFFF), ""), "")
+	invalid := b.CreateOr(surrogate, b.CreateICmpUGT(c, u32(0x10FFFF), ""), "")
+	cp := b.CreateSelect(invalid, u32(0xFFFD), c, "")
+	width := b.CreateSelect(b.CreateICmpULT(cp, u32(0x80), ""), u64(1),
+		b.CreateSelect(b.CreateICmpULT(cp, u32(0x800), ""), u64(2),
+			b.CreateSelect(b.CreateICmpULT(cp, u32(0x10000), ""), u64(3), u64(4), ""), ""), "")
+
+	measureBlock := b.CreateBlock("measure")
+	writeBlock := b.CreateBlock("write")
+	loopBlock := b.CreateBlock("cont.loop")
+	bodyBlock := b.CreateBlock("cont.body")
+	leadBlock := b.CreateBlock("lead")
+	b.CreateCondBr(b.CreateICmpEQ(dst, b.ConstNull(bytePtr), ""), measureBlock, writeBlock)
+
+	v.ctx.SetInsertBlock(measureBlock)
+	b.CreateRet(width)
+
+	// Continuation bytes carry six bits each, from the last byte back
+	v.ctx.SetInsertBlock(writeBlock)
+	restPtr := b.CreateAlloca(types.U32, "rest")
+	b.CreateStore(cp, restPtr)
+	indexPtr := b.CreateAlloca(types.U64, "i")
+	b.CreateStore(b.CreateSub(width, u64(1), ""), indexPtr)
+	b.CreateBr(loopBlock)
+
+	v.ctx.SetInsertBlock(loopBlock)
+	index := b.CreateLoad(types.U64, indexPtr, "")
+	b.CreateCondBr(b.CreateICmpUGT(index, u64(0), ""), bodyBlock, leadBlock)
+
+	v.ctx.SetInsertBlock(bodyBlock)
+	rest := b.CreateLoad(types.U32, restPtr, "")
+	cont := b.CreateOr(b.CreateAnd(rest, u32(0x3F), ""), u32(0x80), "")
+	b.CreateStore(b.CreateTrunc(cont, types.I8, ""), b.CreateGEP(types.I8, dst, []ir.Value{index}, ""))
+	b.CreateStore(b.CreateLShr(rest, u32(6), ""), restPtr)
+	b.CreateStore(b.CreateSub(index, u64(1), ""), indexPtr)
+	b.CreateBr(loopBlock)
+
+	// The lead byte has one high bit set per byte of the sequence
+	v.ctx.SetInsertBlock(leadBlock)
+	prefix := b.CreateAnd(b.CreateShl(u32(0xFF), b.CreateTrunc(b.CreateSub(u64(8), width, ""), types.U32, ""), ""), u32(0xFF), "")
+	prefix = b.CreateSelect(b.CreateICmpEQ(width, u64(1), ""), u32(0), prefix, "")
+	lead := b.CreateOr(prefix, b.CreateLoad(types.U32, restPtr, ""), "")
+	b.CreateStore(b.CreateTrunc(lead, types.I8, ""), dst)
+	b.CreateRet(width)
+	return fn
+}
+
+// emitFormatFloat defines __arc_fmt_float(dst, x, half, precision,
+// zero_width) u64, which writes x in fixed notation with precision
+// decimals; half is 0.5 in the last decimal place, for rounding. Integer
+// parts beyond u64 keep their leading digits and fill the rest with zeros.
+func (v *IRVisitor) emitFormatFloat(formatUint *ir.Function) *ir.Function {
+	b := v.ctx.Builder
+	bytePtr := types.NewPointer(types.I8)
+	fn := v.runtimeFunction("__arc_fmt_float", types.U64,
+		[]types.Type{bytePtr, types.F64, types.F64, types.U64, types.U64},
+		"dst", "x", "half", "precision", "zero_width")
+	dst, x, half, precision, zeroWidth := fn.Arguments[0], fn.Arguments[1], fn.Arguments[2], fn.Arguments[3], fn.Arguments[4]
+	u64 := func(n int64) ir.Value { return b.ConstInt(types.U64, n) }
+	f64 := func(f float64) ir.Value { return b.ConstFloat(types.F64, f) }
+	null := b.ConstNull(bytePtr)
+
+	nanBlock := b.CreateBlock("nan")
+	numberBlock := b.CreateBlock("number")
+	infBlock := b.CreateBlock("inf")
+	finiteBlock := b.CreateBlock("finite")
+	scaleBlock := b.CreateBlock("scale")
+	scaleNextBlock := b.CreateBlock("scale.next")
+	scaledBlock := b.CreateBlock("scaled")
+	measureBlock := b.CreateBlock("measure")
+	writeBlock := b.CreateBlock("write")
+	fracBlock := b.CreateBlock("frac")
+	fracLoopBlock := b.CreateBlock("frac.loop")
+	fracBodyBlock := b.CreateBlock("frac.body")
+	doneBlock := b.CreateBlock("done")
+
+	// Special values are written as text
+	special := func(block *ir.BasicBlock, text string) {
+		v.ctx.SetInsertBlock(block)
+		s := v.stringLiteral(text)
+		skip := b.CreateBlock("special.measure")
+		copyBlock := b.CreateBlock("special.write")
+		b.CreateCondBr(b.CreateICmpEQ(dst, null, ""), skip, copyBlock)
+		v.ctx.SetInsertBlock(skip)
+		b.CreateRet(v.stringLen(s))
+		v.ctx.SetInsertBlock(copyBlock)
+		v.emitCopyBytes(dst, v.stringData(s), v.stringLen(s))
+		b.CreateRet(v.stringLen(s))
+	}
+
+	b.CreateCondBr(b.CreateFCmpOEQ(x, x, ""), numberBlock, nanBlock)
+	special(nanBlock, "nan")
+
+	v.ctx.SetInsertBlock(numberBlock)
+	negative := b.CreateFCmpOLT(x, f64(0), "")
+	magnitude := b.CreateSelect(negative, b.CreateFSub(f64(0), x, ""), x, "")
+	b.CreateCondBr(b.CreateFCmpOGT(magnitude, f64(math.MaxFloat64), ""), infBlock, finiteBlock)
+
+	v.ctx.SetInsertBlock(infBlock)
+	negInfBlock := b.CreateBlock("inf.neg")
+	posInfBlock := b.CreateBlock("inf.pos")
+	b.CreateCondBr(negative, negInfBlock, posInfBlock)
+	special(negInfBlock, "-inf")
+	special(posInfBlock, "inf")
+
+	// Divide integer parts too large for u64 down, counting the zeros owed
+	v.ctx.SetInsertBlock(finiteBlock)
+	rounded := b.CreateFAdd(magnitude, half, "")
+	scaledPtr := b.CreateAlloca(types.F64, "scaled")
+	b.CreateStore(rounded, scaledPtr)
+	zerosPtr := b.CreateAlloca(types.U64, "zeros")
+	b.CreateStore(u64(0), zerosPtr)
+	b.CreateBr(scaleBlock)
+
+	v.ctx.SetInsertBlock(scaleBlock)
+	scaled := b.CreateLoad(types.F64, scaledPtr, "")
+	b.CreateCondBr(b.CreateFCmpOGE(scaled, f64(math.Exp2(64)), ""), scaleNextBlock, scaledBlock)
+
+	v.ctx.SetInsertBlock(scaleNextBlock)
+	b.CreateStore(b.CreateFDiv(scaled, f64(10), ""), scaledPtr)
+	b.CreateStore(b.CreateAdd(b.CreateLoad(types.U64, zerosPtr, ""), u64(1), ""), zerosPtr)
+	b.CreateBr(scaleBlock)
+
+	v.ctx.SetInsertBlock(scaledBlock)
+	intPart := b.CreateFPToUI(scaled, types.U64, "")
+	zeros := b.CreateLoad(types.U64, zerosPtr, "")
+	hasFrac := b.CreateICmpUGT(precision, u64(0), "")
+	fracLen := b.CreateSelect(hasFrac, b.CreateAdd(precision, u64(1), ""), u64(0), "")
+	reserved := b.CreateAdd(fracLen, zeros, "")
+	intWidth := b.CreateSelect(b.CreateICmpUGT(zeroWidth, reserved, ""), b.CreateSub(zeroWidth, reserved, ""), u64(0), "")
+	uintArgs := func(to ir.Value) []ir.Value {
+		return []ir.Value{to, intPart, negative, u64(10), b.False(), intWidth}
+	}
+	intLen := b.CreateCall(formatUint, uintArgs(null), "")
+	total := b.CreateAdd(intLen, reserved, "")
+	b.CreateCondBr(b.CreateICmpEQ(dst, null, ""), measureBlock, writeBlock)
+
+	v.ctx.SetInsertBlock(measureBlock)
+	b.CreateRet(total)
+
+	v.ctx.SetInsertBlock(writeBlock)
+	b.CreateCall(formatUint, uintArgs(dst), "")
+	v.emitFillBytes(b.CreateGEP(types.I8, dst, []ir.Value{intLen}, ""), b.ConstInt(types.I8, '0'), zeros)
+	b.CreateCondBr(hasFrac, fracBlock, doneBlock)
+
+	// Decimals come from the remainder, one multiplication by ten at a time
+	v.ctx.SetInsertBlock(fracBlock)
+	point := b.CreateAdd(intLen, zeros, "")
+	b.CreateStore(b.ConstInt(types.I8, '.'), b.CreateGEP(types.I8, dst, []ir.Value{point}, ""))
+	fracPtr := b.CreateAlloca(types.F64, "frac")
+	remainder := b.CreateFSub(scaled, b.CreateUIToFP(intPart, types.F64, ""), "")
+	b.CreateStore(b.CreateSelect(b.CreateICmpEQ(zeros, u64(0), ""), remainder, f64(0), ""), fracPtr)
+	indexPtr := b.CreateAlloca(types.U64, "i")
+	b.CreateStore(u64(0), indexPtr)
+	b.CreateBr(fracLoopBlock)
+
+	v.ctx.SetInsertBlock(fracLoopBlock)
+	index := b.CreateLoad(types.U64, indexPtr, "")
+	b.CreateCondBr(b.CreateICmpULT(index, precision, ""), fracBodyBlock, doneBlock)
+
+	v.ctx.SetInsertBlock(fracBodyBlock)
+	frac := b.CreateFMul(b.CreateLoad(types.F64, fracPtr, ""), f64(10), "")
+	digit := b.CreateFPToUI(frac, types.U64, "")
+	digit = b.CreateSelect(b.CreateICmpUGT(digit, u64(9), ""), u64(9), digit, "")
+	b.CreateStore(b.CreateFSub(frac, b.CreateUIToFP(digit, types.F64, ""), ""), fracPtr)
+	at := b.CreateAdd(b.CreateAdd(point, u64(1), ""), index, "")
+	b.CreateStore(b.CreateTrunc(b.CreateAdd(digit, u64('0'), ""), types.I8, ""), b.CreateGEP(types.I8, dst, []ir.Value{at}, ""))
+	b.CreateStore(b.CreateAdd(index, u64(1), ""), indexPtr)
+	b.CreateBr(fracLoopBlock)
+
+	v.ctx.SetInsertBlock(doneBlock)
+	b.CreateRet(total)
+	return fn
+}
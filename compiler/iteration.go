@@ -0,0 +1,350 @@
+package compiler
+
+import (
+	"github.com/antlr4-go/antlr/v4"
+	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-builder/types"
+	"github.com/arc-language/core-parser"
+)
+
+// for-in loops walk any iterable through one protocol. Each kind of iterable
+// supplies a forInSource, and emitForIn wraps it in the common loop:
+//
+//	for x in seq { ... }      binds each element (each key, for maps)
+//	for i, x in seq { ... }   also binds the index (the key, for maps)
+//
+// Iterables are ranges, arrays, slices, vectors, maps, strings (by char) and
+// any struct or class with a 'next() ?T' method. Class values bound to loop
+// variables are retained for the iteration and released when it ends, by
+// falling through, continue, break or return alike. Vectors may grow in the
+// body, so their buffer and length are read afresh each step; maps trap if
+// keys are added or removed while they are walked.
+
+// forInSource describes how to walk one iterable
+type forInSource struct {
+	// keyType is bound by the first of two loop variables: the position, or
+	// the key of a map. valueType is the element.
+	keyType   types.Type
+	valueType types.Type
+
+	// keyOnly binds the key rather than the element when there is only one
+	// loop variable
+	keyOnly bool
+
+	// next runs at the top of every iteration and reports whether there is
+	// another element; key and value read the current one; step advances
+	next  func() ir.Value
+	key   func() ir.Value
+	value func() ir.Value
+	step  func()
+}
+
+func (v *IRVisitor) visitForInLoop(ctx *parser.ForStmtContext) interface{} {
+	names := ctx.AllIDENTIFIER()
+	if len(names) > 2 {
+		v.ctx.Logger.Error("for-in loop binds at most two variables, got %d", len(names))
+		return nil
+	}
+	v.logger.Debug("Compiling for-in loop with variable '%s'", names[0].GetText())
+
+	// The loop holds a reference to the iterable until it ends, so the body
+	// cannot free it by reassigning the variable it came from
+	seq := v.Visit(ctx.Expression(0)).(ir.Value)
+	if v.isManaged(seq.Type()) {
+		v.takeOwnership(seq)
+		v.ctx.AddCleanup(func() { v.emitRelease(seq) })
+	}
+	src := v.sourceOf(seq, ctx)
+	if src == nil {
+		return nil
+	}
+	v.releaseTemporaries()
+
+	v.emitForIn(ctx, src)
+	return nil
+}
+
+// sourceOf picks the way to walk seq from its type
+func (v *IRVisitor) sourceOf(seq ir.Value, at antlr.ParserRuleContext) *forInSource {
+	typ := seq.Type()
+	if _, isRange := v.ctx.RangeElem(typ); isRange {
+		return v.rangeSource(seq)
+	}
+	if info, isMap := v.ctx.MapInfo(typ); isMap {
+		return v.mapSource(info, seq, at)
+	}
+	if elem, isVector := v.ctx.VectorElem(typ); isVector {
+		vecType := typ.(*types.PointerType).ElementType.(*types.StructType)
+		data := func() ir.Value { return v.vectorField(vecType, seq, vectorDataField) }
+		length := func() ir.Value { return v.vectorField(vecType, seq, vectorLenField) }
+		return v.indexedSource(data, length, elem)
+	}
+	if elem, isSlice := v.ctx.SliceElem(typ); isSlice {
+		data := v.ctx.Builder.CreateExtractValue(seq, []int{0}, "")
+		length := v.ctx.Builder.CreateExtractValue(seq, []int{1}, "")
+		return v.indexedSource(fixed(data), fixed(length), elem)
+	}
+	if v.ctx.IsString(typ) {
+		return v.stringSource(seq)
+	}
+	if arrType, ok := typ.(*types.ArrayType); ok {
+		addr := v.ctx.Builder.CreateAlloca(arrType, "")
+		v.ctx.Builder.CreateStore(seq, addr)
+		zero := v.ctx.Builder.ConstInt(types.I64, 0)
+		data := v.ctx.Builder.CreateInBoundsGEP(arrType, addr, []ir.Value{zero, zero}, "")
+		return v.indexedSource(fixed(data), fixed(v.ctx.Builder.ConstInt(types.U64, arrType.Length)), arrType.ElementType)
+	}
+	if src := v.iteratorSource(seq); src != nil {
+		return src
+	}
+
+	v.ctx.Logger.Error("Cannot iterate over a value of type %v; expected a range, array, slice, vector, map, string or a type with 'next() ?T'", typ)
+	return nil
+}
+
+// emitForIn emits the loop around src. Loop variables live in the for
+// statement's scope; each iteration gets a scope of its own so break and
+// continue release what the iteration bound.
+func (v *IRVisitor) emitForIn(ctx *parser.ForStmtContext, src *forInSource) {
+	names := ctx.AllIDENTIFIER()
+
+	type binding struct {
+		slot *ir.AllocaInst
+		load func() ir.Value
+	}
+	var bindings []binding
+	bind := func(name string, typ types.Type, load func() ir.Value) {
+		slot := v.ctx.Builder.CreateAlloca(typ, name+".addr")
+		v.ctx.currentScope.Define(name, slot)
+		bindings = append(bindings, binding{slot, load})
+	}
+	switch {
+	case len(names) == 2:
+		bind(names[0].GetText(), src.keyType, src.key)
+		bind(names[1].GetText(), src.valueType, src.value)
+	case src.keyOnly:
+		bind(names[0].GetText(), src.keyType, src.key)
+	default:
+		bind(names[0].GetText(), src.valueType, src.value)
+	}
+
+	uniqueID := v.ctx.BlockSuffix()
+	condBlock := v.ctx.Builder.CreateBlock("for.cond." + uniqueID)
+	bodyBlock := v.ctx.Builder.CreateBlock("for.body." + uniqueID)
+	stepBlock := v.ctx.Builder.CreateBlock("for.step." + uniqueID)
+	endBlock := v.ctx.Builder.CreateBlock("for.end." + uniqueID)
+
+	v.ctx.Builder.CreateBr(condBlock)
+
+	v.ctx.SetInsertBlock(condBlock)
+	v.ctx.Builder.CreateCondBr(src.next(), bodyBlock, endBlock)
+
+	v.ctx.SetInsertBlock(bodyBlock)
+	v.ctx.PushLoop(stepBlock, endBlock)
+	v.ctx.PushScope()
+	for _, b := range bindings {
+		val := b.load()
+		v.takeOwnership(val)
+		v.ctx.Builder.CreateStore(val, b.slot)
+		v.releaseOnExit(b.slot)
+	}
+	v.Visit(ctx.Block())
+	if v.ctx.Builder.GetInsertBlock().Terminator() == nil {
+		v.ctx.currentScope.EmitCleanups()
+		v.ctx.Builder.CreateBr(stepBlock)
+	}
+	v.ctx.PopScope()
+	v.ctx.PopLoop()
+
+	v.ctx.SetInsertBlock(stepBlock)
+	src.step()
+	v.ctx.Builder.CreateBr(condBlock)
+
+	v.ctx.SetInsertBlock(endBlock)
+	v.ctx.currentScope.EmitCleanups()
+}
+
+// counter allocates a u64 position starting at zero and returns it with a
+// function advancing it by one
+func (v *IRVisitor) counter(name string) (*ir.AllocaInst, func()) {
+	slot := v.ctx.Builder.CreateAlloca(types.U64, name)
+	v.ctx.Builder.CreateStore(v.ctx.Builder.ConstInt(types.U64, 0), slot)
+	advance := func() {
+		cur := v.ctx.Builder.CreateLoad(types.U64, slot, "")
+		v.ctx.Builder.CreateStore(v.ctx.Builder.CreateAdd(cur, v.ctx.Builder.ConstInt(types.U64, 1), ""), slot)
+	}
+	return slot, advance
+}
+
+// fixed returns a reader of a value that does not change during the loop
+func fixed(val ir.Value) func() ir.Value {
+	return func() ir.Value { return val }
+}
+
+// indexedSource walks the elements stored contiguously at data, as arrays,
+// slices and vectors do. data and length are read at each use, since a
+// vector may be reallocated by the loop body.
+func (v *IRVisitor) indexedSource(data, length func() ir.Value, elemType types.Type) *forInSource {
+	index, advance := v.counter("for.idx")
+	load := func() ir.Value { return v.ctx.Builder.CreateLoad(types.U64, index, "") }
+
+	return &forInSource{
+		keyType:   types.U64,
+		valueType: elemType,
+		next: func() ir.Value {
+			return v.ctx.Builder.CreateICmpULT(load(), length(), "")
+		},
+		key: load,
+		value: func() ir.Value {
+			elemAddr := v.ctx.Builder.CreateGEP(elemType, data(), []ir.Value{load()}, "")
+			return v.ctx.Builder.CreateLoad(elemType, elemAddr, "")
+		},
+		step: advance,
+	}
+}
+
+// mapSource walks the used slots of a map's table in table order. Adding or
+// removing keys in the loop body would reorder the table, so each step
+// checks the map's generation and traps if it changed; updating the value
+// of an existing key is allowed.
+func (v *IRVisitor) mapSource(info *mapInfo, m ir.Value, at antlr.ParserRuleContext) *forInSource {
+	entries := func() ir.Value { return v.mapField(info, m, mapEntriesField) }
+	capacity := func() ir.Value { return v.mapField(info, m, mapCapField) }
+	gen := v.mapField(info, m, mapGenField)
+	index, advance := v.counter("map.idx")
+	load := func() ir.Value { return v.ctx.Builder.CreateLoad(types.U64, index, "") }
+
+	return &forInSource{
+		keyType:   info.Key,
+		valueType: info.Value,
+		keyOnly:   true,
+		// Skip ahead to the next used slot, if any
+		next: func() ir.Value {
+			b := v.ctx.Builder
+			scanBlock := b.CreateBlock("map.scan")
+			checkBlock := b.CreateBlock("map.check")
+			skipBlock := b.CreateBlock("map.skip")
+			doneBlock := b.CreateBlock("map.found")
+			b.CreateBr(scanBlock)
+
+			v.ctx.SetInsertBlock(scanBlock)
+			b.CreateCondBr(b.CreateICmpULT(load(), capacity(), ""), checkBlock, doneBlock)
+
+			v.ctx.SetInsertBlock(checkBlock)
+			b.CreateCondBr(v.entryUsed(info, entries(), load()), doneBlock, skipBlock)
+
+			v.ctx.SetInsertBlock(skipBlock)
+			advance()
+			b.CreateBr(scanBlock)
+
+			v.ctx.SetInsertBlock(doneBlock)
+			return b.CreateICmpULT(load(), capacity(), "")
+		},
+		key: func() ir.Value {
+			return v.ctx.Builder.CreateLoad(info.Key, v.entryAddress(info, entries(), load(), entryKeyField), "")
+		},
+		value: func() ir.Value {
+			return v.ctx.Builder.CreateLoad(info.Value, v.entryAddress(info, entries(), load(), entryValueField), "")
+		},
+		step: func() {
+			unchanged := v.ctx.Builder.CreateICmpEQ(v.mapField(info, m, mapGenField), gen, "")
+			v.emitCheck(unchanged, "map modified during iteration", at)
+			advance()
+		},
+	}
+}
+
+// stringSource walks a UTF-8 string one code point at a time; the index is
+// the byte offset of each char
+func (v *IRVisitor) stringSource(str ir.Value) *forInSource {
+	decode := v.utf8Decoder()
+	data, length := v.stringData(str), v.stringLen(str)
+	offset := v.ctx.Builder.CreateAlloca(types.U64, "str.off")
+	v.ctx.Builder.CreateStore(v.ctx.Builder.ConstInt(types.U64, 0), offset)
+	width := v.ctx.Builder.CreateAlloca(types.U64, "str.width")
+	load := func() ir.Value { return v.ctx.Builder.CreateLoad(types.U64, offset, "") }
+
+	return &forInSource{
+		keyType:   types.U64,
+		valueType: types.U32,
+		next: func() ir.Value {
+			return v.ctx.Builder.CreateICmpULT(load(), length, "")
+		},
+		key: load,
+		value: func() ir.Value {
+			return v.ctx.Builder.CreateCall(decode, []ir.Value{data, load(), length, width}, "")
+		},
+		step: func() {
+			w := v.ctx.Builder.CreateLoad(types.U64, width, "")
+			v.ctx.Builder.CreateStore(v.ctx.Builder.CreateAdd(load(), w, ""), offset)
+		},
+	}
+}
+
+// iteratorSource walks a struct or class with a 'next() ?T' method, calling
+// it until it returns null. Struct iterators are copied, so the loop does not
+// advance the variable it was given; class iterators are shared.
+func (v *IRVisitor) iteratorSource(iter ir.Value) *forInSource {
+	var structType *types.StructType
+	if ptrType, ok := iter.Type().(*types.PointerType); ok {
+		structType, _ = ptrType.ElementType.(*types.StructType)
+	} else {
+		structType, _ = iter.Type().(*types.StructType)
+	}
+	if structType == nil {
+		return nil
+	}
+	nextFn, ok := v.ctx.LookupMethod(structType.Name, "next")
+	if !ok {
+		return nil
+	}
+	resultType := nextFn.FuncType.ReturnType
+	if slotType, indirect := v.ctx.indirectReturns[nextFn]; indirect {
+		resultType = slotType
+	}
+	elem, isOptional := v.ctx.OptionalElem(resultType)
+	if !isOptional {
+		v.ctx.Logger.Error("Method %s.next used by for-in must return an optional (?T), returns %v", structType.Name, resultType)
+		return nil
+	}
+
+	var iterAddr ir.Value
+	if _, isStruct := iter.Type().(*types.StructType); isStruct {
+		iterAddr = v.ctx.Builder.CreateAlloca(structType, "iter")
+		v.ctx.Builder.CreateStore(iter, iterAddr)
+	}
+	// result owns the optional next() returned last. It is released before
+	// the following call and, through a cleanup, when the loop ends.
+	result := v.ctx.Builder.CreateAlloca(resultType, "iter.next")
+	v.ctx.Builder.CreateStore(v.ctx.Builder.ConstZero(resultType), result)
+	if v.isManaged(resultType) {
+		v.ctx.AddCleanup(func() {
+			v.emitRelease(v.ctx.Builder.CreateLoad(resultType, result, ""))
+		})
+	}
+	index, advance := v.counter("iter.idx")
+
+	return &forInSource{
+		keyType:   types.U64,
+		valueType: elem,
+		next: func() ir.Value {
+			base := iter
+			if iterAddr != nil {
+				base = v.ctx.Builder.CreateLoad(structType, iterAddr, "")
+			}
+			_, self, _ := v.resolveMethod(base, iterAddr, "next")
+			if v.isManaged(resultType) {
+				v.emitRelease(v.ctx.Builder.CreateLoad(resultType, result, ""))
+			}
+			opt := v.emitCall(nextFn, []ir.Value{self})
+			v.ctx.Builder.CreateStore(opt, result)
+			return v.ctx.Builder.CreateExtractValue(opt, []int{optionalPresentField}, "")
+		},
+		key: func() ir.Value { return v.ctx.Builder.CreateLoad(types.U64, index, "") },
+		value: func() ir.Value {
+			opt := v.ctx.Builder.CreateLoad(resultType, result, "")
+			return v.ctx.Builder.CreateExtractValue(opt, []int{optionalValueField}, "")
+		},
+		step: advance,
+	}
+}
@@ -0,0 +1,216 @@
+package compiler
+
+import (
+	"strings"
+
+	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-builder/types"
+	"github.com/arc-language/core-parser"
+)
+
+// Structs follow the C layout of their fields unless attributes say
+// otherwise, so C structs can be declared as ordinary structs:
+//
+//	@packed            no padding between fields, alignment 1
+//	@align(N)          on a struct, raise its alignment (and size) to N
+//	@align(N)          on a field, place it at a multiple of N
+//
+// A struct with attributes lowers to a packed IR struct with explicit
+// [N x i8] padding fields, so the offsets the backend sees are the ones
+// computed here. So does any struct with such a field, and stack slots and
+// globals of these types carry their alignment explicitly. offsetof<T>(field)
+// gives the offset of a field, which may be a path through nested structs,
+// 'offsetof<T>(addr.port)'.
+
+// structLayout is the layout of a struct declared with attributes
+type structLayout struct {
+	size    int
+	align   int
+	fields  []int // IR index of each declared field, in order
+	offsets []int // offset of each IR field, padding included
+	types   []types.Type
+}
+
+// layoutAttributes reads the attributes of a struct declaration; align is 0
+// when none is given
+func (v *IRVisitor) layoutAttributes(name string, attrs []parser.IAttributeContext) (packed bool, align int) {
+	for _, attr := range attrs {
+		switch attrName := attr.IDENTIFIER().GetText(); attrName {
+		case "packed":
+			packed = true
+		case "align":
+			align = v.alignAttribute(name, attr)
+		default:
+			v.ctx.Logger.Error("Unknown attribute @%s on struct %s", attrName, name)
+		}
+	}
+	return packed, align
+}
+
+// fieldAlignAttribute reads the @align of a struct field, 0 if it has none
+func (v *IRVisitor) fieldAlignAttribute(name string, attrs []parser.IAttributeContext) int {
+	align := 0
+	for _, attr := range attrs {
+		if attrName := attr.IDENTIFIER().GetText(); attrName != "align" {
+			v.ctx.Logger.Error("Unknown attribute @%s on field %s", attrName, name)
+			continue
+		}
+		align = v.alignAttribute(name, attr)
+	}
+	return align
+}
+
+// alignAttribute evaluates the argument of @align(N), a power of two
+func (v *IRVisitor) alignAttribute(name string, attr parser.IAttributeContext) int {
+	if attr.Expression() == nil {
+		v.ctx.Logger.Error("@align on %s needs an alignment, as in @align(16)", name)
+		return 0
+	}
+	c, err := v.evalConst(attr.Expression())
+	if err == nil {
+		c, err = v.convertConst(c, types.U64)
+	}
+	if err != nil {
+		v.ctx.Logger.Error("@align on %s must be an integer constant: %v", name, err)
+		return 0
+	}
+	align := c.i.Int64()
+	if align <= 0 || align&(align-1) != 0 {
+		v.ctx.Logger.Error("@align on %s must be a power of two, not %d", name, align)
+		return 0
+	}
+	return int(align)
+}
+
+// layoutStruct places the fields of a struct with attributes, inserting
+// the padding the IR struct needs
+func (v *IRVisitor) layoutStruct(name string, fieldNames []string, fieldTypes []types.Type, fieldAligns []int, packed bool, align int) *structLayout {
+	layout := &structLayout{align: 1}
+	offset := 0
+	pad := func(to int) {
+		if gap := (to - offset%to) % to; gap > 0 {
+			layout.offsets = append(layout.offsets, offset)
+			layout.types = append(layout.types, types.NewArray(types.I8, int64(gap)))
+			offset += gap
+		}
+	}
+
+	for i, fieldType := range fieldTypes {
+		fieldAlign := 1
+		if !packed {
+			fieldAlign = v.calculateAlignOf(fieldType)
+		}
+		if explicit := fieldAligns[i]; explicit != 0 {
+			if explicit < fieldAlign {
+				v.ctx.Logger.Error("@align(%d) on %s.%s is below its natural alignment %d", explicit, name, fieldNames[i], fieldAlign)
+			} else {
+				fieldAlign = explicit
+			}
+		}
+		pad(fieldAlign)
+		layout.fields = append(layout.fields, len(layout.types))
+		layout.offsets = append(layout.offsets, offset)
+		layout.types = append(layout.types, fieldType)
+		offset += v.calculateSizeOf(fieldType)
+		if fieldAlign > layout.align {
+			layout.align = fieldAlign
+		}
+	}
+
+	if align != 0 {
+		if align < layout.align {
+			v.ctx.Logger.Error("@align(%d) on %s is below the alignment %d of its fields", align, name, layout.align)
+		} else {
+			layout.align = align
+		}
+	}
+	pad(layout.align)
+	layout.size = offset
+	return layout
+}
+
+// hasLayout reports whether typ is, or is an array of, a struct with an
+// explicit layout
+func (v *IRVisitor) hasLayout(typ types.Type) bool {
+	switch t := typ.(type) {
+	case *types.StructType:
+		_, ok := v.ctx.structLayouts[t.Name]
+		return ok
+	case *types.ArrayType:
+		return v.hasLayout(t.ElementType)
+	}
+	return false
+}
+
+// alignStorage gives the stack slots and globals of laid-out types their
+// alignment, which their packed IR types do not carry
+func (v *IRVisitor) alignStorage() {
+	for _, fn := range v.ctx.Module.Functions {
+		for _, block := range fn.Blocks {
+			for _, inst := range block.Instructions {
+				if alloca, ok := inst.(*ir.AllocaInst); ok && v.hasLayout(alloca.AllocatedType) {
+					alloca.Align = v.calculateAlignOf(alloca.AllocatedType)
+				}
+			}
+		}
+	}
+	for _, global := range v.ctx.Module.Globals {
+		if ptrType, ok := global.Type().(*types.PointerType); ok && v.hasLayout(ptrType.ElementType) {
+			global.Align = v.calculateAlignOf(ptrType.ElementType)
+		}
+	}
+}
+
+// declaredFields returns the IR indices of the fields a struct declares,
+// skipping layout padding
+func (v *IRVisitor) declaredFields(structType *types.StructType) []int {
+	if layout, ok := v.ctx.structLayouts[structType.Name]; ok {
+		return layout.fields
+	}
+	fields := make([]int, len(structType.Fields))
+	for i := range fields {
+		fields[i] = i
+	}
+	return fields
+}
+
+// fieldOffset returns the byte offset of IR field idx of a struct
+func (v *IRVisitor) fieldOffset(structType *types.StructType, idx int) int {
+	if layout, ok := v.ctx.structLayouts[structType.Name]; ok {
+		return layout.offsets[idx]
+	}
+	offset := 0
+	for i, field := range structType.Fields {
+		if !structType.Packed {
+			if align := v.calculateAlignOf(field); offset%align != 0 {
+				offset += align - offset%align
+			}
+		}
+		if i == idx {
+			break
+		}
+		offset += v.calculateSizeOf(field)
+	}
+	return offset
+}
+
+// offsetOf evaluates offsetof<T>(path), where path names a field of T or,
+// through dots, a field of a nested struct
+func (v *IRVisitor) offsetOf(typ types.Type, path string) (int, bool) {
+	offset := 0
+	for _, name := range strings.Split(path, ".") {
+		structType, isStruct := v.literalStruct(typ)
+		if !isStruct {
+			v.ctx.Logger.Error("offsetof: %s is not a struct", v.typeName(typ))
+			return 0, false
+		}
+		idx := v.findFieldIndex(structType, name)
+		if idx < 0 {
+			v.ctx.Logger.Error("offsetof: struct %s has no field %s", v.typeName(structType), name)
+			return 0, false
+		}
+		offset += v.fieldOffset(structType, idx)
+		typ = structType.Fields[idx]
+	}
+	return offset, true
+}
@@ -0,0 +1,485 @@
+package compiler
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-builder/types"
+)
+
+// Integer literals are decimal, 0x hex, 0o octal or 0b binary, with '_'
+// between digits and an optional type suffix:
+//
+//	1_000_000  0xFF_FFu16  0o755  0b1010  170141183460469231731687303715884105727i128
+//
+// Values are parsed with arbitrary precision. An unsuffixed literal is an
+// int64, or a u64 or i128 when it needs the room, and takes the integer type
+// its context expects; a literal that does not fit its type is an error.
+// Float literals take an f32 or f64 suffix and default to float64.
+//
+// Character literals are 'char' (u32) code points written as a single
+// character or escape:
+//
+//	'a'  'é'  '\n'  '\''  '\0'  '\x41'  '\101'  '\u{1F600}'
+//
+// A char literal used where a narrower integer is expected, such as a
+// 'byte', narrows when its code point fits and is rejected otherwise.
+// String literals share the escapes; in strings \x and octal escapes give
+// raw bytes while \u escapes are encoded as UTF-8.
+
+// simpleEscapes are the C escapes that stand for one character
+var simpleEscapes = map[byte]rune{
+	'a': 0x07, 'b': 0x08, 'e': 0x1B, 'f': 0x0C, 'n': '\n', 'r': '\r', 't': '\t', 'v': 0x0B,
+	'\\': '\\', '\'': '\'', '"': '"', '?': '?',
+}
+
+// decodeEscape decodes the escape sequence starting at s[i] == '\\'. It
+// returns the value, whether it is a raw byte (\x, octal) rather than a
+// code point, and the index just past the escape.
+func decodeEscape(s string, i int) (rune, bool, int, error) {
+	if i+1 >= len(s) {
+		return 0, false, len(s), fmt.Errorf("unterminated escape sequence")
+	}
+	c := s[i+1]
+	if r, ok := simpleEscapes[c]; ok {
+		return r, false, i + 2, nil
+	}
+
+	switch {
+	case c >= '0' && c <= '7':
+		// Up to three octal digits: \0, \12, \101
+		end := i + 1
+		for end < len(s) && end < i+4 && s[end] >= '0' && s[end] <= '7' {
+			end++
+		}
+		n, _ := strconv.ParseUint(s[i+1:end], 8, 32)
+		if n > 0xFF {
+			return 0, false, end, fmt.Errorf("octal escape \\%s is larger than \\377", s[i+1:end])
+		}
+		return rune(n), true, end, nil
+
+	case c == 'x':
+		end := i + 2
+		for end < len(s) && end < i+4 && isHexDigit(s[end]) {
+			end++
+		}
+		if end == i+2 {
+			return 0, false, end, fmt.Errorf("\\x must be followed by hex digits")
+		}
+		n, _ := strconv.ParseUint(s[i+2:end], 16, 32)
+		return rune(n), true, end, nil
+
+	case c == 'u' && i+2 < len(s) && s[i+2] == '{':
+		close := strings.IndexByte(s[i+3:], '}')
+		if close < 0 {
+			return 0, false, len(s), fmt.Errorf("unterminated \\u{...} escape")
+		}
+		digits := strings.ReplaceAll(s[i+3:i+3+close], "_", "")
+		end := i + 3 + close + 1
+		if len(digits) == 0 || len(digits) > 6 {
+			return 0, false, end, fmt.Errorf("\\u{...} needs 1 to 6 hex digits")
+		}
+		n, err := strconv.ParseUint(digits, 16, 32)
+		if err != nil {
+			return 0, false, end, fmt.Errorf("invalid hex digits in \\u{%s}", digits)
+		}
+		return rune(n), false, end, validCodePoint(rune(n))
+
+	case c == 'u' || c == 'U':
+		// C-style fixed-width forms: \uXXXX and \UXXXXXXXX
+		width := 4
+		if c == 'U' {
+			width = 8
+		}
+		end := i + 2 + width
+		if end > len(s) {
+			return 0, false, len(s), fmt.Errorf("\\%c needs %d hex digits", c, width)
+		}
+		n, err := strconv.ParseUint(s[i+2:end], 16, 32)
+		if err != nil {
+			return 0, false, end, fmt.Errorf("\\%c needs %d hex digits", c, width)
+		}
+		return rune(n), false, end, validCodePoint(rune(n))
+	}
+	return 0, false, i + 2, fmt.Errorf("unknown escape sequence \\%c", c)
+}
+
+func isHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// validCodePoint rejects surrogates and values past U+10FFFF
+func validCodePoint(r rune) error {
+	if r > utf8.MaxRune {
+		return fmt.Errorf("U+%X is beyond the last code point U+10FFFF", r)
+	}
+	if r >= 0xD800 && r <= 0xDFFF {
+		return fmt.Errorf("U+%X is a surrogate, not a character", r)
+	}
+	return nil
+}
+
+// parseCharLiteral returns the code point of a quoted char literal
+func parseCharLiteral(raw string) (rune, error) {
+	if len(raw) < 2 || raw[0] != '\'' || raw[len(raw)-1] != '\'' {
+		return 0, fmt.Errorf("malformed character literal")
+	}
+	body := raw[1 : len(raw)-1]
+	if body == "" {
+		return 0, fmt.Errorf("empty character literal")
+	}
+
+	var r rune
+	var next int
+	if body[0] == '\\' {
+		var err error
+		if r, _, next, err = decodeEscape(body, 0); err != nil {
+			return 0, err
+		}
+	} else {
+		var size int
+		r, size = utf8.DecodeRuneInString(body)
+		if r == utf8.RuneError && size <= 1 {
+			return 0, fmt.Errorf("character literal is not valid UTF-8")
+		}
+		next = size
+	}
+	if next != len(body) {
+		return 0, fmt.Errorf("character literal holds more than one character; use a string")
+	}
+	return r, nil
+}
+
+// unescapeString resolves the escapes in the body of a string literal
+func (v *IRVisitor) unescapeString(body string) string {
+	if !strings.ContainsRune(body, '\\') {
+		return body
+	}
+
+	var out strings.Builder
+	for i := 0; i < len(body); {
+		if body[i] != '\\' {
+			out.WriteByte(body[i])
+			i++
+			continue
+		}
+		r, isByte, next, err := decodeEscape(body, i)
+		if err != nil {
+			v.ctx.Logger.Error("Invalid string literal: %v", err)
+		} else if isByte {
+			out.WriteByte(byte(r))
+		} else {
+			out.WriteRune(r)
+		}
+		i = next
+	}
+	return out.String()
+}
+
+// charLiteral compiles a char literal to a u32 constant
+func (v *IRVisitor) charLiteral(raw string) ir.Value {
+	r, err := parseCharLiteral(raw)
+	if err != nil {
+		v.ctx.Logger.Error("Invalid character literal %s: %v", raw, err)
+		return v.ctx.Builder.ConstInt(types.U32, 0)
+	}
+	lit := v.ctx.Builder.ConstInt(types.U32, int64(r))
+	v.charLiterals[lit] = r
+	return lit
+}
+
+// narrowChar converts a char literal to an integer type, rejecting code
+// points the type cannot hold
+func (v *IRVisitor) narrowChar(r rune, target *types.IntType) ir.Value {
+	bits := target.BitWidth
+	if target.Signed {
+		bits--
+	}
+	if bits < 32 && int64(r) >= int64(1)<<bits {
+		v.ctx.Logger.Error("Character literal U+%04X does not fit in %v", r, target)
+	}
+	return v.ctx.Builder.ConstInt(target, int64(r))
+}
+
+// matchLiteralOperands gives a literal operand the type of the other
+// operand. Char and integer literals take its integer type, so that
+// b == '\n' compares bytes; integer literals next to a float become floats.
+func (v *IRVisitor) matchLiteralOperands(x, y ir.Value) (ir.Value, ir.Value) {
+	y = v.adaptLiteral(y, x.Type())
+	x = v.adaptLiteral(x, y.Type())
+	if v.mixesDistinct(x.Type(), y.Type()) {
+		v.ctx.Logger.Error("Mismatched types %s and %s; convert one with cast<>", v.typeName(x.Type()), v.typeName(y.Type()))
+	}
+	return x, y
+}
+
+// isUntypedLiteral reports whether val is an integer, float or char literal
+// whose type adaptLiteral may still change
+func (v *IRVisitor) isUntypedLiteral(val ir.Value) bool {
+	_, isInt := v.intLiterals[val]
+	_, isChar := v.charLiterals[val]
+	return isInt || isChar || v.floatLiterals[val]
+}
+
+// adaptLiteral converts an untyped literal to typ where that is lossless in
+// meaning, and returns any other value unchanged
+func (v *IRVisitor) adaptLiteral(val ir.Value, typ types.Type) ir.Value {
+	if v.ctx.SameType(val.Type(), typ) {
+		return val
+	}
+	if floatType, ok := typ.(*types.FloatType); ok && v.floatLiterals[val] {
+		lit := v.ctx.Builder.ConstFloat(floatType, val.(*ir.ConstantFloat).Value)
+		v.floatLiterals[lit] = true
+		return lit
+	}
+	if r, isChar := v.charLiterals[val]; isChar {
+		if intType, ok := typ.(*types.IntType); ok && !intType.Equal(types.I1) {
+			return v.narrowChar(r, intType)
+		}
+	}
+	if lit, isLiteral := v.intLiterals[val]; isLiteral {
+		switch t := typ.(type) {
+		case *types.IntType:
+			if !t.Equal(types.I1) {
+				return v.retypeIntLiteral(lit, t)
+			}
+		case *types.FloatType:
+			f, _ := new(big.Float).SetInt(lit.value).Float64()
+			return v.ctx.Builder.ConstFloat(t, f)
+		}
+	}
+	return val
+}
+
+// integerSuffixes are the type suffixes of integer literals
+var integerSuffixes = map[string]*types.IntType{
+	"i8": types.I8, "i16": types.I16, "i32": types.I32, "i64": types.I64, "i128": types.I128,
+	"u8": types.U8, "u16": types.U16, "u32": types.U32, "u64": types.U64,
+	"isize": types.I64, "usize": types.U64,
+}
+
+// floatSuffixes are the type suffixes of float literals
+var floatSuffixes = map[string]*types.FloatType{"f32": types.F32, "f64": types.F64}
+
+// intLiteral is an unsuffixed integer literal, which adapts to the integer
+// type its context expects
+type intLiteral struct {
+	value *big.Int
+}
+
+// splitNumericSuffix separates a numeric literal from its type suffix.
+// Hex digits include 'f', so hex literals only take i and u suffixes.
+func splitNumericSuffix(text string) (string, string) {
+	start, suffixStart := 0, "iuf"
+	if len(text) > 2 && text[0] == '0' && strings.ContainsRune("xXoObB", rune(text[1])) {
+		start = 2
+		if text[1] == 'x' || text[1] == 'X' {
+			suffixStart = "iu"
+		}
+	}
+	if i := strings.IndexAny(text[start:], suffixStart); i >= 0 {
+		return text[:start+i], text[start+i:]
+	}
+	return text, ""
+}
+
+// stripSeparators removes the '_' separators between digits
+func stripSeparators(digits string) (string, error) {
+	if strings.HasSuffix(digits, "_") || strings.Contains(digits, "__") {
+		return "", fmt.Errorf("'_' may only separate digits")
+	}
+	return strings.ReplaceAll(digits, "_", ""), nil
+}
+
+// parseIntegerLiteral returns the value of an integer literal without its
+// suffix
+func parseIntegerLiteral(digits string) (*big.Int, error) {
+	base := 10
+	if len(digits) > 1 && digits[0] == '0' {
+		switch digits[1] {
+		case 'x', 'X':
+			base = 16
+		case 'o', 'O':
+			base = 8
+		case 'b', 'B':
+			base = 2
+		default:
+			return nil, fmt.Errorf("leading zeros are not allowed; write octal as 0o%s", strings.TrimLeft(digits, "0"))
+		}
+		digits = digits[2:]
+	}
+
+	digits, err := stripSeparators(digits)
+	if err != nil {
+		return nil, err
+	}
+	if digits == "" {
+		return nil, fmt.Errorf("missing digits")
+	}
+	value, ok := new(big.Int).SetString(digits, base)
+	if !ok {
+		return nil, fmt.Errorf("invalid digit for a base-%d literal", base)
+	}
+	return value, nil
+}
+
+// intRange returns the smallest and largest values of typ
+func intRange(typ *types.IntType) (*big.Int, *big.Int) {
+	one := big.NewInt(1)
+	if typ.Signed {
+		max := new(big.Int).Lsh(one, uint(typ.BitWidth-1))
+		return new(big.Int).Neg(max), max.Sub(max, one)
+	}
+	max := new(big.Int).Lsh(one, uint(typ.BitWidth))
+	return big.NewInt(0), max.Sub(max, one)
+}
+
+func fitsInt(value *big.Int, typ *types.IntType) bool {
+	min, max := intRange(typ)
+	return value.Cmp(min) >= 0 && value.Cmp(max) <= 0
+}
+
+// defaultLiteralType is int64, widened to u64 or i128 for larger values
+func defaultLiteralType(value *big.Int) (*types.IntType, bool) {
+	for _, typ := range []*types.IntType{types.I64, types.U64, types.I128} {
+		if fitsInt(value, typ) {
+			return typ, true
+		}
+	}
+	return nil, false
+}
+
+// intConstant materializes value as typ. 128-bit values that do not fit in
+// 64 bits are assembled from their halves, which needs a function.
+func (v *IRVisitor) intConstant(value *big.Int, typ *types.IntType) ir.Value {
+	b := v.ctx.Builder
+	if value.IsInt64() {
+		return b.ConstInt(typ, value.Int64())
+	}
+	if typ.BitWidth <= 64 {
+		// Large unsigned values keep their bit pattern
+		return b.ConstInt(typ, int64(value.Uint64()))
+	}
+
+	if v.ctx.currentFunction == nil {
+		v.ctx.Logger.Error("128-bit literal %s does not fit in 64 bits and cannot initialize a global", value)
+		return b.ConstInt(typ, 0)
+	}
+	bits := new(big.Int).Set(value)
+	if bits.Sign() < 0 {
+		bits.Add(bits, new(big.Int).Lsh(big.NewInt(1), 128))
+	}
+	mask := new(big.Int).SetUint64(math.MaxUint64)
+	lo := new(big.Int).And(bits, mask).Uint64()
+	hi := new(big.Int).Rsh(bits, 64).Uint64()
+	high := b.CreateShl(b.CreateZExt(b.ConstInt(types.U64, int64(hi)), typ, ""), b.ConstInt(typ, 64), "")
+	return b.CreateOr(high, b.CreateZExt(b.ConstInt(types.U64, int64(lo)), typ, ""), "")
+}
+
+// integerLiteral compiles an integer literal, suffixed or not
+func (v *IRVisitor) integerLiteral(text string) ir.Value {
+	digits, suffix := splitNumericSuffix(text)
+	if floatType, isFloat := floatSuffixes[suffix]; isFloat {
+		return v.floatLiteral(digits, floatType, text)
+	}
+
+	value, err := parseIntegerLiteral(digits)
+	if err != nil {
+		v.ctx.Logger.Error("Invalid integer literal '%s': %v", text, err)
+		return v.ctx.Builder.ConstInt(types.I64, 0)
+	}
+
+	if suffix == "" {
+		typ, ok := defaultLiteralType(value)
+		if !ok {
+			v.ctx.Logger.Error("Integer literal '%s' is too large for any integer type", text)
+			return v.ctx.Builder.ConstInt(types.I64, 0)
+		}
+		lit := v.intConstant(value, typ)
+		v.intLiterals[lit] = intLiteral{value: value}
+		return lit
+	}
+
+	typ, ok := integerSuffixes[suffix]
+	if !ok {
+		v.ctx.Logger.Error("Invalid integer literal '%s': unknown suffix '%s'", text, suffix)
+		return v.ctx.Builder.ConstInt(types.I64, 0)
+	}
+	if !fitsInt(value, typ) {
+		min, max := intRange(typ)
+		v.ctx.Logger.Error("Integer literal '%s' overflows %s (range %s to %s)", text, suffix, min, max)
+	}
+	return v.intConstant(value, typ)
+}
+
+// floatLiteral compiles a float literal; suffix-less literals are float64
+func (v *IRVisitor) floatLiteral(digits string, typ *types.FloatType, text string) ir.Value {
+	digits, err := stripSeparators(digits)
+	if err == nil && strings.Contains(digits, "_") {
+		err = fmt.Errorf("'_' may only separate digits")
+	}
+	var value float64
+	if err == nil {
+		value, err = strconv.ParseFloat(digits, 64)
+	}
+	if err != nil {
+		if numErr, ok := err.(*strconv.NumError); ok && numErr.Err == strconv.ErrRange {
+			err = fmt.Errorf("value is out of range for float64")
+		} else if ok {
+			err = numErr.Err
+		}
+		v.ctx.Logger.Error("Invalid float literal '%s': %v", text, err)
+		return v.ctx.Builder.ConstFloat(typ, 0)
+	}
+	if typ.Equal(types.F32) && math.Abs(value) > math.MaxFloat32 {
+		v.ctx.Logger.Error("Float literal '%s' overflows float32", text)
+	}
+	return v.ctx.Builder.ConstFloat(typ, value)
+}
+
+// floatLiteralText compiles a FLOAT_LITERAL token
+func (v *IRVisitor) floatLiteralText(text string) ir.Value {
+	digits, suffix := splitNumericSuffix(text)
+	if suffix == "" {
+		// Unsuffixed floats adapt to float types, distinct ones included
+		lit := v.floatLiteral(digits, types.F64, text)
+		v.floatLiterals[lit] = true
+		return lit
+	}
+	typ, ok := floatSuffixes[suffix]
+	if !ok {
+		v.ctx.Logger.Error("Invalid float literal '%s': unknown suffix '%s'", text, suffix)
+		return v.ctx.Builder.ConstFloat(types.F64, 0)
+	}
+	return v.floatLiteral(digits, typ, text)
+}
+
+// retypeIntLiteral gives an unsuffixed literal the integer type its context
+// expects
+func (v *IRVisitor) retypeIntLiteral(lit intLiteral, target *types.IntType) ir.Value {
+	if !fitsInt(lit.value, target) {
+		min, max := intRange(target)
+		v.ctx.Logger.Error("Integer literal %s does not fit in %v (range %s to %s)", lit.value, target, min, max)
+	}
+	retyped := v.intConstant(lit.value, target)
+	v.intLiterals[retyped] = lit
+	return retyped
+}
+
+// negateLiteral folds '-literal' so the most negative values are reachable
+func (v *IRVisitor) negateLiteral(lit intLiteral) ir.Value {
+	value := new(big.Int).Neg(lit.value)
+	typ, ok := defaultLiteralType(value)
+	if !ok {
+		v.ctx.Logger.Error("Integer literal %s is too small for any integer type", value)
+		return v.ctx.Builder.ConstInt(types.I64, 0)
+	}
+	negated := v.intConstant(value, typ)
+	v.intLiterals[negated] = intLiteral{value: value}
+	return negated
+}
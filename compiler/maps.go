@@ -0,0 +1,646 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-builder/types"
+	"github.com/arc-language/core-parser"
+)
+
+// map<K, V> is a reference-counted hash table with open addressing and
+// linear probing, managed like a class:
+//
+//	{ i64 refcount, *entry entries, u64 len, u64 cap, u64 gen }
+//	entry = { i8 used, K key, V value }
+//
+// The capacity is a power of two and doubles once the table is three
+// quarters full. gen counts insertions of new keys and removals, so that a
+// for-in loop can tell the table was reordered under it. Removal shifts later entries of the probe run back, so the
+// table needs no tombstones. The generated code calls nothing from libc
+// apart from the allocator, which freestanding builds generate themselves.
+
+const (
+	mapEntriesField = classHeaderFields + iota
+	mapLenField
+	mapCapField
+	mapGenField
+)
+
+const (
+	entryUsedField = iota
+	entryKeyField
+	entryValueField
+)
+
+// mapInitialCap is the capacity of the first table of an empty map
+const mapInitialCap = 8
+
+// Hashing constants (FNV-1a for byte strings, the murmur3 finalizer for
+// integers); kept as variables so the conversion to int64 may wrap
+var (
+	fnvOffsetBasis = uint64(14695981039346656037)
+	fnvPrime       = uint64(1099511628211)
+	fmixMultiplier = uint64(0xff51afd7ed558ccd)
+)
+
+// mapInfo describes one map<K, V> instantiation and its runtime functions
+type mapInfo struct {
+	Key   types.Type
+	Value types.Type
+	Type  *types.StructType
+	Entry *types.StructType
+
+	hash *ir.Function
+	find *ir.Function
+	grow *ir.Function
+	slot *ir.Function
+	get  *ir.Function
+}
+
+// MapInfo returns the map description when typ is a map
+func (c *Context) MapInfo(typ types.Type) (*mapInfo, bool) {
+	ptrType, ok := typ.(*types.PointerType)
+	if !ok {
+		return nil, false
+	}
+	structType, ok := ptrType.ElementType.(*types.StructType)
+	if !ok {
+		return nil, false
+	}
+	info, ok := c.mapInfos[structType]
+	return info, ok
+}
+
+func (v *IRVisitor) resolveMapType(ctx parser.IMapTypeContext) types.Type {
+	typeCtxs := ctx.AllType_()
+	if len(typeCtxs) != 2 {
+		v.ctx.Logger.Error("map expects a key and a value type")
+		return types.I64
+	}
+	return v.mapType(v.resolveType(typeCtxs[0]), v.resolveType(typeCtxs[1]))
+}
+
+// mapType returns map<key, value>, emitting its runtime functions the first
+// time the pair is seen
+func (v *IRVisitor) mapType(key, value types.Type) types.Type {
+	cacheKey := fmt.Sprintf("%v:%v", key, value)
+	if mapType, ok := v.ctx.mapTypes[cacheKey]; ok {
+		return types.NewPointer(mapType)
+	}
+
+	if !v.isHashable(key) {
+		v.ctx.Logger.Error("Type %v cannot be used as a map key", key)
+		return types.I64
+	}
+
+	name := fmt.Sprintf("__map.%d", len(v.ctx.mapTypes))
+	entryType := types.NewStruct(name+".entry", []types.Type{types.I8, key, value}, false)
+	mapType := types.NewStruct(name, []types.Type{types.I64, types.NewPointer(entryType), types.U64, types.U64, types.U64}, false)
+	v.ctx.Module.Types[entryType.Name] = entryType
+	v.ctx.RegisterClass(name, mapType)
+
+	info := &mapInfo{Key: key, Value: value, Type: mapType, Entry: entryType}
+	v.ctx.mapTypes[cacheKey] = mapType
+	v.ctx.mapInfos[mapType] = info
+	v.logger.Debug("Registered %s for map<%v, %v>", name, key, value)
+
+	state := v.ctx.SuspendFunction()
+	v.emitMapHash(info)
+	v.emitMapFind(info)
+	v.emitMapGrow(info)
+	v.emitMapSlot(info)
+	v.emitMapInsert(info)
+	v.emitMapGet(info)
+	v.emitMapContains(info)
+	v.emitMapRemove(info)
+	v.emitMapLen(info)
+	v.emitMapDeinit(info)
+	v.ctx.ResumeFunction(state)
+
+	return types.NewPointer(mapType)
+}
+
+// isHashable reports whether emitHash and emitEqual support typ
+func (v *IRVisitor) isHashable(typ types.Type) bool {
+	switch t := typ.(type) {
+	case *types.IntType, *types.PointerType:
+		return true
+	case *types.StructType:
+		if v.ctx.IsString(t) {
+			return true
+		}
+		if _, isClosure := v.ctx.ClosureSignature(t); isClosure {
+			return false
+		}
+		for _, i := range v.declaredFields(t) {
+			if !v.isHashable(t.Fields[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// emitHash returns a u64 hash of val. Integers and pointers hash by value,
+// strings by content, structs by combining their fields.
+func (v *IRVisitor) emitHash(val ir.Value, typ types.Type) ir.Value {
+	b := v.ctx.Builder
+	switch t := typ.(type) {
+	case *types.IntType:
+		return v.emitMix(v.castValue(val, types.U64))
+	case *types.PointerType:
+		return v.emitMix(b.CreatePtrToInt(val, types.U64, ""))
+	case *types.StructType:
+		if v.ctx.IsString(t) {
+			return b.CreateCall(v.stringRuntime().hash, []ir.Value{val}, "")
+		}
+		var h ir.Value = b.ConstInt(types.U64, 17)
+		for _, i := range v.declaredFields(t) {
+			fieldHash := v.emitHash(b.CreateExtractValue(val, []int{i}, ""), t.Fields[i])
+			h = b.CreateAdd(b.CreateMul(h, b.ConstInt(types.U64, 31), ""), fieldHash, "")
+		}
+		return h
+	}
+	return b.ConstInt(types.U64, 0)
+}
+
+// emitMix scrambles an integer so nearby keys spread over the table
+func (v *IRVisitor) emitMix(x ir.Value) ir.Value {
+	b := v.ctx.Builder
+	x = b.CreateXor(x, b.CreateLShr(x, b.ConstInt(types.U64, 33), ""), "")
+	x = b.CreateMul(x, b.ConstInt(types.U64, int64(fmixMultiplier)), "")
+	return b.CreateXor(x, b.CreateLShr(x, b.ConstInt(types.U64, 33), ""), "")
+}
+
+// emitEqual compares two values of a hashable or comparable type
+func (v *IRVisitor) emitEqual(x, y ir.Value, typ types.Type) ir.Value {
+	b := v.ctx.Builder
+	switch t := typ.(type) {
+	case *types.FloatType:
+		return b.CreateFCmpOEQ(x, y, "")
+	case *types.ArrayType:
+		var eq ir.Value = b.True()
+		for i := 0; i < int(t.Length); i++ {
+			elemEq := v.emitEqual(b.CreateExtractValue(x, []int{i}, ""), b.CreateExtractValue(y, []int{i}, ""), t.ElementType)
+			eq = b.CreateAnd(eq, elemEq, "")
+		}
+		return eq
+	case *types.StructType:
+		if v.ctx.IsString(t) {
+			return v.compareStrings(x, y, "==")
+		}
+		var eq ir.Value = b.True()
+		for _, i := range v.declaredFields(t) {
+			fieldEq := v.emitEqual(b.CreateExtractValue(x, []int{i}, ""), b.CreateExtractValue(y, []int{i}, ""), t.Fields[i])
+			eq = b.CreateAnd(eq, fieldEq, "")
+		}
+		return eq
+	}
+	return b.CreateICmpEQ(x, y, "")
+}
+
+// mapMethod creates a runtime function taking the map as its first argument
+func (v *IRVisitor) mapMethod(info *mapInfo, name string, ret types.Type, params []types.Type, argNames ...string) *ir.Function {
+	allParams := append([]types.Type{types.NewPointer(info.Type)}, params...)
+	fn := v.ctx.Builder.CreateFunction(info.Type.Name+"_"+name, ret, allParams, false)
+	fn.Arguments[0].SetName("self")
+	for i, argName := range argNames {
+		fn.Arguments[i+1].SetName(argName)
+	}
+	v.ctx.SetInsertBlock(v.ctx.Builder.CreateBlock("entry"))
+	return fn
+}
+
+func (v *IRVisitor) mapField(info *mapInfo, m ir.Value, field int) ir.Value {
+	gep := v.ctx.Builder.CreateStructGEP(info.Type, m, field, "")
+	return v.ctx.Builder.CreateLoad(info.Type.Fields[field], gep, "")
+}
+
+func (v *IRVisitor) setMapField(info *mapInfo, m ir.Value, field int, val ir.Value) {
+	v.ctx.Builder.CreateStore(val, v.ctx.Builder.CreateStructGEP(info.Type, m, field, ""))
+}
+
+// bumpMapGeneration records that m gained or lost a key
+func (v *IRVisitor) bumpMapGeneration(info *mapInfo, m ir.Value) {
+	gen := v.mapField(info, m, mapGenField)
+	v.setMapField(info, m, mapGenField, v.ctx.Builder.CreateAdd(gen, v.ctx.Builder.ConstInt(types.U64, 1), ""))
+}
+
+// entryAddress returns the address of field 'field' of entries[index]
+func (v *IRVisitor) entryAddress(info *mapInfo, entries, index ir.Value, field int) ir.Value {
+	entry := v.ctx.Builder.CreateGEP(info.Entry, entries, []ir.Value{index}, "")
+	return v.ctx.Builder.CreateStructGEP(info.Entry, entry, field, "")
+}
+
+func (v *IRVisitor) entryUsed(info *mapInfo, entries, index ir.Value) ir.Value {
+	used := v.ctx.Builder.CreateLoad(types.I8, v.entryAddress(info, entries, index, entryUsedField), "")
+	return v.ctx.Builder.CreateICmpNE(used, v.ctx.Builder.ConstInt(types.I8, 0), "")
+}
+
+// emitMapHash defines hash(key) u64
+func (v *IRVisitor) emitMapHash(info *mapInfo) {
+	fn := v.ctx.Builder.CreateFunction(info.Type.Name+"_hash", types.U64, []types.Type{info.Key}, false)
+	fn.Arguments[0].SetName("key")
+	v.ctx.SetInsertBlock(v.ctx.Builder.CreateBlock("entry"))
+	v.ctx.Builder.CreateRet(v.emitHash(fn.Arguments[0], info.Key))
+	info.hash = fn
+}
+
+// emitMapFind defines find(self, key) u64, the index holding key or the
+// empty slot where it belongs. The table must have at least one empty slot.
+func (v *IRVisitor) emitMapFind(info *mapInfo) {
+	b := v.ctx.Builder
+	fn := v.mapMethod(info, "find", types.U64, []types.Type{info.Key}, "key")
+	self, key := fn.Arguments[0], fn.Arguments[1]
+	info.find = fn
+
+	entries := v.mapField(info, self, mapEntriesField)
+	mask := b.CreateSub(v.mapField(info, self, mapCapField), b.ConstInt(types.U64, 1), "")
+	indexPtr := b.CreateAlloca(types.U64, "i")
+	hash := b.CreateCall(info.hash, []ir.Value{key}, "")
+	b.CreateStore(b.CreateAnd(hash, mask, ""), indexPtr)
+
+	probeBlock := b.CreateBlock("probe")
+	compareBlock := b.CreateBlock("compare")
+	nextBlock := b.CreateBlock("next")
+	foundBlock := b.CreateBlock("found")
+	b.CreateBr(probeBlock)
+
+	v.ctx.SetInsertBlock(probeBlock)
+	index := b.CreateLoad(types.U64, indexPtr, "")
+	b.CreateCondBr(v.entryUsed(info, entries, index), compareBlock, foundBlock)
+
+	v.ctx.SetInsertBlock(compareBlock)
+	stored := b.CreateLoad(info.Key, v.entryAddress(info, entries, index, entryKeyField), "")
+	b.CreateCondBr(v.emitEqual(stored, key, info.Key), foundBlock, nextBlock)
+
+	v.ctx.SetInsertBlock(nextBlock)
+	next := b.CreateAnd(b.CreateAdd(index, b.ConstInt(types.U64, 1), ""), mask, "")
+	b.CreateStore(next, indexPtr)
+	b.CreateBr(probeBlock)
+
+	v.ctx.SetInsertBlock(foundBlock)
+	b.CreateRet(b.CreateLoad(types.U64, indexPtr, ""))
+}
+
+// newEntries allocates a table of n empty entries
+func (v *IRVisitor) newEntries(info *mapInfo, n ir.Value) ir.Value {
+	b := v.ctx.Builder
+	size := b.CreateMul(n, b.ConstInt(types.U64, int64(v.calculateSizeOf(info.Entry))), "")
+	entries := b.CreateBitCast(v.emitMalloc(size), types.NewPointer(info.Entry), "")
+
+	indexPtr := b.CreateAlloca(types.U64, "j")
+	b.CreateStore(b.ConstInt(types.U64, 0), indexPtr)
+	loopBlock := b.CreateBlock("clear.loop")
+	bodyBlock := b.CreateBlock("clear.body")
+	doneBlock := b.CreateBlock("clear.done")
+	b.CreateBr(loopBlock)
+
+	v.ctx.SetInsertBlock(loopBlock)
+	index := b.CreateLoad(types.U64, indexPtr, "")
+	b.CreateCondBr(b.CreateICmpULT(index, n, ""), bodyBlock, doneBlock)
+
+	v.ctx.SetInsertBlock(bodyBlock)
+	b.CreateStore(b.ConstInt(types.I8, 0), v.entryAddress(info, entries, index, entryUsedField))
+	b.CreateStore(b.CreateAdd(index, b.ConstInt(types.U64, 1), ""), indexPtr)
+	b.CreateBr(loopBlock)
+
+	v.ctx.SetInsertBlock(doneBlock)
+	return entries
+}
+
+// emitMapGrow defines grow(self), which doubles the table and reinserts
+// every entry
+func (v *IRVisitor) emitMapGrow(info *mapInfo) {
+	b := v.ctx.Builder
+	fn := v.mapMethod(info, "grow", types.Void, nil)
+	self := fn.Arguments[0]
+	info.grow = fn
+
+	oldEntries := v.mapField(info, self, mapEntriesField)
+	oldCap := v.mapField(info, self, mapCapField)
+	isEmpty := b.CreateICmpEQ(oldCap, b.ConstInt(types.U64, 0), "")
+	doubled := b.CreateMul(oldCap, b.ConstInt(types.U64, 2), "")
+	newCap := b.CreateSelect(isEmpty, b.ConstInt(types.U64, mapInitialCap), doubled, "")
+	v.setMapField(info, self, mapEntriesField, v.newEntries(info, newCap))
+	v.setMapField(info, self, mapCapField, newCap)
+
+	indexPtr := b.CreateAlloca(types.U64, "i")
+	b.CreateStore(b.ConstInt(types.U64, 0), indexPtr)
+	loopBlock := b.CreateBlock("rehash.loop")
+	checkBlock := b.CreateBlock("rehash.check")
+	moveBlock := b.CreateBlock("rehash.move")
+	nextBlock := b.CreateBlock("rehash.next")
+	doneBlock := b.CreateBlock("rehash.done")
+	b.CreateBr(loopBlock)
+
+	v.ctx.SetInsertBlock(loopBlock)
+	index := b.CreateLoad(types.U64, indexPtr, "")
+	b.CreateCondBr(b.CreateICmpULT(index, oldCap, ""), checkBlock, doneBlock)
+
+	v.ctx.SetInsertBlock(checkBlock)
+	b.CreateCondBr(v.entryUsed(info, oldEntries, index), moveBlock, nextBlock)
+
+	// Entries move as a whole; references they hold stay with them
+	v.ctx.SetInsertBlock(moveBlock)
+	oldEntry := b.CreateGEP(info.Entry, oldEntries, []ir.Value{index}, "")
+	entry := b.CreateLoad(info.Entry, oldEntry, "")
+	key := b.CreateExtractValue(entry, []int{entryKeyField}, "")
+	target := b.CreateCall(info.find, []ir.Value{self, key}, "")
+	newEntries := v.mapField(info, self, mapEntriesField)
+	b.CreateStore(entry, b.CreateGEP(info.Entry, newEntries, []ir.Value{target}, ""))
+	b.CreateBr(nextBlock)
+
+	v.ctx.SetInsertBlock(nextBlock)
+	b.CreateStore(b.CreateAdd(index, b.ConstInt(types.U64, 1), ""), indexPtr)
+	b.CreateBr(loopBlock)
+
+	v.ctx.SetInsertBlock(doneBlock)
+	v.emitFree(b.CreateBitCast(oldEntries, types.NewPointer(types.I8), ""))
+	b.CreateRetVoid()
+}
+
+// emitMapSlot defines slot(self, key) *V, which adds key with a zero value
+// when it is missing and returns where its value is stored
+func (v *IRVisitor) emitMapSlot(info *mapInfo) {
+	b := v.ctx.Builder
+	fn := v.mapMethod(info, "slot", types.NewPointer(info.Value), []types.Type{info.Key}, "key")
+	self, key := fn.Arguments[0], fn.Arguments[1]
+	info.slot = fn
+
+	growBlock := b.CreateBlock("grow")
+	findBlock := b.CreateBlock("find")
+	addBlock := b.CreateBlock("add")
+	doneBlock := b.CreateBlock("done")
+
+	// Keep the load factor at or below 3/4
+	length := v.mapField(info, self, mapLenField)
+	capacity := v.mapField(info, self, mapCapField)
+	needed := b.CreateMul(b.CreateAdd(length, b.ConstInt(types.U64, 1), ""), b.ConstInt(types.U64, 4), "")
+	limit := b.CreateMul(capacity, b.ConstInt(types.U64, 3), "")
+	b.CreateCondBr(b.CreateICmpUGT(needed, limit, ""), growBlock, findBlock)
+
+	v.ctx.SetInsertBlock(growBlock)
+	b.CreateCall(info.grow, []ir.Value{self}, "")
+	b.CreateBr(findBlock)
+
+	v.ctx.SetInsertBlock(findBlock)
+	index := b.CreateCall(info.find, []ir.Value{self, key}, "")
+	entries := v.mapField(info, self, mapEntriesField)
+	b.CreateCondBr(v.entryUsed(info, entries, index), doneBlock, addBlock)
+
+	// The table keeps its own reference to class keys
+	v.ctx.SetInsertBlock(addBlock)
+	v.emitRetain(key)
+	b.CreateStore(b.ConstInt(types.I8, 1), v.entryAddress(info, entries, index, entryUsedField))
+	b.CreateStore(key, v.entryAddress(info, entries, index, entryKeyField))
+	b.CreateStore(v.getZeroValue(info.Value), v.entryAddress(info, entries, index, entryValueField))
+	newLen := b.CreateAdd(v.mapField(info, self, mapLenField), b.ConstInt(types.U64, 1), "")
+	v.setMapField(info, self, mapLenField, newLen)
+	v.bumpMapGeneration(info, self)
+	b.CreateBr(doneBlock)
+
+	v.ctx.SetInsertBlock(doneBlock)
+	b.CreateRet(v.entryAddress(info, entries, index, entryValueField))
+}
+
+// emitMapInsert defines insert(self, key, value), replacing any existing value
+func (v *IRVisitor) emitMapInsert(info *mapInfo) {
+	fn := v.mapMethod(info, "insert", types.Void, []types.Type{info.Key, info.Value}, "key", "value")
+	v.ctx.RegisterMethod(info.Type.Name, "insert", fn)
+	slot := v.ctx.Builder.CreateCall(info.slot, []ir.Value{fn.Arguments[0], fn.Arguments[1]}, "")
+	v.storeOwned(fn.Arguments[2], slot, info.Value)
+	v.ctx.Builder.CreateRetVoid()
+}
+
+// emitMapGet defines get(self, key) V, which returns the zero value for
+// missing keys
+func (v *IRVisitor) emitMapGet(info *mapInfo) {
+	b := v.ctx.Builder
+	fn := v.mapMethod(info, "get", info.Value, []types.Type{info.Key}, "key")
+	self, key := fn.Arguments[0], fn.Arguments[1]
+	v.ctx.RegisterMethod(info.Type.Name, "get", fn)
+	info.get = fn
+
+	findBlock := b.CreateBlock("find")
+	hitBlock := b.CreateBlock("hit")
+	missBlock := b.CreateBlock("miss")
+	isEmpty := b.CreateICmpEQ(v.mapField(info, self, mapCapField), b.ConstInt(types.U64, 0), "")
+	b.CreateCondBr(isEmpty, missBlock, findBlock)
+
+	v.ctx.SetInsertBlock(findBlock)
+	index := b.CreateCall(info.find, []ir.Value{self, key}, "")
+	entries := v.mapField(info, self, mapEntriesField)
+	b.CreateCondBr(v.entryUsed(info, entries, index), hitBlock, missBlock)
+
+	// Calls return class values with a reference of their own
+	v.ctx.SetInsertBlock(hitBlock)
+	value := b.CreateLoad(info.Value, v.entryAddress(info, entries, index, entryValueField), "")
+	v.emitRetain(value)
+	b.CreateRet(value)
+
+	v.ctx.SetInsertBlock(missBlock)
+	b.CreateRet(v.getZeroValue(info.Value))
+}
+
+// emitMapContains defines contains(self, key) bool
+func (v *IRVisitor) emitMapContains(info *mapInfo) {
+	b := v.ctx.Builder
+	fn := v.mapMethod(info, "contains", types.I1, []types.Type{info.Key}, "key")
+	self, key := fn.Arguments[0], fn.Arguments[1]
+	v.ctx.RegisterMethod(info.Type.Name, "contains", fn)
+
+	findBlock := b.CreateBlock("find")
+	missBlock := b.CreateBlock("miss")
+	isEmpty := b.CreateICmpEQ(v.mapField(info, self, mapCapField), b.ConstInt(types.U64, 0), "")
+	b.CreateCondBr(isEmpty, missBlock, findBlock)
+
+	v.ctx.SetInsertBlock(findBlock)
+	index := b.CreateCall(info.find, []ir.Value{self, key}, "")
+	b.CreateRet(v.entryUsed(info, v.mapField(info, self, mapEntriesField), index))
+
+	v.ctx.SetInsertBlock(missBlock)
+	b.CreateRet(b.False())
+}
+
+// emitMapRemove defines remove(self, key) bool. Entries after the removed
+// one move back into the gap unless they already sit between their home
+// slot and the gap.
+func (v *IRVisitor) emitMapRemove(info *mapInfo) {
+	b := v.ctx.Builder
+	fn := v.mapMethod(info, "remove", types.I1, []types.Type{info.Key}, "key")
+	self, key := fn.Arguments[0], fn.Arguments[1]
+	v.ctx.RegisterMethod(info.Type.Name, "remove", fn)
+
+	findBlock := b.CreateBlock("find")
+	removeBlock := b.CreateBlock("remove")
+	scanBlock := b.CreateBlock("shift.scan")
+	checkBlock := b.CreateBlock("shift.check")
+	moveBlock := b.CreateBlock("shift.move")
+	doneBlock := b.CreateBlock("shift.done")
+	missBlock := b.CreateBlock("miss")
+
+	isEmpty := b.CreateICmpEQ(v.mapField(info, self, mapCapField), b.ConstInt(types.U64, 0), "")
+	b.CreateCondBr(isEmpty, missBlock, findBlock)
+
+	v.ctx.SetInsertBlock(findBlock)
+	index := b.CreateCall(info.find, []ir.Value{self, key}, "")
+	entries := v.mapField(info, self, mapEntriesField)
+	mask := b.CreateSub(v.mapField(info, self, mapCapField), b.ConstInt(types.U64, 1), "")
+	b.CreateCondBr(v.entryUsed(info, entries, index), removeBlock, missBlock)
+
+	v.ctx.SetInsertBlock(removeBlock)
+	v.emitRelease(b.CreateLoad(info.Key, v.entryAddress(info, entries, index, entryKeyField), ""))
+	v.emitRelease(b.CreateLoad(info.Value, v.entryAddress(info, entries, index, entryValueField), ""))
+	gapPtr := b.CreateAlloca(types.U64, "gap")
+	b.CreateStore(index, gapPtr)
+	scanPtr := b.CreateAlloca(types.U64, "j")
+	b.CreateStore(index, scanPtr)
+	b.CreateBr(scanBlock)
+
+	// Walk the rest of the probe run, which ends at the first empty slot
+	v.ctx.SetInsertBlock(scanBlock)
+	j := b.CreateAnd(b.CreateAdd(b.CreateLoad(types.U64, scanPtr, ""), b.ConstInt(types.U64, 1), ""), mask, "")
+	b.CreateStore(j, scanPtr)
+	b.CreateCondBr(v.entryUsed(info, entries, j), checkBlock, doneBlock)
+
+	// The entry at j stays when its home slot lies cyclically in (gap, j]
+	v.ctx.SetInsertBlock(checkBlock)
+	gap := b.CreateLoad(types.U64, gapPtr, "")
+	stored := b.CreateLoad(info.Key, v.entryAddress(info, entries, j, entryKeyField), "")
+	home := b.CreateAnd(b.CreateCall(info.hash, []ir.Value{stored}, ""), mask, "")
+	afterGap := b.CreateICmpUGT(home, gap, "")
+	atOrBeforeJ := b.CreateICmpULE(home, j, "")
+	noWrap := b.CreateICmpULE(gap, j, "")
+	staysNoWrap := b.CreateAnd(afterGap, atOrBeforeJ, "")
+	staysWrap := b.CreateOr(afterGap, atOrBeforeJ, "")
+	stays := b.CreateSelect(noWrap, staysNoWrap, staysWrap, "")
+	b.CreateCondBr(stays, scanBlock, moveBlock)
+
+	v.ctx.SetInsertBlock(moveBlock)
+	moved := b.CreateLoad(info.Entry, b.CreateGEP(info.Entry, entries, []ir.Value{j}, ""), "")
+	b.CreateStore(moved, b.CreateGEP(info.Entry, entries, []ir.Value{gap}, ""))
+	b.CreateStore(j, gapPtr)
+	b.CreateBr(scanBlock)
+
+	v.ctx.SetInsertBlock(doneBlock)
+	finalGap := b.CreateLoad(types.U64, gapPtr, "")
+	b.CreateStore(b.ConstInt(types.I8, 0), v.entryAddress(info, entries, finalGap, entryUsedField))
+	newLen := b.CreateSub(v.mapField(info, self, mapLenField), b.ConstInt(types.U64, 1), "")
+	v.setMapField(info, self, mapLenField, newLen)
+	v.bumpMapGeneration(info, self)
+	b.CreateRet(b.True())
+
+	v.ctx.SetInsertBlock(missBlock)
+	b.CreateRet(b.False())
+}
+
+// emitMapLen defines len(self) u64
+func (v *IRVisitor) emitMapLen(info *mapInfo) {
+	fn := v.mapMethod(info, "len", types.U64, nil)
+	v.ctx.RegisterMethod(info.Type.Name, "len", fn)
+	v.ctx.Builder.CreateRet(v.mapField(info, fn.Arguments[0], mapLenField))
+}
+
+// emitMapDeinit releases managed keys and values and frees the table; the
+// class release function calls it when the count reaches zero
+func (v *IRVisitor) emitMapDeinit(info *mapInfo) {
+	b := v.ctx.Builder
+	fn := v.mapMethod(info, "deinit", types.Void, nil)
+	self := fn.Arguments[0]
+	v.ctx.Deinits[info.Type.Name] = fn
+
+	entries := v.mapField(info, self, mapEntriesField)
+	if v.isManaged(info.Key) || v.isManaged(info.Value) {
+		v.forEachEntry(info, entries, v.mapField(info, self, mapCapField), func(index ir.Value) {
+			v.emitRelease(b.CreateLoad(info.Key, v.entryAddress(info, entries, index, entryKeyField), ""))
+			v.emitRelease(b.CreateLoad(info.Value, v.entryAddress(info, entries, index, entryValueField), ""))
+		})
+	}
+
+	v.emitFree(b.CreateBitCast(entries, types.NewPointer(types.I8), ""))
+	b.CreateRetVoid()
+}
+
+// forEachEntry emits a loop calling body with the index of each used entry
+func (v *IRVisitor) forEachEntry(info *mapInfo, entries, capacity ir.Value, body func(index ir.Value)) {
+	b := v.ctx.Builder
+	indexPtr := b.CreateAlloca(types.U64, "i")
+	b.CreateStore(b.ConstInt(types.U64, 0), indexPtr)
+
+	loopBlock := b.CreateBlock("entries.loop")
+	checkBlock := b.CreateBlock("entries.check")
+	bodyBlock := b.CreateBlock("entries.body")
+	nextBlock := b.CreateBlock("entries.next")
+	doneBlock := b.CreateBlock("entries.done")
+	b.CreateBr(loopBlock)
+
+	v.ctx.SetInsertBlock(loopBlock)
+	index := b.CreateLoad(types.U64, indexPtr, "")
+	b.CreateCondBr(b.CreateICmpULT(index, capacity, ""), checkBlock, doneBlock)
+
+	v.ctx.SetInsertBlock(checkBlock)
+	b.CreateCondBr(v.entryUsed(info, entries, index), bodyBlock, nextBlock)
+
+	v.ctx.SetInsertBlock(bodyBlock)
+	body(index)
+	b.CreateBr(nextBlock)
+
+	v.ctx.SetInsertBlock(nextBlock)
+	b.CreateStore(b.CreateAdd(index, b.ConstInt(types.U64, 1), ""), indexPtr)
+	b.CreateBr(loopBlock)
+
+	v.ctx.SetInsertBlock(doneBlock)
+}
+
+// visitMapLiteral builds a map from '{k1: v1, k2: v2}'. Key and value types
+// come from the declared type when there is one, otherwise from the first
+// entry.
+func (v *IRVisitor) visitMapLiteral(ctx *parser.CollectionLiteralContext, hint types.Type) ir.Value {
+	entries := ctx.AllMapEntry()
+	keys := make([]ir.Value, len(entries))
+	values := make([]ir.Value, len(entries))
+	for i, entry := range entries {
+		keys[i] = v.Visit(entry.Expression(0)).(ir.Value)
+		values[i] = v.Visit(entry.Expression(1)).(ir.Value)
+	}
+
+	var info *mapInfo
+	if hint != nil {
+		var isMap bool
+		if info, isMap = v.ctx.MapInfo(hint); !isMap {
+			v.ctx.Logger.Error("Map literal cannot initialize a value of type %v", hint)
+			return v.getZeroValue(hint)
+		}
+	} else {
+		mapPtr := v.mapType(keys[0].Type(), values[0].Type())
+		if info, _ = v.ctx.MapInfo(mapPtr); info == nil {
+			return v.ctx.Builder.ConstInt(types.I64, 0)
+		}
+	}
+
+	m := v.allocClassInstance(info.Type)
+	for i := range entries {
+		key := v.coerceTo(keys[i], info.Key)
+		slot := v.ctx.Builder.CreateCall(info.slot, []ir.Value{m, key}, "")
+		v.storeOwned(v.coerceTo(values[i], info.Value), slot, info.Value)
+		v.releaseTemporary(key)
+	}
+
+	v.markOwned(m)
+	return m
+}
+
+// mapValueAddress returns where m[key] is stored, adding the key if needed
+func (v *IRVisitor) mapValueAddress(info *mapInfo, m, key ir.Value) ir.Value {
+	return v.ctx.Builder.CreateCall(info.slot, []ir.Value{m, v.coerceTo(key, info.Key)}, "")
+}
+
+// mapLookup reads m[key], the zero value when the key is missing
+func (v *IRVisitor) mapLookup(info *mapInfo, m, key ir.Value) ir.Value {
+	result := v.ctx.Builder.CreateCall(info.get, []ir.Value{m, v.coerceTo(key, info.Key)}, "")
+	v.markOwned(result)
+	return result
+}
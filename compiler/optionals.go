@@ -0,0 +1,58 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-builder/types"
+	"github.com/arc-language/core-parser"
+)
+
+// An optional (?T) is a {i1 present, T value} pair. A T converts to ?T
+// implicitly and 'null' converts to the empty optional. Optionals do not
+// hold a reference of their own to class values.
+
+const (
+	optionalPresentField = iota
+	optionalValueField
+)
+
+// OptionalType returns the struct representing ?elem, creating it once
+func (c *Context) OptionalType(elem types.Type) *types.StructType {
+	key := fmt.Sprint(elem)
+	if optType, ok := c.optionalTypes[key]; ok {
+		return optType
+	}
+
+	name := fmt.Sprintf("__optional.%d", len(c.optionalTypes))
+	optType := types.NewStruct(name, []types.Type{types.I1, elem}, false)
+	c.optionalTypes[key] = optType
+	c.optionalElems[optType] = elem
+	c.Logger.Debug("Registered optional type %s for ?%v", name, elem)
+	return optType
+}
+
+// OptionalElem returns the wrapped type when typ is an optional
+func (c *Context) OptionalElem(typ types.Type) (types.Type, bool) {
+	structType, ok := typ.(*types.StructType)
+	if !ok {
+		return nil, false
+	}
+	elem, ok := c.optionalElems[structType]
+	return elem, ok
+}
+
+func (v *IRVisitor) resolveOptionalType(ctx parser.IOptionalTypeContext) types.Type {
+	return v.ctx.OptionalType(v.resolveType(ctx.Type_()))
+}
+
+// wrapOptional converts val to the optional type optType: 'null' becomes the
+// empty optional, a value of the wrapped type a present one
+func (v *IRVisitor) wrapOptional(val ir.Value, optType *types.StructType, elem types.Type) ir.Value {
+	if _, isNull := val.(*ir.ConstantNull); isNull {
+		return v.ctx.Builder.ConstZero(optType)
+	}
+	var agg ir.Value = v.ctx.Builder.ConstZero(optType)
+	agg = v.ctx.Builder.CreateInsertValue(agg, v.ctx.Builder.True(), []int{optionalPresentField}, "")
+	return v.ctx.Builder.CreateInsertValue(agg, v.coerceTo(val, elem), []int{optionalValueField}, "")
+}
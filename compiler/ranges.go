@@ -0,0 +1,350 @@
+package compiler
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/antlr4-go/antlr/v4"
+	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-builder/types"
+	"github.com/arc-language/core-parser"
+)
+
+// A range is a value like any other: 'a..b' excludes b, 'a..=b' includes it,
+// and '(a..b).step(k)' walks by k. A negative step walks downwards from a
+// towards b, so '(10..0).step(-2)' yields 10, 8, 6, 4, 2. The step must be
+// neither zero nor i64.min, whose magnitude does not fit in i64. Ranges of any
+// integer type are represented as
+//
+//	{ T start, T end, i64 step, i1 inclusive }
+//
+// Bounds compare with the signedness of T, and iteration stops before a step
+// would pass the end, so '0..=255' over u8 terminates.
+
+const (
+	rangeStartField = iota
+	rangeEndField
+	rangeStepField
+	rangeInclusiveField
+)
+
+// rangeParts remembers the operands of a range expression, so uses that need
+// constant bounds (such as slicing an array) can still see them
+type rangeParts struct {
+	start, end ir.Value
+	inclusive  bool
+}
+
+// RangeElem returns the bound type when typ is a range
+func (c *Context) RangeElem(typ types.Type) (types.Type, bool) {
+	structType, ok := typ.(*types.StructType)
+	if !ok {
+		return nil, false
+	}
+	elem, ok := c.rangeElems[structType]
+	return elem, ok
+}
+
+// rangeType returns range<elem>, emitting its methods the first time the
+// bound type is seen
+func (v *IRVisitor) rangeType(elem types.Type) *types.StructType {
+	key := fmt.Sprint(elem)
+	if rangeType, ok := v.ctx.rangeTypes[key]; ok {
+		return rangeType
+	}
+
+	name := fmt.Sprintf("__range.%d", len(v.ctx.rangeTypes))
+	rangeType := types.NewStruct(name, []types.Type{elem, elem, types.I64, types.I1}, false)
+	v.ctx.Module.Types[name] = rangeType
+	v.ctx.rangeTypes[key] = rangeType
+	v.ctx.rangeElems[rangeType] = elem
+	v.logger.Debug("Registered %s for range<%v>", name, elem)
+
+	state := v.ctx.SuspendFunction()
+	v.emitRangeStep(rangeType, elem)
+	v.emitRangeContains(rangeType, elem)
+	v.ctx.ResumeFunction(state)
+
+	return rangeType
+}
+
+func (v *IRVisitor) resolveRangeType(ctx parser.IRangeTypeContext) types.Type {
+	elem := v.resolveType(ctx.Type_())
+	if !types.IsInteger(elem) {
+		v.ctx.Logger.Error("Range bounds must be integers, got %v", elem)
+		return types.I64
+	}
+	return v.rangeType(elem)
+}
+
+func (v *IRVisitor) VisitRangeExpression(ctx *parser.RangeExpressionContext) interface{} {
+	if ctx.RANGE() == nil && ctx.RANGE_INCLUSIVE() == nil {
+		return v.Visit(ctx.AdditiveExpression(0))
+	}
+
+	start := v.Visit(ctx.AdditiveExpression(0)).(ir.Value)
+	end := v.Visit(ctx.AdditiveExpression(1)).(ir.Value)
+	elem, ok := v.rangeElemType(start, end)
+	if !ok {
+		return start
+	}
+
+	start = v.castValue(start, elem)
+	end = v.castValue(end, elem)
+	inclusive := ctx.RANGE_INCLUSIVE() != nil
+	rng := v.makeRange(v.rangeType(elem), start, end, v.ctx.Builder.ConstInt(types.I64, 1), v.ctx.Builder.ConstInt(types.I1, boolToInt(inclusive)))
+	v.rangeLiterals[rng] = rangeParts{start: start, end: end, inclusive: inclusive}
+	return rng
+}
+
+// rangeElemType picks the type of a range from its bounds. An untyped
+// literal takes the type of the other bound, so '0..n' has the type of n;
+// otherwise the bounds must agree in signedness and the wider type wins.
+func (v *IRVisitor) rangeElemType(start, end ir.Value) (types.Type, bool) {
+	startType, startIsInt := start.Type().(*types.IntType)
+	endType, endIsInt := end.Type().(*types.IntType)
+	if !startIsInt || !endIsInt {
+		v.ctx.Logger.Error("Range bounds must be integers, got %v and %v", start.Type(), end.Type())
+		return nil, false
+	}
+
+	_, startIsConst := v.constIntValue(start)
+	_, endIsConst := v.constIntValue(end)
+	switch {
+	case startType.Equal(endType):
+		return startType, true
+	case startIsConst && !endIsConst:
+		return endType, true
+	case endIsConst && !startIsConst:
+		return startType, true
+	case startType.Signed != endType.Signed:
+		v.ctx.Logger.Error("Mismatched range bounds %s and %s; convert one with cast<>", v.typeName(startType), v.typeName(endType))
+		return nil, false
+	case startType.BitWidth > endType.BitWidth:
+		return startType, true
+	}
+	return endType, true
+}
+
+func boolToInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (v *IRVisitor) makeRange(rangeType *types.StructType, start, end, step, inclusive ir.Value) ir.Value {
+	var agg ir.Value = v.ctx.Builder.ConstZero(rangeType)
+	agg = v.ctx.Builder.CreateInsertValue(agg, start, []int{rangeStartField}, "")
+	agg = v.ctx.Builder.CreateInsertValue(agg, end, []int{rangeEndField}, "")
+	agg = v.ctx.Builder.CreateInsertValue(agg, step, []int{rangeStepField}, "")
+	return v.ctx.Builder.CreateInsertValue(agg, inclusive, []int{rangeInclusiveField}, "")
+}
+
+// compareLess emits x < y (or x <= y) with the signedness of their type
+func (v *IRVisitor) compareLess(x, y ir.Value, orEqual bool) ir.Value {
+	signed := true
+	if intType, ok := x.Type().(*types.IntType); ok {
+		signed = intType.Signed
+	}
+	switch {
+	case signed && orEqual:
+		return v.ctx.Builder.CreateICmpSLE(x, y, "")
+	case signed:
+		return v.ctx.Builder.CreateICmpSLT(x, y, "")
+	case orEqual:
+		return v.ctx.Builder.CreateICmpULE(x, y, "")
+	}
+	return v.ctx.Builder.CreateICmpULT(x, y, "")
+}
+
+// toU64 zero-extends a non-negative difference to u64
+func (v *IRVisitor) toU64(x ir.Value) ir.Value {
+	if intType, ok := x.Type().(*types.IntType); ok && intType.BitWidth < 64 {
+		return v.ctx.Builder.CreateZExt(x, types.U64, "")
+	}
+	return v.castValue(x, types.U64)
+}
+
+// rangeShape unpacks a range into its bounds, direction and stride
+type rangeShape struct {
+	start, end, inclusive ir.Value
+	descending            ir.Value
+	stride                ir.Value // |step| as u64
+}
+
+func (v *IRVisitor) unpackRange(rng ir.Value) rangeShape {
+	b := v.ctx.Builder
+	step := b.CreateExtractValue(rng, []int{rangeStepField}, "")
+	descending := b.CreateICmpSLT(step, b.ConstInt(types.I64, 0), "")
+	negated := b.CreateSub(b.ConstInt(types.I64, 0), step, "")
+	return rangeShape{
+		start:      b.CreateExtractValue(rng, []int{rangeStartField}, ""),
+		end:        b.CreateExtractValue(rng, []int{rangeEndField}, ""),
+		inclusive:  b.CreateExtractValue(rng, []int{rangeInclusiveField}, ""),
+		descending: descending,
+		stride:     v.castValue(b.CreateSelect(descending, negated, step, ""), types.U64),
+	}
+}
+
+// before reports whether x lies strictly before y in the range's direction
+func (v *IRVisitor) before(shape rangeShape, x, y ir.Value, orEqual bool) ir.Value {
+	up := v.compareLess(x, y, orEqual)
+	down := v.compareLess(y, x, orEqual)
+	return v.ctx.Builder.CreateSelect(shape.descending, down, up, "")
+}
+
+// distance is how far y lies beyond x in the range's direction, as u64
+func (v *IRVisitor) distance(shape rangeShape, x, y ir.Value) ir.Value {
+	up := v.ctx.Builder.CreateSub(y, x, "")
+	down := v.ctx.Builder.CreateSub(x, y, "")
+	return v.toU64(v.ctx.Builder.CreateSelect(shape.descending, down, up, ""))
+}
+
+// inBounds reports whether x has not passed the end of the range
+func (v *IRVisitor) inBounds(shape rangeShape, x ir.Value) ir.Value {
+	exclusive := v.before(shape, x, shape.end, false)
+	inclusive := v.before(shape, x, shape.end, true)
+	return v.ctx.Builder.CreateSelect(shape.inclusive, inclusive, exclusive, "")
+}
+
+// emitRangeStep defines step(self, k) range<T>, the same bounds walked by k
+func (v *IRVisitor) emitRangeStep(rangeType *types.StructType, elem types.Type) {
+	b := v.ctx.Builder
+	fn := b.CreateFunction(rangeType.Name+"_step", rangeType, []types.Type{rangeType, types.I64}, false)
+	fn.Arguments[0].SetName("self")
+	fn.Arguments[1].SetName("k")
+	v.ctx.RegisterMethod(rangeType.Name, "step", fn)
+
+	entry := b.CreateBlock("entry")
+	zeroBlock := b.CreateBlock("zero")
+	checkMinBlock := b.CreateBlock("check.min")
+	minBlock := b.CreateBlock("min")
+	okBlock := b.CreateBlock("ok")
+
+	v.ctx.SetInsertBlock(entry)
+	isZero := b.CreateICmpEQ(fn.Arguments[1], b.ConstInt(types.I64, 0), "")
+	b.CreateCondBr(isZero, zeroBlock, checkMinBlock)
+
+	v.ctx.SetInsertBlock(zeroBlock)
+	v.emitTrap("arc: range step must not be zero\n")
+
+	v.ctx.SetInsertBlock(checkMinBlock)
+	isMin := b.CreateICmpEQ(fn.Arguments[1], b.ConstInt(types.I64, math.MinInt64), "")
+	b.CreateCondBr(isMin, minBlock, okBlock)
+
+	v.ctx.SetInsertBlock(minBlock)
+	v.emitTrap("arc: range step must not be i64.min\n")
+
+	v.ctx.SetInsertBlock(okBlock)
+	b.CreateRet(b.CreateInsertValue(fn.Arguments[0], fn.Arguments[1], []int{rangeStepField}, ""))
+}
+
+// checkRangeStep rejects a constant step the step method would trap on
+func (v *IRVisitor) checkRangeStep(fn *ir.Function, args []ir.Value) {
+	if len(fn.Arguments) != 2 || len(args) != 2 {
+		return
+	}
+	rangeType, ok := fn.Arguments[0].Type().(*types.StructType)
+	if !ok || fn.Name() != rangeType.Name+"_step" {
+		return
+	}
+	if _, isRange := v.ctx.RangeElem(rangeType); !isRange {
+		return
+	}
+	k, isConst := v.constIntValue(args[1])
+	if !isConst {
+		return
+	}
+	switch k {
+	case 0:
+		v.ctx.Logger.Error("Range step must not be zero")
+	case math.MinInt64:
+		v.ctx.Logger.Error("Range step must not be i64.min; its magnitude does not fit in i64")
+	}
+}
+
+// emitRangeContains defines contains(self, x) bool: x lies within the
+// bounds and is reached by whole steps from the start
+func (v *IRVisitor) emitRangeContains(rangeType *types.StructType, elem types.Type) {
+	b := v.ctx.Builder
+	fn := b.CreateFunction(rangeType.Name+"_contains", types.I1, []types.Type{rangeType, elem}, false)
+	fn.Arguments[0].SetName("self")
+	fn.Arguments[1].SetName("x")
+	v.ctx.RegisterMethod(rangeType.Name, "contains", fn)
+	v.ctx.SetInsertBlock(b.CreateBlock("entry"))
+
+	shape := v.unpackRange(fn.Arguments[0])
+	x := fn.Arguments[1]
+	notBefore := b.CreateXor(v.before(shape, x, shape.start, false), b.True(), "")
+	within := b.CreateAnd(notBefore, v.inBounds(shape, x), "")
+	offset := v.distance(shape, shape.start, x)
+	onStep := b.CreateICmpEQ(b.CreateURem(offset, shape.stride, ""), b.ConstInt(types.U64, 0), "")
+	b.CreateRet(b.CreateAnd(within, onStep, ""))
+}
+
+// rangeSource walks a range. The loop stops once the next step would pass
+// the end, testing the remaining distance rather than the incremented value
+// so it never overflows.
+func (v *IRVisitor) rangeSource(rng ir.Value) *forInSource {
+	b := v.ctx.Builder
+	elem, _ := v.ctx.RangeElem(rng.Type())
+	shape := v.unpackRange(rng)
+
+	current := b.CreateAlloca(elem, "range.cur")
+	b.CreateStore(shape.start, current)
+	done := b.CreateAlloca(types.I1, "range.done")
+	b.CreateStore(b.CreateXor(v.inBounds(shape, shape.start), b.True(), ""), done)
+	index, advance := v.counter("range.idx")
+
+	return &forInSource{
+		keyType:   types.U64,
+		valueType: elem,
+		next: func() ir.Value {
+			return b.CreateXor(b.CreateLoad(types.I1, done, ""), b.True(), "")
+		},
+		key:   func() ir.Value { return b.CreateLoad(types.U64, index, "") },
+		value: func() ir.Value { return b.CreateLoad(elem, current, "") },
+		step: func() {
+			cur := b.CreateLoad(elem, current, "")
+			remaining := v.distance(shape, cur, shape.end)
+			beyond := b.CreateICmpUGT(remaining, shape.stride, "")
+			reaches := b.CreateICmpUGE(remaining, shape.stride, "")
+			more := b.CreateSelect(shape.inclusive, reaches, beyond, "")
+
+			stride := v.castValue(shape.stride, elem)
+			up := b.CreateAdd(cur, stride, "")
+			down := b.CreateSub(cur, stride, "")
+			b.CreateStore(b.CreateSelect(shape.descending, down, up, ""), current)
+			b.CreateStore(b.CreateXor(more, b.True(), ""), done)
+			advance()
+		},
+	}
+}
+
+// sliceBounds returns the half-open [lo, hi) bounds, as u64, of a range used
+// to slice. Range expressions keep their operands, so constant bounds stay
+// constant; other ranges must have a step of 1.
+func (v *IRVisitor) sliceBounds(rng ir.Value, at antlr.ParserRuleContext) (ir.Value, ir.Value) {
+	b := v.ctx.Builder
+	if parts, ok := v.rangeLiterals[rng]; ok {
+		lo := v.castValue(parts.start, types.U64)
+		hi := v.castValue(parts.end, types.U64)
+		if parts.inclusive {
+			if c, isConst := v.constIntValue(hi); isConst {
+				hi = b.ConstInt(types.U64, c+1)
+			} else {
+				hi = b.CreateAdd(hi, b.ConstInt(types.U64, 1), "")
+			}
+		}
+		return lo, hi
+	}
+
+	step := b.CreateExtractValue(rng, []int{rangeStepField}, "")
+	v.emitCheck(b.CreateICmpEQ(step, b.ConstInt(types.I64, 1), ""), "slice range must have step 1", at)
+	lo := v.castValue(b.CreateExtractValue(rng, []int{rangeStartField}, ""), types.U64)
+	end := v.castValue(b.CreateExtractValue(rng, []int{rangeEndField}, ""), types.U64)
+	inclusive := b.CreateExtractValue(rng, []int{rangeInclusiveField}, "")
+	hi := b.CreateSelect(inclusive, b.CreateAdd(end, b.ConstInt(types.U64, 1), ""), end, "")
+	return lo, hi
+}
@@ -0,0 +1,415 @@
+package compiler
+
+import (
+	"sort"
+
+	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-builder/types"
+)
+
+// Class instances live on the heap behind a hidden reference count stored
+// in field 0 of the class struct. Struct literals and calls produce owned
+// (+1) values; loads of variables are borrowed and get retained when bound.
+// Structs, tuples and arrays holding class references are managed the same
+// way, reference by reference, and so are strings, whose heap buffers are
+// counted as a hidden class (see strings.go). Owned temporaries nothing binds are released
+// at the end of the statement that made them.
+
+// classHeaderFields is the number of hidden fields preceding class fields
+const classHeaderFields = 1
+
+// liveObjectsName is the global counting live instances in leak-check mode
+const liveObjectsName = "__arc_live_objects"
+
+// destroyingCount replaces the count of an instance while its deinit runs,
+// so that retaining and releasing self there does nothing
+const destroyingCount = -1
+
+// maxUnrolledElements is the longest array whose references are retained
+// and released one by one rather than in a loop
+const maxUnrolledElements = 8
+
+// classOf returns the class struct when typ is a class reference
+func (v *IRVisitor) classOf(typ types.Type) (*types.StructType, bool) {
+	ptrType, ok := typ.(*types.PointerType)
+	if !ok {
+		return nil, false
+	}
+	structType, ok := ptrType.ElementType.(*types.StructType)
+	if !ok || !v.ctx.IsClassType(structType.Name) {
+		return nil, false
+	}
+	return structType, true
+}
+
+// isManaged reports whether values of typ hold references: class
+// references, closures, and structs, tuples and arrays containing them
+func (v *IRVisitor) isManaged(typ types.Type) bool {
+	switch t := typ.(type) {
+	case *types.PointerType:
+		_, isClass := v.classOf(t)
+		return isClass
+	case *types.StructType:
+		if _, isClosure := v.ctx.ClosureSignature(t); isClosure {
+			return true
+		}
+		for _, field := range t.Fields {
+			if v.isManaged(field) {
+				return true
+			}
+		}
+	case *types.ArrayType:
+		return v.isManaged(t.ElementType)
+	}
+	return false
+}
+
+// markOwned records that val carries a +1 reference the caller must consume
+func (v *IRVisitor) markOwned(val ir.Value) {
+	if _, owned := v.ownedTemps[val]; !owned && v.isManaged(val.Type()) {
+		v.ownedSeq++
+		v.ownedTemps[val] = v.ownedSeq
+	}
+}
+
+// takeOwnership prepares val to be stored somewhere that owns a reference:
+// owned temporaries are consumed as-is, borrowed values are retained
+func (v *IRVisitor) takeOwnership(val ir.Value) {
+	// Constants hold no references, only nulls
+	if _, isConst := val.(ir.Constant); isConst || !v.isManaged(val.Type()) {
+		return
+	}
+	if _, owned := v.ownedTemps[val]; owned {
+		delete(v.ownedTemps, val)
+		return
+	}
+	v.emitRetain(val)
+}
+
+// holdTemporary records that val carries a +1 reference kept until the end
+// of the statement, such as the string behind a C string
+func (v *IRVisitor) holdTemporary(val ir.Value) {
+	v.markOwned(val)
+	v.heldTemps[val] = true
+}
+
+// releaseTemporary drops an owned temporary that was not bound to anything
+func (v *IRVisitor) releaseTemporary(val ir.Value) {
+	if _, owned := v.ownedTemps[val]; val == nil || !owned || v.heldTemps[val] {
+		return
+	}
+	delete(v.ownedTemps, val)
+	v.emitRelease(val)
+}
+
+// pendingTemporaries returns the owned temporaries not yet bound, oldest
+// first
+func (v *IRVisitor) pendingTemporaries() []ir.Value {
+	pending := make([]ir.Value, 0, len(v.ownedTemps))
+	for val := range v.ownedTemps {
+		pending = append(pending, val)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return v.ownedTemps[pending[i]] < v.ownedTemps[pending[j]]
+	})
+	return pending
+}
+
+// releaseTemporaries ends a full expression: the owned temporaries it left
+// unbound, such as the object in 'make_buffer(1).size', are released. After
+// a return there is nothing left to release.
+func (v *IRVisitor) releaseTemporaries() {
+	terminated := v.ctx.Builder.GetInsertBlock() != nil && v.ctx.Builder.GetInsertBlock().Terminator() != nil
+	for _, val := range v.pendingTemporaries() {
+		if !terminated {
+			v.emitRelease(val)
+		}
+		delete(v.ownedTemps, val)
+		delete(v.heldTemps, val)
+	}
+}
+
+// releasePending releases the unbound temporaries on an early exit from the
+// middle of a statement. They stay owned on the path that carries on.
+func (v *IRVisitor) releasePending() {
+	for _, val := range v.pendingTemporaries() {
+		v.emitRelease(val)
+	}
+}
+
+// withTemporaries compiles code whose temporaries and unhandled errors are
+// its own, such as a deferred expression emitted while another statement is
+// half done, and ends it like a statement
+func (v *IRVisitor) withTemporaries(emit func()) {
+	outerTemps, outerSeq, outerErrors := v.ownedTemps, v.ownedSeq, v.errorResults
+	v.ownedTemps = make(map[ir.Value]int)
+	v.errorResults = make(map[ir.Value]string)
+	emit()
+	v.reportIgnoredErrors()
+	v.releaseTemporaries()
+	v.ownedTemps, v.ownedSeq, v.errorResults = outerTemps, outerSeq, outerErrors
+}
+
+func (v *IRVisitor) emitRetain(val ir.Value) {
+	v.forEachReference(val, func(ref ir.Value) {
+		classType, _ := v.classOf(ref.Type())
+		v.ctx.Builder.CreateCallByName("__arc_retain_"+classType.Name, types.Void, []ir.Value{ref}, "")
+	})
+}
+
+func (v *IRVisitor) emitRelease(val ir.Value) {
+	v.forEachReference(val, func(ref ir.Value) {
+		classType, _ := v.classOf(ref.Type())
+		v.ctx.Builder.CreateCallByName("__arc_release_"+classType.Name, types.Void, []ir.Value{ref}, "")
+	})
+}
+
+// forEachReference calls emit with each class reference val holds,
+// environments of closures included
+func (v *IRVisitor) forEachReference(val ir.Value, emit func(ref ir.Value)) {
+	// String literals have no buffer to count
+	if _, isLiteral := v.stringLiterals[val]; isLiteral {
+		return
+	}
+	b := v.ctx.Builder
+	switch t := val.Type().(type) {
+	case *types.PointerType:
+		if _, isClass := v.classOf(t); isClass {
+			emit(val)
+		}
+	case *types.StructType:
+		// A closure holds a reference to its environment
+		if _, isClosure := v.ctx.ClosureSignature(t); isClosure {
+			env := b.CreateExtractValue(val, []int{1}, "")
+			emit(b.CreateBitCast(env, types.NewPointer(v.ctx.ClosureEnvType), ""))
+			return
+		}
+		for i, field := range t.Fields {
+			if v.isManaged(field) {
+				v.forEachReference(b.CreateExtractValue(val, []int{i}, ""), emit)
+			}
+		}
+	case *types.ArrayType:
+		if !v.isManaged(t.ElementType) {
+			return
+		}
+		if t.Length <= maxUnrolledElements {
+			for i := 0; i < int(t.Length); i++ {
+				v.forEachReference(b.CreateExtractValue(val, []int{i}, ""), emit)
+			}
+			return
+		}
+
+		// Longer arrays are walked in memory
+		addr := b.CreateAlloca(t, "refs")
+		b.CreateStore(val, addr)
+		indexPtr := b.CreateAlloca(types.U64, "i")
+		b.CreateStore(b.ConstInt(types.U64, 0), indexPtr)
+
+		condBlock := b.CreateBlock("refs.cond")
+		bodyBlock := b.CreateBlock("refs.body")
+		doneBlock := b.CreateBlock("refs.done")
+		b.CreateBr(condBlock)
+
+		v.ctx.SetInsertBlock(condBlock)
+		index := b.CreateLoad(types.U64, indexPtr, "")
+		b.CreateCondBr(b.CreateICmpULT(index, b.ConstInt(types.U64, t.Length), ""), bodyBlock, doneBlock)
+
+		v.ctx.SetInsertBlock(bodyBlock)
+		elemAddr := b.CreateInBoundsGEP(t, addr, []ir.Value{b.ConstInt(types.I64, 0), index}, "")
+		v.forEachReference(b.CreateLoad(t.ElementType, elemAddr, ""), emit)
+		b.CreateStore(b.CreateAdd(index, b.ConstInt(types.U64, 1), ""), indexPtr)
+		b.CreateBr(condBlock)
+
+		v.ctx.SetInsertBlock(doneBlock)
+	}
+}
+
+// releaseOnExit releases the references held by a variable when its scope
+// ends
+func (v *IRVisitor) releaseOnExit(slot *ir.AllocaInst) {
+	if !v.isManaged(slot.AllocatedType) {
+		return
+	}
+	v.ctx.AddCleanup(func() {
+		current := v.ctx.Builder.CreateLoad(slot.AllocatedType, slot, "")
+		v.emitRelease(current)
+	})
+}
+
+// allocClassInstance heap-allocates a zeroed class instance with a
+// reference count of one
+func (v *IRVisitor) allocClassInstance(classType *types.StructType) ir.Value {
+	size := v.ctx.Builder.ConstInt(types.U64, int64(v.calculateSizeOf(classType)))
+	raw := v.emitMalloc(size)
+	obj := v.ctx.Builder.CreateBitCast(raw, types.NewPointer(classType), classType.Name+".instance")
+
+	rc := v.ctx.Builder.CreateStructGEP(classType, obj, 0, "")
+	v.ctx.Builder.CreateStore(v.ctx.Builder.ConstInt(types.I64, 1), rc)
+	for i := classHeaderFields; i < len(classType.Fields); i++ {
+		gep := v.ctx.Builder.CreateStructGEP(classType, obj, i, "")
+		v.ctx.Builder.CreateStore(v.getZeroValue(classType.Fields[i]), gep)
+	}
+
+	if v.ctx.DebugLeaks {
+		v.adjustLiveObjects(1)
+	}
+
+	return obj
+}
+
+func (v *IRVisitor) adjustLiveObjects(delta int64) {
+	live := v.liveObjectsGlobal()
+	count := v.ctx.Builder.CreateLoad(types.I64, live, "")
+	count = v.ctx.Builder.CreateAdd(count, v.ctx.Builder.ConstInt(types.I64, delta), "")
+	v.ctx.Builder.CreateStore(count, live)
+}
+
+func (v *IRVisitor) liveObjectsGlobal() *ir.Global {
+	if g := v.ctx.Module.GetGlobal(liveObjectsName); g != nil {
+		return g
+	}
+	return v.ctx.Builder.CreateGlobalVariable(liveObjectsName, types.I64, v.ctx.Builder.ConstInt(types.I64, 0))
+}
+
+// emitRuntimeSupport defines the retain/release helpers for every class,
+// the report called when main returns in leak-check mode, the allocator of
+// freestanding builds and the module init function. It runs once, after all
+// packages have been compiled, so out-of-line deinits are known.
+func (v *IRVisitor) emitRuntimeSupport() {
+	names := make([]string, 0, len(v.ctx.classTypes))
+	for name := range v.ctx.classTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		typ, _ := v.ctx.GetType(name)
+		classType := typ.(*types.StructType)
+		v.emitRetainFunction(classType)
+		v.emitReleaseFunction(classType)
+	}
+
+	if v.ctx.DebugLeaks {
+		v.emitLeakReport()
+	}
+
+	if v.ctx.Freestanding {
+		v.emitFreestandingAllocator()
+	}
+
+	v.emitModuleInit()
+	v.alignStorage()
+}
+
+func (v *IRVisitor) emitRetainFunction(classType *types.StructType) {
+	ptrType := types.NewPointer(classType)
+	fn := v.ctx.Builder.CreateFunction("__arc_retain_"+classType.Name, types.Void, []types.Type{ptrType}, false)
+	fn.Arguments[0].SetName("obj")
+	obj := fn.Arguments[0]
+
+	entry := v.ctx.Builder.CreateBlock("entry")
+	checkBlock := v.ctx.Builder.CreateBlock("check")
+	incBlock := v.ctx.Builder.CreateBlock("inc")
+	doneBlock := v.ctx.Builder.CreateBlock("done")
+
+	v.ctx.SetInsertBlock(entry)
+	isNull := v.ctx.Builder.CreateICmpEQ(obj, v.ctx.Builder.ConstNull(ptrType), "")
+	v.ctx.Builder.CreateCondBr(isNull, doneBlock, checkBlock)
+
+	v.ctx.SetInsertBlock(checkBlock)
+	rc := v.ctx.Builder.CreateStructGEP(classType, obj, 0, "")
+	count := v.ctx.Builder.CreateLoad(types.I64, rc, "")
+	destroying := v.ctx.Builder.CreateICmpEQ(count, v.ctx.Builder.ConstInt(types.I64, destroyingCount), "")
+	v.ctx.Builder.CreateCondBr(destroying, doneBlock, incBlock)
+
+	v.ctx.SetInsertBlock(incBlock)
+	count = v.ctx.Builder.CreateAdd(count, v.ctx.Builder.ConstInt(types.I64, 1), "")
+	v.ctx.Builder.CreateStore(count, rc)
+	v.ctx.Builder.CreateBr(doneBlock)
+
+	v.ctx.SetInsertBlock(doneBlock)
+	v.ctx.Builder.CreateRetVoid()
+}
+
+func (v *IRVisitor) emitReleaseFunction(classType *types.StructType) {
+	ptrType := types.NewPointer(classType)
+	fn := v.ctx.Builder.CreateFunction("__arc_release_"+classType.Name, types.Void, []types.Type{ptrType}, false)
+	fn.Arguments[0].SetName("obj")
+	obj := fn.Arguments[0]
+
+	entry := v.ctx.Builder.CreateBlock("entry")
+	checkBlock := v.ctx.Builder.CreateBlock("check")
+	decBlock := v.ctx.Builder.CreateBlock("dec")
+	destroyBlock := v.ctx.Builder.CreateBlock("destroy")
+	doneBlock := v.ctx.Builder.CreateBlock("done")
+
+	v.ctx.SetInsertBlock(entry)
+	isNull := v.ctx.Builder.CreateICmpEQ(obj, v.ctx.Builder.ConstNull(ptrType), "")
+	v.ctx.Builder.CreateCondBr(isNull, doneBlock, checkBlock)
+
+	v.ctx.SetInsertBlock(checkBlock)
+	rc := v.ctx.Builder.CreateStructGEP(classType, obj, 0, "")
+	count := v.ctx.Builder.CreateLoad(types.I64, rc, "")
+	destroying := v.ctx.Builder.CreateICmpEQ(count, v.ctx.Builder.ConstInt(types.I64, destroyingCount), "")
+	v.ctx.Builder.CreateCondBr(destroying, doneBlock, decBlock)
+
+	v.ctx.SetInsertBlock(decBlock)
+	count = v.ctx.Builder.CreateSub(count, v.ctx.Builder.ConstInt(types.I64, 1), "")
+	v.ctx.Builder.CreateStore(count, rc)
+	isZero := v.ctx.Builder.CreateICmpEQ(count, v.ctx.Builder.ConstInt(types.I64, 0), "")
+	v.ctx.Builder.CreateCondBr(isZero, destroyBlock, doneBlock)
+
+	// Count reached zero: run deinit, drop owned fields, free the memory.
+	// The instance is marked as being destroyed first, so deinit can pass
+	// self around without bringing the count back to zero.
+	v.ctx.SetInsertBlock(destroyBlock)
+	v.ctx.Builder.CreateStore(v.ctx.Builder.ConstInt(types.I64, destroyingCount), rc)
+	if deinit, ok := v.ctx.Deinits[classType.Name]; ok {
+		v.ctx.Builder.CreateCall(deinit, []ir.Value{obj}, "")
+	}
+	for i := classHeaderFields; i < len(classType.Fields); i++ {
+		if v.isManaged(classType.Fields[i]) {
+			gep := v.ctx.Builder.CreateStructGEP(classType, obj, i, "")
+			field := v.ctx.Builder.CreateLoad(classType.Fields[i], gep, "")
+			v.emitRelease(field)
+		}
+	}
+	if v.ctx.DebugLeaks {
+		v.adjustLiveObjects(-1)
+	}
+	raw := v.ctx.Builder.CreateBitCast(obj, types.NewPointer(types.I8), "")
+	v.emitFree(raw)
+	v.ctx.Builder.CreateBr(doneBlock)
+
+	v.ctx.SetInsertBlock(doneBlock)
+	v.ctx.Builder.CreateRetVoid()
+}
+
+// emitLeakReport writes a diagnostic to stderr if instances are still alive
+func (v *IRVisitor) emitLeakReport() {
+	v.ctx.Builder.CreateFunction("__arc_report_leaks", types.Void, []types.Type{}, false)
+
+	entry := v.ctx.Builder.CreateBlock("entry")
+	reportBlock := v.ctx.Builder.CreateBlock("report")
+	doneBlock := v.ctx.Builder.CreateBlock("done")
+
+	v.ctx.SetInsertBlock(entry)
+	live := v.ctx.Builder.CreateLoad(types.I64, v.liveObjectsGlobal(), "")
+	leaked := v.ctx.Builder.CreateICmpNE(live, v.ctx.Builder.ConstInt(types.I64, 0), "")
+	v.ctx.Builder.CreateCondBr(leaked, reportBlock, doneBlock)
+
+	v.ctx.SetInsertBlock(reportBlock)
+	msg := "arc: class instances leaked at exit\n"
+	msgPtr := v.ctx.Builder.CreatePtrToInt(v.createStringConstant(msg), types.I64, "")
+	v.ctx.Builder.CreateSyscall([]ir.Value{
+		v.ctx.Builder.ConstInt(types.I64, 1), // SYS_write
+		v.ctx.Builder.ConstInt(types.I64, 2), // stderr
+		msgPtr,
+		v.ctx.Builder.ConstInt(types.I64, int64(len(msg))),
+	})
+	v.ctx.Builder.CreateBr(doneBlock)
+
+	v.ctx.SetInsertBlock(doneBlock)
+	v.ctx.Builder.CreateRetVoid()
+}
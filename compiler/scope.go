@@ -2,6 +2,7 @@ package compiler
 
 import (
 	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-builder/types"
 )
 
 // Symbol represents a named value in the symbol table
@@ -10,12 +11,37 @@ type Symbol struct {
 	Value     ir.Value
 	IsConst   bool
 	Namespace string // Which namespace this symbol belongs to
+	
+	// Value is the address of storage holding an ElemType (captured
+	// variables, globals), loaded and stored like an alloca
+	IsAddress bool
+	ElemType  types.Type
+	
+	// Untyped constants remember the literal they were declared with: an
+	// intLiteral, rune or float64 adapts to its context, and string contents
+	// are rebuilt where used since a string value is not an IR constant
+	Literal interface{}
+}
+
+// Address returns the storage address and element type of a variable
+// symbol, whether it is a local alloca or another addressable location
+func (sym *Symbol) Address() (ir.Value, types.Type, bool) {
+	if alloca, ok := sym.Value.(*ir.AllocaInst); ok {
+		return alloca, alloca.AllocatedType, true
+	}
+	if sym.IsAddress {
+		return sym.Value, sym.ElemType, true
+	}
+	return nil, nil, false
 }
 
 // Scope represents a lexical scope with symbol table
 type Scope struct {
 	parent  *Scope
 	symbols map[string]*Symbol
+	
+	// Cleanup emitters run in reverse order whenever control leaves the scope
+	cleanups []func()
 }
 
 // NewScope creates a new scope
@@ -54,6 +80,16 @@ func (s *Scope) DefineInNamespace(name string, value ir.Value, namespace string)
 	}
 }
 
+// DefineAddress adds a variable whose storage lives at addr
+func (s *Scope) DefineAddress(name string, addr ir.Value, elemType types.Type) {
+	s.symbols[name] = &Symbol{
+		Name:      name,
+		Value:     addr,
+		IsAddress: true,
+		ElemType:  elemType,
+	}
+}
+
 // Lookup searches for a symbol in the current scope and parent scopes
 func (s *Scope) Lookup(name string) (*Symbol, bool) {
 	// Check current scope
@@ -79,4 +115,16 @@ func (s *Scope) LookupLocal(name string) (*Symbol, bool) {
 func (s *Scope) IsDefined(name string) bool {
 	_, ok := s.symbols[name]
 	return ok
+}
+
+// AddCleanup registers an emitter to run when control leaves this scope
+func (s *Scope) AddCleanup(fn func()) {
+	s.cleanups = append(s.cleanups, fn)
+}
+
+// EmitCleanups emits this scope's cleanups in LIFO order
+func (s *Scope) EmitCleanups() {
+	for i := len(s.cleanups) - 1; i >= 0; i-- {
+		s.cleanups[i]()
+	}
 }
\ No newline at end of file
@@ -0,0 +1,150 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/antlr4-go/antlr/v4"
+	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-builder/types"
+)
+
+// A slice ([]T) is a {ptr, len} pair viewing elements owned by something
+// else: an array, a buffer behind a pointer, or another slice. Indexing and
+// slicing are checked at runtime unless bounds checks are disabled.
+
+// SliceType returns the struct representing []elem, creating it once
+func (c *Context) SliceType(elem types.Type) *types.StructType {
+	key := fmt.Sprint(elem)
+	if sliceType, ok := c.sliceTypes[key]; ok {
+		return sliceType
+	}
+
+	name := fmt.Sprintf("__slice.%d", len(c.sliceTypes))
+	sliceType := types.NewStruct(name, []types.Type{types.NewPointer(elem), types.U64}, false)
+	c.sliceTypes[key] = sliceType
+	c.sliceElems[sliceType] = elem
+	c.Logger.Debug("Registered slice type %s for []%v", name, elem)
+	return sliceType
+}
+
+// SliceElem returns the element type when typ is a slice
+func (c *Context) SliceElem(typ types.Type) (types.Type, bool) {
+	structType, ok := typ.(*types.StructType)
+	if !ok {
+		return nil, false
+	}
+	elem, ok := c.sliceElems[structType]
+	return elem, ok
+}
+
+func (v *IRVisitor) makeSlice(ptr, length ir.Value, sliceType *types.StructType) ir.Value {
+	var agg ir.Value = v.ctx.Builder.ConstZero(sliceType)
+	agg = v.ctx.Builder.CreateInsertValue(agg, ptr, []int{0}, "")
+	return v.ctx.Builder.CreateInsertValue(agg, length, []int{1}, "")
+}
+
+// sliceValue evaluates base[rng]
+func (v *IRVisitor) sliceValue(base, baseAddr, rng ir.Value, at antlr.ParserRuleContext) ir.Value {
+	lo, hi := v.sliceBounds(rng, at)
+	if v.ctx.IsString(base.Type()) {
+		return v.substring(base, lo, hi, at)
+	}
+
+	var elemType types.Type
+	var ptr ir.Value
+	switch typ := base.Type().(type) {
+	case *types.ArrayType:
+		loConst, loIsConst := v.constIntValue(lo)
+		hiConst, hiIsConst := v.constIntValue(hi)
+		if loIsConst && hiIsConst && (loConst > hiConst || hiConst > typ.Length) {
+			v.ctx.Logger.Error("Slice [%d..%d] out of bounds for array of length %d", loConst, hiConst, typ.Length)
+		}
+		v.emitSliceCheck(lo, hi, v.ctx.Builder.ConstInt(types.U64, typ.Length), at)
+		if baseAddr == nil {
+			baseAddr = v.ctx.Builder.CreateAlloca(typ, "")
+			v.ctx.Builder.CreateStore(base, baseAddr)
+		}
+		elemType = typ.ElementType
+		zero := v.ctx.Builder.ConstInt(types.I64, 0)
+		ptr = v.ctx.Builder.CreateInBoundsGEP(typ, baseAddr, []ir.Value{zero, lo}, "")
+	case *types.PointerType:
+		elemType = typ.ElementType
+		ptr = v.ctx.Builder.CreateGEP(elemType, base, []ir.Value{lo}, "")
+	default:
+		elem, isSlice := v.ctx.SliceElem(base.Type())
+		if !isSlice {
+			v.ctx.Logger.Error("Cannot slice value of type %v", base.Type())
+			return base
+		}
+		elemType = elem
+		length := v.ctx.Builder.CreateExtractValue(base, []int{1}, "")
+		v.emitSliceCheck(lo, hi, length, at)
+		data := v.ctx.Builder.CreateExtractValue(base, []int{0}, "")
+		ptr = v.ctx.Builder.CreateGEP(elemType, data, []ir.Value{lo}, "")
+	}
+
+	length := v.ctx.Builder.CreateSub(hi, lo, "")
+	return v.makeSlice(ptr, length, v.ctx.SliceType(elemType))
+}
+
+// sliceElementAddress returns the address of slice[index] after checking
+// the index against the slice length
+func (v *IRVisitor) sliceElementAddress(slice ir.Value, elemType types.Type, index ir.Value, at antlr.ParserRuleContext) ir.Value {
+	length := v.ctx.Builder.CreateExtractValue(slice, []int{1}, "")
+	v.emitBoundsCheck(index, length, at)
+	data := v.ctx.Builder.CreateExtractValue(slice, []int{0}, "")
+	return v.ctx.Builder.CreateGEP(elemType, data, []ir.Value{v.castValue(index, types.I64)}, "")
+}
+
+// emitBoundsCheck traps unless 0 <= index < length. Treating the index as
+// unsigned catches negative indices with the same comparison.
+func (v *IRVisitor) emitBoundsCheck(index, length ir.Value, at antlr.ParserRuleContext) {
+	if !v.ctx.BoundsChecks {
+		return
+	}
+	idx := v.castValue(index, types.U64)
+	inBounds := v.ctx.Builder.CreateICmpULT(idx, v.castValue(length, types.U64), "")
+	v.emitCheck(inBounds, "index out of bounds", at)
+}
+
+// emitSliceCheck traps unless lo <= hi <= length
+func (v *IRVisitor) emitSliceCheck(lo, hi, length ir.Value, at antlr.ParserRuleContext) {
+	if !v.ctx.BoundsChecks {
+		return
+	}
+	ordered := v.ctx.Builder.CreateICmpULE(lo, hi, "")
+	inBounds := v.ctx.Builder.CreateICmpULE(hi, length, "")
+	v.emitCheck(v.ctx.Builder.CreateAnd(ordered, inBounds, ""), "slice bounds out of range", at)
+}
+
+// emitCheck continues when cond holds and otherwise reports what failed,
+// with its source location, and exits
+func (v *IRVisitor) emitCheck(cond ir.Value, what string, at antlr.ParserRuleContext) {
+	token := at.GetStart()
+	suffix := v.ctx.BlockSuffix()
+	failBlock := v.ctx.Builder.CreateBlock("check.fail." + suffix)
+	okBlock := v.ctx.Builder.CreateBlock("check.ok." + suffix)
+	v.ctx.Builder.CreateCondBr(cond, okBlock, failBlock)
+
+	v.ctx.SetInsertBlock(failBlock)
+	msg := fmt.Sprintf("%s:%d:%d: %s\n", v.currentFile, token.GetLine(), token.GetColumn()+1, what)
+	v.emitTrap(msg)
+
+	v.ctx.SetInsertBlock(okBlock)
+}
+
+// emitTrap writes msg to stderr and exits with status 134, as abort() would
+func (v *IRVisitor) emitTrap(msg string) {
+	msgPtr := v.ctx.Builder.CreatePtrToInt(v.createStringConstant(msg), types.I64, "")
+	v.ctx.Builder.CreateSyscall([]ir.Value{
+		v.ctx.Builder.ConstInt(types.I64, 1), // SYS_write
+		v.ctx.Builder.ConstInt(types.I64, 2), // stderr
+		msgPtr,
+		v.ctx.Builder.ConstInt(types.I64, int64(len(msg))),
+	})
+	v.ctx.Builder.CreateSyscall([]ir.Value{
+		v.ctx.Builder.ConstInt(types.I64, 231), // SYS_exit_group
+		v.ctx.Builder.ConstInt(types.I64, 134),
+	})
+	v.ctx.Builder.CreateUnreachable()
+}
@@ -0,0 +1,606 @@
+package compiler
+
+import (
+	"github.com/antlr4-go/antlr/v4"
+	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-builder/types"
+)
+
+// string is an immutable view of UTF-8 bytes:
+//
+//	{ *i8 data, u64 len, *__string_buffer owner }
+//
+// Strings compare by content, '+' concatenates into a new heap buffer, s[i]
+// reads a byte, s[a..b] takes a substring and s.char_at(n) decodes the n-th
+// char. Heap buffers are reference counted like class instances: owner
+// points at the count, which the bytes follow, and a substring shares the
+// owner of the string it came from. Literals and strings read from C have
+// no owner. Apart from the zero string, which has no buffer, the byte after
+// the last one is always readable: literals and concatenations end in a
+// NUL, and substrings end inside the string they came from. Converting to a
+// C string therefore copies only when that byte is not already a NUL, and
+// the C string lives until the end of the statement that made it, or to the
+// end of the scope when it initializes a local; storing it anywhere else is
+// an error. Extern
+// signatures see 'string' as a C string, and strings passed to C varargs
+// are converted the same way.
+
+const (
+	stringDataField = iota
+	stringLenField
+	stringOwnerField
+)
+
+// stringBufferHeader is the size of the count preceding the bytes of a heap
+// string buffer
+const stringBufferHeader = 8
+
+// stringFuncs holds the string runtime, emitted on first use
+type stringFuncs struct {
+	eq          *ir.Function
+	cmp         *ir.Function
+	concat      *ir.Function
+	cstr        *ir.Function
+	terminated  *ir.Function
+	fromCString *ir.Function
+	charAt      *ir.Function
+	hash        *ir.Function
+}
+
+// IsString reports whether typ is the string type
+func (c *Context) IsString(typ types.Type) bool {
+	structType, ok := typ.(*types.StructType)
+	return ok && structType == c.StringType
+}
+
+// makeString builds a string without an owner
+func (v *IRVisitor) makeString(data, length ir.Value) ir.Value {
+	var agg ir.Value = v.ctx.Builder.ConstZero(v.ctx.StringType)
+	agg = v.ctx.Builder.CreateInsertValue(agg, data, []int{stringDataField}, "")
+	return v.ctx.Builder.CreateInsertValue(agg, length, []int{stringLenField}, "")
+}
+
+// makeOwnedString builds a string whose bytes live in owner's buffer
+func (v *IRVisitor) makeOwnedString(data, length, owner ir.Value) ir.Value {
+	return v.ctx.Builder.CreateInsertValue(v.makeString(data, length), owner, []int{stringOwnerField}, "")
+}
+
+// allocStringBuffer heap-allocates a buffer for length bytes and the NUL
+// after them, with a reference count of one. The NUL is stored here, so
+// every buffer keeps the invariant whatever its caller writes. It returns
+// the owner and the address of the bytes.
+func (v *IRVisitor) allocStringBuffer(length ir.Value) (owner, data ir.Value) {
+	b := v.ctx.Builder
+	size := b.CreateAdd(length, b.ConstInt(types.U64, stringBufferHeader+1), "")
+	raw := v.emitMalloc(size)
+	owner = b.CreateBitCast(raw, types.NewPointer(v.ctx.StringBufferType), "")
+	b.CreateStore(b.ConstInt(types.I64, 1), b.CreateStructGEP(v.ctx.StringBufferType, owner, 0, ""))
+	if v.ctx.DebugLeaks {
+		v.adjustLiveObjects(1)
+	}
+	data = b.CreateGEP(types.I8, raw, []ir.Value{b.ConstInt(types.U64, stringBufferHeader)}, "")
+	b.CreateStore(b.ConstInt(types.I8, 0), b.CreateGEP(types.I8, data, []ir.Value{length}, ""))
+	return owner, data
+}
+
+// stringLiteral returns a string for content stored in a NUL-terminated global
+func (v *IRVisitor) stringLiteral(content string) ir.Value {
+	data := v.createStringConstant(content)
+	s := v.makeString(data, v.ctx.Builder.ConstInt(types.U64, int64(len(content))))
+	v.stringLiterals[s] = content
+	return s
+}
+
+func (v *IRVisitor) stringData(s ir.Value) ir.Value {
+	return v.ctx.Builder.CreateExtractValue(s, []int{stringDataField}, "")
+}
+
+func (v *IRVisitor) stringLen(s ir.Value) ir.Value {
+	return v.ctx.Builder.CreateExtractValue(s, []int{stringLenField}, "")
+}
+
+func (v *IRVisitor) stringOwner(s ir.Value) ir.Value {
+	return v.ctx.Builder.CreateExtractValue(s, []int{stringOwnerField}, "")
+}
+
+// stringMember resolves s.len, s.cstr() and s.char_at(n)
+func (v *IRVisitor) stringMember(s ir.Value, name string) ir.Value {
+	switch name {
+	case "len":
+		return v.stringLen(s)
+	case "cstr":
+		v.pendingMethodSelf = v.terminatedString(s)
+		return v.stringRuntime().cstr
+	case "char_at":
+		v.pendingMethodSelf = s
+		return v.stringRuntime().charAt
+	}
+	v.ctx.Logger.Error("string has no member '%s'", name)
+	return v.ctx.Builder.ConstInt(types.I64, 0)
+}
+
+// stringToCString converts s to a NUL-terminated pointer for C, valid until
+// the end of the statement
+func (v *IRVisitor) stringToCString(s ir.Value) ir.Value {
+	return v.stringData(v.terminatedString(s))
+}
+
+// terminatedString returns s, or a copy of it when its bytes are not
+// followed by a NUL. The result is held until the end of the statement,
+// even when it is passed as an argument.
+func (v *IRVisitor) terminatedString(s ir.Value) ir.Value {
+	t := v.ctx.Builder.CreateCall(v.stringRuntime().terminated, []ir.Value{s}, "")
+	v.holdTemporary(t)
+	return t
+}
+
+// bindCString keeps the string behind a cstr() result that initializes the
+// local name alive until the local's scope ends
+func (v *IRVisitor) bindCString(name string, cstr ir.Value) {
+	str, isCString := v.cstrResults[cstr]
+	if !isCString {
+		return
+	}
+	delete(v.heldTemps, str)
+	v.takeOwnership(str)
+	slot := v.ctx.Builder.CreateAlloca(v.ctx.StringType, name+".cstr")
+	v.ctx.Builder.CreateStore(str, slot)
+	v.releaseOnExit(slot)
+}
+
+// rejectStoredCString reports storing a cstr() result anywhere but a new
+// local, since nothing else keeps its buffer alive
+func (v *IRVisitor) rejectStoredCString(val ir.Value) {
+	if _, isCString := v.cstrResults[val]; isCString {
+		v.ctx.Logger.Error("The pointer from cstr() is valid only until the end of the statement; bind it with 'let' or pass it directly")
+	}
+}
+
+// stringFromCString wraps a NUL-terminated pointer, measuring its length
+func (v *IRVisitor) stringFromCString(p ir.Value) ir.Value {
+	bytePtr := types.NewPointer(types.I8)
+	if !p.Type().Equal(bytePtr) {
+		p = v.ctx.Builder.CreateBitCast(p, bytePtr, "")
+	}
+	return v.ctx.Builder.CreateCall(v.stringRuntime().fromCString, []ir.Value{p}, "")
+}
+
+// compareStrings evaluates x op y for ==, !=, <, <=, > and >=
+func (v *IRVisitor) compareStrings(x, y ir.Value, op string) ir.Value {
+	rt := v.stringRuntime()
+	b := v.ctx.Builder
+	switch op {
+	case "==":
+		return b.CreateCall(rt.eq, []ir.Value{x, y}, "")
+	case "!=":
+		return b.CreateXor(b.CreateCall(rt.eq, []ir.Value{x, y}, ""), b.True(), "")
+	}
+
+	order := b.CreateCall(rt.cmp, []ir.Value{x, y}, "")
+	zero := b.ConstInt(types.I32, 0)
+	switch op {
+	case "<":
+		return b.CreateICmpSLT(order, zero, "")
+	case "<=":
+		return b.CreateICmpSLE(order, zero, "")
+	case ">":
+		return b.CreateICmpSGT(order, zero, "")
+	}
+	return b.CreateICmpSGE(order, zero, "")
+}
+
+func (v *IRVisitor) concatStrings(x, y ir.Value) ir.Value {
+	result := v.ctx.Builder.CreateCall(v.stringRuntime().concat, []ir.Value{x, y}, "")
+	v.markOwned(result)
+	return result
+}
+
+// substring returns s[lo..hi] after checking lo <= hi <= len
+func (v *IRVisitor) substring(s, lo, hi ir.Value, at antlr.ParserRuleContext) ir.Value {
+	v.emitSliceCheck(lo, hi, v.stringLen(s), at)
+	data := v.ctx.Builder.CreateGEP(types.I8, v.stringData(s), []ir.Value{lo}, "")
+	return v.makeOwnedString(data, v.ctx.Builder.CreateSub(hi, lo, ""), v.stringOwner(s))
+}
+
+// stringByte returns s[index] as a byte after checking the index
+func (v *IRVisitor) stringByte(s, index ir.Value, at antlr.ParserRuleContext) ir.Value {
+	v.emitBoundsCheck(index, v.stringLen(s), at)
+	addr := v.ctx.Builder.CreateGEP(types.I8, v.stringData(s), []ir.Value{v.castValue(index, types.I64)}, "")
+	return v.ctx.Builder.CreateBitCast(v.ctx.Builder.CreateLoad(types.I8, addr, ""), types.U8, "")
+}
+
+// emitCopyBytes copies n bytes from src to dst
+func (v *IRVisitor) emitCopyBytes(dst, src, n ir.Value) {
+	b := v.ctx.Builder
+	indexPtr := b.CreateAlloca(types.U64, "i")
+	b.CreateStore(b.ConstInt(types.U64, 0), indexPtr)
+
+	loopBlock := b.CreateBlock("copy.loop")
+	bodyBlock := b.CreateBlock("copy.body")
+	doneBlock := b.CreateBlock("copy.done")
+	b.CreateBr(loopBlock)
+
+	v.ctx.SetInsertBlock(loopBlock)
+	index := b.CreateLoad(types.U64, indexPtr, "")
+	b.CreateCondBr(b.CreateICmpULT(index, n, ""), bodyBlock, doneBlock)
+
+	v.ctx.SetInsertBlock(bodyBlock)
+	c := b.CreateLoad(types.I8, b.CreateGEP(types.I8, src, []ir.Value{index}, ""), "")
+	b.CreateStore(c, b.CreateGEP(types.I8, dst, []ir.Value{index}, ""))
+	b.CreateStore(b.CreateAdd(index, b.ConstInt(types.U64, 1), ""), indexPtr)
+	b.CreateBr(loopBlock)
+
+	v.ctx.SetInsertBlock(doneBlock)
+}
+
+// runtimeFunction creates a helper function and positions at its entry
+func (v *IRVisitor) runtimeFunction(name string, ret types.Type, params []types.Type, argNames ...string) *ir.Function {
+	fn := v.ctx.Builder.CreateFunction(name, ret, params, false)
+	for i, argName := range argNames {
+		fn.Arguments[i].SetName(argName)
+	}
+	v.ctx.SetInsertBlock(v.ctx.Builder.CreateBlock("entry"))
+	return fn
+}
+
+// stringRuntime returns the string helpers, emitting them the first time
+func (v *IRVisitor) stringRuntime() *stringFuncs {
+	if v.ctx.stringFuncs != nil {
+		return v.ctx.stringFuncs
+	}
+
+	decode := v.utf8Decoder()
+	state := v.ctx.SuspendFunction()
+	rt := &stringFuncs{}
+	v.ctx.stringFuncs = rt
+	rt.eq = v.emitStringEq()
+	rt.cmp = v.emitStringCmp()
+	rt.concat = v.emitStringConcat()
+	rt.cstr = v.emitStringCString()
+	rt.terminated = v.emitStringTerminated()
+	rt.fromCString = v.emitStringFromCString()
+	rt.charAt = v.emitStringCharAt(decode)
+	rt.hash = v.emitStringHash()
+	v.ctx.ResumeFunction(state)
+	return rt
+}
+
+// emitStringEq defines __arc_string_eq(a, b) bool
+func (v *IRVisitor) emitStringEq() *ir.Function {
+	b := v.ctx.Builder
+	str := v.ctx.StringType
+	fn := v.runtimeFunction("__arc_string_eq", types.I1, []types.Type{str, str}, "a", "b")
+	x, y := fn.Arguments[0], fn.Arguments[1]
+
+	loopBlock := b.CreateBlock("loop")
+	bodyBlock := b.CreateBlock("body")
+	nextBlock := b.CreateBlock("next")
+	equalBlock := b.CreateBlock("equal")
+	differBlock := b.CreateBlock("differ")
+
+	length := v.stringLen(x)
+	indexPtr := b.CreateAlloca(types.U64, "i")
+	b.CreateStore(b.ConstInt(types.U64, 0), indexPtr)
+	b.CreateCondBr(b.CreateICmpEQ(length, v.stringLen(y), ""), loopBlock, differBlock)
+
+	v.ctx.SetInsertBlock(loopBlock)
+	index := b.CreateLoad(types.U64, indexPtr, "")
+	b.CreateCondBr(b.CreateICmpULT(index, length, ""), bodyBlock, equalBlock)
+
+	v.ctx.SetInsertBlock(bodyBlock)
+	cx := b.CreateLoad(types.I8, b.CreateGEP(types.I8, v.stringData(x), []ir.Value{index}, ""), "")
+	cy := b.CreateLoad(types.I8, b.CreateGEP(types.I8, v.stringData(y), []ir.Value{index}, ""), "")
+	b.CreateCondBr(b.CreateICmpEQ(cx, cy, ""), nextBlock, differBlock)
+
+	v.ctx.SetInsertBlock(nextBlock)
+	b.CreateStore(b.CreateAdd(index, b.ConstInt(types.U64, 1), ""), indexPtr)
+	b.CreateBr(loopBlock)
+
+	v.ctx.SetInsertBlock(equalBlock)
+	b.CreateRet(b.True())
+
+	v.ctx.SetInsertBlock(differBlock)
+	b.CreateRet(b.False())
+	return fn
+}
+
+// emitStringCmp defines __arc_string_cmp(a, b) i32, which orders strings
+// bytewise, a prefix before any longer string
+func (v *IRVisitor) emitStringCmp() *ir.Function {
+	b := v.ctx.Builder
+	str := v.ctx.StringType
+	fn := v.runtimeFunction("__arc_string_cmp", types.I32, []types.Type{str, str}, "a", "b")
+	x, y := fn.Arguments[0], fn.Arguments[1]
+
+	loopBlock := b.CreateBlock("loop")
+	bodyBlock := b.CreateBlock("body")
+	nextBlock := b.CreateBlock("next")
+	differBlock := b.CreateBlock("differ")
+	prefixBlock := b.CreateBlock("prefix")
+
+	lenX, lenY := v.stringLen(x), v.stringLen(y)
+	shorter := b.CreateSelect(b.CreateICmpULT(lenX, lenY, ""), lenX, lenY, "")
+	indexPtr := b.CreateAlloca(types.U64, "i")
+	b.CreateStore(b.ConstInt(types.U64, 0), indexPtr)
+	b.CreateBr(loopBlock)
+
+	v.ctx.SetInsertBlock(loopBlock)
+	index := b.CreateLoad(types.U64, indexPtr, "")
+	b.CreateCondBr(b.CreateICmpULT(index, shorter, ""), bodyBlock, prefixBlock)
+
+	v.ctx.SetInsertBlock(bodyBlock)
+	cx := b.CreateLoad(types.I8, b.CreateGEP(types.I8, v.stringData(x), []ir.Value{index}, ""), "")
+	cy := b.CreateLoad(types.I8, b.CreateGEP(types.I8, v.stringData(y), []ir.Value{index}, ""), "")
+	b.CreateCondBr(b.CreateICmpEQ(cx, cy, ""), nextBlock, differBlock)
+
+	v.ctx.SetInsertBlock(nextBlock)
+	b.CreateStore(b.CreateAdd(index, b.ConstInt(types.U64, 1), ""), indexPtr)
+	b.CreateBr(loopBlock)
+
+	// Bytes compare unsigned, so UTF-8 orders by code point
+	v.ctx.SetInsertBlock(differBlock)
+	b.CreateRet(b.CreateSub(b.CreateZExt(cx, types.I32, ""), b.CreateZExt(cy, types.I32, ""), ""))
+
+	v.ctx.SetInsertBlock(prefixBlock)
+	longer := b.CreateSelect(b.CreateICmpUGT(lenX, lenY, ""), b.ConstInt(types.I32, 1), b.ConstInt(types.I32, 0), "")
+	b.CreateRet(b.CreateSelect(b.CreateICmpULT(lenX, lenY, ""), b.ConstInt(types.I32, -1), longer, ""))
+	return fn
+}
+
+// emitStringConcat defines __arc_string_concat(a, b) string, which returns
+// a new buffer with a count of one
+func (v *IRVisitor) emitStringConcat() *ir.Function {
+	b := v.ctx.Builder
+	str := v.ctx.StringType
+	fn := v.runtimeFunction("__arc_string_concat", str, []types.Type{str, str}, "a", "b")
+	x, y := fn.Arguments[0], fn.Arguments[1]
+
+	lenX, lenY := v.stringLen(x), v.stringLen(y)
+	length := b.CreateAdd(lenX, lenY, "")
+	owner, buf := v.allocStringBuffer(length)
+	v.emitCopyBytes(buf, v.stringData(x), lenX)
+	v.emitCopyBytes(b.CreateGEP(types.I8, buf, []ir.Value{lenX}, ""), v.stringData(y), lenY)
+	b.CreateRet(v.makeOwnedString(buf, length, owner))
+	return fn
+}
+
+// emitStringCString defines __arc_string_cstr(s) *i8, the method behind
+// s.cstr(). The compiler passes it a string from __arc_string_terminated.
+func (v *IRVisitor) emitStringCString() *ir.Function {
+	fn := v.runtimeFunction("__arc_string_cstr", types.NewPointer(types.I8), []types.Type{v.ctx.StringType}, "s")
+	v.ctx.Builder.CreateRet(v.stringData(fn.Arguments[0]))
+	return fn
+}
+
+// emitStringTerminated defines __arc_string_terminated(s) string, which
+// returns a reference to s when a NUL follows its bytes and a NUL-terminated
+// copy otherwise
+func (v *IRVisitor) emitStringTerminated() *ir.Function {
+	b := v.ctx.Builder
+	fn := v.runtimeFunction("__arc_string_terminated", v.ctx.StringType, []types.Type{v.ctx.StringType}, "s")
+	s := fn.Arguments[0]
+
+	emptyBlock := b.CreateBlock("empty")
+	checkBlock := b.CreateBlock("check")
+	terminatedBlock := b.CreateBlock("terminated")
+	copyBlock := b.CreateBlock("copy")
+
+	// A zero-initialized string has no buffer at all
+	data, length := v.stringData(s), v.stringLen(s)
+	b.CreateCondBr(b.CreateICmpEQ(data, b.ConstNull(types.NewPointer(types.I8)), ""), emptyBlock, checkBlock)
+
+	v.ctx.SetInsertBlock(emptyBlock)
+	b.CreateRet(v.stringLiteral(""))
+
+	v.ctx.SetInsertBlock(checkBlock)
+	after := b.CreateLoad(types.I8, b.CreateGEP(types.I8, data, []ir.Value{length}, ""), "")
+	b.CreateCondBr(b.CreateICmpEQ(after, b.ConstInt(types.I8, 0), ""), terminatedBlock, copyBlock)
+
+	v.ctx.SetInsertBlock(terminatedBlock)
+	v.emitRetain(s)
+	b.CreateRet(s)
+
+	v.ctx.SetInsertBlock(copyBlock)
+	owner, buf := v.allocStringBuffer(length)
+	v.emitCopyBytes(buf, data, length)
+	b.CreateRet(v.makeOwnedString(buf, length, owner))
+	return fn
+}
+
+// emitStringFromCString defines __arc_string_from_cstr(p) string; a null
+// pointer gives the empty string
+func (v *IRVisitor) emitStringFromCString() *ir.Function {
+	b := v.ctx.Builder
+	bytePtr := types.NewPointer(types.I8)
+	fn := v.runtimeFunction("__arc_string_from_cstr", v.ctx.StringType, []types.Type{bytePtr}, "p")
+	p := fn.Arguments[0]
+
+	nullBlock := b.CreateBlock("null")
+	loopBlock := b.CreateBlock("loop")
+	nextBlock := b.CreateBlock("next")
+	doneBlock := b.CreateBlock("done")
+
+	indexPtr := b.CreateAlloca(types.U64, "n")
+	b.CreateStore(b.ConstInt(types.U64, 0), indexPtr)
+	b.CreateCondBr(b.CreateICmpEQ(p, b.ConstNull(bytePtr), ""), nullBlock, loopBlock)
+
+	v.ctx.SetInsertBlock(nullBlock)
+	b.CreateRet(v.stringLiteral(""))
+
+	v.ctx.SetInsertBlock(loopBlock)
+	index := b.CreateLoad(types.U64, indexPtr, "")
+	c := b.CreateLoad(types.I8, b.CreateGEP(types.I8, p, []ir.Value{index}, ""), "")
+	b.CreateCondBr(b.CreateICmpEQ(c, b.ConstInt(types.I8, 0), ""), doneBlock, nextBlock)
+
+	v.ctx.SetInsertBlock(nextBlock)
+	b.CreateStore(b.CreateAdd(index, b.ConstInt(types.U64, 1), ""), indexPtr)
+	b.CreateBr(loopBlock)
+
+	v.ctx.SetInsertBlock(doneBlock)
+	b.CreateRet(v.makeString(p, index))
+	return fn
+}
+
+// emitStringCharAt defines __arc_string_char_at(s, n) char, which decodes
+// the n-th char by walking from the start
+func (v *IRVisitor) emitStringCharAt(decode *ir.Function) *ir.Function {
+	b := v.ctx.Builder
+	fn := v.runtimeFunction("__arc_string_char_at", types.U32, []types.Type{v.ctx.StringType, types.U64}, "s", "n")
+	s, n := fn.Arguments[0], fn.Arguments[1]
+
+	loopBlock := b.CreateBlock("loop")
+	decodeBlock := b.CreateBlock("decode")
+	nextBlock := b.CreateBlock("next")
+	foundBlock := b.CreateBlock("found")
+	outBlock := b.CreateBlock("out")
+
+	data, length := v.stringData(s), v.stringLen(s)
+	offsetPtr := b.CreateAlloca(types.U64, "off")
+	b.CreateStore(b.ConstInt(types.U64, 0), offsetPtr)
+	countPtr := b.CreateAlloca(types.U64, "k")
+	b.CreateStore(b.ConstInt(types.U64, 0), countPtr)
+	width := b.CreateAlloca(types.U64, "width")
+	b.CreateBr(loopBlock)
+
+	v.ctx.SetInsertBlock(loopBlock)
+	offset := b.CreateLoad(types.U64, offsetPtr, "")
+	b.CreateCondBr(b.CreateICmpULT(offset, length, ""), decodeBlock, outBlock)
+
+	v.ctx.SetInsertBlock(decodeBlock)
+	char := b.CreateCall(decode, []ir.Value{data, offset, length, width}, "")
+	count := b.CreateLoad(types.U64, countPtr, "")
+	b.CreateCondBr(b.CreateICmpEQ(count, n, ""), foundBlock, nextBlock)
+
+	v.ctx.SetInsertBlock(nextBlock)
+	b.CreateStore(b.CreateAdd(offset, b.CreateLoad(types.U64, width, ""), ""), offsetPtr)
+	b.CreateStore(b.CreateAdd(count, b.ConstInt(types.U64, 1), ""), countPtr)
+	b.CreateBr(loopBlock)
+
+	v.ctx.SetInsertBlock(foundBlock)
+	b.CreateRet(char)
+
+	v.ctx.SetInsertBlock(outBlock)
+	v.emitTrap("arc: char index out of range\n")
+	return fn
+}
+
+// emitStringHash defines __arc_string_hash(s) u64 (FNV-1a over the bytes)
+func (v *IRVisitor) emitStringHash() *ir.Function {
+	b := v.ctx.Builder
+	fn := v.runtimeFunction("__arc_string_hash", types.U64, []types.Type{v.ctx.StringType}, "s")
+	s := fn.Arguments[0]
+
+	loopBlock := b.CreateBlock("loop")
+	bodyBlock := b.CreateBlock("body")
+	doneBlock := b.CreateBlock("done")
+
+	data, length := v.stringData(s), v.stringLen(s)
+	hashPtr := b.CreateAlloca(types.U64, "h")
+	b.CreateStore(b.ConstInt(types.U64, int64(fnvOffsetBasis)), hashPtr)
+	indexPtr := b.CreateAlloca(types.U64, "i")
+	b.CreateStore(b.ConstInt(types.U64, 0), indexPtr)
+	b.CreateBr(loopBlock)
+
+	v.ctx.SetInsertBlock(loopBlock)
+	index := b.CreateLoad(types.U64, indexPtr, "")
+	b.CreateCondBr(b.CreateICmpULT(index, length, ""), bodyBlock, doneBlock)
+
+	v.ctx.SetInsertBlock(bodyBlock)
+	c := b.CreateLoad(types.I8, b.CreateGEP(types.I8, data, []ir.Value{index}, ""), "")
+	h := b.CreateXor(b.CreateLoad(types.U64, hashPtr, ""), b.CreateZExt(c, types.U64, ""), "")
+	b.CreateStore(b.CreateMul(h, b.ConstInt(types.U64, int64(fnvPrime)), ""), hashPtr)
+	b.CreateStore(b.CreateAdd(index, b.ConstInt(types.U64, 1), ""), indexPtr)
+	b.CreateBr(loopBlock)
+
+	v.ctx.SetInsertBlock(doneBlock)
+	b.CreateRet(b.CreateLoad(types.U64, hashPtr, ""))
+	return fn
+}
+
+// utf8Decoder returns __arc_utf8_decode(s, i, n, *width) char, which decodes
+// the code point starting at byte i of the n bytes at s and stores its
+// length in bytes. Malformed or truncated sequences decode to U+FFFD.
+func (v *IRVisitor) utf8Decoder() *ir.Function {
+	if v.ctx.utf8Decode != nil {
+		return v.ctx.utf8Decode
+	}
+
+	state := v.ctx.SuspendFunction()
+	b := v.ctx.Builder
+	bytePtr := types.NewPointer(types.I8)
+	fn := v.runtimeFunction("__arc_utf8_decode", types.U32, []types.Type{bytePtr, types.U64, types.U64, types.NewPointer(types.U64)}, "s", "i", "n", "width")
+	s, i, n, width := fn.Arguments[0], fn.Arguments[1], fn.Arguments[2], fn.Arguments[3]
+	v.ctx.utf8Decode = fn
+
+	u32 := func(x int64) ir.Value { return b.ConstInt(types.U32, x) }
+	u64 := func(x int64) ir.Value { return b.ConstInt(types.U64, x) }
+	byteAt := func(index ir.Value) ir.Value {
+		c := b.CreateLoad(types.I8, b.CreateGEP(types.I8, s, []ir.Value{index}, ""), "")
+		return b.CreateZExt(c, types.U32, "")
+	}
+
+	asciiBlock := b.CreateBlock("ascii")
+	leadBlock := b.CreateBlock("lead")
+	multiBlock := b.CreateBlock("multi")
+	loopBlock := b.CreateBlock("cont.loop")
+	boundBlock := b.CreateBlock("cont.bound")
+	readBlock := b.CreateBlock("cont.read")
+	addBlock := b.CreateBlock("cont.add")
+	doneBlock := b.CreateBlock("done")
+	badBlock := b.CreateBlock("bad")
+
+	b0 := byteAt(i)
+	b.CreateStore(u64(1), width)
+	b.CreateCondBr(b.CreateICmpULT(b0, u32(0x80), ""), asciiBlock, leadBlock)
+
+	v.ctx.SetInsertBlock(asciiBlock)
+	b.CreateRet(b0)
+
+	// Continuation bytes (10xxxxxx) and bytes above 0xF7 cannot start a char
+	v.ctx.SetInsertBlock(leadBlock)
+	validLead := b.CreateAnd(b.CreateICmpUGE(b0, u32(0xC0), ""), b.CreateICmpULT(b0, u32(0xF8), ""), "")
+	b.CreateCondBr(validLead, multiBlock, badBlock)
+
+	// The lead byte gives the number of continuation bytes: 1, 2 or 3
+	v.ctx.SetInsertBlock(multiBlock)
+	extra := b.CreateSelect(b.CreateICmpUGE(b0, u32(0xF0), ""), u64(3),
+		b.CreateSelect(b.CreateICmpUGE(b0, u32(0xE0), ""), u64(2), u64(1), ""), "")
+	mask := b.CreateLShr(u32(0x7F), b.CreateTrunc(b.CreateAdd(extra, u64(1), ""), types.U32, ""), "")
+	cpPtr := b.CreateAlloca(types.U32, "cp")
+	b.CreateStore(b.CreateAnd(b0, mask, ""), cpPtr)
+	kPtr := b.CreateAlloca(types.U64, "k")
+	b.CreateStore(u64(1), kPtr)
+	b.CreateBr(loopBlock)
+
+	v.ctx.SetInsertBlock(loopBlock)
+	k := b.CreateLoad(types.U64, kPtr, "")
+	b.CreateCondBr(b.CreateICmpULE(k, extra, ""), boundBlock, doneBlock)
+
+	// The sequence may not run past the end of the string
+	v.ctx.SetInsertBlock(boundBlock)
+	at := b.CreateAdd(i, k, "")
+	b.CreateCondBr(b.CreateICmpULT(at, n, ""), readBlock, badBlock)
+
+	// Any byte other than a continuation byte ends the sequence early
+	v.ctx.SetInsertBlock(readBlock)
+	c := byteAt(at)
+	isCont := b.CreateICmpEQ(b.CreateAnd(c, u32(0xC0), ""), u32(0x80), "")
+	b.CreateCondBr(isCont, addBlock, badBlock)
+
+	v.ctx.SetInsertBlock(addBlock)
+	cp := b.CreateLoad(types.U32, cpPtr, "")
+	b.CreateStore(b.CreateOr(b.CreateShl(cp, u32(6), ""), b.CreateAnd(c, u32(0x3F), ""), ""), cpPtr)
+	b.CreateStore(b.CreateAdd(k, u64(1), ""), kPtr)
+	b.CreateStore(b.CreateAdd(k, u64(1), ""), width)
+	b.CreateBr(loopBlock)
+
+	v.ctx.SetInsertBlock(doneBlock)
+	b.CreateRet(b.CreateLoad(types.U32, cpPtr, ""))
+
+	// Skip the bytes examined so far and report the replacement character
+	v.ctx.SetInsertBlock(badBlock)
+	b.CreateRet(u32(0xFFFD))
+
+	v.ctx.ResumeFunction(state)
+	return fn
+}
@@ -0,0 +1,274 @@
+package compiler
+
+import (
+	"fmt"
+	"unicode"
+
+	"github.com/antlr4-go/antlr/v4"
+	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-builder/types"
+	"github.com/arc-language/core-parser"
+)
+
+// Struct literals name their fields, 'Point{x: 1, y: 2}', or list them in
+// declaration order, 'Point{1, 2}', for structs of at most
+// maxPositionalFields fields. Where the context already says which struct
+// is wanted (a field, an annotated variable, ...) the name can be left out:
+// 'Line{from: {1, 2}, to: {x: 3, y: 4}}'. Omitted fields take the default
+// of their declaration, 'x: int32 = 1', which must be a compile-time
+// constant; fields without a default are zero, except struct fields, which
+// take the defaults of their own struct.
+//
+// Structs and tuples compare with == and != field by field when every
+// field is comparable: numbers, pointers and references (by identity),
+// strings (by content), and arrays and structs of comparable fields.
+
+// maxPositionalFields is the most fields a positional literal may fill
+const maxPositionalFields = 4
+
+// fieldDefault is the declared default of a struct field, evaluated the
+// first time it is needed
+type fieldDefault struct {
+	expr      parser.IExpressionContext
+	namespace *Namespace
+	resolved  bool
+	value     constValue
+	err       error
+}
+
+// fieldInit is one initializer of a struct literal; name is empty for a
+// positional one
+type fieldInit struct {
+	name string
+	expr antlr.ParseTree
+}
+
+// literalStruct returns the struct type when typ is a struct declared with
+// 'struct', which literals can build
+func (v *IRVisitor) literalStruct(typ types.Type) (*types.StructType, bool) {
+	structType, ok := typ.(*types.StructType)
+	if !ok || v.ctx.IsClassType(structType.Name) {
+		return nil, false
+	}
+	_, isStruct := v.ctx.StructFieldIndices[structType.Name]
+	return structType, isStruct
+}
+
+// fieldName names field idx of a struct, or numbers it for tuples
+func (v *IRVisitor) fieldName(structType *types.StructType, idx int) string {
+	for name, i := range v.ctx.StructFieldIndices[structType.Name] {
+		if i == idx {
+			return name
+		}
+	}
+	return fmt.Sprint(idx)
+}
+
+// structFromCollection builds a struct from a literal without a type name,
+// '{x: 1, y: 2}' or '{1, 2}'
+func (v *IRVisitor) structFromCollection(ctx *parser.CollectionLiteralContext, structType *types.StructType) ir.Value {
+	var inits []fieldInit
+	for _, expr := range ctx.AllExpression() {
+		inits = append(inits, fieldInit{expr: expr})
+	}
+	for _, entry := range ctx.AllMapEntry() {
+		name := entry.Expression(0).GetText()
+		if !isIdentifierText(name) {
+			v.ctx.Logger.Error("Expected a field name of %s, found '%s'", v.typeName(structType), name)
+			continue
+		}
+		inits = append(inits, fieldInit{name: name, expr: entry.Expression(1)})
+	}
+	return v.buildStruct(structType, inits)
+}
+
+func isIdentifierText(text string) bool {
+	for i, r := range text {
+		if r != '_' && !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return text != ""
+}
+
+// buildStruct builds a struct value from the initializers of a literal
+func (v *IRVisitor) buildStruct(structType *types.StructType, inits []fieldInit) ir.Value {
+	name := v.typeName(structType)
+	fields := v.declaredFields(structType)
+	values := make([]ir.Value, len(structType.Fields))
+	for i, init := range inits {
+		if (init.name == "") != (inits[0].name == "") {
+			v.ctx.Logger.Error("%s literal cannot mix positional and named fields", name)
+			break
+		}
+
+		var idx int
+		if init.name != "" {
+			if idx = v.findFieldIndex(structType, init.name); idx < 0 {
+				v.ctx.Logger.Error("Struct %s has no field %s", name, init.name)
+				continue
+			}
+			if values[idx] != nil {
+				v.ctx.Logger.Error("Field '%s' of %s is initialized twice", init.name, name)
+				continue
+			}
+		} else if len(fields) > maxPositionalFields {
+			v.ctx.Logger.Error("Struct %s has more than %d fields; its literals must name them", name, maxPositionalFields)
+			break
+		} else if i >= len(fields) {
+			v.ctx.Logger.Error("Too many values for %s, which has %d fields", name, len(fields))
+			break
+		} else {
+			idx = fields[i]
+		}
+
+		fieldType := structType.Fields[idx]
+		values[idx] = v.coerceTo(v.visitWithHint(init.expr, fieldType), fieldType)
+		// The struct owns its class fields
+		v.takeOwnership(values[idx])
+	}
+
+	agg, _ := v.fillDefaults(structType, values)
+	v.markOwned(agg)
+	return agg
+}
+
+// fillDefaults builds a struct from values, giving the fields without one
+// their default. It also reports whether any field was set.
+func (v *IRVisitor) fillDefaults(structType *types.StructType, values []ir.Value) (ir.Value, bool) {
+	var agg ir.Value = v.ctx.Builder.ConstZero(structType)
+	filled := false
+	for idx, val := range values {
+		if val == nil {
+			val = v.defaultField(structType, idx)
+		}
+		if val != nil {
+			agg = v.ctx.Builder.CreateInsertValue(agg, val, []int{idx}, "")
+			filled = true
+		}
+	}
+	return agg, filled
+}
+
+// defaultField returns the value of a field a literal leaves out, or nil
+// when it is zero
+func (v *IRVisitor) defaultField(structType *types.StructType, idx int) ir.Value {
+	fieldType := structType.Fields[idx]
+	def, ok := v.ctx.fieldDefaults[structType.Name][idx]
+	if !ok {
+		if nested, isStruct := v.literalStruct(fieldType); isStruct {
+			if agg, filled := v.fillDefaults(nested, make([]ir.Value, len(nested.Fields))); filled {
+				return agg
+			}
+		}
+		return nil
+	}
+	if c, ok := v.resolveFieldDefault(structType, idx, def); ok {
+		return v.coerceTo(v.constToValue(c), fieldType)
+	}
+	return nil
+}
+
+// resolveFieldDefault evaluates a default in the namespace of its struct,
+// reporting it once if it is not a constant of the field's type
+func (v *IRVisitor) resolveFieldDefault(structType *types.StructType, idx int, def *fieldDefault) (constValue, bool) {
+	if !def.resolved {
+		def.resolved = true
+		name := structType.Name + "." + v.fieldName(structType, idx)
+		def.value, def.err = v.evalConstIn(def.expr, def.namespace, name)
+		if def.err == nil {
+			def.value, def.err = v.convertConst(def.value, structType.Fields[idx])
+		}
+		if def.err != nil {
+			v.ctx.Logger.Error("Default value of %s must be a compile-time constant: %v", name, def.err)
+		}
+	}
+	return def.value, def.err == nil
+}
+
+// checkFieldDefaults evaluates the defaults of a struct declaration, so
+// bad ones are reported even when no literal uses them
+func (v *IRVisitor) checkFieldDefaults(ctx *parser.StructDeclContext) {
+	typ, _ := v.ctx.GetType(ctx.IDENTIFIER().GetText())
+	structType, ok := v.literalStruct(typ)
+	if !ok {
+		return
+	}
+	for idx := range structType.Fields {
+		if def, ok := v.ctx.fieldDefaults[structType.Name][idx]; ok {
+			v.resolveFieldDefault(structType, idx, def)
+		}
+	}
+}
+
+// isComparable reports whether == can compare values of typ
+func (v *IRVisitor) isComparable(typ types.Type) bool {
+	switch t := typ.(type) {
+	case *types.IntType, *types.FloatType, *types.PointerType:
+		return true
+	case *types.ArrayType:
+		return v.isComparable(t.ElementType)
+	case *types.StructType:
+		if v.ctx.IsString(t) {
+			return true
+		}
+		if _, isSlice := v.ctx.SliceElem(t); isSlice {
+			return false
+		}
+		if _, isClosure := v.ctx.ClosureSignature(t); isClosure {
+			return false
+		}
+		if _, isOptional := v.ctx.OptionalElem(t); isOptional {
+			return false
+		}
+		if _, isRange := v.ctx.RangeElem(t); isRange {
+			return false
+		}
+		for _, i := range v.declaredFields(t) {
+			if !v.isComparable(t.Fields[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// compareStructs compares two structs or tuples field by field; op is
+// "==" or "!="
+func (v *IRVisitor) compareStructs(x, y ir.Value, op string) ir.Value {
+	b := v.ctx.Builder
+	structType := x.Type().(*types.StructType)
+	if !v.ctx.SameType(structType, y.Type()) {
+		// Mixing a distinct type with its base is reported by
+		// matchLiteralOperands
+		if !v.mixesDistinct(structType, y.Type()) {
+			v.ctx.Logger.Error("Cannot compare %s with %s", v.typeName(structType), v.typeName(y.Type()))
+		}
+		return b.False()
+	}
+	if !v.isComparable(structType) {
+		v.reportIncomparable(structType)
+		return b.False()
+	}
+
+	eq := v.emitEqual(x, y, structType)
+	if op == "!=" {
+		return b.CreateXor(eq, b.True(), "")
+	}
+	return eq
+}
+
+// reportIncomparable names the field that keeps a struct from comparing
+func (v *IRVisitor) reportIncomparable(structType *types.StructType) {
+	if _, isStruct := v.ctx.StructFieldIndices[structType.Name]; isStruct || v.ctx.IsTupleType(structType) {
+		for _, idx := range v.declaredFields(structType) {
+			if field := structType.Fields[idx]; !v.isComparable(field) {
+				v.ctx.Logger.Error("Cannot compare %s: field '%s' of type %s is not comparable",
+					v.typeName(structType), v.fieldName(structType, idx), v.typeName(field))
+				return
+			}
+		}
+	}
+	v.ctx.Logger.Error("Values of type %s cannot be compared with == or !=", v.typeName(structType))
+}
@@ -0,0 +1,177 @@
+package compiler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-builder/types"
+	"github.com/arc-language/core-parser"
+)
+
+// Tuples are anonymous structs. Functions returning tuples larger than two
+// eightbytes receive a hidden trailing pointer to the caller's result slot
+// instead of returning the aggregate in registers.
+
+// maxRegisterReturnSize is the largest aggregate returned in registers
+const maxRegisterReturnSize = 16
+
+// TupleType returns the anonymous struct for a tuple, creating it once
+func (c *Context) TupleType(elems []types.Type) *types.StructType {
+	parts := make([]string, len(elems))
+	for i, e := range elems {
+		parts[i] = fmt.Sprint(e)
+	}
+	key := "(" + strings.Join(parts, ", ") + ")"
+	if tupleType, ok := c.tupleTypes[key]; ok {
+		return tupleType
+	}
+
+	tupleType := types.NewStruct("", elems, false)
+	c.tupleTypes[key] = tupleType
+	c.tupleSet[tupleType] = true
+	c.Logger.Debug("Registered tuple type %s", key)
+	return tupleType
+}
+
+// IsTupleType checks if a type is a tuple
+func (c *Context) IsTupleType(typ types.Type) bool {
+	structType, ok := typ.(*types.StructType)
+	return ok && c.tupleSet[structType]
+}
+
+// returnsIndirectly reports whether values of typ are returned through a
+// hidden result pointer
+func (v *IRVisitor) returnsIndirectly(typ types.Type) bool {
+	return v.ctx.IsTupleType(typ) && v.calculateSizeOf(typ) > maxRegisterReturnSize
+}
+
+func (v *IRVisitor) resolveTupleType(ctx parser.ITupleTypeContext) types.Type {
+	elems := make([]types.Type, 0)
+	for _, typeCtx := range ctx.AllType_() {
+		elems = append(elems, v.resolveType(typeCtx))
+	}
+	return v.ctx.TupleType(elems)
+}
+
+func (v *IRVisitor) VisitTupleLiteral(ctx *parser.TupleLiteralContext) interface{} {
+	values := make([]ir.Value, 0)
+	elems := make([]types.Type, 0)
+	for _, expr := range ctx.AllExpression() {
+		val := v.Visit(expr).(ir.Value)
+		// The tuple owns its class elements until it is destructured
+		v.takeOwnership(val)
+		values = append(values, val)
+		elems = append(elems, val.Type())
+	}
+
+	tupleType := v.ctx.TupleType(elems)
+	var agg ir.Value = v.ctx.Builder.ConstZero(tupleType)
+	for i, val := range values {
+		agg = v.ctx.Builder.CreateInsertValue(agg, val, []int{i}, "")
+	}
+	v.markOwned(agg)
+	return agg
+}
+
+// tupleElement extracts element 'index' of a tuple value (t.0)
+func (v *IRVisitor) tupleElement(tuple ir.Value, indexText string) ir.Value {
+	tupleType, ok := tuple.Type().(*types.StructType)
+	if !ok || !v.ctx.IsTupleType(tupleType) {
+		v.ctx.Logger.Error("Positional access .%s requires a tuple", indexText)
+		return tuple
+	}
+
+	if callee, unhandled := v.errorResults[tuple]; unhandled {
+		v.ctx.Logger.Error("'.%s' on the result of '%s' ignores its error; use 'try' or destructure the result", indexText, callee)
+		delete(v.errorResults, tuple)
+	}
+
+	index, err := strconv.Atoi(indexText)
+	if err != nil || index < 0 || index >= len(tupleType.Fields) {
+		v.ctx.Logger.Error("Tuple index %s out of range for tuple of %d element(s)", indexText, len(tupleType.Fields))
+		return v.ctx.Builder.ConstZero(types.I64)
+	}
+
+	return v.ctx.Builder.CreateExtractValue(tuple, []int{index}, "")
+}
+
+// declareTuplePattern binds 'let (a, b) = expr', skipping '_' elements
+func (v *IRVisitor) declareTuplePattern(pattern parser.ITuplePatternContext, tuple ir.Value) {
+	names := pattern.AllIDENTIFIER()
+	// Destructuring a throwing call's result handles its error
+	delete(v.errorResults, tuple)
+	_, owned := v.ownedTemps[tuple]
+	delete(v.ownedTemps, tuple)
+
+	tupleType, ok := tuple.Type().(*types.StructType)
+	if !ok || !v.ctx.IsTupleType(tupleType) {
+		v.ctx.Logger.Error("Cannot destructure non-tuple value of type %v", tuple.Type())
+		return
+	}
+	if len(names) != len(tupleType.Fields) {
+		v.ctx.Logger.Error("Tuple has %d element(s) but pattern binds %d", len(tupleType.Fields), len(names))
+		return
+	}
+
+	for i, ident := range names {
+		name := ident.GetText()
+		elem := v.ctx.Builder.CreateExtractValue(tuple, []int{i}, "")
+		// Elements of an owned tuple carry the references it held; those of
+		// a variable are borrowed
+		if owned {
+			v.markOwned(elem)
+		}
+
+		if name == "_" {
+			v.releaseTemporary(elem)
+			continue
+		}
+
+		v.takeOwnership(elem)
+		alloca := v.ctx.Builder.CreateAlloca(tupleType.Fields[i], name+".addr")
+		v.ctx.Builder.CreateStore(elem, alloca)
+		v.ctx.currentScope.Define(name, alloca)
+		v.releaseOnExit(alloca)
+	}
+}
+
+// emitCall calls a named function, coercing arguments to the parameter
+// types and supplying the hidden result slot for indirect returns
+func (v *IRVisitor) emitCall(fn *ir.Function, args []ir.Value) ir.Value {
+	if sig, isExtern := v.ctx.cSignatures[fn]; isExtern {
+		return v.emitCCall(fn, sig, args)
+	}
+	resultType, indirect := v.ctx.indirectReturns[fn]
+
+	numParams := len(fn.Arguments)
+	if indirect {
+		numParams--
+	}
+	for i := range args {
+		if i < numParams {
+			args[i] = v.coerceTo(args[i], fn.Arguments[i].Type())
+		} else if v.ctx.IsString(args[i].Type()) {
+			// C varargs such as printf's take strings as C strings
+			args[i] = v.stringToCString(args[i])
+		}
+	}
+
+	if !indirect {
+		return v.ctx.Builder.CreateCall(fn, args, "")
+	}
+	if len(args) < numParams {
+		v.ctx.Logger.Error("Function '%s' expects %d argument(s), got %d", fn.Name(), numParams, len(args))
+		return v.getZeroValue(resultType)
+	}
+
+	// The result slot follows the declared parameters, before any varargs
+	slot := v.ctx.Builder.CreateAlloca(resultType, "ret.slot")
+	callArgs := make([]ir.Value, 0, len(args)+1)
+	callArgs = append(callArgs, args[:numParams]...)
+	callArgs = append(callArgs, slot)
+	callArgs = append(callArgs, args[numParams:]...)
+	v.ctx.Builder.CreateCall(fn, callArgs, "")
+	return v.ctx.Builder.CreateLoad(resultType, slot, "")
+}
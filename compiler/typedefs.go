@@ -0,0 +1,129 @@
+package compiler
+
+import (
+	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-builder/types"
+	"github.com/arc-language/core-parser"
+)
+
+// 'type Fd = int32' declares an alias, which is the same type as int32
+// under another name. 'distinct type Port = uint16' declares a new type
+// with the representation of uint16: it lowers to the same IR, including in
+// extern signatures, but values only convert to and from uint16 (or any
+// other type) through cast<>. Untyped literals take a distinct type like
+// any other. Like structs, both are visible to importing namespaces.
+
+// distinctType describes a type declared 'distinct type'
+type distinctType struct {
+	name string
+	base types.Type
+}
+
+func (v *IRVisitor) VisitTypeAliasDecl(ctx *parser.TypeAliasDeclContext) interface{} {
+	name := ctx.IDENTIFIER().GetText()
+	if _, exists := v.ctx.GetType(name); exists {
+		v.ctx.Logger.Error("Type '%s' is already declared", name)
+		return nil
+	}
+	target := v.resolveType(ctx.Type_())
+
+	if ctx.DISTINCT() == nil {
+		v.logger.Debug("Type alias %s = %v", name, target)
+		v.ctx.RegisterType(name, target)
+		return nil
+	}
+
+	typ, ok := v.newDistinctType(name, v.ctx.BaseType(target))
+	if !ok {
+		v.ctx.Logger.Error("Cannot declare distinct type '%s' of %v", name, target)
+		return nil
+	}
+	v.ctx.distinctTypes[typ] = &distinctType{name: name, base: v.ctx.BaseType(target)}
+	v.ctx.RegisterType(name, typ)
+	v.logger.Debug("Distinct type %s of %v", name, target)
+	return nil
+}
+
+// newDistinctType makes a copy of base that the compiler can tell apart.
+// Structs get a struct of their own with the same fields; classes, strings
+// and the compiler's own aggregates (slices, maps, ...) cannot be copied.
+func (v *IRVisitor) newDistinctType(name string, base types.Type) (types.Type, bool) {
+	switch t := base.(type) {
+	case *types.IntType:
+		copied := *t
+		return &copied, true
+	case *types.FloatType:
+		copied := *t
+		return &copied, true
+	case *types.PointerType:
+		if _, isClass := v.classOf(t); isClass {
+			return nil, false
+		}
+		copied := *t
+		return &copied, true
+	case *types.ArrayType:
+		copied := *t
+		return &copied, true
+	case *types.StructType:
+		fields, isStruct := v.ctx.StructFieldIndices[t.Name]
+		if !isStruct || v.ctx.IsClassType(t.Name) {
+			return nil, false
+		}
+		v.ctx.StructFieldIndices[name] = fields
+		v.ctx.fieldDefaults[name] = v.ctx.fieldDefaults[t.Name]
+		if layout, ok := v.ctx.structLayouts[t.Name]; ok {
+			v.ctx.structLayouts[name] = layout
+		}
+		return types.NewStruct(name, t.Fields, t.Packed), true
+	}
+	return nil, false
+}
+
+// IsDistinct reports whether t was declared 'distinct type'
+func (c *Context) IsDistinct(t types.Type) bool {
+	_, ok := c.distinctTypes[t]
+	return ok
+}
+
+// BaseType returns the representation of a distinct type, and any other
+// type unchanged
+func (c *Context) BaseType(t types.Type) types.Type {
+	if d, ok := c.distinctTypes[t]; ok {
+		return d.base
+	}
+	return t
+}
+
+// SameType reports whether a and b are the same type, telling distinct
+// types apart from their base
+func (c *Context) SameType(a, b types.Type) bool {
+	return a.Equal(b) && c.distinctTypes[a] == c.distinctTypes[b]
+}
+
+// typeName names a type in diagnostics, using the name of distinct types
+func (v *IRVisitor) typeName(t types.Type) string {
+	if d, ok := v.ctx.distinctTypes[t]; ok {
+		return d.name
+	}
+	return t.String()
+}
+
+// mixesDistinct reports whether a value of type a used as b crosses
+// between a distinct type and another type
+func (v *IRVisitor) mixesDistinct(a, b types.Type) bool {
+	return !v.ctx.SameType(a, b) && (v.ctx.IsDistinct(a) || v.ctx.IsDistinct(b))
+}
+
+// retag gives val the type dest, which has the same representation
+func (v *IRVisitor) retag(val ir.Value, dest types.Type) ir.Value {
+	structType, isStruct := dest.(*types.StructType)
+	if !isStruct {
+		return v.ctx.Builder.CreateBitCast(val, dest, "")
+	}
+	var agg ir.Value = v.ctx.Builder.ConstZero(structType)
+	for i := range structType.Fields {
+		field := v.ctx.Builder.CreateExtractValue(val, []int{i}, "")
+		agg = v.ctx.Builder.CreateInsertValue(agg, field, []int{i}, "")
+	}
+	return agg
+}
@@ -0,0 +1,307 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/antlr4-go/antlr/v4"
+	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-builder/types"
+	"github.com/arc-language/core-parser"
+)
+
+// vector<T> is a reference-counted heap object, managed like a class:
+//
+//	{ i64 refcount, *T data, u64 len, u64 cap }
+//
+// Assigning a vector shares it. The element buffer grows by doubling and is
+// freed, after releasing class elements, when the last reference goes away.
+// push, pop, len and cap are generated per element type as methods.
+
+const (
+	vectorDataField = classHeaderFields + iota
+	vectorLenField
+	vectorCapField
+)
+
+// vectorInitialCap is the capacity of the first allocation of an empty vector
+const vectorInitialCap = 4
+
+// VectorElem returns the element type when typ is a vector
+func (c *Context) VectorElem(typ types.Type) (types.Type, bool) {
+	ptrType, ok := typ.(*types.PointerType)
+	if !ok {
+		return nil, false
+	}
+	structType, ok := ptrType.ElementType.(*types.StructType)
+	if !ok {
+		return nil, false
+	}
+	elem, ok := c.vectorElems[structType]
+	return elem, ok
+}
+
+// vectorType returns vector<elem>, emitting its methods the first time the
+// element type is seen
+func (v *IRVisitor) vectorType(elem types.Type) types.Type {
+	key := fmt.Sprint(elem)
+	if vecType, ok := v.ctx.vectorTypes[key]; ok {
+		return types.NewPointer(vecType)
+	}
+
+	name := fmt.Sprintf("__vector.%d", len(v.ctx.vectorTypes))
+	vecType := types.NewStruct(name, []types.Type{types.I64, types.NewPointer(elem), types.U64, types.U64}, false)
+	v.ctx.vectorTypes[key] = vecType
+	v.ctx.vectorElems[vecType] = elem
+	v.ctx.RegisterClass(name, vecType)
+	v.logger.Debug("Registered %s for vector<%v>", name, elem)
+
+	state := v.ctx.SuspendFunction()
+	v.emitVectorPush(vecType, elem)
+	v.emitVectorPop(vecType, elem)
+	v.emitVectorField(vecType, "len", vectorLenField)
+	v.emitVectorField(vecType, "cap", vectorCapField)
+	v.emitVectorDeinit(vecType, elem)
+	v.ctx.ResumeFunction(state)
+
+	return types.NewPointer(vecType)
+}
+
+func (v *IRVisitor) vectorField(vecType *types.StructType, vec ir.Value, field int) ir.Value {
+	gep := v.ctx.Builder.CreateStructGEP(vecType, vec, field, "")
+	return v.ctx.Builder.CreateLoad(vecType.Fields[field], gep, "")
+}
+
+func (v *IRVisitor) setVectorField(vecType *types.StructType, vec ir.Value, field int, val ir.Value) {
+	gep := v.ctx.Builder.CreateStructGEP(vecType, vec, field, "")
+	v.ctx.Builder.CreateStore(val, gep)
+}
+
+// reserveVector sets the capacity of an empty vector
+func (v *IRVisitor) reserveVector(vecType *types.StructType, vec ir.Value, elem types.Type, capacity ir.Value) {
+	elemSize := v.ctx.Builder.ConstInt(types.U64, int64(v.calculateSizeOf(elem)))
+	size := v.ctx.Builder.CreateMul(capacity, elemSize, "")
+	raw := v.emitMalloc(size)
+	data := v.ctx.Builder.CreateBitCast(raw, types.NewPointer(elem), "")
+	v.setVectorField(vecType, vec, vectorDataField, data)
+	v.setVectorField(vecType, vec, vectorCapField, capacity)
+}
+
+func (v *IRVisitor) emitVectorPush(vecType *types.StructType, elem types.Type) {
+	ptrType := types.NewPointer(vecType)
+	fn := v.ctx.Builder.CreateFunction(vecType.Name+"_push", types.Void, []types.Type{ptrType, elem}, false)
+	fn.Arguments[0].SetName("self")
+	fn.Arguments[1].SetName("value")
+	self, value := fn.Arguments[0], fn.Arguments[1]
+	v.ctx.RegisterMethod(vecType.Name, "push", fn)
+
+	entry := v.ctx.Builder.CreateBlock("entry")
+	growBlock := v.ctx.Builder.CreateBlock("grow")
+	storeBlock := v.ctx.Builder.CreateBlock("store")
+
+	v.ctx.SetInsertBlock(entry)
+	length := v.vectorField(vecType, self, vectorLenField)
+	capacity := v.vectorField(vecType, self, vectorCapField)
+	full := v.ctx.Builder.CreateICmpEQ(length, capacity, "")
+	v.ctx.Builder.CreateCondBr(full, growBlock, storeBlock)
+
+	// Double the capacity, starting from vectorInitialCap
+	v.ctx.SetInsertBlock(growBlock)
+	isEmpty := v.ctx.Builder.CreateICmpEQ(capacity, v.ctx.Builder.ConstInt(types.U64, 0), "")
+	doubled := v.ctx.Builder.CreateMul(capacity, v.ctx.Builder.ConstInt(types.U64, 2), "")
+	newCap := v.ctx.Builder.CreateSelect(isEmpty, v.ctx.Builder.ConstInt(types.U64, vectorInitialCap), doubled, "")
+	elemSize := v.ctx.Builder.ConstInt(types.U64, int64(v.calculateSizeOf(elem)))
+	oldData := v.ctx.Builder.CreateBitCast(v.vectorField(vecType, self, vectorDataField), types.NewPointer(types.I8), "")
+	size := v.ctx.Builder.CreateMul(newCap, elemSize, "")
+	raw := v.emitRealloc(oldData, size)
+	v.setVectorField(vecType, self, vectorDataField, v.ctx.Builder.CreateBitCast(raw, types.NewPointer(elem), ""))
+	v.setVectorField(vecType, self, vectorCapField, newCap)
+	v.ctx.Builder.CreateBr(storeBlock)
+
+	// The vector keeps its own reference to class elements
+	v.ctx.SetInsertBlock(storeBlock)
+	v.emitRetain(value)
+	data := v.vectorField(vecType, self, vectorDataField)
+	slot := v.ctx.Builder.CreateGEP(elem, data, []ir.Value{length}, "")
+	v.ctx.Builder.CreateStore(value, slot)
+	newLen := v.ctx.Builder.CreateAdd(length, v.ctx.Builder.ConstInt(types.U64, 1), "")
+	v.setVectorField(vecType, self, vectorLenField, newLen)
+	v.ctx.Builder.CreateRetVoid()
+}
+
+func (v *IRVisitor) emitVectorPop(vecType *types.StructType, elem types.Type) {
+	ptrType := types.NewPointer(vecType)
+	fn := v.ctx.Builder.CreateFunction(vecType.Name+"_pop", elem, []types.Type{ptrType}, false)
+	fn.Arguments[0].SetName("self")
+	self := fn.Arguments[0]
+	v.ctx.RegisterMethod(vecType.Name, "pop", fn)
+
+	entry := v.ctx.Builder.CreateBlock("entry")
+	emptyBlock := v.ctx.Builder.CreateBlock("empty")
+	popBlock := v.ctx.Builder.CreateBlock("pop")
+
+	v.ctx.SetInsertBlock(entry)
+	length := v.vectorField(vecType, self, vectorLenField)
+	isEmpty := v.ctx.Builder.CreateICmpEQ(length, v.ctx.Builder.ConstInt(types.U64, 0), "")
+	v.ctx.Builder.CreateCondBr(isEmpty, emptyBlock, popBlock)
+
+	v.ctx.SetInsertBlock(emptyBlock)
+	v.emitTrap("arc: pop from empty vector\n")
+
+	// The vector's reference to a class element passes to the caller
+	v.ctx.SetInsertBlock(popBlock)
+	newLen := v.ctx.Builder.CreateSub(length, v.ctx.Builder.ConstInt(types.U64, 1), "")
+	v.setVectorField(vecType, self, vectorLenField, newLen)
+	data := v.vectorField(vecType, self, vectorDataField)
+	slot := v.ctx.Builder.CreateGEP(elem, data, []ir.Value{newLen}, "")
+	v.ctx.Builder.CreateRet(v.ctx.Builder.CreateLoad(elem, slot, ""))
+}
+
+// emitVectorField emits a method returning one of the u64 header fields
+func (v *IRVisitor) emitVectorField(vecType *types.StructType, name string, field int) {
+	ptrType := types.NewPointer(vecType)
+	fn := v.ctx.Builder.CreateFunction(vecType.Name+"_"+name, types.U64, []types.Type{ptrType}, false)
+	fn.Arguments[0].SetName("self")
+	v.ctx.RegisterMethod(vecType.Name, name, fn)
+
+	v.ctx.SetInsertBlock(v.ctx.Builder.CreateBlock("entry"))
+	v.ctx.Builder.CreateRet(v.vectorField(vecType, fn.Arguments[0], field))
+}
+
+// emitVectorDeinit releases managed elements and frees the buffer; the class
+// release function calls it when the count reaches zero
+func (v *IRVisitor) emitVectorDeinit(vecType *types.StructType, elem types.Type) {
+	ptrType := types.NewPointer(vecType)
+	fn := v.ctx.Builder.CreateFunction(vecType.Name+"_deinit", types.Void, []types.Type{ptrType}, false)
+	fn.Arguments[0].SetName("self")
+	self := fn.Arguments[0]
+	v.ctx.Deinits[vecType.Name] = fn
+
+	entry := v.ctx.Builder.CreateBlock("entry")
+	v.ctx.SetInsertBlock(entry)
+	data := v.vectorField(vecType, self, vectorDataField)
+
+	if v.isManaged(elem) {
+		length := v.vectorField(vecType, self, vectorLenField)
+		indexPtr := v.ctx.Builder.CreateAlloca(types.U64, "i")
+		v.ctx.Builder.CreateStore(v.ctx.Builder.ConstInt(types.U64, 0), indexPtr)
+
+		condBlock := v.ctx.Builder.CreateBlock("release.cond")
+		bodyBlock := v.ctx.Builder.CreateBlock("release.body")
+		doneBlock := v.ctx.Builder.CreateBlock("release.done")
+		v.ctx.Builder.CreateBr(condBlock)
+
+		v.ctx.SetInsertBlock(condBlock)
+		index := v.ctx.Builder.CreateLoad(types.U64, indexPtr, "")
+		more := v.ctx.Builder.CreateICmpULT(index, length, "")
+		v.ctx.Builder.CreateCondBr(more, bodyBlock, doneBlock)
+
+		v.ctx.SetInsertBlock(bodyBlock)
+		slot := v.ctx.Builder.CreateGEP(elem, data, []ir.Value{index}, "")
+		v.emitRelease(v.ctx.Builder.CreateLoad(elem, slot, ""))
+		v.ctx.Builder.CreateStore(v.ctx.Builder.CreateAdd(index, v.ctx.Builder.ConstInt(types.U64, 1), ""), indexPtr)
+		v.ctx.Builder.CreateBr(condBlock)
+
+		v.ctx.SetInsertBlock(doneBlock)
+	}
+
+	raw := v.ctx.Builder.CreateBitCast(data, types.NewPointer(types.I8), "")
+	v.emitFree(raw)
+	v.ctx.Builder.CreateRetVoid()
+}
+
+// vectorElementAddress returns the address of vec[index] after checking the
+// index against the vector length
+func (v *IRVisitor) vectorElementAddress(vec ir.Value, elem types.Type, index ir.Value, at antlr.ParserRuleContext) ir.Value {
+	vecType := vec.Type().(*types.PointerType).ElementType.(*types.StructType)
+	v.emitBoundsCheck(index, v.vectorField(vecType, vec, vectorLenField), at)
+	data := v.vectorField(vecType, vec, vectorDataField)
+	return v.ctx.Builder.CreateGEP(elem, data, []ir.Value{v.castValue(index, types.I64)}, "")
+}
+
+// VisitCollectionLiteral builds a vector from '{a, b, c}', or a map from
+// '{k: v}'. The element type comes from the declared type when there is one,
+// otherwise from the first element.
+func (v *IRVisitor) VisitCollectionLiteral(ctx *parser.CollectionLiteralContext) interface{} {
+	hint := v.typeHint
+	v.typeHint = nil
+
+	if structType, isStruct := v.literalStruct(hint); isStruct {
+		return v.structFromCollection(ctx, structType)
+	}
+	if len(ctx.AllMapEntry()) > 0 {
+		return v.visitMapLiteral(ctx, hint)
+	}
+	if info, isMap := v.ctx.MapInfo(hint); isMap && len(ctx.AllExpression()) == 0 {
+		m := v.allocClassInstance(info.Type)
+		v.markOwned(m)
+		return m
+	}
+
+	exprs := ctx.AllExpression()
+	values := make([]ir.Value, len(exprs))
+	for i, expr := range exprs {
+		values[i] = v.Visit(expr).(ir.Value)
+	}
+
+	var elem types.Type
+	if hint != nil {
+		var isVector bool
+		if elem, isVector = v.ctx.VectorElem(hint); !isVector {
+			v.ctx.Logger.Error("Collection literal cannot initialize a value of type %v", hint)
+			return v.getZeroValue(hint)
+		}
+	} else if len(values) > 0 {
+		elem = values[0].Type()
+	} else {
+		v.ctx.Logger.Error("Empty collection literal needs a type annotation")
+		return v.ctx.Builder.ConstInt(types.I64, 0)
+	}
+
+	vecPtr := v.vectorType(elem).(*types.PointerType)
+	vecType := vecPtr.ElementType.(*types.StructType)
+	vec := v.allocClassInstance(vecType)
+
+	if len(values) > 0 {
+		v.reserveVector(vecType, vec, elem, v.ctx.Builder.ConstInt(types.U64, int64(len(values))))
+		data := v.vectorField(vecType, vec, vectorDataField)
+		for i, val := range values {
+			val = v.coerceTo(val, elem)
+			v.takeOwnership(val)
+			slot := v.ctx.Builder.CreateGEP(elem, data, []ir.Value{v.ctx.Builder.ConstInt(types.I64, int64(i))}, "")
+			v.ctx.Builder.CreateStore(val, slot)
+		}
+		v.setVectorField(vecType, vec, vectorLenField, v.ctx.Builder.ConstInt(types.U64, int64(len(values))))
+	}
+
+	v.markOwned(vec)
+	return vec
+}
+
+// visitWithHint evaluates expr where a value of type hint is expected, so
+// literals without a type of their own can take it
+func (v *IRVisitor) visitWithHint(expr antlr.ParseTree, hint types.Type) ir.Value {
+	// Only an expression that is just a collection literal takes the hint
+	if !isCollectionLiteral(expr) {
+		return v.Visit(expr).(ir.Value)
+	}
+	saved := v.typeHint
+	v.typeHint = hint
+	val := v.Visit(expr).(ir.Value)
+	v.typeHint = saved
+	return val
+}
+
+// isCollectionLiteral reports whether tree is a collection literal, looking
+// through the single-child rules the expression grammar wraps it in
+func isCollectionLiteral(tree antlr.Tree) bool {
+	for {
+		if _, ok := tree.(*parser.CollectionLiteralContext); ok {
+			return true
+		}
+		children := tree.GetChildren()
+		if len(children) != 1 {
+			return false
+		}
+		tree = children[0]
+	}
+}
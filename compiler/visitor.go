@@ -17,6 +17,43 @@ type IRVisitor struct {
 	
 	// Method call tracking
 	pendingMethodSelf ir.Value
+	
+	// Managed values holding a +1 reference that has not been bound yet,
+	// numbered in the order they were made
+	ownedTemps map[ir.Value]int
+	ownedSeq   int
+	
+	// Owned temporaries kept until the end of the statement even when
+	// passed as arguments
+	heldTemps map[ir.Value]bool
+	
+	// Results of throwing calls whose error has not been handled yet, with
+	// the name of the function called
+	errorResults map[ir.Value]string
+	
+	// Operands of range expressions, by the range value they produced
+	rangeLiterals map[ir.Value]rangeParts
+	
+	// Code points of char literals, which narrow to smaller integer types
+	charLiterals map[ir.Value]rune
+	
+	// Values of unsuffixed integer literals, which adapt to their context
+	intLiterals map[ir.Value]intLiteral
+	
+	// Unsuffixed float literals, which adapt to the float type expected
+	floatLiterals map[ir.Value]bool
+	
+	// Contents of string literals, which top-level constants may hold
+	stringLiterals map[ir.Value]string
+	
+	// Results of s.cstr(), with the terminated string they point into
+	cstrResults map[ir.Value]ir.Value
+	
+	// Type expected by the enclosing declaration, for untyped literals
+	typeHint types.Type
+	
+	// Namespace of the file declaring the extern block being visited
+	externOwner *Namespace
 }
 
 // NewIRVisitor creates a new IR visitor
@@ -30,6 +67,15 @@ func NewIRVisitor(c *Compiler, filename string) *IRVisitor {
 		ctx:                  c.context,
 		currentFile:          filename,
 		logger:               logger,
+		ownedTemps:           make(map[ir.Value]int),
+		heldTemps:            make(map[ir.Value]bool),
+		errorResults:         make(map[ir.Value]string),
+		rangeLiterals:        make(map[ir.Value]rangeParts),
+		charLiterals:         make(map[ir.Value]rune),
+		intLiterals:          make(map[ir.Value]intLiteral),
+		floatLiterals:        make(map[ir.Value]bool),
+		stringLiterals:       make(map[ir.Value]string),
+		cstrResults:          make(map[ir.Value]ir.Value),
 	}
 }
 
@@ -55,6 +101,8 @@ func (v *IRVisitor) Visit(tree antlr.ParseTree) interface{} {
 		return v.VisitExternMember(ctx)
 	case *parser.ExternFunctionDeclContext:
 		return v.VisitExternFunctionDecl(ctx)
+	case *parser.ExternVariableDeclContext:
+		return v.VisitExternVariableDecl(ctx)
 	case *parser.FunctionDeclContext:
 		return v.VisitFunctionDecl(ctx)
 	case *parser.StructDeclContext:
@@ -67,6 +115,8 @@ func (v *IRVisitor) Visit(tree antlr.ParseTree) interface{} {
 		return v.VisitClassField(ctx)
 	case *parser.DeinitDeclContext:
 		return v.VisitDeinitDecl(ctx)
+	case *parser.TypeAliasDeclContext:
+		return v.VisitTypeAliasDecl(ctx)
 	case *parser.BlockContext:
 		return v.VisitBlock(ctx)
 	case *parser.StatementContext:
@@ -89,6 +139,8 @@ func (v *IRVisitor) Visit(tree antlr.ParseTree) interface{} {
 		return v.VisitContinueStmt(ctx)
 	case *parser.DeferStmtContext:
 		return v.VisitDeferStmt(ctx)
+	case *parser.ThrowStmtContext:
+		return v.VisitThrowStmt(ctx)
 	case *parser.ExpressionStmtContext:
 		return v.VisitExpressionStmt(ctx)
 	case *parser.ExpressionContext:
@@ -117,6 +169,14 @@ func (v *IRVisitor) Visit(tree antlr.ParseTree) interface{} {
 		return v.VisitLiteral(ctx)
 	case *parser.StructLiteralContext:
 		return v.VisitStructLiteral(ctx)
+	case *parser.FunctionLiteralContext:
+		return v.VisitFunctionLiteral(ctx)
+	case *parser.TupleLiteralContext:
+		return v.VisitTupleLiteral(ctx)
+	case *parser.ArrayLiteralContext:
+		return v.VisitArrayLiteral(ctx)
+	case *parser.CollectionLiteralContext:
+		return v.VisitCollectionLiteral(ctx)
 	case *parser.CastExpressionContext:
 		return v.VisitCastExpression(ctx)
 	case *parser.AllocaExpressionContext:
@@ -152,32 +212,60 @@ func (v *IRVisitor) VisitCompilationUnit(ctx *parser.CompilationUnitContext) int
 		v.Visit(ns)
 	}
 
-	// Pass 1: Register all type declarations (structs and classes)
+	// Pass 1: Register all type declarations (structs, classes and type
+	// aliases), in source order
 	v.logger.Debug("Pass 1 - Registering types")
 	for _, decl := range ctx.AllTopLevelDecl() {
 		if decl.StructDecl() != nil {
 			v.registerStructType(decl.StructDecl().(*parser.StructDeclContext))
 		} else if decl.ClassDecl() != nil {
 			v.registerClassType(decl.ClassDecl().(*parser.ClassDeclContext))
+		} else if decl.TypeAliasDecl() != nil {
+			v.Visit(decl.TypeAliasDecl())
 		}
 	}
 	
-	// Pass 2: Process everything else
-	v.logger.Debug("Pass 2 - Processing declarations")
+	// Functions and methods are declared before any body is compiled, so
+	// global initializers and earlier functions can call them
+	v.logger.Debug("Declaring functions")
+	v.declareFunctions(ctx)
 	
+	// Pass 2: Externs, constants and globals, so every function can refer
+	// to them and global initializers can call any function. Const functions
+	// are registered first so that constants can call them.
+	v.logger.Debug("Pass 2 - Declaring externs, constants and globals")
 	for _, decl := range ctx.AllTopLevelDecl() {
 		if decl.FunctionDecl() != nil {
-			v.Visit(decl.FunctionDecl())
-		} else if decl.ExternDecl() != nil {
+			v.registerConstFunction(decl.FunctionDecl().(*parser.FunctionDeclContext))
+		}
+	}
+	for _, decl := range ctx.AllTopLevelDecl() {
+		if decl.ExternDecl() != nil {
 			v.Visit(decl.ExternDecl())
 		} else if decl.ConstDecl() != nil {
 			v.Visit(decl.ConstDecl())
 		} else if decl.VariableDecl() != nil {
 			v.Visit(decl.VariableDecl())
+		}
+	}
+	for _, decl := range ctx.AllTopLevelDecl() {
+		if decl.StructDecl() != nil {
+			v.checkFieldDefaults(decl.StructDecl().(*parser.StructDeclContext))
+		}
+	}
+	
+	// Pass 3: Process everything else
+	v.logger.Debug("Pass 3 - Processing declarations")
+	
+	for _, decl := range ctx.AllTopLevelDecl() {
+		if decl.FunctionDecl() != nil {
+			v.Visit(decl.FunctionDecl())
 		} else if decl.StructDecl() != nil {
 			v.Visit(decl.StructDecl())
 		} else if decl.ClassDecl() != nil {
 			v.Visit(decl.ClassDecl())
+		} else if decl.DeinitDecl() != nil {
+			v.Visit(decl.DeinitDecl())
 		}
 	}
 	
@@ -204,6 +292,12 @@ func (v *IRVisitor) VisitTopLevelDecl(ctx *parser.TopLevelDeclContext) interface
 	if ctx.VariableDecl() != nil {
 		return v.Visit(ctx.VariableDecl())
 	}
+	if ctx.DeinitDecl() != nil {
+		return v.Visit(ctx.DeinitDecl())
+	}
+	if ctx.TypeAliasDecl() != nil {
+		return v.Visit(ctx.TypeAliasDecl())
+	}
 	return nil
 }
 
@@ -236,6 +330,10 @@ func (v *IRVisitor) resolveType(ctx parser.ITypeContext) types.Type {
 	
 	if typeCtx.PointerType() != nil {
 		elemType := v.resolveType(typeCtx.PointerType().Type_())
+		// Classes are already references; *Connection names the same thing
+		if _, isClass := v.classOf(elemType); isClass {
+			return elemType
+		}
 		return types.NewPointer(elemType)
 	}
 	
@@ -244,19 +342,44 @@ func (v *IRVisitor) resolveType(ctx parser.ITypeContext) types.Type {
 		return types.NewPointer(elemType)
 	}
 	
+	if typeCtx.SliceType() != nil {
+		return v.ctx.SliceType(v.resolveType(typeCtx.SliceType().Type_()))
+	}
+	
+	if typeCtx.ArrayType() != nil {
+		return v.resolveArrayType(typeCtx.ArrayType())
+	}
+	
+	if typeCtx.TupleType() != nil {
+		return v.resolveTupleType(typeCtx.TupleType())
+	}
+	
+	if typeCtx.FunctionType() != nil {
+		return v.resolveFunctionType(typeCtx.FunctionType())
+	}
+	
 	if typeCtx.VectorType() != nil {
-		v.ctx.Logger.Warning("Vector types not yet implemented")
-		return types.I64
+		return v.vectorType(v.resolveType(typeCtx.VectorType().Type_()))
+	}
+	
+	if typeCtx.RangeType() != nil {
+		return v.resolveRangeType(typeCtx.RangeType())
+	}
+	
+	if typeCtx.OptionalType() != nil {
+		return v.resolveOptionalType(typeCtx.OptionalType())
 	}
 	
 	if typeCtx.MapType() != nil {
-		v.ctx.Logger.Warning("Map types not yet implemented")
-		return types.I64
+		return v.resolveMapType(typeCtx.MapType())
 	}
 	
 	if typeCtx.IDENTIFIER() != nil {
 		name := typeCtx.IDENTIFIER().GetText()
 		if typ, ok := v.ctx.GetType(name); ok {
+			if v.ctx.IsClassType(name) {
+				return types.NewPointer(typ)
+			}
 			return typ
 		}
 		v.ctx.Logger.Error("Unknown type: %s", name)
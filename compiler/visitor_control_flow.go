@@ -4,21 +4,20 @@ import (
 	"fmt"
 
 	"github.com/arc-language/core-builder/ir"
-	"github.com/arc-language/core-builder/types"
 	"github.com/arc-language/core-parser"
 )
 
 func (v *IRVisitor) VisitIfStmt(ctx *parser.IfStmtContext) interface{} {
-	// Generate unique suffix based on the source position (Line_Column)
 	token := ctx.GetStart()
-	uniqueID := fmt.Sprintf("%d_%d", token.GetLine(), token.GetColumn())
+	uniqueID := v.ctx.BlockSuffix()
 
-	v.logger.Debug("Compiling if statement at %s", uniqueID)
+	v.logger.Debug("Compiling if statement at %d:%d", token.GetLine(), token.GetColumn())
 
 	mergeBlock := v.ctx.Builder.CreateBlock("if.end." + uniqueID)
 
 	// First if condition
 	cond := v.Visit(ctx.Expression(0)).(ir.Value)
+	v.releaseTemporaries()
 	thenBlock := v.ctx.Builder.CreateBlock("if.then." + uniqueID)
 	nextCheckBlock := v.ctx.Builder.CreateBlock("if.next." + uniqueID)
 
@@ -38,6 +37,7 @@ func (v *IRVisitor) VisitIfStmt(ctx *parser.IfStmtContext) interface{} {
 	for i := 1; i < count; i++ {
 		v.logger.Debug("Compiling else-if branch %d", i)
 		cond := v.Visit(ctx.Expression(i)).(ir.Value)
+		v.releaseTemporaries()
 		
 		// Use index 'i' to ensure unique block names for else-if chains
 		thenName := fmt.Sprintf("elseif.then.%s.%d", uniqueID, i)
@@ -84,9 +84,9 @@ func (v *IRVisitor) VisitForStmt(ctx *parser.ForStmtContext) interface{} {
 
 	// Standard for-loop (C-style)
 	token := ctx.GetStart()
-	uniqueID := fmt.Sprintf("%d_%d", token.GetLine(), token.GetColumn())
+	uniqueID := v.ctx.BlockSuffix()
 
-	v.logger.Debug("Compiling C-style for loop at %s", uniqueID)
+	v.logger.Debug("Compiling C-style for loop at %d:%d", token.GetLine(), token.GetColumn())
 
 	semicolons := ctx.AllSEMICOLON()
 	isClause := len(semicolons) == 2
@@ -102,6 +102,7 @@ func (v *IRVisitor) VisitForStmt(ctx *parser.ForStmtContext) interface{} {
 				v.Visit(firstAssign)
 			}
 		}
+		v.releaseTemporaries()
 	}
 
 	condBlock := v.ctx.Builder.CreateBlock("loop.cond." + uniqueID)
@@ -139,6 +140,7 @@ func (v *IRVisitor) VisitForStmt(ctx *parser.ForStmtContext) interface{} {
 	} else {
 		cond = v.ctx.Builder.True()
 	}
+	v.releaseTemporaries()
 
 	v.ctx.Builder.CreateCondBr(cond, bodyBlock, endBlock)
 
@@ -166,6 +168,7 @@ func (v *IRVisitor) VisitForStmt(ctx *parser.ForStmtContext) interface{} {
 				v.Visit(expr)
 			}
 		}
+		v.releaseTemporaries()
 	}
 
 	if v.ctx.Builder.GetInsertBlock().Terminator() == nil {
@@ -173,99 +176,7 @@ func (v *IRVisitor) VisitForStmt(ctx *parser.ForStmtContext) interface{} {
 	}
 
 	v.ctx.SetInsertBlock(endBlock)
-	return nil
-}
-
-func (v *IRVisitor) visitForInLoop(ctx *parser.ForStmtContext) interface{} {
-	// Format: for IDENTIFIER in EXPRESSION { BLOCK }
-	varName := ctx.IDENTIFIER(0).GetText()
-	
-	v.logger.Debug("Compiling for-in loop with variable '%s'", varName)
-
-	// 1. Unpack the Range Expression
-	expr := ctx.Expression(0)
-	
-	var rngCtx parser.IRangeExpressionContext
-	
-	// Safe navigation down the AST to find RangeExpression
-	if lor := expr.LogicalOrExpression(); lor != nil {
-		if land := lor.LogicalAndExpression(0); land != nil {
-			if eq := land.EqualityExpression(0); eq != nil {
-				if rel := eq.RelationalExpression(0); rel != nil {
-					rngCtx = rel.RangeExpression(0)
-				}
-			}
-		}
-	}
-
-	// Check if we actually found a range ".."
-	if rngCtx == nil || rngCtx.RANGE() == nil {
-		v.ctx.Logger.Error("for-in loop expects a range (e.g., 1..10)")
-		return nil
-	}
-
-	// 2. Evaluate Start and End
-	startVal := v.Visit(rngCtx.AdditiveExpression(0)).(ir.Value)
-	endVal := v.Visit(rngCtx.AdditiveExpression(1)).(ir.Value)
-
-	// Basic type check
-	if !startVal.Type().Equal(endVal.Type()) {
-		v.logger.Warning("Range start and end types differ, may need implicit cast")
-	}
-
-	// 3. Setup Loop Variable
-	loopVarType := startVal.Type()
-	loopVarPtr := v.ctx.Builder.CreateAlloca(loopVarType, varName+".addr")
-	
-	// Initialize loop variable
-	v.ctx.Builder.CreateStore(startVal, loopVarPtr)
-	v.ctx.currentScope.Define(varName, loopVarPtr)
-
-	// 4. Create Blocks
-	token := ctx.GetStart()
-	uniqueID := fmt.Sprintf("%d_%d", token.GetLine(), token.GetColumn())
-	
-	condBlock := v.ctx.Builder.CreateBlock("for.cond." + uniqueID)
-	bodyBlock := v.ctx.Builder.CreateBlock("for.body." + uniqueID)
-	stepBlock := v.ctx.Builder.CreateBlock("for.step." + uniqueID)
-	endBlock := v.ctx.Builder.CreateBlock("for.end." + uniqueID)
-
-	v.ctx.Builder.CreateBr(condBlock)
-
-	// 5. Condition Block: if x < end
-	v.ctx.SetInsertBlock(condBlock)
-	currVal := v.ctx.Builder.CreateLoad(loopVarType, loopVarPtr, "")
-	
-	cmp := v.ctx.Builder.CreateICmpSLT(currVal, endVal, "")
-	v.ctx.Builder.CreateCondBr(cmp, bodyBlock, endBlock)
-
-	// 6. Body Block
-	v.ctx.SetInsertBlock(bodyBlock)
-	v.ctx.PushLoop(stepBlock, endBlock) 
-	v.Visit(ctx.Block())
-	v.ctx.PopLoop()
-
-	if v.ctx.Builder.GetInsertBlock().Terminator() == nil {
-		v.ctx.Builder.CreateBr(stepBlock)
-	}
-
-	// 7. Step Block: x = x + 1
-	v.ctx.SetInsertBlock(stepBlock)
-	currValForStep := v.ctx.Builder.CreateLoad(loopVarType, loopVarPtr, "")
-	
-	var one ir.Constant
-	if intType, ok := loopVarType.(*types.IntType); ok {
-		one = v.ctx.Builder.ConstInt(intType, 1)
-	} else {
-		one = v.ctx.Builder.ConstInt(types.I64, 1)
-	}
-
-	nextVal := v.ctx.Builder.CreateAdd(currValForStep, one, "")
-	v.ctx.Builder.CreateStore(nextVal, loopVarPtr)
-	v.ctx.Builder.CreateBr(condBlock)
-
-	// 8. End Block
-	v.ctx.SetInsertBlock(endBlock)
+	v.ctx.currentScope.EmitCleanups()
 	return nil
 }
 
@@ -276,6 +187,7 @@ func (v *IRVisitor) VisitBreakStmt(ctx *parser.BreakStmtContext) interface{} {
 		return nil
 	}
 	v.logger.Debug("Emitting break instruction")
+	v.ctx.EmitCleanupsUntil(loop.Scope)
 	v.ctx.Builder.CreateBr(loop.BreakBlock)
 	return nil
 }
@@ -287,6 +199,7 @@ func (v *IRVisitor) VisitContinueStmt(ctx *parser.ContinueStmtContext) interface
 		return nil
 	}
 	v.logger.Debug("Emitting continue instruction")
+	v.ctx.EmitCleanupsUntil(loop.Scope)
 	v.ctx.Builder.CreateBr(loop.ContinueBlock)
 	return nil
 }
\ No newline at end of file
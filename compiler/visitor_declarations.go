@@ -4,6 +4,7 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/antlr4-go/antlr/v4"
 	"github.com/arc-language/core-builder/ir"
 	"github.com/arc-language/core-builder/types"
 	"github.com/arc-language/core-parser"
@@ -45,6 +46,7 @@ func (v *IRVisitor) VisitImportDecl(ctx *parser.ImportDeclContext) interface{} {
 
 func (v *IRVisitor) VisitExternDecl(ctx *parser.ExternDeclContext) interface{} {
 	var namespaceName string
+	v.externOwner = v.declaringNamespace()
 	
 	if ctx.IDENTIFIER() != nil {
 		namespaceName = ctx.IDENTIFIER().GetText()
@@ -75,15 +77,19 @@ func (v *IRVisitor) VisitExternMember(ctx *parser.ExternMemberContext) interface
 	if ctx.ExternFunctionDecl() != nil {
 		return v.Visit(ctx.ExternFunctionDecl())
 	}
+	if ctx.ExternVariableDecl() != nil {
+		return v.Visit(ctx.ExternVariableDecl())
+	}
 	return nil
 }
 
 func (v *IRVisitor) VisitExternFunctionDecl(ctx *parser.ExternFunctionDeclContext) interface{} {
 	name := ctx.IDENTIFIER().GetText()
+	linkName := externLinkName(name, ctx.STRING_LITERAL())
 	
 	var retType types.Type = types.Void
 	if ctx.Type_() != nil {
-		retType = v.resolveType(ctx.Type_())
+		retType = v.externType(v.resolveType(ctx.Type_()))
 	}
 	
 	paramTypes := make([]types.Type, 0)
@@ -95,49 +101,237 @@ func (v *IRVisitor) VisitExternFunctionDecl(ctx *parser.ExternFunctionDeclContex
 			variadic = true
 		}
 		for _, typeCtx := range paramCtx.AllType_() {
-			paramTypes = append(paramTypes, v.resolveType(typeCtx))
+			// Function types cross the C boundary as raw function pointers
+			paramTypes = append(paramTypes, v.externType(v.resolveType(typeCtx)))
 		}
 	}
 	
-	fn := v.ctx.Builder.DeclareFunction(name, retType, paramTypes, variadic)
+	fn := v.declareCFunction(linkName, retType, paramTypes, variadic)
+	if fn == nil || !v.registerExtern(name, linkName, &Symbol{Name: name, Value: fn}) {
+		return nil
+	}
 	
-	// Register in current namespace
+	// Register under the Arc name in current namespace
 	if v.ctx.currentNamespace != nil {
 		v.ctx.currentNamespace.Functions[name] = fn
-		v.logger.Debug("Declared extern function '%s' in namespace '%s'", name, v.ctx.currentNamespace.Name)
+		v.logger.Debug("Declared extern function '%s' (%s) in namespace '%s'", name, linkName, v.ctx.currentNamespace.Name)
 	} else {
 		v.ctx.currentScope.Define(name, fn)
-		v.logger.Debug("Declared extern function '%s' in global scope", name)
+		v.logger.Debug("Declared extern function '%s' (%s) in global scope", name, linkName)
+	}
+	
+	return nil
+}
+
+// VisitExternVariableDecl declares a variable defined in C, such as
+// 'let environ: **byte' or 'let out "stdout": *void'
+func (v *IRVisitor) VisitExternVariableDecl(ctx *parser.ExternVariableDeclContext) interface{} {
+	name := ctx.IDENTIFIER().GetText()
+	linkName := externLinkName(name, ctx.STRING_LITERAL())
+	if ctx.Type_() == nil {
+		v.ctx.Logger.Error("Extern variable '%s' needs a type", name)
+		return nil
+	}
+	typ := v.externType(v.resolveType(ctx.Type_()))
+	
+	global := v.ctx.Module.GetGlobal(linkName)
+	if global == nil {
+		global = v.ctx.Builder.DeclareGlobal(linkName, typ)
+	} else if !global.Type().(*types.PointerType).ElementType.Equal(typ) {
+		v.ctx.Logger.Error("Extern variable '%s' redeclares C symbol '%s' with a different type", name, linkName)
+		return nil
+	}
+	
+	sym := &Symbol{Name: name, Value: global, IsAddress: true, ElemType: typ}
+	if !v.registerExtern(name, linkName, sym) {
+		return nil
+	}
+	if ns := v.ctx.currentNamespace; ns != nil {
+		sym.Namespace = ns.Name
+		ns.Globals[name] = sym
+		v.logger.Debug("Declared extern variable '%s' (%s) in namespace '%s'", name, linkName, ns.Name)
+	} else {
+		v.ctx.currentScope.DefineAddress(name, global, typ)
+		v.logger.Debug("Declared extern variable '%s' (%s) in global scope", name, linkName)
 	}
 	
 	return nil
 }
 
+// registerExtern makes an extern visible without qualification to the
+// namespace declaring it. An Arc name can stand for only one C symbol there.
+func (v *IRVisitor) registerExtern(name, linkName string, sym *Symbol) bool {
+	owner := v.externOwner
+	if prev, ok := v.ctx.externs[owner][name]; ok && prev.Value != sym.Value {
+		v.ctx.Logger.Error("Extern '%s' (%s) conflicts with an earlier extern of that name in namespace '%s'", name, linkName, owner.Name)
+		return false
+	}
+	if v.ctx.externs[owner] == nil {
+		v.ctx.externs[owner] = make(map[string]*Symbol)
+	}
+	v.ctx.externs[owner][name] = sym
+	return true
+}
+
+// externLinkName returns the C symbol of an extern, given as a string after
+// its name, 'func sleep "usleep"(...)', or else the name itself
+func externLinkName(name string, symbol antlr.TerminalNode) string {
+	if symbol == nil {
+		return name
+	}
+	return strings.Trim(symbol.GetText(), "\"")
+}
+
 // ============================================================================
 // FUNCTION DECLARATIONS
 // ============================================================================
 
+// functionProto is a function declared ahead of its body, so that global
+// initializers and functions compiled before it can call it
+type functionProto struct {
+	fn         *ir.Function
+	entry      *ir.BasicBlock
+	name       string
+	isMain     bool
+	throws     bool
+	indirect   bool
+	exported   bool
+	retType    types.Type
+	valueType  types.Type
+	paramNames []string
+}
+
+// declareFunctions declares every function and method of a file before
+// globals are initialized and bodies compiled
+func (v *IRVisitor) declareFunctions(ctx *parser.CompilationUnitContext) {
+	for _, decl := range ctx.AllTopLevelDecl() {
+		if decl.FunctionDecl() != nil {
+			v.declareFunction(decl.FunctionDecl().(*parser.FunctionDeclContext))
+		} else if decl.StructDecl() != nil {
+			for _, member := range decl.StructDecl().AllStructMember() {
+				if member.FunctionDecl() != nil {
+					v.declareFunction(member.FunctionDecl().(*parser.FunctionDeclContext))
+				}
+			}
+		} else if decl.ClassDecl() != nil {
+			for _, member := range decl.ClassDecl().AllClassMember() {
+				if member.FunctionDecl() != nil {
+					v.declareFunction(member.FunctionDecl().(*parser.FunctionDeclContext))
+				}
+			}
+		}
+	}
+}
+
 func (v *IRVisitor) VisitFunctionDecl(ctx *parser.FunctionDeclContext) interface{} {
+	proto, declared := v.ctx.functionProtos[ctx]
+	if !declared {
+		proto = v.declareFunction(ctx)
+	}
+	if proto == nil {
+		return nil
+	}
+	fn, name, isMain := proto.fn, proto.name, proto.isMain
+	retType, valueType, paramNames := proto.retType, proto.valueType, proto.paramNames
+	
+	v.ctx.EnterFunction(fn)
+	if proto.indirect {
+		v.ctx.returnSlot = fn.Arguments[len(fn.Arguments)-1]
+	}
+	
+	if isMain && v.ctx.DebugLeaks {
+		v.ctx.AddCleanup(func() {
+			v.ctx.Builder.CreateCallByName("__arc_report_leaks", types.Void, []ir.Value{}, "")
+		})
+	}
+	
+	if ctx.Block() != nil {
+		v.ctx.SetInsertBlock(proto.entry)
+		
+		// Allocate space for parameters and store them
+		for i, arg := range fn.Arguments[:len(paramNames)] {
+			alloc := v.ctx.Builder.CreateAlloca(arg.Type(), paramNames[i]+".addr")
+			v.ctx.Builder.CreateStore(arg, alloc)
+			v.ctx.currentScope.Define(paramNames[i], alloc)
+		}
+		
+		// Globals with non-constant initializers are set before main runs
+		if isMain {
+			v.ctx.moduleInitUsed = true
+			v.ctx.Builder.CreateCallByName("__arc_module_init", types.Void, []ir.Value{}, "")
+		}
+		
+		v.Visit(ctx.Block())
+		
+		// Add default return if needed
+		if v.ctx.Builder.GetInsertBlock().Terminator() == nil && proto.throws {
+			v.emitReturn(v.errorResult(valueType, nil, v.ctx.Builder.ConstInt(types.I32, 0)))
+		} else if v.ctx.Builder.GetInsertBlock().Terminator() == nil {
+			v.ctx.EmitCleanupsUntil(nil)
+			if retType.Kind() == types.VoidKind || proto.indirect {
+				v.ctx.Builder.CreateRetVoid()
+			} else {
+				zero := v.getZeroValue(retType)
+				v.ctx.Builder.CreateRet(zero)
+			}
+		}
+	}
+	
+	v.ctx.ExitFunction()
+	if proto.exported {
+		v.cAdapter(fn, name)
+	}
+	return nil
+}
+
+// declareFunction creates the IR function of a declaration and registers
+// it, without compiling its body. Each declaration is declared once; nil
+// means it was rejected.
+func (v *IRVisitor) declareFunction(ctx *parser.FunctionDeclContext) *functionProto {
+	if proto, declared := v.ctx.functionProtos[ctx]; declared {
+		return proto
+	}
+	v.ctx.functionProtos[ctx] = nil
+	
 	name := ctx.IDENTIFIER().GetText()
+	methodName := name
 	
 	// Check if this is a method inside a class/struct
-	var methodPrefix string
+	var ownerType string
 	if parent := ctx.GetParent(); parent != nil {
 		if classMember, ok := parent.(*parser.ClassMemberContext); ok {
 			if classDecl, ok := classMember.GetParent().(*parser.ClassDeclContext); ok {
-				className := classDecl.IDENTIFIER().GetText()
-				methodPrefix = className + "_"
-				name = methodPrefix + name
+				ownerType = classDecl.IDENTIFIER().GetText()
 			}
 		} else if structMember, ok := parent.(*parser.StructMemberContext); ok {
 			if structDecl, ok := structMember.GetParent().(*parser.StructDeclContext); ok {
-				structName := structDecl.IDENTIFIER().GetText()
-				methodPrefix = structName + "_"
-				name = methodPrefix + name
+				ownerType = structDecl.IDENTIFIER().GetText()
+			}
+		}
+	}
+	
+	// An explicit 'self' receiver binds the function to its type, which is
+	// how out-of-line methods (func start(self s: *Server)) are declared
+	if ctx.ParameterList() != nil {
+		params := ctx.ParameterList().AllParameter()
+		if len(params) > 0 && params[0].SELF() != nil {
+			receiverType := v.receiverTypeName(params[0])
+			if _, ok := v.ctx.GetType(receiverType); !ok {
+				v.ctx.Logger.Error("Unknown receiver type '%s' for method '%s'", receiverType, methodName)
+				return nil
+			}
+			if ownerType != "" && receiverType != ownerType {
+				v.ctx.Logger.Error("Method '%s' declared in '%s' has receiver of type '%s'", methodName, ownerType, receiverType)
+				return nil
 			}
+			ownerType = receiverType
 		}
 	}
 	
+	if ownerType != "" {
+		name = ownerType + "_" + name
+	}
+	
 	// Handle Namespacing
 	var irName string = name
 	
@@ -155,6 +349,17 @@ func (v *IRVisitor) VisitFunctionDecl(ctx *parser.FunctionDeclContext) interface
 		retType = v.resolveType(ctx.Type_())
 	}
 	
+	// Throwing functions return their value together with an error code
+	valueType := retType
+	throws := ctx.THROWS() != nil
+	if throws {
+		if isMain {
+			v.ctx.Logger.Error("'main' cannot be declared 'throws'")
+			return nil
+		}
+		retType = v.errorResultType(valueType)
+	}
+	
 	paramTypes := make([]types.Type, 0)
 	paramNames := make([]string, 0)
 	variadic := false
@@ -172,45 +377,87 @@ func (v *IRVisitor) VisitFunctionDecl(ctx *parser.FunctionDeclContext) interface
 		}
 	}
 
-	fn := v.ctx.Builder.CreateFunction(irName, retType, paramTypes, variadic)
+	// '@export' functions are callable from C by their unqualified name,
+	// through an adapter when the C signature differs
+	exported := false
+	for _, attr := range ctx.AllAttribute() {
+		if attrName := attr.IDENTIFIER().GetText(); attrName != "export" {
+			v.ctx.Logger.Error("Unknown attribute @%s on function '%s'", attrName, name)
+			continue
+		}
+		if ownerType != "" || throws || variadic {
+			v.ctx.Logger.Error("Function '%s' cannot be exported: methods, throwing and variadic functions have no C signature", name)
+			continue
+		}
+		exported = true
+		if irName == name {
+			cRet, cParams := v.cTypes(retType, paramTypes)
+			if v.cSignature(cRet, cParams).lowered() || v.returnsIndirectly(retType) {
+				irName = name + ".arc"
+			}
+		}
+	}
+
+	// Large tuples are written to a caller-provided slot
+	irRetType := retType
+	indirect := v.returnsIndirectly(retType)
+	if indirect {
+		irRetType = types.Void
+		paramTypes = append(paramTypes, types.NewPointer(retType))
+	}
+	
+	fn := v.ctx.Builder.CreateFunction(irName, irRetType, paramTypes, variadic)
+	if indirect {
+		v.ctx.indirectReturns[fn] = retType
+		fn.Arguments[len(fn.Arguments)-1].SetName("ret.slot")
+	}
+	if throws {
+		v.ctx.throwing[fn] = valueType
+	}
 	
 	// Register function in the current namespace
 	if v.ctx.currentNamespace != nil {
 		v.ctx.currentNamespace.Functions[name] = fn
 	}
+	
+	// Register method on its receiver type
+	if ownerType != "" {
+		v.ctx.RegisterMethod(ownerType, methodName, fn)
+	}
 
 	for i, paramName := range paramNames {
 		fn.Arguments[i].SetName(paramName)
 	}
 	
-	v.ctx.EnterFunction(fn)
-	
+	proto := &functionProto{
+		fn:         fn,
+		name:       name,
+		isMain:     isMain,
+		throws:     throws,
+		indirect:   indirect,
+		exported:   exported,
+		retType:    retType,
+		valueType:  valueType,
+		paramNames: paramNames,
+	}
 	if ctx.Block() != nil {
-		entry := v.ctx.Builder.CreateBlock("entry")
-		v.ctx.SetInsertBlock(entry)
-		
-		// Allocate space for parameters and store them
-		for i, arg := range fn.Arguments {
-			alloc := v.ctx.Builder.CreateAlloca(arg.Type(), paramNames[i]+".addr")
-			v.ctx.Builder.CreateStore(arg, alloc)
-			v.ctx.currentScope.Define(paramNames[i], alloc)
-		}
-		
-		v.Visit(ctx.Block())
-		
-		// Add default return if needed
-		if v.ctx.Builder.GetInsertBlock().Terminator() == nil {
-			if retType.Kind() == types.VoidKind {
-				v.ctx.Builder.CreateRetVoid()
-			} else {
-				zero := v.getZeroValue(retType)
-				v.ctx.Builder.CreateRet(zero)
-			}
-		}
+		proto.entry = v.ctx.Builder.CreateBlock("entry")
 	}
-	
-	v.ctx.ExitFunction()
-	return nil
+	v.ctx.functionProtos[ctx] = proto
+	return proto
+}
+
+// receiverTypeName returns the type name of a 'self' receiver parameter,
+// looking through a pointer receiver (self c: *Connection)
+func (v *IRVisitor) receiverTypeName(param parser.IParameterContext) string {
+	typeCtx := param.Type_().(*parser.TypeContext)
+	if typeCtx.PointerType() != nil {
+		typeCtx = typeCtx.PointerType().Type_().(*parser.TypeContext)
+	}
+	if typeCtx.IDENTIFIER() != nil {
+		return typeCtx.IDENTIFIER().GetText()
+	}
+	return typeCtx.GetText()
 }
 
 // ============================================================================
@@ -218,8 +465,36 @@ func (v *IRVisitor) VisitFunctionDecl(ctx *parser.FunctionDeclContext) interface
 // ============================================================================
 
 func (v *IRVisitor) VisitVariableDecl(ctx *parser.VariableDeclContext) interface{} {
+	// Top-level variables are globals
+	if v.ctx.currentFunction == nil {
+		if ctx.TuplePattern() != nil || ctx.IDENTIFIER().GetText() == "_" {
+			v.ctx.Logger.Error("Top-level 'let' must declare a single named variable")
+			return nil
+		}
+		v.declareGlobal(ctx)
+		return nil
+	}
+	
+	// Destructuring: let (n, err) = read(fd, buf, len)
+	if ctx.TuplePattern() != nil {
+		if ctx.Expression() == nil {
+			v.ctx.Logger.Error("Tuple pattern needs an initializer")
+			return nil
+		}
+		v.declareTuplePattern(ctx.TuplePattern(), v.Visit(ctx.Expression()).(ir.Value))
+		return nil
+	}
+	
 	name := ctx.IDENTIFIER().GetText()
 	
+	// 'let _ = expr' evaluates expr and explicitly discards its result
+	if name == "_" && ctx.Expression() != nil {
+		val := v.Visit(ctx.Expression()).(ir.Value)
+		delete(v.errorResults, val)
+		v.releaseTemporary(val)
+		return nil
+	}
+	
 	v.logger.Debug("Declaring variable: %s", name)
 	
 	var varType types.Type
@@ -229,10 +504,17 @@ func (v *IRVisitor) VisitVariableDecl(ctx *parser.VariableDeclContext) interface
 	
 	var initValue ir.Value
 	if ctx.Expression() != nil {
-		initValue = v.Visit(ctx.Expression()).(ir.Value)
+		initValue = v.visitWithHint(ctx.Expression(), varType)
+		v.bindCString(name, initValue)
 		if varType == nil {
 			varType = initValue.Type()
+			// Functions stored in variables are closures
+			if fn, ok := initValue.(*ir.Function); ok {
+				sig := v.functionSignature(fn)
+				varType = v.ctx.ClosureType(sig.Ret, sig.Params)
+			}
 		}
+		initValue = v.coerceTo(initValue, varType)
 	} else {
 		if varType == nil {
 			v.ctx.Logger.Error("Variable '%s' needs type annotation or initializer", name)
@@ -240,10 +522,13 @@ func (v *IRVisitor) VisitVariableDecl(ctx *parser.VariableDeclContext) interface
 		}
 		initValue = v.getZeroValue(varType)
 	}
-
+	
+	v.takeOwnership(initValue)
+	
 	alloca := v.ctx.Builder.CreateAlloca(varType, name+".addr")
 	v.ctx.Builder.CreateStore(initValue, alloca)
 	v.ctx.currentScope.Define(name, alloca)
+	v.releaseOnExit(alloca)
 	
 	return nil
 }
@@ -258,7 +543,34 @@ func (v *IRVisitor) VisitConstDecl(ctx *parser.ConstDeclContext) interface{} {
 		return nil
 	}
 	
-	initValue := v.Visit(ctx.Expression()).(ir.Value)
+	var typ types.Type
+	if ctx.Type_() != nil {
+		typ = v.resolveType(ctx.Type_())
+	}
+	
+	// Top-level constants belong to the namespace
+	if v.ctx.currentFunction == nil {
+		v.declareNamespaceConst(name, typ, ctx.Expression())
+		return nil
+	}
+	
+	// Local constants are folded when they can be, and otherwise are
+	// immutable bindings of a runtime value
+	var initValue ir.Value
+	if c, err := v.evalConst(ctx.Expression()); err == nil {
+		if typ != nil {
+			if c, err = v.convertConst(c, typ); err != nil {
+				v.ctx.Logger.Error("Constant '%s': %v", name, err)
+				return nil
+			}
+		}
+		initValue = v.constToValue(c)
+	} else {
+		initValue = v.visitWithHint(ctx.Expression(), typ)
+		if typ != nil {
+			initValue = v.coerceTo(initValue, typ)
+		}
+	}
 	v.ctx.currentScope.DefineConst(name, initValue)
 	
 	return nil
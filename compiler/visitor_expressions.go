@@ -2,7 +2,6 @@ package compiler
 
 import (
 	"fmt"
-	"strconv"
 
 	"github.com/arc-language/core-builder/ir"
 	"github.com/arc-language/core-builder/types"
@@ -35,7 +34,16 @@ func (v *IRVisitor) VisitEqualityExpression(ctx *parser.EqualityExpressionContex
 	result := v.Visit(ctx.RelationalExpression(0)).(ir.Value)
 	for i := 1; i < len(ctx.AllRelationalExpression()); i++ {
 		rhs := v.Visit(ctx.RelationalExpression(i)).(ir.Value)
+		result, rhs = v.matchLiteralOperands(result, rhs)
+		op := "!="
 		if i-1 < len(ctx.AllEQ()) {
+			op = "=="
+		}
+		if v.ctx.IsString(result.Type()) && v.ctx.IsString(rhs.Type()) {
+			result = v.compareStrings(result, rhs, op)
+		} else if _, isStruct := result.Type().(*types.StructType); isStruct {
+			result = v.compareStructs(result, rhs, op)
+		} else if op == "==" {
 			result = v.ctx.Builder.CreateICmpEQ(result, rhs, "")
 		} else {
 			result = v.ctx.Builder.CreateICmpNE(result, rhs, "")
@@ -48,7 +56,18 @@ func (v *IRVisitor) VisitRelationalExpression(ctx *parser.RelationalExpressionCo
 	result := v.Visit(ctx.RangeExpression(0)).(ir.Value)
 	for i := 1; i < len(ctx.AllRangeExpression()); i++ {
 		rhs := v.Visit(ctx.RangeExpression(i)).(ir.Value)
-		if i-1 < len(ctx.AllLT()) {
+		result, rhs = v.matchLiteralOperands(result, rhs)
+		if v.ctx.IsString(result.Type()) && v.ctx.IsString(rhs.Type()) {
+			op := ">="
+			if i-1 < len(ctx.AllLT()) {
+				op = "<"
+			} else if i-1-len(ctx.AllLT()) < len(ctx.AllLE()) {
+				op = "<="
+			} else if i-1-len(ctx.AllLT())-len(ctx.AllLE()) < len(ctx.AllGT()) {
+				op = ">"
+			}
+			result = v.compareStrings(result, rhs, op)
+		} else if i-1 < len(ctx.AllLT()) {
 			result = v.ctx.Builder.CreateICmpSLT(result, rhs, "")
 		} else if i-1-len(ctx.AllLT()) < len(ctx.AllLE()) {
 			result = v.ctx.Builder.CreateICmpSLE(result, rhs, "")
@@ -61,15 +80,18 @@ func (v *IRVisitor) VisitRelationalExpression(ctx *parser.RelationalExpressionCo
 	return result
 }
 
-func (v *IRVisitor) VisitRangeExpression(ctx *parser.RangeExpressionContext) interface{} {
-	return v.Visit(ctx.AdditiveExpression(0))
-}
-
 func (v *IRVisitor) VisitAdditiveExpression(ctx *parser.AdditiveExpressionContext) interface{} {
 	result := v.Visit(ctx.MultiplicativeExpression(0)).(ir.Value)
 	for i := 1; i < len(ctx.AllMultiplicativeExpression()); i++ {
 		rhs := v.Visit(ctx.MultiplicativeExpression(i)).(ir.Value)
-		if i-1 < len(ctx.AllPLUS()) {
+		result, rhs = v.matchLiteralOperands(result, rhs)
+		if v.ctx.IsString(result.Type()) || v.ctx.IsString(rhs.Type()) {
+			if i-1 >= len(ctx.AllPLUS()) || !v.ctx.IsString(result.Type()) || !v.ctx.IsString(rhs.Type()) {
+				v.ctx.Logger.Error("Strings only support '+' with another string")
+				continue
+			}
+			result = v.concatStrings(result, rhs)
+		} else if i-1 < len(ctx.AllPLUS()) {
 			result = v.ctx.Builder.CreateAdd(result, rhs, "")
 		} else {
 			result = v.ctx.Builder.CreateSub(result, rhs, "")
@@ -82,6 +104,7 @@ func (v *IRVisitor) VisitMultiplicativeExpression(ctx *parser.MultiplicativeExpr
 	result := v.Visit(ctx.UnaryExpression(0)).(ir.Value)
 	for i := 1; i < len(ctx.AllUnaryExpression()); i++ {
 		rhs := v.Visit(ctx.UnaryExpression(i)).(ir.Value)
+		result, rhs = v.matchLiteralOperands(result, rhs)
 		if i-1 < len(ctx.AllSTAR()) {
 			result = v.ctx.Builder.CreateMul(result, rhs, "")
 		} else if i-1-len(ctx.AllSTAR()) < len(ctx.AllSLASH()) {
@@ -96,12 +119,19 @@ func (v *IRVisitor) VisitMultiplicativeExpression(ctx *parser.MultiplicativeExpr
 func (v *IRVisitor) VisitUnaryExpression(ctx *parser.UnaryExpressionContext) interface{} {
 	if ctx.MINUS() != nil {
 		val := v.Visit(ctx.UnaryExpression()).(ir.Value)
+		if lit, isLiteral := v.intLiterals[val]; isLiteral {
+			return v.negateLiteral(lit)
+		}
 		zero := v.getZeroValue(val.Type())
 		return v.ctx.Builder.CreateSub(zero, val, "")
 	}
 	
 	if ctx.NOT() != nil {
 		val := v.Visit(ctx.UnaryExpression()).(ir.Value)
+		// On integers '!' is the bitwise complement
+		if intType, ok := val.Type().(*types.IntType); ok && intType.BitWidth > 1 {
+			return v.ctx.Builder.CreateXor(val, v.ctx.Builder.ConstInt(intType, -1), "")
+		}
 		return v.ctx.Builder.CreateXor(val, v.ctx.Builder.ConstInt(types.I1, 1), "")
 	}
 	
@@ -119,28 +149,61 @@ func (v *IRVisitor) VisitUnaryExpression(ctx *parser.UnaryExpressionContext) int
 		return v.Visit(ctx.UnaryExpression())
 	}
 	
+	if ctx.TRY() != nil {
+		return v.visitTry(v.Visit(ctx.UnaryExpression()).(ir.Value))
+	}
+	
 	return v.Visit(ctx.PostfixExpression())
 }
 
 func (v *IRVisitor) VisitPostfixExpression(ctx *parser.PostfixExpressionContext) interface{} {
+	ops := ctx.AllPostfixOp()
+	
+	// Builtin len(x), unless a user symbol shadows it
+	if primaryCtx := ctx.PrimaryExpression(); primaryCtx != nil && primaryCtx.IDENTIFIER() != nil &&
+		primaryCtx.IDENTIFIER().GetText() == "len" && len(ops) > 0 && ops[0].LPAREN() != nil {
+		if _, shadowed := v.lookupSymbol("len"); !shadowed {
+			var args []ir.Value
+			if argList := ops[0].ArgumentList(); argList != nil {
+				args, _ = v.Visit(argList).([]ir.Value)
+			}
+			result := v.builtinLen(args)
+			for _, op := range ops[1:] {
+				result = v.visitPostfixOp(result, op.(*parser.PostfixOpContext), "", nil)
+			}
+			return result
+		}
+	}
+	
 	result := v.Visit(ctx.PrimaryExpression()).(ir.Value)
 	
 	// Track if we're starting with a namespace identifier
 	var baseIdentifier string
+	// Address of a struct variable, so pointer receivers can mutate it in place
+	var baseAddr ir.Value
 	if primaryCtx := ctx.PrimaryExpression(); primaryCtx != nil {
 		if primaryCtx.IDENTIFIER() != nil {
 			baseIdentifier = primaryCtx.IDENTIFIER().GetText()
+			if sym, ok := v.lookupSymbol(baseIdentifier); ok {
+				if addr, elemType, isVar := sym.Address(); isVar {
+					switch elemType.(type) {
+					case *types.StructType, *types.ArrayType:
+						baseAddr = addr
+					}
+				}
+			}
 		}
 	}
 	
-	for _, op := range ctx.AllPostfixOp() {
-		result = v.visitPostfixOp(result, op.(*parser.PostfixOpContext), baseIdentifier)
+	for _, op := range ops {
+		result = v.visitPostfixOp(result, op.(*parser.PostfixOpContext), baseIdentifier, baseAddr)
 		baseIdentifier = "" // Clear after first use
+		baseAddr = nil
 	}
 	return result
 }
 
-func (v *IRVisitor) visitPostfixOp(base ir.Value, ctx *parser.PostfixOpContext, baseIdentifier string) ir.Value {
+func (v *IRVisitor) visitPostfixOp(base ir.Value, ctx *parser.PostfixOpContext, baseIdentifier string, baseAddr ir.Value) ir.Value {
 	// Function call (check this FIRST)
 	if ctx.LPAREN() != nil {
 		var args []ir.Value
@@ -162,13 +225,54 @@ func (v *IRVisitor) visitPostfixOp(base ir.Value, ctx *parser.PostfixOpContext,
 			}
 			
 			v.logger.Debug("Calling function: %s", fn.Name())
-			return v.ctx.Builder.CreateCall(fn, args, "")
+			result := v.emitCall(fn, args)
+			if _, throws := v.ctx.throwing[fn]; throws {
+				v.errorResults[result] = fn.Name()
+			}
+			v.checkRangeStep(fn, args)
+			if rt := v.ctx.stringFuncs; rt != nil && fn == rt.cstr {
+				v.cstrResults[result] = args[0]
+			}
+			
+			// Arguments are borrowed by the callee; drop temporaries now
+			for _, arg := range args {
+				v.releaseTemporary(arg)
+			}
+			// Class values returned from calls carry a +1 reference
+			v.markOwned(result)
+			return result
+		}
+		
+		// Closure value: call through its code pointer with the environment
+		if sig, ok := v.ctx.ClosureSignature(base.Type()); ok {
+			result := v.callClosure(base, sig, args)
+			for _, arg := range args {
+				v.releaseTemporary(arg)
+			}
+			v.markOwned(result)
+			return result
 		}
 		
 		v.ctx.Logger.Error("Cannot call non-function")
 		return base
 	}
 	
+	// Indexing (a[i])
+	if ctx.LBRACKET() != nil {
+		index := v.Visit(ctx.Expression()).(ir.Value)
+		
+		// Slicing (a[lo..hi], or by any range value)
+		if _, isRange := v.ctx.RangeElem(index.Type()); isRange {
+			return v.sliceValue(base, baseAddr, index, ctx)
+		}
+		return v.indexValue(base, baseAddr, index, ctx)
+	}
+	
+	// Tuple element access (t.0)
+	if ctx.DOT() != nil && ctx.INTEGER_LITERAL() != nil {
+		return v.tupleElement(base, ctx.INTEGER_LITERAL().GetText())
+	}
+	
 	// Member access (DOT)
 	if ctx.DOT() != nil && ctx.IDENTIFIER() != nil {
 		memberName := ctx.IDENTIFIER().GetText()
@@ -183,32 +287,80 @@ func (v *IRVisitor) visitPostfixOp(base ir.Value, ctx *parser.PostfixOpContext,
 					v.logger.Debug("Resolved %s.%s to function", baseIdentifier, memberName)
 					return fn
 				}
-				v.ctx.Logger.Error("Function '%s' not found in namespace '%s'", memberName, baseIdentifier)
+				if sym, ok := ns.LookupGlobal(memberName); ok {
+					v.logger.Debug("Resolved %s.%s to global", baseIdentifier, memberName)
+					return v.symbolValue(sym)
+				}
+				v.ctx.Logger.Error("'%s' not found in namespace '%s'", memberName, baseIdentifier)
 				return v.ctx.Builder.ConstInt(types.I64, 0)
 			}
 		}
 		
-		// 2. Check for class method
-		if ptrType, ok := base.Type().(*types.PointerType); ok {
-			if structType, ok := ptrType.ElementType.(*types.StructType); ok {
-				if v.ctx.IsClassType(structType.Name) {
-					methodName := structType.Name + "_" + memberName
-					if fn := v.ctx.Module.GetFunction(methodName); fn != nil {
-						v.pendingMethodSelf = base
-						v.logger.Debug("Resolved method %s on class %s", memberName, structType.Name)
-						return fn
-					}
-				}
+		// 2. Destructors run automatically and cannot be called by hand
+		if memberName == "deinit" {
+			if _, isClass := v.classOf(base.Type()); isClass {
+				v.ctx.Logger.Error("deinit cannot be called directly; it runs when the last reference is released")
+				return v.ctx.Builder.ConstInt(types.I64, 0)
 			}
 		}
 		
-		// 3. Field access
+		// 3. String members: len, cstr() and char_at(n)
+		if v.ctx.IsString(base.Type()) {
+			return v.stringMember(base, memberName)
+		}
+		
+		// 4. Check for struct/class method
+		if fn, self, ok := v.resolveMethod(base, baseAddr, memberName); ok {
+			v.pendingMethodSelf = self
+			return fn
+		}
+		
+		// 5. Field access
 		return v.handleFieldAccess(base, memberName)
 	}
 	
 	return base
 }
 
+// resolveMethod looks up a method on the receiver's type and adapts the
+// receiver to the form the method declares (value or pointer)
+func (v *IRVisitor) resolveMethod(base, baseAddr ir.Value, methodName string) (*ir.Function, ir.Value, bool) {
+	var structType *types.StructType
+	isPtr := false
+	if ptrType, ok := base.Type().(*types.PointerType); ok {
+		structType, _ = ptrType.ElementType.(*types.StructType)
+		isPtr = true
+	} else {
+		structType, _ = base.Type().(*types.StructType)
+	}
+	if structType == nil {
+		return nil, nil, false
+	}
+	
+	fn, ok := v.ctx.LookupMethod(structType.Name, methodName)
+	if !ok {
+		return nil, nil, false
+	}
+	
+	self := base
+	if len(fn.Arguments) > 0 {
+		wantsPtr := types.IsPointer(fn.Arguments[0].Type())
+		if wantsPtr && !isPtr {
+			if baseAddr == nil {
+				// Temporary value: spill it so the method has an address
+				baseAddr = v.ctx.Builder.CreateAlloca(structType, "")
+				v.ctx.Builder.CreateStore(base, baseAddr)
+			}
+			self = baseAddr
+		} else if !wantsPtr && isPtr {
+			self = v.ctx.Builder.CreateLoad(structType, base, "")
+		}
+	}
+	
+	v.logger.Debug("Resolved method %s on type %s", methodName, structType.Name)
+	return fn, self, true
+}
+
 func (v *IRVisitor) handleFieldAccess(base ir.Value, fieldName string) ir.Value {
 	// Case 1: Pointer to struct/class
 	if ptrType, ok := base.Type().(*types.PointerType); ok {
@@ -257,6 +409,22 @@ func (v *IRVisitor) handleFieldAccess(base ir.Value, fieldName string) ir.Value
 }
 
 func (v *IRVisitor) VisitPrimaryExpression(ctx *parser.PrimaryExpressionContext) interface{} {
+	if ctx.FunctionLiteral() != nil {
+		return v.Visit(ctx.FunctionLiteral())
+	}
+	
+	if ctx.TupleLiteral() != nil {
+		return v.Visit(ctx.TupleLiteral())
+	}
+	
+	if ctx.ArrayLiteral() != nil {
+		return v.Visit(ctx.ArrayLiteral())
+	}
+	
+	if ctx.CollectionLiteral() != nil {
+		return v.Visit(ctx.CollectionLiteral())
+	}
+	
 	if ctx.StructLiteral() != nil {
 		return v.Visit(ctx.StructLiteral())
 	}
@@ -301,7 +469,7 @@ func (v *IRVisitor) VisitPrimaryExpression(ctx *parser.PrimaryExpressionContext)
 		}
 		
 		// Normal variable lookup
-		sym, ok := v.ctx.currentScope.Lookup(name)
+		sym, ok := v.lookupSymbol(name)
 		if !ok {
 			// Check if it's a function in the current namespace
 			if v.ctx.currentNamespace != nil {
@@ -319,13 +487,7 @@ func (v *IRVisitor) VisitPrimaryExpression(ctx *parser.PrimaryExpressionContext)
 			return v.ctx.Builder.ConstInt(types.I64, 0)
 		}
 
-		if ptr, isAlloca := sym.Value.(*ir.AllocaInst); isAlloca {
-			ptrType := ptr.Type().(*types.PointerType)
-			loaded := v.ctx.Builder.CreateLoad(ptrType.ElementType, ptr, "")
-			return loaded
-		}
-
-		return sym.Value
+		return v.symbolValue(sym)
 	}
 	
 	return v.ctx.Builder.ConstInt(types.I64, 0)
@@ -347,6 +509,17 @@ func (v *IRVisitor) VisitIntrinsicExpression(ctx *parser.IntrinsicExpressionCont
 		return v.ctx.Builder.ConstInt(types.U64, int64(align))
 	}
 	
+	if ctx.OFFSETOF() != nil {
+		typ := v.resolveType(ctx.Type_())
+		if len(ctx.AllExpression()) != 1 {
+			v.ctx.Logger.Error("offsetof requires exactly one field")
+			return v.ctx.Builder.ConstInt(types.U64, 0)
+		}
+		offset, _ := v.offsetOf(typ, ctx.Expression(0).GetText())
+		v.logger.Debug("offsetof(%v, %s) = %d", typ, ctx.Expression(0).GetText(), offset)
+		return v.ctx.Builder.ConstInt(types.U64, int64(offset))
+	}
+	
 	// Handle bit_cast<T>(value)
 	if ctx.BIT_CAST() != nil {
 		if len(ctx.AllExpression()) != 1 {
@@ -373,6 +546,10 @@ func (v *IRVisitor) VisitIntrinsicExpression(ctx *parser.IntrinsicExpressionCont
 			v.ctx.Logger.Error("Intrinsic argument is not a value")
 			continue
 		}
+		// The C-level intrinsics take strings as C strings
+		if v.ctx.IsString(val.Type()) {
+			val = v.stringToCString(val)
+		}
 		args = append(args, val)
 	}
 	
@@ -455,16 +632,22 @@ func (v *IRVisitor) VisitIntrinsicExpression(ctx *parser.IntrinsicExpressionCont
 func (v *IRVisitor) calculateSizeOf(typ types.Type) int {
 	switch t := typ.(type) {
 	case *types.IntType:
-		return t.BitWidth / 8
+		return (t.BitWidth + 7) / 8 // bool takes a byte
 	case *types.FloatType:
 		return t.BitWidth / 8
 	case *types.PointerType:
 		return 8 // 64-bit pointers
 	case *types.StructType:
+		if layout, ok := v.ctx.structLayouts[t.Name]; ok {
+			return layout.size
+		}
 		size := 0
 		for _, field := range t.Fields {
 			fieldSize := v.calculateSizeOf(field)
 			fieldAlign := v.calculateAlignOf(field)
+			if t.Packed {
+				fieldAlign = 1
+			}
 			if size%fieldAlign != 0 {
 				size += fieldAlign - (size % fieldAlign)
 			}
@@ -507,6 +690,12 @@ func (v *IRVisitor) calculateAlignOf(typ types.Type) int {
 	case *types.PointerType:
 		return 8
 	case *types.StructType:
+		if layout, ok := v.ctx.structLayouts[t.Name]; ok {
+			return layout.align
+		}
+		if t.Packed {
+			return 1
+		}
 		maxAlign := 1
 		for _, field := range t.Fields {
 			align := v.calculateAlignOf(field)
@@ -538,21 +727,17 @@ func (v *IRVisitor) VisitStructLiteral(ctx *parser.StructLiteralContext) interfa
 
 	v.logger.Debug("Creating struct literal for type: %s", name)
 
-	// Check if this is a class (requires heap allocation)
+	// Check if this is a class (heap allocated, reference counted)
 	if v.ctx.IsClassType(name) {
-		ptrToClass := v.ctx.Builder.CreateAlloca(structType, name+".instance")
-		
-		// Zero-initialize all fields first
-		for i := 0; i < len(structType.Fields); i++ {
-			gep := v.ctx.Builder.CreateStructGEP(structType, ptrToClass, i, "")
-			zero := v.getZeroValue(structType.Fields[i])
-			v.ctx.Builder.CreateStore(zero, gep)
-		}
+		ptrToClass := v.allocClassInstance(structType)
 		
 		// Initialize specified fields
 		for _, field := range ctx.AllFieldInit() {
+			if field.IDENTIFIER() == nil {
+				v.ctx.Logger.Error("Class %s literal must name its fields", name)
+				continue
+			}
 			fieldName := field.IDENTIFIER().GetText()
-			fieldVal := v.Visit(field.Expression()).(ir.Value)
 			
 			var idx int = -1
 			if fieldIndices, ok := v.ctx.ClassFieldIndices[name]; ok {
@@ -565,45 +750,37 @@ func (v *IRVisitor) VisitStructLiteral(ctx *parser.StructLiteralContext) interfa
 				v.ctx.Logger.Error("Class %s has no field %s", name, fieldName)
 				continue
 			}
+			fieldVal := v.visitWithHint(field.Expression(), structType.Fields[idx])
+			v.takeOwnership(fieldVal)
+			fieldVal = v.coerceTo(fieldVal, structType.Fields[idx])
 			
 			gep := v.ctx.Builder.CreateStructGEP(structType, ptrToClass, idx, "")
 			v.ctx.Builder.CreateStore(fieldVal, gep)
 		}
 		
+		v.markOwned(ptrToClass)
 		return ptrToClass
 	}
 
 	// Regular struct - build value directly
-	var agg ir.Value = v.ctx.Builder.ConstZero(structType)
-
-	// Populate specified fields
+	var inits []fieldInit
 	for _, field := range ctx.AllFieldInit() {
-		fieldName := field.IDENTIFIER().GetText()
-		fieldVal := v.Visit(field.Expression()).(ir.Value)
-		
-		idx := v.findFieldIndex(structType, fieldName)
-		if idx < 0 {
-			v.ctx.Logger.Error("Struct %s has no field %s", name, fieldName)
-			continue
+		init := fieldInit{expr: field.Expression()}
+		if field.IDENTIFIER() != nil {
+			init.name = field.IDENTIFIER().GetText()
 		}
-		
-		agg = v.ctx.Builder.CreateInsertValue(agg, fieldVal, []int{idx}, "")
+		inits = append(inits, init)
 	}
-	
-	return agg
+	return v.buildStruct(structType, inits)
 }
 
 func (v *IRVisitor) VisitLiteral(ctx *parser.LiteralContext) interface{} {
 	if ctx.INTEGER_LITERAL() != nil {
-		text := ctx.INTEGER_LITERAL().GetText()
-		val, _ := strconv.ParseInt(text, 0, 64)
-		return v.ctx.Builder.ConstInt(types.I64, val)
+		return v.integerLiteral(ctx.INTEGER_LITERAL().GetText())
 	}
 	
 	if ctx.FLOAT_LITERAL() != nil {
-		text := ctx.FLOAT_LITERAL().GetText()
-		val, _ := strconv.ParseFloat(text, 64)
-		return v.ctx.Builder.ConstFloat(types.F64, val)
+		return v.floatLiteralText(ctx.FLOAT_LITERAL().GetText())
 	}
 	
 	if ctx.BOOLEAN_LITERAL() != nil {
@@ -615,37 +792,77 @@ func (v *IRVisitor) VisitLiteral(ctx *parser.LiteralContext) interface{} {
 	
 	if ctx.STRING_LITERAL() != nil {
 		rawText := ctx.STRING_LITERAL().GetText()
-		content, err := strconv.Unquote(rawText)
-		if err != nil {
-			if len(rawText) >= 2 {
-				content = rawText[1 : len(rawText)-1]
-			} else {
-				content = rawText
-			}
+		if len(rawText) >= 2 && interpolates(rawText[1:len(rawText)-1]) {
+			return v.visitInterpolatedString(ctx.STRING_LITERAL().GetSymbol(), rawText[1 : len(rawText)-1])
 		}
-		
-		bytes := append([]byte(content), 0)
-		elements := make([]ir.Constant, len(bytes))
-		for i, b := range bytes {
-			elements[i] = v.ctx.Builder.ConstInt(types.I8, int64(b))
-		}
-		
-		arrType := types.NewArray(types.I8, int64(len(bytes)))
-		constArr := &ir.ConstantArray{
-			BaseValue: ir.BaseValue{ValType: arrType},
-			Elements:  elements,
+		if len(rawText) < 2 {
+			return v.stringLiteral(rawText)
 		}
-		
-		strName := fmt.Sprintf(".str.%d", len(v.ctx.Module.Globals))
-		global := v.ctx.Builder.CreateGlobalConstant(strName, constArr)
-		zero := v.ctx.Builder.ConstInt(types.I32, 0)
-		
-		return v.ctx.Builder.CreateInBoundsGEP(arrType, global, []ir.Value{zero, zero}, "")
+		return v.stringLiteral(v.unescapeString(rawText[1 : len(rawText)-1]))
+	}
+	
+	if ctx.CHAR_LITERAL() != nil {
+		return v.charLiteral(ctx.CHAR_LITERAL().GetText())
+	}
+	
+	if ctx.NULL() != nil {
+		return v.ctx.Builder.ConstNull(types.NewPointer(types.Void))
 	}
 	
 	return v.ctx.Builder.ConstInt(types.I64, 0)
 }
 
+// createStringConstant returns a pointer to the first byte of a
+// NUL-terminated copy of content in read-only data
+func (v *IRVisitor) createStringConstant(content string) ir.Value {
+	global := v.internString(content)
+	arrType := types.NewArray(types.I8, int64(len(content)+1))
+	zero := v.ctx.Builder.ConstInt(types.I32, 0)
+	
+	return v.ctx.Builder.CreateInBoundsGEP(arrType, global, []ir.Value{zero, zero}, "")
+}
+
+// internString returns the global holding content. Each package keeps one
+// global per distinct literal, named .str.<package>.<n>; with constant
+// merging all packages share a single pool named .str.<n>.
+func (v *IRVisitor) internString(content string) *ir.Global {
+	pool := ""
+	if !v.ctx.MergeConstants && v.ctx.currentNamespace != nil {
+		pool = v.ctx.currentNamespace.Name
+	}
+	interned, ok := v.ctx.stringConstants[pool]
+	if !ok {
+		interned = make(map[string]*ir.Global)
+		v.ctx.stringConstants[pool] = interned
+	}
+	if global, ok := interned[content]; ok {
+		return global
+	}
+	
+	bytes := append([]byte(content), 0)
+	elements := make([]ir.Constant, len(bytes))
+	for i, b := range bytes {
+		elements[i] = v.ctx.Builder.ConstInt(types.I8, int64(b))
+	}
+	
+	arrType := types.NewArray(types.I8, int64(len(bytes)))
+	constArr := &ir.ConstantArray{
+		BaseValue: ir.BaseValue{ValType: arrType},
+		Elements:  elements,
+	}
+	
+	strName := fmt.Sprintf(".str.%d", len(interned))
+	if pool != "" {
+		strName = fmt.Sprintf(".str.%s.%d", pool, len(interned))
+	}
+	global := v.ctx.Builder.CreateGlobalConstant(strName, constArr)
+	global.Linkage = ir.PrivateLinkage
+	global.Section = ".rodata"
+	interned[content] = global
+	
+	return global
+}
+
 func (v *IRVisitor) VisitCastExpression(ctx *parser.CastExpressionContext) interface{} {
 	val := v.Visit(ctx.Expression()).(ir.Value)
 	destType := v.resolveType(ctx.Type_())
@@ -653,6 +870,16 @@ func (v *IRVisitor) VisitCastExpression(ctx *parser.CastExpressionContext) inter
 	
 	v.logger.Debug("Casting from %v to %v", srcType, destType)
 	
+	// Between a distinct type and its base only the type changes
+	if !v.ctx.SameType(srcType, destType) && v.ctx.BaseType(srcType).Equal(v.ctx.BaseType(destType)) {
+		return v.retag(val, destType)
+	}
+	if v.ctx.IsString(srcType) && types.IsPointer(destType) {
+		return v.coerceTo(val, destType)
+	}
+	if types.IsPointer(srcType) && v.ctx.IsString(destType) {
+		return v.stringFromCString(val)
+	}
 	if types.IsPointer(srcType) && types.IsInteger(destType) {
 		return v.ctx.Builder.CreatePtrToInt(val, destType, "")
 	}
@@ -764,7 +991,7 @@ func (v *IRVisitor) VisitArgumentList(ctx *parser.ArgumentListContext) interface
 func (v *IRVisitor) VisitLeftHandSide(ctx *parser.LeftHandSideContext) interface{} {
 	if ctx.IDENTIFIER() != nil && ctx.DOT() == nil && ctx.STAR() == nil {
 		name := ctx.IDENTIFIER().GetText()
-		sym, ok := v.ctx.currentScope.Lookup(name)
+		sym, ok := v.lookupSymbol(name)
 		if ok {
 			return sym.Value
 		}
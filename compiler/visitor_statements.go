@@ -10,6 +10,9 @@ import (
 )
 
 func (v *IRVisitor) VisitStatement(ctx *parser.StatementContext) interface{} {
+	defer v.releaseTemporaries()
+	defer v.reportIgnoredErrors()
+	
 	if ctx.VariableDecl() != nil {
 		return v.Visit(ctx.VariableDecl())
 	}
@@ -37,6 +40,9 @@ func (v *IRVisitor) VisitStatement(ctx *parser.StatementContext) interface{} {
 	if ctx.DeferStmt() != nil {
 		return v.Visit(ctx.DeferStmt())
 	}
+	if ctx.ThrowStmt() != nil {
+		return v.Visit(ctx.ThrowStmt())
+	}
 	if ctx.ExpressionStmt() != nil {
 		return v.Visit(ctx.ExpressionStmt())
 	}
@@ -60,6 +66,11 @@ func (v *IRVisitor) VisitBlock(ctx *parser.BlockContext) interface{} {
 		}
 	}
 	
+	// Falling off the end of the block leaves its scope
+	if v.ctx.Builder.GetInsertBlock().Terminator() == nil {
+		v.ctx.currentScope.EmitCleanups()
+	}
+	
 	v.ctx.PopScope()
 	return nil
 }
@@ -70,23 +81,30 @@ func (v *IRVisitor) VisitAssignmentStmt(ctx *parser.AssignmentStmtContext) inter
 	// Simple Variable Assignment: IDENTIFIER = value
 	if lhsCtx.IDENTIFIER() != nil && lhsCtx.DOT() == nil && lhsCtx.STAR() == nil {
 		name := lhsCtx.IDENTIFIER().GetText()
-		rhs := v.Visit(ctx.Expression()).(ir.Value)
 		
 		v.logger.Debug("Assigning to variable: %s", name)
 		
-		sym, ok := v.ctx.currentScope.Lookup(name)
+		sym, ok := v.lookupSymbol(name)
 		if !ok {
 			v.ctx.Logger.Error("Undefined: %s", name)
 			return nil
 		}
 		
+		var rhs ir.Value
+		if _, elemType, isVar := sym.Address(); isVar {
+			rhs = v.visitWithHint(ctx.Expression(), elemType)
+		} else {
+			rhs = v.Visit(ctx.Expression()).(ir.Value)
+		}
+		v.rejectStoredCString(rhs)
+		
 		if sym.IsConst {
 			v.ctx.Logger.Error("Cannot assign to constant '%s'", name)
 			return nil
 		}
 		
-		if ptr, isAlloca := sym.Value.(*ir.AllocaInst); isAlloca {
-			v.ctx.Builder.CreateStore(rhs, ptr)
+		if addr, elemType, isVar := sym.Address(); isVar {
+			v.storeOwned(v.coerceTo(rhs, elemType), addr, elemType)
 			return nil
 		}
 		
@@ -94,12 +112,49 @@ func (v *IRVisitor) VisitAssignmentStmt(ctx *parser.AssignmentStmtContext) inter
 		return nil
 	}
 	
+	// Indexed Assignment: a[i] = value, s.items[i] = value, ptr[i] = value
+	if lhsCtx.LBRACKET() != nil {
+		// The target is evaluated once: in place when it names a variable
+		// or a path into one, otherwise as a value
+		slot, slotType, ok := v.addressOf(lhsCtx.PostfixExpression())
+		var base ir.Value
+		if !ok {
+			base = v.Visit(lhsCtx.PostfixExpression()).(ir.Value)
+		}
+		index := v.Visit(lhsCtx.Expression()).(ir.Value)
+		var elemAddr ir.Value
+		var elemType types.Type
+		if ok {
+			elemAddr, elemType, ok = v.indexAddress(slot, slotType, index, lhsCtx)
+		} else if types.IsPointer(base.Type()) {
+			// Pointer produced by an expression, such as a call
+			elemType = base.Type().(*types.PointerType).ElementType
+			elemAddr = v.ctx.Builder.CreateGEP(elemType, base, []ir.Value{v.castValue(index, types.I64)}, "")
+			ok = true
+		}
+		if !ok {
+			v.ctx.Logger.Error("Cannot assign to element of '%s'", lhsCtx.PostfixExpression().GetText())
+			return nil
+		}
+		
+		rhs := v.Visit(ctx.Expression()).(ir.Value)
+		v.rejectStoredCString(rhs)
+		v.storeOwned(v.coerceTo(rhs, elemType), elemAddr, elemType)
+		return nil
+	}
+	
 	// Pointer Assignment: *ptr = value
 	if lhsCtx.STAR() != nil {
 		v.logger.Debug("Assigning through pointer dereference")
 		ptr := v.Visit(lhsCtx.PostfixExpression()).(ir.Value)
+		ptrType, ok := ptr.Type().(*types.PointerType)
+		if !ok {
+			v.ctx.Logger.Error("Cannot assign through '%s', which is not a pointer", lhsCtx.PostfixExpression().GetText())
+			return nil
+		}
 		rhs := v.Visit(ctx.Expression()).(ir.Value)
-		v.ctx.Builder.CreateStore(rhs, ptr)
+		v.rejectStoredCString(rhs)
+		v.storeOwned(v.coerceTo(rhs, ptrType.ElementType), ptr, ptrType.ElementType)
 		return nil
 	}
 	
@@ -114,15 +169,15 @@ func (v *IRVisitor) VisitAssignmentStmt(ctx *parser.AssignmentStmtContext) inter
 			if primaryCtx.IDENTIFIER() != nil {
 				varName := primaryCtx.IDENTIFIER().GetText()
 				
-				if sym, ok := v.ctx.currentScope.Lookup(varName); ok {
-					if alloca, isAlloca := sym.Value.(*ir.AllocaInst); isAlloca {
-						// Check what the alloca contains
-						if _, isPtr := alloca.AllocatedType.(*types.PointerType); isPtr {
+				if sym, ok := v.lookupSymbol(varName); ok {
+					if addr, elemType, isVar := sym.Address(); isVar {
+						// Check what the variable contains
+						if _, isPtr := elemType.(*types.PointerType); isPtr {
 							// It's a pointer - load it
-							basePtr = v.ctx.Builder.CreateLoad(alloca.AllocatedType, alloca, "")
-						} else if _, isStruct := alloca.AllocatedType.(*types.StructType); isStruct {
-							// Direct struct allocation
-							basePtr = alloca
+							basePtr = v.ctx.Builder.CreateLoad(elemType, addr, "")
+						} else if _, isStruct := elemType.(*types.StructType); isStruct {
+							// Direct struct storage
+							basePtr = addr
 						}
 					}
 				}
@@ -158,7 +213,8 @@ func (v *IRVisitor) VisitAssignmentStmt(ctx *parser.AssignmentStmtContext) inter
 					if fieldIdx >= 0 {
 						gep := v.ctx.Builder.CreateStructGEP(structType, basePtr, fieldIdx, "")
 						rhs := v.Visit(ctx.Expression()).(ir.Value)
-						v.ctx.Builder.CreateStore(rhs, gep)
+						v.rejectStoredCString(rhs)
+						v.storeOwned(v.coerceTo(rhs, structType.Fields[fieldIdx]), gep, structType.Fields[fieldIdx])
 						return nil
 					} else {
 						v.ctx.Logger.Error("Struct/class '%s' has no field '%s'", structType.Name, fieldName)
@@ -179,31 +235,62 @@ func (v *IRVisitor) VisitAssignmentStmt(ctx *parser.AssignmentStmtContext) inter
 func (v *IRVisitor) VisitReturnStmt(ctx *parser.ReturnStmtContext) interface{} {
 	v.logger.Debug("Compiling return statement")
 	
-	// Execute deferred statements
-	deferred := v.ctx.GetDeferredStmts()
-	for i := len(deferred) - 1; i >= 0; i-- {
-		_ = deferred[i]
-	}
-	
 	if ctx.Expression() != nil {
-		retVal := v.Visit(ctx.Expression()).(ir.Value)
+		var hint types.Type
+		if v.ctx.currentFunction != nil {
+			hint = v.ctx.currentFunction.FuncType.ReturnType
+			if valueType, throws := v.ctx.throwing[v.ctx.currentFunction]; throws {
+				hint = valueType
+			}
+		}
+		retVal := v.visitWithHint(ctx.Expression(), hint)
+		v.rejectStoredCString(retVal)
+		
+		// Throwing functions return the value together with a zero error code
+		if valueType, throws := v.ctx.throwing[v.ctx.currentFunction]; throws {
+			retVal = v.coerceTo(retVal, valueType)
+			v.takeOwnership(retVal)
+			retVal = v.errorResult(valueType, retVal, v.ctx.Builder.ConstInt(types.I32, 0))
+			v.markOwned(retVal)
+		}
 		
 		// Cast to expected return type if needed
 		if v.ctx.currentFunction != nil {
 			expectedType := v.ctx.currentFunction.FuncType.ReturnType
+			if resultType, indirect := v.ctx.indirectReturns[v.ctx.currentFunction]; indirect {
+				expectedType = resultType
+			}
 			if !retVal.Type().Equal(expectedType) {
-				retVal = v.castValue(retVal, expectedType)
+				retVal = v.coerceTo(retVal, expectedType)
 			}
 		}
 		
-		v.ctx.Builder.CreateRet(retVal)
+		v.emitReturn(retVal)
+	} else if _, throws := v.ctx.throwing[v.ctx.currentFunction]; throws {
+		v.emitReturn(v.ctx.Builder.ConstInt(types.I32, 0))
 	} else {
+		v.ctx.EmitCleanupsUntil(nil)
 		v.ctx.Builder.CreateRetVoid()
 	}
 	
 	return nil
 }
 
+// emitReturn returns retVal from the current function. The caller receives
+// its own reference; deferred calls and local releases run after the return
+// value has been computed.
+func (v *IRVisitor) emitReturn(retVal ir.Value) {
+	v.takeOwnership(retVal)
+	v.releasePending()
+	v.ctx.EmitCleanupsUntil(nil)
+	if v.ctx.returnSlot != nil {
+		v.ctx.Builder.CreateStore(retVal, v.ctx.returnSlot)
+		v.ctx.Builder.CreateRetVoid()
+	} else {
+		v.ctx.Builder.CreateRet(retVal)
+	}
+}
+
 func (v *IRVisitor) VisitExpressionStmt(ctx *parser.ExpressionStmtContext) interface{} {
 	// Check if this looks like an assignment that wasn't parsed as such
 	exprText := ctx.Expression().GetText()
@@ -211,18 +298,145 @@ func (v *IRVisitor) VisitExpressionStmt(ctx *parser.ExpressionStmtContext) inter
 		v.logger.Warning("Expression contains '=' - might be a failed assignment parse: %s", exprText)
 	}
 	
-	v.Visit(ctx.Expression())
+	result := v.Visit(ctx.Expression())
+	if val, ok := result.(ir.Value); ok {
+		if _, unhandled := v.errorResults[val]; unhandled {
+			v.ctx.Logger.Error("Error returned by '%s' is ignored; use 'try', handle it, or discard it with 'let _ = ...'", exprText)
+			delete(v.errorResults, val)
+		}
+		v.releaseTemporary(val)
+	}
 	return nil
 }
 
+// storeOwned stores val into a slot that owns references, retaining the
+// new value before releasing the one it replaces
+func (v *IRVisitor) storeOwned(val, slot ir.Value, slotType types.Type) {
+	if !v.isManaged(slotType) {
+		v.ctx.Builder.CreateStore(val, slot)
+		return
+	}
+	v.takeOwnership(val)
+	old := v.ctx.Builder.CreateLoad(slotType, slot, "")
+	v.ctx.Builder.CreateStore(val, slot)
+	v.emitRelease(old)
+}
+
+// VisitDeferStmt registers the expression as a cleanup of the enclosing
+// scope. Cleanups run in LIFO order on every exit: falling off the end of the
+// block, return, break and continue. Variables the expression reads are
+// captured by value here, so 'defer free(ptr)' frees the pointer 'ptr' held
+// at the defer even if it is reassigned later.
 func (v *IRVisitor) VisitDeferStmt(ctx *parser.DeferStmtContext) interface{} {
-	if ctx.Expression() != nil {
-		_ = v.Visit(ctx.Expression())
+	if ctx.Expression() == nil {
+		return nil
 	}
-	v.ctx.Logger.Warning("defer statement is not fully implemented yet")
+	expr := ctx.Expression()
+
+	captured := NewScope(nil)
+	inPlace := make(map[string]bool)
+	v.findInPlaceUses(expr, inPlace)
+	retained := v.captureIdentifiers(expr, captured, inPlace, nil)
+
+	v.ctx.AddCleanup(func() {
+		saved := v.ctx.currentScope
+		captured.parent = saved
+		v.ctx.currentScope = captured
+
+		// Cleanups run in the middle of other statements, such as a return
+		v.withTemporaries(func() { v.Visit(expr) })
+		for _, val := range retained {
+			v.emitRelease(val)
+		}
+
+		v.ctx.currentScope = saved
+	})
+
+	v.logger.Debug("Deferred expression: %s", expr.GetText())
 	return nil
 }
 
+// captureIdentifiers snapshots the current value of every local variable the
+// tree references, except struct variables in inPlace, which stay by
+// reference. Captured references are retained and returned, for the cleanup
+// to release once it has run.
+func (v *IRVisitor) captureIdentifiers(tree antlr.Tree, captured *Scope, inPlace map[string]bool, retained []ir.Value) []ir.Value {
+	if primary, ok := tree.(*parser.PrimaryExpressionContext); ok && primary.IDENTIFIER() != nil {
+		name := primary.IDENTIFIER().GetText()
+		if _, done := captured.LookupLocal(name); !done && !inPlace[name] {
+			if sym, ok := v.ctx.currentScope.Lookup(name); ok {
+				if addr, elemType, isVar := sym.Address(); isVar {
+					val := v.ctx.Builder.CreateLoad(elemType, addr, name+".captured")
+					captured.DefineConst(name, val)
+					if v.isManaged(elemType) {
+						v.emitRetain(val)
+						retained = append(retained, val)
+					}
+				}
+			}
+		}
+	}
+
+	for _, child := range tree.GetChildren() {
+		retained = v.captureIdentifiers(child, captured, inPlace, retained)
+	}
+	return retained
+}
+
+// findInPlaceUses collects the struct variables the tree needs the storage
+// of rather than a copy: receivers of pointer-receiver methods, and operands
+// of '&' and of the va_* intrinsics, such as 'args' in 'va_end(args)'
+func (v *IRVisitor) findInPlaceUses(tree antlr.Tree, inPlace map[string]bool) {
+	if primary, ok := tree.(*parser.PrimaryExpressionContext); ok && primary.IDENTIFIER() != nil {
+		name := primary.IDENTIFIER().GetText()
+		if sym, ok := v.ctx.currentScope.Lookup(name); ok {
+			if _, elemType, isVar := sym.Address(); isVar {
+				if structType, isStruct := elemType.(*types.StructType); isStruct && v.usedInPlace(primary, structType) {
+					inPlace[name] = true
+				}
+			}
+		}
+	}
+
+	for _, child := range tree.GetChildren() {
+		v.findInPlaceUses(child, inPlace)
+	}
+}
+
+// usedInPlace reports whether primary, a variable of type structType, is
+// used through its address
+func (v *IRVisitor) usedInPlace(primary *parser.PrimaryExpressionContext, structType *types.StructType) bool {
+	// Receiver of a method taking a pointer: s.close()
+	if postfix, ok := primary.GetParent().(*parser.PostfixExpressionContext); ok {
+		ops := postfix.AllPostfixOp()
+		if len(ops) >= 2 && ops[0].DOT() != nil && ops[0].IDENTIFIER() != nil && ops[1].LPAREN() != nil {
+			method, ok := v.ctx.LookupMethod(structType.Name, ops[0].IDENTIFIER().GetText())
+			if ok && len(method.Arguments) > 0 && types.IsPointer(method.Arguments[0].Type()) {
+				return true
+			}
+		}
+	}
+
+	// Operand of '&' or of a va_* intrinsic, through the single-child rules
+	// wrapping it
+	var node antlr.Tree = primary
+	for {
+		parent := node.GetParent()
+		switch p := parent.(type) {
+		case *parser.UnaryExpressionContext:
+			if p.AMP() != nil {
+				return true
+			}
+		case *parser.IntrinsicExpressionContext:
+			return p.VA_START() != nil || p.VA_ARG() != nil || p.VA_END() != nil
+		}
+		if parent == nil || len(parent.GetChildren()) != 1 {
+			return false
+		}
+		node = parent
+	}
+}
+
 // Helpers for token ordering
 func (v *IRVisitor) isBefore(ctx antlr.ParserRuleContext, token antlr.TerminalNode) bool {
 	if ctx == nil || token == nil {
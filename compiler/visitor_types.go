@@ -19,7 +19,11 @@ func (v *IRVisitor) registerStructType(ctx *parser.StructDeclContext) {
 	
 	// Create field map
 	fieldMap := make(map[string]int)
+	fieldNames := make([]string, 0)
 	fieldTypes := make([]types.Type, 0)
+	fieldAligns := make([]int, 0)
+	hasLayout := len(ctx.AllAttribute()) > 0
+	defaults := make(map[int]*fieldDefault)
 	
 	fieldIndex := 0
 	for _, member := range ctx.AllStructMember() {
@@ -28,17 +32,45 @@ func (v *IRVisitor) registerStructType(ctx *parser.StructDeclContext) {
 			fieldName := field.IDENTIFIER().GetText()
 			fieldType := v.resolveType(field.Type_())
 			
+			fieldNames = append(fieldNames, fieldName)
 			fieldTypes = append(fieldTypes, fieldType)
+			fieldAligns = append(fieldAligns, v.fieldAlignAttribute(name+"."+fieldName, field.AllAttribute()))
+			// Structs holding laid-out structs are laid out too, or the
+			// backend would place those at their packed alignment of 1
+			hasLayout = hasLayout || len(field.AllAttribute()) > 0 || v.hasLayout(fieldType)
 			fieldMap[fieldName] = fieldIndex
+			if field.Expression() != nil {
+				defaults[fieldIndex] = &fieldDefault{expr: field.Expression(), namespace: v.declaringNamespace()}
+			}
 			v.logger.Debug("  Field '%s' at index %d, type: %v", fieldName, fieldIndex, fieldType)
 			fieldIndex++
 		}
 	}
 	
+	// Attributes lay the fields out with explicit padding, which moves
+	// them to other IR indices
+	packed := false
+	if hasLayout {
+		var align int
+		packed, align = v.layoutAttributes(name, ctx.AllAttribute())
+		layout := v.layoutStruct(name, fieldNames, fieldTypes, fieldAligns, packed, align)
+		for fieldName, idx := range fieldMap {
+			fieldMap[fieldName] = layout.fields[idx]
+		}
+		moved := make(map[int]*fieldDefault)
+		for idx, def := range defaults {
+			moved[layout.fields[idx]] = def
+		}
+		defaults, fieldTypes, packed = moved, layout.types, true
+		v.ctx.structLayouts[name] = layout
+		v.logger.Debug("  Layout: size %d, align %d", layout.size, layout.align)
+	}
+	
 	// Register mapping in context
 	v.ctx.StructFieldIndices[name] = fieldMap
+	v.ctx.fieldDefaults[name] = defaults
 
-	structType := types.NewStruct(name, fieldTypes, false)
+	structType := types.NewStruct(name, fieldTypes, packed)
 	v.ctx.RegisterType(name, structType)
 }
 
@@ -54,11 +86,11 @@ func (v *IRVisitor) registerClassType(ctx *parser.ClassDeclContext) {
 		return
 	}
 	
-	// Create field map
+	// Create field map; index 0 holds the hidden reference count
 	fieldMap := make(map[string]int)
-	fieldTypes := make([]types.Type, 0)
+	fieldTypes := []types.Type{types.I64}
 	
-	fieldIndex := 0
+	fieldIndex := classHeaderFields
 	for _, member := range ctx.AllClassMember() {
 		if member.ClassField() != nil {
 			field := member.ClassField()
@@ -80,7 +112,7 @@ func (v *IRVisitor) registerClassType(ctx *parser.ClassDeclContext) {
 	structType := types.NewStruct(name, fieldTypes, false)
 	
 	v.ctx.RegisterClass(name, structType)
-	v.logger.Debug("Registered class '%s' with %d fields", name, len(fieldTypes))
+	v.logger.Debug("Registered class '%s' with %d fields", name, len(fieldTypes)-classHeaderFields)
 }
 
 func (v *IRVisitor) VisitStructDecl(ctx *parser.StructDeclContext) interface{} {
@@ -139,7 +171,81 @@ func (v *IRVisitor) VisitClassMember(ctx *parser.ClassMemberContext) interface{}
 	return nil
 }
 
+// VisitDeinitDecl compiles a destructor into Class_deinit. Both the inline
+// form inside a class body and the out-of-line form taking a self receiver
+// are accepted. The destructor is invoked by the class's release helper once
+// the last reference goes away, which for a value that was never shared is
+// the end of its scope.
 func (v *IRVisitor) VisitDeinitDecl(ctx *parser.DeinitDeclContext) interface{} {
-	v.ctx.Logger.Warning("deinit is not yet implemented")
+	var className string
+	if classMember, ok := ctx.GetParent().(*parser.ClassMemberContext); ok {
+		if classDecl, ok := classMember.GetParent().(*parser.ClassDeclContext); ok {
+			className = classDecl.IDENTIFIER().GetText()
+		}
+	}
+	
+	// deinit takes exactly one parameter: the self receiver
+	var params []parser.IParameterContext
+	if ctx.ParameterList() != nil {
+		params = ctx.ParameterList().AllParameter()
+	}
+	if len(params) != 1 || params[0].SELF() == nil {
+		v.ctx.Logger.Error("deinit must take a single self receiver, e.g. deinit(self s: *%s)", className)
+		return nil
+	}
+	
+	receiverType := v.receiverTypeName(params[0])
+	if className == "" {
+		className = receiverType
+	} else if receiverType != className {
+		v.ctx.Logger.Error("deinit declared in '%s' has receiver of type '%s'", className, receiverType)
+		return nil
+	}
+	
+	if _, ok := v.ctx.GetType(className); !ok {
+		v.ctx.Logger.Error("Unknown receiver type '%s' for deinit", className)
+		return nil
+	}
+	if !v.ctx.IsClassType(className) {
+		v.ctx.Logger.Error("deinit is only allowed on classes, '%s' is a struct", className)
+		return nil
+	}
+	if _, exists := v.ctx.Deinits[className]; exists {
+		v.ctx.Logger.Error("Class '%s' already has a deinit", className)
+		return nil
+	}
+	
+	irName := className + "_deinit"
+	if v.ctx.currentNamespace != nil && v.ctx.currentNamespace.Name != "" {
+		irName = v.ctx.currentNamespace.Name + "_" + irName
+	}
+	
+	v.logger.Debug("Compiling deinit for class '%s' (IR: %s)", className, irName)
+	
+	selfName := params[0].IDENTIFIER().GetText()
+	selfType := v.resolveType(params[0].Type_())
+	fn := v.ctx.Builder.CreateFunction(irName, types.Void, []types.Type{selfType}, false)
+	fn.Arguments[0].SetName(selfName)
+	
+	// Not registered as a method so user code cannot call it
+	v.ctx.Deinits[className] = fn
+	
+	v.ctx.EnterFunction(fn)
+	
+	entry := v.ctx.Builder.CreateBlock("entry")
+	v.ctx.SetInsertBlock(entry)
+	
+	alloc := v.ctx.Builder.CreateAlloca(selfType, selfName+".addr")
+	v.ctx.Builder.CreateStore(fn.Arguments[0], alloc)
+	v.ctx.currentScope.Define(selfName, alloc)
+	
+	v.Visit(ctx.Block())
+	
+	if v.ctx.Builder.GetInsertBlock().Terminator() == nil {
+		v.ctx.EmitCleanupsUntil(nil)
+		v.ctx.Builder.CreateRetVoid()
+	}
+	
+	v.ctx.ExitFunction()
 	return nil
 }
\ No newline at end of file